@@ -2,20 +2,38 @@ package aeadutils
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	b64 "encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/cryptofmt"
 	"github.com/google/tink/go/daead"
 	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/prf"
+	aesctrhmacaeadpb "github.com/google/tink/go/proto/aes_ctr_hmac_aead_go_proto"
+	aesgcmpb "github.com/google/tink/go/proto/aes_gcm_go_proto"
+	aesgcmsivpb "github.com/google/tink/go/proto/aes_gcm_siv_go_proto"
+	aessivpb "github.com/google/tink/go/proto/aes_siv_go_proto"
+	chacha20poly1305pb "github.com/google/tink/go/proto/chacha20_poly1305_go_proto"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+	xchacha20poly1305pb "github.com/google/tink/go/proto/xchacha20_poly1305_go_proto"
 	"github.com/google/tink/go/tink"
 
 	hclog "github.com/hashicorp/go-hclog"
 	cmap "github.com/orcaman/concurrent-map"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 func CreateInsecureHandleAndAead(rawKeyset string) (*keyset.Handle, tink.AEAD, error) {
@@ -61,8 +79,25 @@ func ExtractInsecureKeySetFromKeyhandle(kh *keyset.Handle) (string, error) {
 	return buf.String(), nil
 }
 
+// newKeysetHandle generates the keyset of the create paths. It is only replaced in tests, with a seeded source so
+// the generated keysets can be asserted, everything else must get its keys from tink's secure randomness
+var newKeysetHandle = keyset.NewHandle
+
 func CreateNewDeterministicAead() (*keyset.Handle, tink.DeterministicAEAD, error) {
-	kh, err := keyset.NewHandle(daead.AESSIVKeyTemplate())
+	return CreateNewDeterministicAeadWithOutputPrefix("TINK")
+}
+
+func CreateNewDeterministicAeadWithOutputPrefix(outputPrefix string) (*keyset.Handle, tink.DeterministicAEAD, error) {
+	return CreateNewDeterministicAeadWithTemplate(daead.AESSIVKeyTemplate(), outputPrefix)
+}
+
+// CreateNewDeterministicAeadWithTemplate creates a keyset from a DAEAD template with the output prefix type
+func CreateNewDeterministicAeadWithTemplate(template *tinkpb.KeyTemplate, outputPrefix string) (*keyset.Handle, tink.DeterministicAEAD, error) {
+	template, err := WithOutputPrefix(template, outputPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	kh, err := newKeysetHandle(template)
 	if err != nil {
 		hclog.L().Error("cannot create key handle:  %v", err)
 	}
@@ -75,7 +110,20 @@ func CreateNewDeterministicAead() (*keyset.Handle, tink.DeterministicAEAD, error
 }
 
 func CreateNewAead() (*keyset.Handle, tink.AEAD, error) {
-	kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	return CreateNewAeadWithOutputPrefix("TINK")
+}
+
+func CreateNewAeadWithOutputPrefix(outputPrefix string) (*keyset.Handle, tink.AEAD, error) {
+	return CreateNewAeadWithTemplate(aead.AES256GCMKeyTemplate(), outputPrefix)
+}
+
+// CreateNewAeadWithTemplate creates a keyset from an AEAD template with the output prefix type
+func CreateNewAeadWithTemplate(template *tinkpb.KeyTemplate, outputPrefix string) (*keyset.Handle, tink.AEAD, error) {
+	template, err := WithOutputPrefix(template, outputPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	kh, err := newKeysetHandle(template)
 	if err != nil {
 		hclog.L().Error("cannot create new aead keyhandle:  %v", err)
 		return nil, nil, err
@@ -89,6 +137,179 @@ func CreateNewAead() (*keyset.Handle, tink.AEAD, error) {
 	return kh, a, nil
 }
 
+// AeadTemplates are the templates DEFAULT_AEAD_TEMPLATE can name for createAEADkey
+var AeadTemplates = map[string]func() *tinkpb.KeyTemplate{
+	"AES128_GCM":             aead.AES128GCMKeyTemplate,
+	"AES256_GCM":             aead.AES256GCMKeyTemplate,
+	"AES128_CTR_HMAC_SHA256": aead.AES128CTRHMACSHA256KeyTemplate,
+	"AES256_CTR_HMAC_SHA256": aead.AES256CTRHMACSHA256KeyTemplate,
+	"CHACHA20_POLY1305":      aead.ChaCha20Poly1305KeyTemplate,
+	"XCHACHA20_POLY1305":     aead.XChaCha20Poly1305KeyTemplate,
+}
+
+// DaeadTemplates are the templates DEFAULT_DAEAD_TEMPLATE can name for createDAEADkey
+var DaeadTemplates = map[string]func() *tinkpb.KeyTemplate{
+	"AES256_SIV": daead.AESSIVKeyTemplate,
+}
+
+// PRFKeyPrefix is the prefix of the config entries holding a PRF keyset, prf/<name>. PRF keysets derive sub-keys and
+// never encrypt, so they are kept apart from the gcm/ and siv/ keysets
+const PRFKeyPrefix = "prf/"
+
+// ExportKeyPrefix is the prefix of the config entries holding the export keyset of a field, export/<field>. An export
+// keyset is a copy of the keyset of the field with another output prefix, ie RAW for BigQuery
+const ExportKeyPrefix = "export/"
+
+// PrfTemplates are the templates createPRFkey can name
+var PrfTemplates = map[string]func() *tinkpb.KeyTemplate{
+	"HMAC_SHA256_PRF": prf.HMACSHA256PRFKeyTemplate,
+	"HMAC_SHA512_PRF": prf.HMACSHA512PRFKeyTemplate,
+	"HKDF_SHA256":     prf.HKDFSHA256PRFKeyTemplate,
+	"AES_CMAC_PRF":    prf.AESCMACPRFKeyTemplate,
+}
+
+// CreateNewPRFKeySet creates a PRF keyset from the template
+func CreateNewPRFKeySet(template *tinkpb.KeyTemplate) (*keyset.Handle, error) {
+	kh, err := newKeysetHandle(template)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := prf.NewPRFSet(kh); err != nil {
+		return nil, err
+	}
+	return kh, nil
+}
+
+// ComputePRF returns length bytes of the PRF of the input under the primary key of the PRF keyset, and the id of the
+// primary key. The same keyset and input always give the same output
+func ComputePRF(rawKeyset string, input []byte, length int) ([]byte, int, error) {
+	kh, err := ValidateKeySetJson(rawKeyset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("not a valid keyset")
+	}
+	prfSet, err := prf.NewPRFSet(kh)
+	if err != nil {
+		return nil, 0, fmt.Errorf("not a PRF keyset")
+	}
+	if length < 1 {
+		return nil, 0, fmt.Errorf("the output length must be at least 1")
+	}
+	output, err := prfSet.ComputePrimaryPRF(input, uint32(length))
+	if err != nil {
+		return nil, 0, err
+	}
+	return output, int(prfSet.PrimaryID), nil
+}
+
+// TemplateNames returns the sorted names of the templates, for error messages
+func TemplateNames(templates map[string]func() *tinkpb.KeyTemplate) []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithOutputPrefix sets the output prefix type (TINK, RAW, LEGACY or CRUNCHY) on a key template
+func WithOutputPrefix(template *tinkpb.KeyTemplate, outputPrefix string) (*tinkpb.KeyTemplate, error) {
+	prefixType, ok := tinkpb.OutputPrefixType_value[strings.ToUpper(outputPrefix)]
+	if !ok || prefixType == int32(tinkpb.OutputPrefixType_UNKNOWN_PREFIX) {
+		return nil, fmt.Errorf("invalid output prefix type %s", outputPrefix)
+	}
+	template.OutputPrefixType = tinkpb.OutputPrefixType(prefixType)
+	return template, nil
+}
+
+// NewKeySetFromTemplateJson generates a fresh keyset from a json tink key template
+// ie {"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiA=","outputPrefixType":"TINK"}
+// only AEAD and DAEAD templates are accepted
+func NewKeySetFromTemplateJson(templateJson string) (*keyset.Handle, error) {
+	template, err := KeyTemplateFromJson(templateJson)
+	if err != nil {
+		return nil, err
+	}
+	kh, err := newKeysetHandle(template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a keyset from the template: %w", err)
+	}
+	_, aeadErr := aead.New(kh)
+	_, daeadErr := daead.New(kh)
+	if aeadErr != nil && daeadErr != nil {
+		return nil, fmt.Errorf("template %s is not an AEAD or DAEAD template", template.TypeUrl)
+	}
+	return kh, nil
+}
+
+// KeyTemplateFromJson reads a protojson key template, ie {"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"ECA=","outputPrefixType":"TINK"}
+func KeyTemplateFromJson(templateJson string) (*tinkpb.KeyTemplate, error) {
+	template := &tinkpb.KeyTemplate{}
+	err := protojson.Unmarshal([]byte(templateJson), template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	return template, nil
+}
+
+// IsKeyTemplateDeterministic checks the template makes a key we can use and whether it is deterministic
+func IsKeyTemplateDeterministic(template *tinkpb.KeyTemplate) (bool, error) {
+	kh, err := keyset.NewHandle(template)
+	if err != nil {
+		return false, fmt.Errorf("failed to create a keyset from the template: %w", err)
+	}
+	if _, err := daead.New(kh); err == nil {
+		return true, nil
+	}
+	if _, err := aead.New(kh); err == nil {
+		return false, nil
+	}
+	return false, fmt.Errorf("template %s is not an AEAD or DAEAD template", template.TypeUrl)
+}
+
+// RotateKeysWithTemplate adds a new primary key made from the template, the existing keys are kept so they still decrypt
+func RotateKeysWithTemplate(kh *keyset.Handle, template *tinkpb.KeyTemplate) error {
+	manager := keyset.NewManagerFromHandle(kh)
+	return manager.Rotate(template)
+}
+
+// RotateKeySet adds a new primary key to an AEAD or DAEAD keyset, made from the template or, if it is nil, the default
+// template of the keyset's kind, returning the id of the new primary key
+func RotateKeySet(kh *keyset.Handle, template *tinkpb.KeyTemplate) (uint32, error) {
+	deterministic := false
+	if _, err := daead.New(kh); err == nil {
+		deterministic = true
+	} else if _, err := aead.New(kh); err != nil {
+		return 0, fmt.Errorf("not an AEAD or DAEAD keyset: %w", err)
+	}
+
+	if template == nil {
+		RotateKeys(kh, deterministic)
+	} else {
+		err := RotateKeysWithTemplate(kh, template)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return kh.KeysetInfo().PrimaryKeyId, nil
+}
+
+// AddKeySet adds a new ENABLED key to an AEAD or DAEAD keyset without changing its primary, ie for a blue/green
+// rotation where the new key is promoted once consumers have it, made from the template or, if it is nil, the
+// default template of the keyset's kind. It returns the id of the new key
+func AddKeySet(kh *keyset.Handle, template *tinkpb.KeyTemplate) (uint32, error) {
+	if template == nil {
+		if _, err := daead.New(kh); err == nil {
+			template = daead.AESSIVKeyTemplate()
+		} else if _, err := aead.New(kh); err == nil {
+			template = aead.AES256GCMKeyTemplate()
+		} else {
+			return 0, fmt.Errorf("not an AEAD or DAEAD keyset: %w", err)
+		}
+	}
+	manager := keyset.NewManagerFromHandle(kh)
+	return manager.Add(template)
+}
+
 func RotateKeys(kh *keyset.Handle, deterministic bool) {
 	manager := keyset.NewManagerFromHandle(kh)
 	if deterministic {
@@ -370,6 +591,229 @@ func UpdatePrimaryKeyID(kh *keyset.Handle, keyId string) (*keyset.Handle, error)
 	return newkh, nil
 }
 
+// KeyIDByMaterial returns the id of the key in the keyset whose key material (the base64 keyData value) is material.
+// It errors if no key or more than one key has the material, or if the key is not enabled so cannot be the primary
+func KeyIDByMaterial(kh *keyset.Handle, material string) (int, error) {
+	materialBytes, err := b64.StdEncoding.DecodeString(material)
+	if err != nil {
+		return 0, fmt.Errorf("the key material is not valid base64")
+	}
+
+	buf := new(bytes.Buffer)
+	insecurecleartextkeyset.Write(kh, keyset.NewJSONWriter(buf))
+	var keySetStruct KeySetStruct
+	err = json.Unmarshal(buf.Bytes(), &keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to unmarshall the keyset")
+		return 0, err
+	}
+
+	var matches []int
+	for i, key := range keySetStruct.Key {
+		valueBytes, err := b64.StdEncoding.DecodeString(key.KeyData.Value)
+		if err == nil && bytes.Equal(valueBytes, materialBytes) {
+			matches = append(matches, i)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("no key in the keyset has the key material")
+	case 1:
+	default:
+		return 0, fmt.Errorf("%d keys in the keyset have the key material", len(matches))
+	}
+	key := keySetStruct.Key[matches[0]]
+	if key.Status != "ENABLED" {
+		return 0, fmt.Errorf("key %d has the key material but is %s", key.KeyID, key.Status)
+	}
+	return key.KeyID, nil
+}
+
+// IndexKeyBytes is the length of the random keys NewIndexKey creates, the output size of HMAC-SHA256
+const IndexKeyBytes = 32
+
+// NewIndexKey returns a new random key for IndexToken as base64
+func NewIndexKey() (string, error) {
+	key := make([]byte, IndexKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return b64.StdEncoding.EncodeToString(key), nil
+}
+
+// IndexToken returns the base64 HMAC-SHA256 of the plaintext under the base64 key. Equal plaintexts give equal tokens
+// under the same key, so the token can be stored and searched on beside a non-deterministic cyphertext
+func IndexToken(key string, plaintext []byte) (string, error) {
+	keyBytes, err := b64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("the index key is not valid base64")
+	}
+	if len(keyBytes) < IndexKeyBytes {
+		return "", fmt.Errorf("the index key must be at least %d bytes", IndexKeyBytes)
+	}
+	mac := hmac.New(sha256.New, keyBytes)
+	mac.Write(plaintext)
+	return b64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// CheckPrimary returns why the primary key of the keyset cannot encrypt, or "" if it can, and the id of the key that
+// could replace it - the newest (last added) ENABLED key, or 0 if there is none
+func CheckPrimary(kh *keyset.Handle) (string, int, error) {
+	buf := new(bytes.Buffer)
+	insecurecleartextkeyset.Write(kh, keyset.NewJSONWriter(buf))
+	var keySetStruct KeySetStruct
+	err := json.Unmarshal(buf.Bytes(), &keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to unmarshall the keyset")
+		return "", 0, err
+	}
+
+	candidate := 0
+	for _, key := range keySetStruct.Key {
+		if key.Status == "ENABLED" {
+			candidate = key.KeyID
+		}
+	}
+
+	index, err := keySetStruct.GetKeyID(keySetStruct.PrimaryKeyID)
+	if err != nil {
+		return fmt.Sprintf("primary key %d is not in the keyset", keySetStruct.PrimaryKeyID), candidate, nil
+	}
+	status := keySetStruct.Key[index].Status
+	if status != "ENABLED" {
+		return fmt.Sprintf("primary key %d is %s", keySetStruct.PrimaryKeyID, status), candidate, nil
+	}
+	return "", candidate, nil
+}
+
+// PurgeKeys removes the DISABLED (and optionally DESTROYED) keys from the keyset, returning the new key handle and
+// how many keys were removed. ENABLED keys and the primary are never removed
+func PurgeKeys(kh *keyset.Handle, includeDestroyed bool) (*keyset.Handle, int, error) {
+	// extract the JSON key that could be stored
+	buf := new(bytes.Buffer)
+	jsonWriter := keyset.NewJSONWriter(buf)
+
+	insecurecleartextkeyset.Write(kh, jsonWriter)
+
+	// unmarshall the keyset
+	str := buf.String()
+	var keySetStruct KeySetStruct
+	err := json.Unmarshal([]byte(str), &keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to unmarshall the keyset")
+		return nil, 0, err
+	}
+
+	// keep the primary and anything not being purged
+	keptKeys := keySetStruct.Key[:0]
+	enabledKeys := 0
+	for _, key := range keySetStruct.Key {
+		purge := key.Status == "DISABLED" || (includeDestroyed && key.Status == "DESTROYED")
+		if key.KeyID == keySetStruct.PrimaryKeyID || !purge {
+			keptKeys = append(keptKeys, key)
+			if key.Status == "ENABLED" {
+				enabledKeys++
+			}
+		}
+	}
+	purged := len(keySetStruct.Key) - len(keptKeys)
+	keySetStruct.Key = keptKeys
+	if enabledKeys == 0 {
+		return nil, 0, fmt.Errorf("the keyset would have no enabled keys")
+	}
+
+	// make the json again
+	data, err := json.Marshal(keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to marshall the keyset")
+		return nil, 0, err
+	}
+
+	// make a key handle from the json, if it doesnt error, its still valid
+	r := keyset.NewJSONReader(bytes.NewBufferString(string(data)))
+	newkh, err := insecurecleartextkeyset.Read(r)
+	if err != nil {
+		hclog.L().Info("Failed to make a key handle from the json:" + string(data) + " Error:" + err.Error())
+		return nil, 0, err
+	}
+
+	return newkh, purged, nil
+}
+
+// PrimaryOutputPrefix returns the output prefix type (TINK, RAW, LEGACY or CRUNCHY) of the primary key of the keyset
+func PrimaryOutputPrefix(kh *keyset.Handle) (string, error) {
+	ks := insecurecleartextkeyset.KeysetMaterial(kh)
+	for _, key := range ks.GetKey() {
+		if key.GetKeyId() == ks.GetPrimaryKeyId() {
+			return key.GetOutputPrefixType().String(), nil
+		}
+	}
+	return "", fmt.Errorf("the primary key %d is not in the keyset", ks.GetPrimaryKeyId())
+}
+
+// ConvertOutputPrefix sets the output prefix type (TINK, RAW, LEGACY or CRUNCHY) of every key in the keyset
+// existing cyphertext made with a different output prefix will no longer decrypt. It returns whether anything changed
+func ConvertOutputPrefix(kh *keyset.Handle, outputPrefix string) (*keyset.Handle, bool, error) {
+	prefixType, ok := tinkpb.OutputPrefixType_value[strings.ToUpper(outputPrefix)]
+	if !ok || prefixType == int32(tinkpb.OutputPrefixType_UNKNOWN_PREFIX) {
+		return nil, false, fmt.Errorf("invalid output prefix type %s", outputPrefix)
+	}
+	outputPrefix = tinkpb.OutputPrefixType(prefixType).String()
+
+	// extract the JSON key that could be stored
+	buf := new(bytes.Buffer)
+	jsonWriter := keyset.NewJSONWriter(buf)
+
+	insecurecleartextkeyset.Write(kh, jsonWriter)
+
+	// unmarshall the keyset
+	str := buf.String()
+	var keySetStruct KeySetStruct
+	err := json.Unmarshal([]byte(str), &keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to unmarshall the keyset")
+		return nil, false, err
+	}
+
+	changed := false
+	for i := range keySetStruct.Key {
+		if keySetStruct.Key[i].OutputPrefixType != outputPrefix {
+			keySetStruct.Key[i].OutputPrefixType = outputPrefix
+			changed = true
+		}
+	}
+
+	// make the json again
+	data, err := json.Marshal(keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to marshall the keyset")
+		return nil, false, err
+	}
+
+	// make a key handle from the json, if it doesnt error, its still valid
+	r := keyset.NewJSONReader(bytes.NewBufferString(string(data)))
+	newkh, err := insecurecleartextkeyset.Read(r)
+	if err != nil {
+		hclog.L().Info("Failed to make a key handle from the json:" + string(data) + " Error:" + err.Error())
+		return nil, false, err
+	}
+
+	return newkh, changed, nil
+}
+
+// ParseKeySetJson makes a key handle from the json as ValidateKeySetJson does, but neither logs the json nor returns an
+// error that quotes it, for json that may be key material that is only part written
+func ParseKeySetJson(keySetJson string) (*keyset.Handle, error) {
+	if !isEncryptionJsonKey(keySetJson) {
+		return nil, fmt.Errorf("not a keyset, it has no primaryKeyId")
+	}
+	kh, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewBufferString(keySetJson)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to make a key handle from the json")
+	}
+	return kh, nil
+}
+
 func ValidateKeySetJson(keySetJson string) (*keyset.Handle, error) {
 
 	if !isEncryptionJsonKey(keySetJson) {
@@ -384,6 +828,127 @@ func ValidateKeySetJson(keySetJson string) (*keyset.Handle, error) {
 	return kh, nil
 }
 
+// ValidateImportKeySetJson checks a keyset can be imported and used: it must parse, its primary key must be one of its
+// enabled keys, no two keys can share a key id, and its keys must all be of a supported type (see SupportedKeyTypes) and
+// all deterministic or all not
+func ValidateImportKeySetJson(keySetJson string) (*keyset.Handle, error) {
+	kh, err := ValidateKeySetJson(keySetJson)
+	if err != nil {
+		return nil, err
+	}
+	if err := keyset.Validate(insecurecleartextkeyset.KeysetMaterial(kh)); err != nil {
+		return nil, err
+	}
+	// tink allows two keys with the same id, but then the id no longer says which key made the cyphertext
+	keyIDs := make(map[uint32]bool)
+	for _, key := range insecurecleartextkeyset.KeysetMaterial(kh).GetKey() {
+		if keyIDs[key.GetKeyId()] {
+			return nil, fmt.Errorf("key id %d is used by more than one key", key.GetKeyId())
+		}
+		keyIDs[key.GetKeyId()] = true
+	}
+
+	algorithms, err := GetKeySetAlgorithms(keySetJson)
+	if err != nil {
+		return nil, err
+	}
+	deterministic := 0
+	for _, algorithm := range strings.Split(algorithms, ",") {
+		supported := false
+		for _, keyType := range SupportedKeyTypes {
+			if algorithm == keyType {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, fmt.Errorf("key type %s is not supported, expected one of %s", algorithm, strings.Join(SupportedKeyTypes, ","))
+		}
+		if algorithm == "AesSiv" {
+			deterministic++
+		}
+	}
+	if deterministic > 0 && deterministic < len(strings.Split(algorithms, ",")) {
+		return nil, fmt.Errorf("keyset mixes deterministic and non deterministic key types %s", algorithms)
+	}
+	return kh, nil
+}
+
+// KeySetBits returns the strength in bits of the weakest key in the keyset, the size of its AES or ChaCha20 key. An
+// AES-SIV key is two AES keys so it is half of its size, an AesCtrHmacAead key is the size of its AES key
+func KeySetBits(kh *keyset.Handle) (int, error) {
+	minBits := 0
+	for _, key := range insecurecleartextkeyset.KeysetMaterial(kh).GetKey() {
+		bits, err := keyBits(key.GetKeyData())
+		if err != nil {
+			return 0, fmt.Errorf("key %d: %w", key.GetKeyId(), err)
+		}
+		if minBits == 0 || bits < minBits {
+			minBits = bits
+		}
+	}
+	if minBits == 0 {
+		return 0, fmt.Errorf("keyset contains no keys")
+	}
+	return minBits, nil
+}
+
+// TemplateBits returns the strength in bits of the keys the template creates
+func TemplateBits(template *tinkpb.KeyTemplate) (int, error) {
+	kh, err := keyset.NewHandle(template)
+	if err != nil {
+		return 0, err
+	}
+	return KeySetBits(kh)
+}
+
+func keyBits(keyData *tinkpb.KeyData) (int, error) {
+	typeURL := keyData.GetTypeUrl()
+	algorithm := strings.TrimSuffix(typeURL[strings.LastIndex(typeURL, ".")+1:], "Key")
+	var keyValue []byte
+	switch algorithm {
+	case "AesGcm":
+		key := &aesgcmpb.AesGcmKey{}
+		if err := proto.Unmarshal(keyData.GetValue(), key); err != nil {
+			return 0, err
+		}
+		keyValue = key.GetKeyValue()
+	case "AesGcmSiv":
+		key := &aesgcmsivpb.AesGcmSivKey{}
+		if err := proto.Unmarshal(keyData.GetValue(), key); err != nil {
+			return 0, err
+		}
+		keyValue = key.GetKeyValue()
+	case "AesCtrHmacAead":
+		key := &aesctrhmacaeadpb.AesCtrHmacAeadKey{}
+		if err := proto.Unmarshal(keyData.GetValue(), key); err != nil {
+			return 0, err
+		}
+		keyValue = key.GetAesCtrKey().GetKeyValue()
+	case "ChaCha20Poly1305":
+		key := &chacha20poly1305pb.ChaCha20Poly1305Key{}
+		if err := proto.Unmarshal(keyData.GetValue(), key); err != nil {
+			return 0, err
+		}
+		keyValue = key.GetKeyValue()
+	case "XChaCha20Poly1305":
+		key := &xchacha20poly1305pb.XChaCha20Poly1305Key{}
+		if err := proto.Unmarshal(keyData.GetValue(), key); err != nil {
+			return 0, err
+		}
+		keyValue = key.GetKeyValue()
+	case "AesSiv":
+		key := &aessivpb.AesSivKey{}
+		if err := proto.Unmarshal(keyData.GetValue(), key); err != nil {
+			return 0, err
+		}
+		return len(key.GetKeyValue()) * 8 / 2, nil
+	default:
+		return 0, fmt.Errorf("the strength of key type %s is not known", algorithm)
+	}
+	return len(keyValue) * 8, nil
+}
+
 func ValidateB64Key(base64Keyset string) (string, error) {
 	keysetByte, err := b64.StdEncoding.DecodeString(base64Keyset)
 	if err != nil {
@@ -404,6 +969,80 @@ func ValidateB64Key(base64Keyset string) (string, error) {
 	return keysetStr, err
 }
 
+// SupportedKeyTypes are the algorithms (as returned by GetKeySetAlgorithms) of the keysets the plugin can use
+var SupportedKeyTypes = []string{"AesGcm", "AesGcmSiv", "AesCtrHmacAead", "ChaCha20Poly1305", "XChaCha20Poly1305", "AesSiv"}
+
+// TinkTypeURLPrefix is the prefix of the type url of every tink key, the type url is the prefix, the key type and Key
+const TinkTypeURLPrefix = "type.googleapis.com/google.crypto.tink."
+
+// SupportedTypeURLs returns the tink type urls of the SupportedKeyTypes, ie type.googleapis.com/google.crypto.tink.AesGcmKey
+func SupportedTypeURLs() []string {
+	typeURLs := make([]string, 0, len(SupportedKeyTypes))
+	for _, keyType := range SupportedKeyTypes {
+		typeURLs = append(typeURLs, TinkTypeURLPrefix+keyType+"Key")
+	}
+	return typeURLs
+}
+
+// TemplateTypeURLs returns the sorted type urls of the keys the templates make
+func TemplateTypeURLs(templates map[string]func() *tinkpb.KeyTemplate) []string {
+	seen := make(map[string]bool, len(templates))
+	typeURLs := make([]string, 0, len(templates))
+	for _, template := range templates {
+		typeURL := template().GetTypeUrl()
+		if !seen[typeURL] {
+			seen[typeURL] = true
+			typeURLs = append(typeURLs, typeURL)
+		}
+	}
+	sort.Strings(typeURLs)
+	return typeURLs
+}
+
+// KeySetFingerprint returns a stable hash of the keyset, ie sha256:<hex>, over the deterministic binary serialization of the keyset
+// so the same keyset always gives the same fingerprint regardless of how its json was formatted
+func KeySetFingerprint(kh *keyset.Handle) (string, error) {
+	ks := insecurecleartextkeyset.KeysetMaterial(kh)
+	serialized, err := proto.MarshalOptions{Deterministic: true}.Marshal(ks)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(serialized)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// GetKeySetAlgorithms returns the algorithm(s) used by a keyset, derived from the type url of each key,
+// ie type.googleapis.com/google.crypto.tink.AesGcmKey is AesGcm. Mixed keysets are comma separated
+func GetKeySetAlgorithms(rawKeyset string) (string, error) {
+	var keySetStruct KeySetStruct
+	err := json.Unmarshal([]byte(rawKeyset), &keySetStruct)
+	if err != nil {
+		return "", err
+	}
+	if len(keySetStruct.Key) == 0 {
+		return "", fmt.Errorf("keyset contains no keys")
+	}
+	algorithms := []string{}
+	for _, key := range keySetStruct.Key {
+		typeURL := key.KeyData.TypeURL
+		algorithm := strings.TrimSuffix(typeURL[strings.LastIndex(typeURL, ".")+1:], "Key")
+		if algorithm == "" {
+			return "", fmt.Errorf("failed to determine the algorithm of key %d", key.KeyID)
+		}
+		found := false
+		for _, a := range algorithms {
+			if a == algorithm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return strings.Join(algorithms, ","), nil
+}
+
 func isEncryptionJsonKey(keyStr string) bool {
 	//TODO find better way to check this
 	return strings.Contains(keyStr, "primaryKeyId")
@@ -506,29 +1145,110 @@ func GetEncryptionKey(fieldName string, AEAD_CONFIG cmap.ConcurrentMap, setDepth
 	return key, found
 }
 
-func MuteKeyMaterial(theKey string) string {
-	type jsonKey struct {
-		Key []struct {
-			KeyData struct {
-				Value string `json:"value"`
-			} `json:"keyData"`
-		} `json:"key"`
+// GetEncryptionKeyName follows the same config pointers as GetEncryptionKey but returns the name of
+// the config entry that holds the keyset rather than the keyset itself
+func GetEncryptionKeyName(fieldName string, AEAD_CONFIG cmap.ConcurrentMap, setDepth ...int) (string, bool) {
+	maxDepth := 5
+	if len(setDepth) > 0 {
+		maxDepth = setDepth[0]
 	}
-	var resp jsonKey
-	err := json.Unmarshal([]byte(theKey), &resp)
+
+	for currDepth := 0; currDepth < maxDepth; currDepth++ {
+		configValue, ok := AEAD_CONFIG.Get(fieldName)
+		if !ok {
+			return "", false
+		}
+		configValueStr := fmt.Sprintf("%v", configValue)
+		if _, err := ValidateKeySetJson(configValueStr); err == nil {
+			// this is a valid key
+			return fieldName, true
+		}
+		fieldName = configValueStr
+	}
+	return "", false
+}
+
+// EncryptWithKeyHandle encrypts with the primary key of the key handle, deterministically or not depending on the key type
+func EncryptWithKeyHandle(kh *keyset.Handle, plainText []byte, additionalData []byte) ([]byte, error) {
+	if IsKeyHandleDeterministic(kh) {
+		d, err := daead.New(kh)
+		if err != nil {
+			return nil, err
+		}
+		return d.EncryptDeterministically(plainText, additionalData)
+	}
+	a, err := aead.New(kh)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	mutedMaterial := theKey
-	for _, key := range resp.Key {
-		mutedMaterial = strings.Replace(mutedMaterial, key.KeyData.Value, "***", -1)
+	return a.Encrypt(plainText, additionalData)
+}
+
+// DecryptWithKeyHandle decrypts with any enabled key of the key handle, deterministically or not depending on the key type
+func DecryptWithKeyHandle(kh *keyset.Handle, cipherText []byte, additionalData []byte) ([]byte, error) {
+	if IsKeyHandleDeterministic(kh) {
+		d, err := daead.New(kh)
+		if err != nil {
+			return nil, err
+		}
+		return d.DecryptDeterministically(cipherText, additionalData)
 	}
-	return mutedMaterial
+	a, err := aead.New(kh)
+	if err != nil {
+		return nil, err
+	}
+	return a.Decrypt(cipherText, additionalData)
+}
+
+func MuteKeyMaterial(theKey string) string {
+	return MuteKeyMaterialWithMask(theKey, "***")
+}
+
+// MuteKeyMaterialWithMask replaces every "value" under every "keyData" in the json, however deeply nested, with the mask.
+// If the json cannot be parsed the whole thing is masked rather than risk returning key material
+func MuteKeyMaterialWithMask(theKey string, mask string) string {
+	var parsed interface{}
+	decoder := json.NewDecoder(strings.NewReader(theKey))
+	decoder.UseNumber() // keep key ids as they are rather than as floats
+	if err := decoder.Decode(&parsed); err != nil {
+		hclog.L().Error("failed to unmarshall the key to mute it")
+		return mask
+	}
+
+	// define a var for the recursive function
+	var walk func(node interface{}, underKeyData bool)
+	walk = func(node interface{}, underKeyData bool) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for k, v := range n {
+				if underKeyData && k == "value" {
+					n[k] = mask
+					continue
+				}
+				walk(v, k == "keyData")
+			}
+		case []interface{}:
+			for _, v := range n {
+				walk(v, false)
+			}
+		}
+	}
+	walk(parsed, false)
+
+	// don't html escape the mask (ie <hidden>)
+	var mutedMaterial bytes.Buffer
+	encoder := json.NewEncoder(&mutedMaterial)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(parsed); err != nil {
+		hclog.L().Error("failed to marshall the muted key")
+		return mask
+	}
+	return strings.TrimSuffix(mutedMaterial.String(), "\n")
 }
 
 func GetKeyPrefix(fieldName string, potentialAEADKey string, kh *keyset.Handle) string {
 	// if the fieldname already has the prefix, dont double up
-	if strings.HasPrefix(fieldName, "siv/") || strings.HasPrefix(fieldName, "gcm/") {
+	if strings.HasPrefix(fieldName, "siv/") || strings.HasPrefix(fieldName, "gcm/") || strings.HasPrefix(fieldName, PRFKeyPrefix) || strings.HasPrefix(fieldName, ExportKeyPrefix) {
 		// its either not an AEAD keyset or it is but already has the prefix
 		return ""
 	}
@@ -560,16 +1280,92 @@ func GetKeyPrefix(fieldName string, potentialAEADKey string, kh *keyset.Handle)
 	return prefix
 }
 
+// the prefixes RemoveKeyPrefix strips, siv/ and gcm/ plus any set by SetKeyPrefixes
+var (
+	keyPrefixes     = defaultKeyPrefixes
+	keyPrefixesLock sync.RWMutex
+)
+
+var defaultKeyPrefixes = []string{"siv/", "gcm/"}
+
+// SetKeyPrefixes sets the prefixes RemoveKeyPrefix strips as well as siv/ and gcm/, ie folders of a KV layout such as
+// chacha/ or team-a/. A prefix without a trailing "/" has one added, and nil or empty restores the default
+func SetKeyPrefixes(prefixes []string) {
+	newPrefixes := append([]string{}, defaultKeyPrefixes...)
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		newPrefixes = append(newPrefixes, prefix)
+	}
+	keyPrefixesLock.Lock()
+	defer keyPrefixesLock.Unlock()
+	keyPrefixes = newPrefixes
+}
+
+// ParseKeyPrefixes splits a comma separated list of prefixes, ie the KEY_PREFIXES option, for SetKeyPrefixes
+func ParseKeyPrefixes(prefixes string) []string {
+	if strings.TrimSpace(prefixes) == "" {
+		return nil
+	}
+	return strings.Split(prefixes, ",")
+}
+
+// KeyPrefixes returns the prefixes RemoveKeyPrefix strips
+func KeyPrefixes() []string {
+	keyPrefixesLock.RLock()
+	defer keyPrefixesLock.RUnlock()
+	return append([]string{}, keyPrefixes...)
+}
+
+// HasKeyPrefix returns true if the key name starts with one of the prefixes RemoveKeyPrefix strips
+func HasKeyPrefix(keyName string) bool {
+	for _, prefix := range KeyPrefixes() {
+		if strings.HasPrefix(keyName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveKeyPrefix strips the first of the KeyPrefixes the key name starts with. A name that still has a "/" has a
+// prefix that is not known, it is left intact with a warning as it is not a valid field name
 func RemoveKeyPrefix(fieldName string) string {
-	if strings.HasPrefix(fieldName, "siv/") {
-		return strings.TrimPrefix(fieldName, "siv/")
+	for _, prefix := range KeyPrefixes() {
+		if strings.HasPrefix(fieldName, prefix) {
+			return strings.TrimPrefix(fieldName, prefix)
+		}
 	}
-	if strings.HasPrefix(fieldName, "gcm/") {
-		return strings.TrimPrefix(fieldName, "gcm/")
+	if strings.Contains(fieldName, "/") {
+		hclog.L().Warn(fmt.Sprintf("%s has an unknown prefix, it is left intact - add the prefix to KEY_PREFIXES to strip it", fieldName))
 	}
 	return fieldName
 }
 
+// BQFieldName is the name a field has in BQ routines, "-" is not allowed in BQ so it is translated to "_"
+func BQFieldName(fieldName string) string {
+	return strings.Replace(RemoveKeyPrefix(fieldName), "-", "_", -1)
+}
+
+// ValidateFieldName returns an error if the field name (without its gcm/ or siv/ prefix) cannot be used as
+// the name of a BQ routine, after "-" is translated to "_"
+func ValidateFieldName(fieldName string) error {
+	name := RemoveKeyPrefix(fieldName)
+	if name == "" {
+		return fmt.Errorf("invalid field name %q: it must not be empty", fieldName)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return fmt.Errorf("invalid field name %q: only letters, digits, _ and - are allowed, found %q", fieldName, c)
+		}
+	}
+	return nil
+}
+
 func ReverseKeyPrefix(fieldName string) string {
 	if strings.HasPrefix(fieldName, "siv/") {
 		return strings.TrimPrefix(fieldName, "siv/")
@@ -602,3 +1398,120 @@ func IsSecretAnAEADKeyset(secret interface{}, fName string) (string, *keyset.Han
 	}
 	return jsonToValidate, kh, nil
 }
+
+// DecryptWithKeyID decrypts the cipherText by trying each ENABLED key in the keyset in turn,
+// returning the plaintext together with the id of the key that succeeded
+func DecryptWithKeyID(rawKeyset string, cipherText []byte, additionalData []byte) ([]byte, int, error) {
+	var keySetStruct KeySetStruct
+	err := json.Unmarshal([]byte(rawKeyset), &keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to unmarshall the keyset")
+		return nil, 0, err
+	}
+	_, deterministic := IsKeyJsonDeterministic(rawKeyset)
+
+	for _, key := range keySetStruct.Key {
+		if key.Status != "ENABLED" {
+			continue
+		}
+
+		// make a keyset of just this key
+		singleKeySet := KeySetStruct{PrimaryKeyID: key.KeyID}
+		singleKeySet.Key = append(singleKeySet.Key, key)
+		data, err := json.Marshal(singleKeySet)
+		if err != nil {
+			hclog.L().Error("failed to marshall the keyset")
+			return nil, 0, err
+		}
+		kh, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewBuffer(data)))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var plainText []byte
+		if deterministic {
+			d, err := daead.New(kh)
+			if err != nil {
+				return nil, 0, err
+			}
+			plainText, err = d.DecryptDeterministically(cipherText, additionalData)
+			if err == nil {
+				return plainText, key.KeyID, nil
+			}
+		} else {
+			a, err := aead.New(kh)
+			if err != nil {
+				return nil, 0, err
+			}
+			plainText, err = a.Decrypt(cipherText, additionalData)
+			if err == nil {
+				return plainText, key.KeyID, nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("no enabled key could decrypt the data")
+}
+
+// CiphertextKeyID returns the id of the key in the keyset that made the cipherText. The key id prefix of cyphertext of
+// a TINK, LEGACY or CRUNCHY key says which key it is, the cyphertext of a RAW key is decrypted with each key in turn
+// as DecryptWithKeyID does
+func CiphertextKeyID(rawKeyset string, cipherText []byte, additionalData []byte) (int, error) {
+	var keySetStruct KeySetStruct
+	if err := json.Unmarshal([]byte(rawKeyset), &keySetStruct); err != nil {
+		hclog.L().Error("failed to unmarshall the keyset")
+		return 0, err
+	}
+	if len(cipherText) > cryptofmt.NonRawPrefixSize {
+		prefixKeyID := int(binary.BigEndian.Uint32(cipherText[1:cryptofmt.NonRawPrefixSize]))
+		for _, key := range keySetStruct.Key {
+			if key.KeyID != prefixKeyID || key.Status != "ENABLED" {
+				continue
+			}
+			switch key.OutputPrefixType {
+			case tinkpb.OutputPrefixType_TINK.String():
+				if cipherText[0] == cryptofmt.TinkStartByte {
+					return key.KeyID, nil
+				}
+			case tinkpb.OutputPrefixType_LEGACY.String(), tinkpb.OutputPrefixType_CRUNCHY.String():
+				if cipherText[0] == cryptofmt.LegacyStartByte {
+					return key.KeyID, nil
+				}
+			}
+		}
+	}
+	_, keyID, err := DecryptWithKeyID(rawKeyset, cipherText, additionalData)
+	return keyID, err
+}
+
+// DecryptTryAllKeys decrypts the cipherText as DecryptWithKeyID and, if no key can, tries each ENABLED key again as a
+// RAW key, for cyphertext without the key id prefix of its key (ie made before the keyset was converted with
+// convertPrefix, or with the prefix stripped). It returns the plaintext together with the id of the key that succeeded
+func DecryptTryAllKeys(rawKeyset string, cipherText []byte, additionalData []byte) ([]byte, int, error) {
+	plainText, keyID, err := DecryptWithKeyID(rawKeyset, cipherText, additionalData)
+	if err == nil {
+		return plainText, keyID, nil
+	}
+
+	var keySetStruct KeySetStruct
+	if err := json.Unmarshal([]byte(rawKeyset), &keySetStruct); err != nil {
+		hclog.L().Error("failed to unmarshall the keyset")
+		return nil, 0, err
+	}
+	converted := false
+	for i := range keySetStruct.Key {
+		if keySetStruct.Key[i].OutputPrefixType != tinkpb.OutputPrefixType_RAW.String() {
+			keySetStruct.Key[i].OutputPrefixType = tinkpb.OutputPrefixType_RAW.String()
+			converted = true
+		}
+	}
+	if !converted {
+		// every key was already tried as RAW
+		return nil, 0, err
+	}
+	data, err := json.Marshal(keySetStruct)
+	if err != nil {
+		hclog.L().Error("failed to marshall the keyset")
+		return nil, 0, err
+	}
+	return DecryptWithKeyID(string(data), cipherText, additionalData)
+}
@@ -2,14 +2,26 @@ package aeadutils
 
 import (
 	"bytes"
+	"fmt"
 	"log"
+	mathrand "math/rand"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/daead"
 	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/mac"
+	aesgcmpb "github.com/google/tink/go/proto/aes_gcm_go_proto"
+	gcmsivpb "github.com/google/tink/go/proto/aes_gcm_siv_go_proto"
+	aessivpb "github.com/google/tink/go/proto/aes_siv_go_proto"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+	hclog "github.com/hashicorp/go-hclog"
 	cmap "github.com/orcaman/concurrent-map"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestAeadUtils(t *testing.T) {
@@ -621,6 +633,278 @@ func TestAeadUtils(t *testing.T) {
 		}
 
 	})
+
+	t.Run("test KeyIDByMaterial", func(t *testing.T) {
+		rawKeyset := `{"primaryKeyId":3987026049,"key":[{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiB5m/rHV+xmMiRngaWWi6zel8IjlOPCdEpGnEsb8RfrMQ==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":1456486908,"outputPrefixType":"TINK"},{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":3987026049,"outputPrefixType":"TINK"},{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":1111111111,"outputPrefixType":"TINK"},{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiBs9EEVquF+igDsDI+FskdsDjVOf6vxLZQHkbJrrIoQLQ==","keyMaterialType":"SYMMETRIC"},"status":"DISABLED","keyId":2222222222,"outputPrefixType":"TINK"}]}`
+		kh, _, err := CreateInsecureHandleAndAead(rawKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyID, err := KeyIDByMaterial(kh, "GiB5m/rHV+xmMiRngaWWi6zel8IjlOPCdEpGnEsb8RfrMQ==")
+		if err != nil || keyID != 1456486908 {
+			t.Errorf("expected 1456486908 got %d %v", keyID, err)
+		}
+		if _, err := KeyIDByMaterial(kh, "GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A=="); err == nil {
+			t.Error("expected an error as two keys have the material")
+		}
+		if _, err := KeyIDByMaterial(kh, "GiBs9EEVquF+igDsDI+FskdsDjVOf6vxLZQHkbJrrIoQLQ=="); err == nil {
+			t.Error("expected an error as the key is disabled")
+		}
+		if _, err := KeyIDByMaterial(kh, "GiBf14hIKBzJYUGjc4LXzaG3dT3aVsvv0vpyZJVZNh02MQ=="); err == nil {
+			t.Error("expected an error as no key has the material")
+		}
+		if _, err := KeyIDByMaterial(kh, "not base64!"); err == nil {
+			t.Error("expected an error as the material is not base64")
+		}
+	})
+
+	t.Run("test IndexToken", func(t *testing.T) {
+		key, err := NewIndexKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKey, _ := NewIndexKey()
+		if key == otherKey {
+			t.Error("expected two new index keys to differ")
+		}
+
+		token1, err := IndexToken(key, []byte("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token2, _ := IndexToken(key, []byte("hello world"))
+		if token1 != token2 {
+			t.Errorf("expected equal plaintexts to give equal tokens %s %s", token1, token2)
+		}
+		if token3, _ := IndexToken(key, []byte("hello world2")); token3 == token1 {
+			t.Error("expected different plaintexts to give different tokens")
+		}
+		if token4, _ := IndexToken(otherKey, []byte("hello world")); token4 == token1 {
+			t.Error("expected different keys to give different tokens")
+		}
+		if _, err := IndexToken("c2hvcnQ=", []byte("hello world")); err == nil {
+			t.Error("expected an error as the key is too short")
+		}
+		if _, err := IndexToken("not base64!", []byte("hello world")); err == nil {
+			t.Error("expected an error as the key is not base64")
+		}
+	})
+
+	t.Run("test PRF", func(t *testing.T) {
+		kh, err := CreateNewPRFKeySet(PrfTemplates["HMAC_SHA256_PRF"]())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawKeyset, err := ExtractInsecureKeySetFromKeyhandle(kh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output1, keyID, err := ComputePRF(rawKeyset, []byte("tenant-1"), 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(output1) != 32 || keyID != int(kh.KeysetInfo().GetPrimaryKeyId()) {
+			t.Errorf("expected 32 bytes from the primary key got %d bytes from %d", len(output1), keyID)
+		}
+		output2, _, _ := ComputePRF(rawKeyset, []byte("tenant-1"), 32)
+		if !bytes.Equal(output1, output2) {
+			t.Error("expected the same input to give the same output")
+		}
+		output3, _, _ := ComputePRF(rawKeyset, []byte("tenant-2"), 32)
+		if bytes.Equal(output1, output3) {
+			t.Error("expected different inputs to give different outputs")
+		}
+		if _, _, err := ComputePRF(rawKeyset, []byte("tenant-1"), 64); err == nil {
+			t.Error("expected an error as HMAC_SHA256_PRF cannot output 64 bytes")
+		}
+		if _, _, err := ComputePRF(rawKeyset, []byte("tenant-1"), 0); err == nil {
+			t.Error("expected an error for a zero length")
+		}
+
+		aeadKh, _, _ := CreateNewAead()
+		aeadKeyset, _ := ExtractInsecureKeySetFromKeyhandle(aeadKh)
+		if _, _, err := ComputePRF(aeadKeyset, []byte("tenant-1"), 32); err == nil {
+			t.Error("expected an error as the keyset is not a PRF keyset")
+		}
+	})
+
+	t.Run("test check primary", func(t *testing.T) {
+		kh, _, _ := CreateNewAead()
+		oldPrimary := int(kh.KeysetInfo().GetPrimaryKeyId())
+		newKey, err := RotateKeySet(kh, aead.AES256GCMKeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		problem, candidate, err := CheckPrimary(kh)
+		if err != nil || problem != "" || candidate != int(newKey) {
+			t.Errorf("expected no problem and candidate %d got %q %d %v", newKey, problem, candidate, err)
+		}
+
+		// point the primary back at the first key and disable it
+		kh, _ = UpdatePrimaryKeyID(kh, strconv.Itoa(oldPrimary))
+		kh, _ = UpdateKeyStatus(kh, strconv.Itoa(oldPrimary), "DISABLED")
+		problem, candidate, err = CheckPrimary(kh)
+		if err != nil || problem != fmt.Sprintf("primary key %d is DISABLED", oldPrimary) || candidate != int(newKey) {
+			t.Errorf("expected the disabled primary and candidate %d got %q %d %v", newKey, problem, candidate, err)
+		}
+
+		kh, _ = UpdateKeyStatus(kh, strconv.Itoa(int(newKey)), "DISABLED")
+		_, candidate, _ = CheckPrimary(kh)
+		if candidate != 0 {
+			t.Errorf("expected no candidate when no key is enabled got %d", candidate)
+		}
+	})
+
+	t.Run("test add key keeps the primary", func(t *testing.T) {
+		for _, deterministic := range []bool{false, true} {
+			var kh *keyset.Handle
+			if deterministic {
+				kh, _, _ = CreateNewDeterministicAead()
+			} else {
+				kh, _, _ = CreateNewAead()
+			}
+			primary := kh.KeysetInfo().GetPrimaryKeyId()
+			keyID, err := AddKeySet(kh, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := kh.KeysetInfo()
+			if info.GetPrimaryKeyId() != primary || len(info.GetKeyInfo()) != 2 || info.GetKeyInfo()[1].GetKeyId() != keyID {
+				t.Errorf("expected key %d added with the primary %d unchanged got %v", keyID, primary, info)
+			}
+			if IsKeyHandleDeterministic(kh) != deterministic {
+				t.Errorf("expected the added key to be deterministic %v", deterministic)
+			}
+		}
+	})
+
+	t.Run("test seeded key generation", func(t *testing.T) {
+		defer func() { newKeysetHandle = keyset.NewHandle }()
+		keySetJson := func(kh *keyset.Handle) string {
+			rawKeyset, err := ExtractInsecureKeySetFromKeyhandle(kh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return rawKeyset
+		}
+
+		for _, deterministic := range []bool{false, true} {
+			var keySets []string
+			for i := 0; i < 2; i++ {
+				newKeysetHandle = seededKeysetHandle(42)
+				var kh *keyset.Handle
+				var err error
+				if deterministic {
+					kh, _, err = CreateNewDeterministicAead()
+				} else {
+					kh, _, err = CreateNewAead()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if IsKeyHandleDeterministic(kh) != deterministic {
+					t.Errorf("expected a deterministic %v keyset", deterministic)
+				}
+				keySets = append(keySets, keySetJson(kh))
+			}
+			if keySets[0] != keySets[1] {
+				t.Errorf("expected the same seed to generate the same keyset got %s and %s", keySets[0], keySets[1])
+			}
+		}
+
+		newKeysetHandle = seededKeysetHandle(42)
+		kh, a, err := CreateNewAead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cypherText, err := a.Encrypt([]byte("hello"), []byte("aad"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainText, err := a.Decrypt(cypherText, []byte("aad"))
+		if err != nil || string(plainText) != "hello" {
+			t.Errorf("expected the seeded keyset to decrypt its cyphertext got %s %v", plainText, err)
+		}
+		newKeysetHandle = seededKeysetHandle(43)
+		other, _, err := CreateNewAead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keySetJson(kh) == keySetJson(other) {
+			t.Error("expected a different seed to generate a different keyset")
+		}
+	})
+
+	t.Run("test configurable key prefixes", func(t *testing.T) {
+		defer SetKeyPrefixes(nil)
+		var logged bytes.Buffer
+		previous := hclog.L()
+		hclog.SetDefault(hclog.New(&hclog.LoggerOptions{Output: &logged}))
+		defer hclog.SetDefault(previous)
+
+		SetKeyPrefixes(ParseKeyPrefixes("chacha/, team-a"))
+		for keyName, expected := range map[string]string{
+			"gcm/address":        "address",
+			"siv/email":          "email",
+			"chacha/phone":       "phone",
+			"team-a/postcode":    "postcode",
+			"team-a/first-name":  "first-name",
+			"plainfield":         "plainfield",
+			"team-b/postcode":    "team-b/postcode",
+			"chacha/team-a/name": "team-a/name",
+		} {
+			if got := RemoveKeyPrefix(keyName); got != expected {
+				t.Errorf("expected %s to give %s got %s", keyName, expected, got)
+			}
+		}
+		if BQFieldName("team-a/first-name") != "first_name" {
+			t.Errorf("expected the BQ name first_name got %s", BQFieldName("team-a/first-name"))
+		}
+		if !HasKeyPrefix("chacha/phone") || HasKeyPrefix("team-b/postcode") {
+			t.Error("expected only configured prefixes to be known")
+		}
+		if !strings.Contains(logged.String(), "team-b/postcode has an unknown prefix") {
+			t.Errorf("expected a warning for the unknown prefix got %s", logged.String())
+		}
+
+		SetKeyPrefixes(nil)
+		if RemoveKeyPrefix("chacha/phone") != "chacha/phone" || RemoveKeyPrefix("gcm/address") != "address" {
+			t.Error("expected only gcm/ and siv/ to be stripped by default")
+		}
+	})
+
+	t.Run("test keyset bits", func(t *testing.T) {
+		for name, expected := range map[string]int{
+			"AES128_GCM":             128,
+			"AES256_GCM":             256,
+			"AES128_CTR_HMAC_SHA256": 128,
+			"AES256_CTR_HMAC_SHA256": 256,
+			"CHACHA20_POLY1305":      256,
+			"XCHACHA20_POLY1305":     256,
+		} {
+			bits, err := TemplateBits(AeadTemplates[name]())
+			if err != nil || bits != expected {
+				t.Errorf("expected %s to be %d bits got %d %v", name, expected, bits, err)
+			}
+		}
+		if bits, err := TemplateBits(DaeadTemplates["AES256_SIV"]()); err != nil || bits != 256 {
+			t.Errorf("expected AES256_SIV to be 256 bits got %d %v", bits, err)
+		}
+
+		// the weakest key of a keyset decides
+		kh, _, _ := CreateNewAead()
+		if _, err := RotateKeySet(kh, aead.AES128GCMKeyTemplate()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RotateKeySet(kh, aead.AES256GCMKeyTemplate()); err != nil {
+			t.Fatal(err)
+		}
+		if bits, err := KeySetBits(kh); err != nil || bits != 128 {
+			t.Errorf("expected the 128 bit key to decide got %d %v", bits, err)
+		}
+	})
 	var AEAD_CONFIG = cmap.New()
 
 	t.Run("test getEncryptionKey", func(t *testing.T) {
@@ -752,4 +1036,263 @@ func TestAeadUtils(t *testing.T) {
 			t.Errorf("should find the keyset. got: %s", key.(string))
 		}
 	})
+
+	t.Run("test mute key material", func(t *testing.T) {
+		// pretty printed, mixed key types, statuses and prefixes, and json escapes in the values
+		// (\/ and \u002b are valid json for / and +) which a plain string replace would miss
+		rawKeyset := `{
+			"primaryKeyId": 3987026049,
+			"key": [
+				{
+					"keyData": {
+						"typeUrl": "type.googleapis.com/google.crypto.tink.AesGcmKey",
+						"value": "GiB5m\/rHV\u002bxmMiRngaWWi6zel8IjlOPCdEpGnEsb8RfrMQ==",
+						"keyMaterialType": "SYMMETRIC"
+					},
+					"status": "DISABLED",
+					"keyId": 1456486908,
+					"outputPrefixType": "RAW"
+				},
+				{
+					"keyData": {
+						"typeUrl": "type.googleapis.com/google.crypto.tink.AesGcmKey",
+						"value": "GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==",
+						"keyMaterialType": "SYMMETRIC"
+					},
+					"status": "ENABLED",
+					"keyId": 3987026049,
+					"outputPrefixType": "TINK"
+				},
+				{
+					"keyData": {
+						"value": "EkDAEgACCd1\/yruZMuI49Eig5Glb5koi0DXgx1mXVALYJWNRn5wYuQR46ggNuMhFfhrJCsddVp\/Q7Pot2hvHoaQS",
+						"typeUrl": "type.googleapis.com/google.crypto.tink.AesSivKey",
+						"keyMaterialType": "SYMMETRIC"
+					},
+					"status": "ENABLED",
+					"keyId": 42267057,
+					"outputPrefixType": "LEGACY"
+				}
+			]
+		}`
+
+		// make sure it is a valid keyset
+		_, err := ValidateKeySetJson(rawKeyset)
+		if err != nil {
+			t.Fatalf("expected a valid keyset: %v", err)
+		}
+
+		materials := []string{
+			"GiB5m/rHV+xmMiRngaWWi6zel8IjlOPCdEpGnEsb8RfrMQ==",
+			"GiB5m\\/rHV\\u002bxmMiRngaWWi6zel8IjlOPCdEpGnEsb8RfrMQ==",
+			"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==",
+			"EkDAEgACCd1/yruZMuI49Eig5Glb5koi0DXgx1mXVALYJWNRn5wYuQR46ggNuMhFfhrJCsddVp/Q7Pot2hvHoaQS",
+			"EkDAEgACCd1\\/yruZMuI49Eig5Glb5koi0DXgx1mXVALYJWNRn5wYuQR46ggNuMhFfhrJCsddVp\\/Q7Pot2hvHoaQS",
+		}
+
+		muted := MuteKeyMaterialWithMask(rawKeyset, "#REDACTED#")
+		for _, material := range materials {
+			if strings.Contains(muted, material) {
+				t.Errorf("key material %s survived masking: %s", material, muted)
+			}
+		}
+		if strings.Count(muted, `"value":"#REDACTED#"`) != 3 {
+			t.Errorf("expected 3 masked values, got: %s", muted)
+		}
+		// key ids must not be mangled
+		if !strings.Contains(muted, `"primaryKeyId":3987026049`) || !strings.Contains(muted, `"keyId":42267057`) {
+			t.Errorf("key ids were changed by masking: %s", muted)
+		}
+
+		// the default mask still applies
+		muted = MuteKeyMaterial(rawKeyset)
+		if strings.Count(muted, `"value":"***"`) != 3 {
+			t.Errorf("expected 3 values masked with ***, got: %s", muted)
+		}
+
+		// unparseable input is masked entirely
+		muted = MuteKeyMaterialWithMask(`{"key":[{"keyData":{"value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A=="`, "***")
+		if muted != "***" {
+			t.Errorf("expected invalid json to be masked entirely, got: %s", muted)
+		}
+	})
+
+	t.Run("test keyset algorithms", func(t *testing.T) {
+		mixedKeyset := `{"primaryKeyId":3987026049,"key":[{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiB5m/rHV+xmMiRngaWWi6zel8IjlOPCdEpGnEsb8RfrMQ==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":1456486908,"outputPrefixType":"TINK"},{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.XChaCha20Poly1305Key","value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":3987026049,"outputPrefixType":"TINK"},{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":42,"outputPrefixType":"TINK"}]}`
+		algorithms, err := GetKeySetAlgorithms(mixedKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algorithms != "AesGcm,XChaCha20Poly1305" {
+			t.Errorf("expected AesGcm,XChaCha20Poly1305 got %s", algorithms)
+		}
+
+		_, err = GetKeySetAlgorithms("gcm/somefield")
+		if err == nil {
+			t.Errorf("expected an error for a non keyset")
+		}
+	})
+
+	t.Run("test supported key types", func(t *testing.T) {
+		// there is no AES-GCM-SIV template in this version of tink
+		gcmSivFormat, _ := proto.Marshal(&gcmsivpb.AesGcmSivKeyFormat{KeySize: 32})
+		gcmSivTemplate := &tinkpb.KeyTemplate{
+			TypeUrl:          "type.googleapis.com/google.crypto.tink.AesGcmSivKey",
+			Value:            gcmSivFormat,
+			OutputPrefixType: tinkpb.OutputPrefixType_TINK,
+		}
+		templates := []*tinkpb.KeyTemplate{
+			aead.AES256GCMKeyTemplate(),
+			gcmSivTemplate,
+			aead.AES256CTRHMACSHA256KeyTemplate(),
+			aead.ChaCha20Poly1305KeyTemplate(),
+			aead.XChaCha20Poly1305KeyTemplate(),
+			daead.AESSIVKeyTemplate(),
+		}
+		for _, template := range templates {
+			kh, err := keyset.NewHandle(template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rawKeyset, _ := ExtractInsecureKeySetFromKeyhandle(kh)
+			algorithm, err := GetKeySetAlgorithms(rawKeyset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, keyType := range SupportedKeyTypes {
+				found = found || keyType == algorithm
+			}
+			if !found {
+				t.Errorf("expected %s to be a supported key type", algorithm)
+			}
+
+			// and it can actually be used
+			cypherText, err := EncryptWithKeyHandle(kh, []byte("plaintext"), []byte("aad"))
+			if err != nil {
+				t.Fatalf("failed to encrypt with %s: %v", algorithm, err)
+			}
+			plainText, err := DecryptWithKeyHandle(kh, cypherText, []byte("aad"))
+			if err != nil || string(plainText) != "plaintext" {
+				t.Errorf("failed to decrypt with %s: %v", algorithm, err)
+			}
+		}
+	})
+
+	t.Run("test keyset fingerprint", func(t *testing.T) {
+		compact := `{"primaryKeyId":3987026049,"key":[{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":3987026049,"outputPrefixType":"TINK"}]}`
+		// same keyset, different json formatting and field order
+		pretty := `{
+			"key": [
+				{
+					"keyId": 3987026049,
+					"status": "ENABLED",
+					"outputPrefixType": "TINK",
+					"keyData": {
+						"keyMaterialType": "SYMMETRIC",
+						"value": "GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==",
+						"typeUrl": "type.googleapis.com/google.crypto.tink.AesGcmKey"
+					}
+				}
+			],
+			"primaryKeyId": 3987026049
+		}`
+		fingerprints := []string{}
+		for _, rawKeyset := range []string{compact, pretty} {
+			kh, err := ValidateKeySetJson(rawKeyset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fingerprint, err := KeySetFingerprint(kh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fingerprints = append(fingerprints, fingerprint)
+		}
+		if fingerprints[0] != fingerprints[1] {
+			t.Errorf("expected %s to be %s", fingerprints[0], fingerprints[1])
+		}
+
+		// any change to the keyset changes the fingerprint
+		kh, _ := ValidateKeySetJson(compact)
+		RotateKeys(kh, false)
+		fingerprint2, _ := KeySetFingerprint(kh)
+		if fingerprint2 == fingerprints[0] {
+			t.Errorf("expected a rotated keyset to have a different fingerprint")
+		}
+	})
+
+	t.Run("test rotate keyset", func(t *testing.T) {
+		for _, template := range []*tinkpb.KeyTemplate{aead.AES128GCMKeyTemplate(), daead.AESSIVKeyTemplate()} {
+			kh, err := keyset.NewHandle(template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldPrimaryKeyId := kh.KeysetInfo().PrimaryKeyId
+			primaryKeyId, err := RotateKeySet(kh, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if primaryKeyId == oldPrimaryKeyId || primaryKeyId != kh.KeysetInfo().PrimaryKeyId {
+				t.Errorf("expected a new primary key id %d", primaryKeyId)
+			}
+			if len(kh.KeysetInfo().KeyInfo) != 2 {
+				t.Errorf("expected 2 keys got %d", len(kh.KeysetInfo().KeyInfo))
+			}
+		}
+
+		kh, err := keyset.NewHandle(mac.HMACSHA256Tag256KeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = RotateKeySet(kh, nil)
+		if err == nil {
+			t.Errorf("expected an error rotating a mac keyset")
+		}
+	})
+}
+
+// seededKeysetHandle generates AES-GCM and AES-SIV keysets from a seeded source instead of secure randomness, so a
+// test can assert the keysets the create paths generate
+func seededKeysetHandle(seed int64) func(*tinkpb.KeyTemplate) (*keyset.Handle, error) {
+	random := mathrand.New(mathrand.NewSource(seed))
+	return func(template *tinkpb.KeyTemplate) (*keyset.Handle, error) {
+		var keySize uint32
+		var keyValue func([]byte) ([]byte, error)
+		switch template.GetTypeUrl() {
+		case TinkTypeURLPrefix + "AesGcmKey":
+			format := &aesgcmpb.AesGcmKeyFormat{}
+			if err := proto.Unmarshal(template.GetValue(), format); err != nil {
+				return nil, err
+			}
+			keySize = format.GetKeySize()
+			keyValue = func(b []byte) ([]byte, error) { return proto.Marshal(&aesgcmpb.AesGcmKey{KeyValue: b}) }
+		case TinkTypeURLPrefix + "AesSivKey":
+			format := &aessivpb.AesSivKeyFormat{}
+			if err := proto.Unmarshal(template.GetValue(), format); err != nil {
+				return nil, err
+			}
+			keySize = format.GetKeySize()
+			keyValue = func(b []byte) ([]byte, error) { return proto.Marshal(&aessivpb.AesSivKey{KeyValue: b}) }
+		default:
+			return nil, fmt.Errorf("no seeded key for %s", template.GetTypeUrl())
+		}
+		material := make([]byte, keySize)
+		random.Read(material)
+		value, err := keyValue(material)
+		if err != nil {
+			return nil, err
+		}
+		keyID := random.Uint32()
+		ks := &tinkpb.Keyset{
+			PrimaryKeyId: keyID,
+			Key: []*tinkpb.Keyset_Key{{
+				KeyData:          &tinkpb.KeyData{TypeUrl: template.GetTypeUrl(), Value: value, KeyMaterialType: tinkpb.KeyData_SYMMETRIC},
+				Status:           tinkpb.KeyStatusType_ENABLED,
+				KeyId:            keyID,
+				OutputPrefixType: template.GetOutputPrefixType(),
+			}},
+		}
+		return insecurecleartextkeyset.Read(&keyset.MemReaderWriter{Keyset: ks})
+	}
 }
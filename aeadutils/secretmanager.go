@@ -0,0 +1,60 @@
+package aeadutils
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// SecretManagerScheme prefixes a reference to a GCP Secret Manager secret version, ie sm://projects/x/secrets/y/versions/z
+const SecretManagerScheme = "sm://"
+
+var secretVersionName = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+/versions/[^/]+$`)
+
+// SecretFetcher reads the payload of a secret version, so a keyset can be imported by reference rather than passing
+// the key material through the vault request
+type SecretFetcher interface {
+	AccessSecretVersion(ctx context.Context, name string) ([]byte, error)
+}
+
+// IsSecretManagerRef is true if the value is a sm:// reference
+func IsSecretManagerRef(v string) bool {
+	return strings.HasPrefix(v, SecretManagerScheme)
+}
+
+// SecretManagerName returns the secret version name of a sm:// reference, ie projects/x/secrets/y/versions/z
+func SecretManagerName(ref string) (string, error) {
+	name := strings.TrimPrefix(ref, SecretManagerScheme)
+	if !IsSecretManagerRef(ref) || !secretVersionName.MatchString(name) {
+		return "", fmt.Errorf("%s is not a secret manager reference, expected sm://projects/<project>/secrets/<secret>/versions/<version>", ref)
+	}
+	return name, nil
+}
+
+// NewSecretFetcher creates a SecretFetcher for GCP Secret Manager using the default credentials of the vault host
+func NewSecretFetcher(ctx context.Context) (SecretFetcher, error) {
+	service, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpSecretFetcher{service: service}, nil
+}
+
+type gcpSecretFetcher struct {
+	service *secretmanager.Service
+}
+
+func (f *gcpSecretFetcher) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	resp, err := f.service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Payload == nil {
+		return nil, fmt.Errorf("secret %s has no payload", name)
+	}
+	return b64.StdEncoding.DecodeString(resp.Payload.Data)
+}
@@ -0,0 +1,51 @@
+package aeadutils
+
+import (
+	"context"
+
+	"github.com/google/tink/go/keyset"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name the plugin's spans are created under
+const TracerName = "github.com/Vodafone/vault-plugin-aead"
+
+// the span attributes, only ever names and ids - never plaintext, cyphertext or key material
+const (
+	SpanOperation     = attribute.Key("aead.operation")
+	SpanField         = attribute.Key("aead.field")
+	SpanFields        = attribute.Key("aead.fields")
+	SpanKeyName       = attribute.Key("aead.key_name")
+	SpanKeyID         = attribute.Key("aead.key_id")
+	SpanDeterministic = attribute.Key("aead.deterministic")
+	SpanBulk          = attribute.Key("aead.bulk")
+	SpanRegion        = attribute.Key("aead.region")
+	SpanDataset       = attribute.Key("aead.dataset")
+	SpanRoutine       = attribute.Key("aead.routine")
+	SpanKMSKey        = attribute.Key("aead.kms_key")
+)
+
+// StartSpan starts a span from the global tracer provider, which is a no-op unless the process has configured one
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends the span, marking it as failed if there was an error. The error text is not recorded as errors
+// can quote the value that failed, ie an invalid keyset
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, "failed")
+	}
+	span.End()
+}
+
+// AddKeySetEvent records the name and primary key id of a keyset the span changed, ie after a rotate or import
+func AddKeySetEvent(span trace.Span, event string, keyName string, kh *keyset.Handle) {
+	span.AddEvent(event, trace.WithAttributes(
+		SpanKeyName.String(keyName),
+		SpanKeyID.Int64(int64(kh.KeysetInfo().GetPrimaryKeyId())),
+	))
+}
@@ -2,13 +2,20 @@ package aeadplugin
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Factory creates a new usable instance of this secrets engine.
@@ -25,18 +32,32 @@ type backend struct {
 	*framework.Backend
 
 	clientMutex sync.RWMutex
+
+	// fieldLocks are taken for writing while a keyset is written and for reading while one is used, see lockFields
+	fieldLocks []*locksutil.LockEntry
+
+	// storagePrefix is the STORAGE_PREFIX of the backend config, put in front of every storage key so two logical
+	// engines can share one storage
+	storagePrefix string
 }
 
 // Backend creates a new backend.
 func Backend(c *logical.BackendConfig) *backend {
 	var b backend
+	b.fieldLocks = locksutil.CreateLocks()
+	if c != nil {
+		b.storagePrefix = c.Config["STORAGE_PREFIX"]
+	}
 
 	b.Backend = &framework.Backend{
-		BackendType: logical.TypeLogical,
-		Help:        backendHelp,
+		BackendType:    logical.TypeLogical,
+		Help:           backendHelp,
+		InitializeFunc: b.initialize,
 		PathsSpecial: &logical.Paths{
 			SealWrapStorage: []string{
-				"config",
+				b.storagePrefix + "config",
+				// the archived keysets of configDelete
+				b.storagePrefix + archivePrefix,
 			},
 		},
 
@@ -48,21 +69,91 @@ func Backend(c *logical.BackendConfig) *backend {
 			config
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/config -H "Content-Type: application/json" -d '{"key":"value"}'
 				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/config
+			configDiff
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/configDiff -H "Content-Type: application/json" -d '{"key":"value"}'
+			mapFamily
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/mapFamily -H "Content-Type: application/json" -d '{"FAMILY":"FAMILY_ADDRESS","FIELDS":["address-line1","postcode"]}'
+			settings
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/settings -H "Content-Type: application/json" -d '{"BQ_PROJECT":"your-bq-project"}'
+				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/settings
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/settingsDelete -H "Content-Type: application/json" -d '{"BQ_PROJECT":""}'
+			restoreArchived
+				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/restoreArchived | jq
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/restoreArchived -H "Content-Type: application/json" -d '{"gcm/fieldname":""}'
 			encrypt
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/encrypt -H "Content-Type: application/json" -d '{"fieldname":"plaintext"}'
 			decrypt
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/decrypt -H "Content-Type: application/json" -d '{"fieldname":"cyphertext"}'
+			decryptTyped
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/decryptTyped -H "Content-Type: application/json" -d '{"fieldname":"cyphertext","TYPES":{"fieldname":"int"}}'
+			verifyDecrypt
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/verifyDecrypt -H "Content-Type: application/json" -d '{"fieldname":"cyphertext"}'
+			selftest
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/selftest -H "Content-Type: application/json" -d '{"fieldname":""}'
+			decryptWithKey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/decryptWithKey -H "Content-Type: application/json" -d '{"KEYSET":{"primaryKeyId":97978150,"key":[...]},"CIPHERTEXT":"cyphertext","ADDITIONAL_DATA":"fieldname"}'
+			indexToken
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/indexToken -H "Content-Type: application/json" -d '{"fieldname":"plaintext"}'
+			derive
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/derive -H "Content-Type: application/json" -d '{"KEY":"tenant-master","INPUT":"tenant-42","LENGTH":"32"}'
 			rotate
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/rotate -H "Content-Type: application/json" -d '{"key":"value"}'
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/rotate
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/rotate -H "Content-Type: application/json" -d '{"TEMPLATE":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"ECA=","outputPrefixType":"TINK"}}'
+			rotateAll
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/rotateAll
+			rekeyData
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/rekeyData -H "Content-Type: application/json" -d '{"fieldname":"cyphertext"}'
+			rollKey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/rollKey -H "Content-Type: application/json" -d '{"fieldname":"cyphertext","INCLUDE_DESTROYED":"true"}'
+			purgeKeys
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/purgeKeys -H "Content-Type: application/json" -d '{"fieldname":"","INCLUDE_DESTROYED":"true"}'
+			repairPrimary
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/repairPrimary -H "Content-Type: application/json" -d '{"fieldname":"","REPAIR":"true"}'
+			renameKey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/renameKey -H "Content-Type: application/json" -d '{"oldfieldname":"newfieldname","KEEP_ADDITIONAL_DATA":"true"}'
+			rewrapConfig
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/rewrapConfig
+			addKey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/addKey -H "Content-Type: application/json" -d '{"fieldname":""}'
+			setPrimaryByMaterial
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/setPrimaryByMaterial -H "Content-Type: application/json" -d '{"fieldname":"GiBQUDTlxVawIr3T1/dRvuF5CzBhTZtnnpuVsNZayxv1LQ=="}'
 			createAEADkey
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/createAEADkey -H "Content-Type: application/json" -d '{"fieldname":"plaintext"}'
 			createDAEADkey
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/createDAEADkey -H "Content-Type: application/json" -d '{"fieldname-det":"plaintext"}'
+			createIndexKey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/createIndexKey -H "Content-Type: application/json" -d '{"fieldname":""}'
+			createPRFkey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/createPRFkey -H "Content-Type: application/json" -d '{"tenant-master":""}'
+			convertPrefix
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/convertPrefix -H "Content-Type: application/json" -d '{"fieldname":"RAW"}'
+			exportKey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/exportKey -H "Content-Type: application/json" -d '{"fieldname":"RAW"}'
+			importTemplate
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/importTemplate -H "Content-Type: application/json" -d '{"fieldname":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"ECA=","outputPrefixType":"TINK"}}'
+			importKeyEncrypted
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/importKeyEncrypted -H "Content-Type: application/json" -d '{"fieldname":"base64 wrapped keyset","KMS_KEY":"projects/p/locations/europe/keyRings/r/cryptoKeys/import-key"}'
+			validateKey
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/validateKey -H "Content-Type: application/json" -d '{"fieldname":"keyset json"}'
+			capabilities
+				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/capabilities | jq
 			keytypes
 				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/keytypes | jq
+			keyinfo
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/keyinfo -H "Content-Type: application/json" -d '{"FIELDS":["fieldname1","fieldname2"]}'
+			estimate
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/estimate -H "Content-Type: application/json" -d '{"ROWS":100000,"FIELDS":{"fieldname1":20,"fieldname2":200}}'
+			listKeys
+				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/listKeys | jq
+			fingerprint
+				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/fingerprint | jq
+			validateConfig
+				curl -sk -X GET --header "X-Vault-Token: "${VAULT_TOKEN} ${VAULT_URL}/v1/aead-secrets/validateConfig | jq
 			bqsync
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/bqsync
+			kmscheck
+				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/kmscheck
 
 			adding key-families:
 				curl -sk --header "X-Vault-Token: "${VAULT_TOKEN} --request POST ${VAULT_URL}/v1/aead-secrets/createAEADkey -H "Content-Type: application/json" -d '{"FAMILY_ADDRESS":"plaintext"}'
@@ -122,6 +213,32 @@ func Backend(c *logical.BackendConfig) *backend {
 					},
 				},
 			},
+			// aead/configDiff
+			&framework.Path{
+				Pattern:         "configDiff",
+				HelpSynopsis:    "Preview a config overwrite.",
+				HelpDescription: "Returns, per key, whether configOverwrite would add, change or leave it unchanged. Key material is never returned.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.pathConfigDiff,
+					},
+				},
+			},
+			// aead/mapFamily
+			&framework.Path{
+				Pattern:         "mapFamily",
+				HelpSynopsis:    "Point a list of fields at a key family.",
+				HelpDescription: "Configure every field in FIELDS to use the keyset of FAMILY, returning whether each mapping was created or already existed.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathMapFamily),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
 			&framework.Path{
 				Pattern:         "configDelete",
 				HelpSynopsis:    "Configure aead secret engine.",
@@ -138,6 +255,54 @@ func Backend(c *logical.BackendConfig) *backend {
 					},
 				},
 			},
+			// aead/restoreArchived
+			&framework.Path{
+				Pattern:         "restoreArchived",
+				HelpSynopsis:    "Restore keysets archived by configDelete.",
+				HelpDescription: "Read lists when each archived keyset was deleted. Write puts archived keysets back in the config, each field the config name with \"\" for its latest archive or the archived_at of the one to restore.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.withErrorCodes(b.pathArchivesRead),
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathRestoreArchived),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/settings
+			&framework.Path{
+				Pattern:         "settings",
+				HelpSynopsis:    "Configure the non key options of the aead secret engine.",
+				HelpDescription: "Read or write the settings, the non key options ie BQ_PROJECT, stored apart from the keysets in config. Options that are not settings are still read from config.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.pathSettingsRead,
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathSettingsWrite),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/settingsDelete
+			&framework.Path{
+				Pattern:         "settingsDelete",
+				HelpSynopsis:    "Delete settings.",
+				HelpDescription: "Delete the settings named in the request.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.pathSettingsDelete,
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
 			// aead/encrypt
 			&framework.Path{
 				Pattern:         "encrypt",
@@ -152,7 +317,7 @@ func Backend(c *logical.BackendConfig) *backend {
 				},
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback: b.pathAeadEncrypt,
+						Callback: b.traced("encrypt", b.withErrorCodes(b.withFieldLocks(b.pathAeadEncrypt))),
 					},
 				},
 				// Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -173,13 +338,119 @@ func Backend(c *logical.BackendConfig) *backend {
 				},
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback: b.pathAeadDecrypt,
+						Callback: b.traced("decrypt", b.withErrorCodes(b.withFieldLocks(b.pathAeadDecrypt))),
 					},
 				},
 				// Callbacks: map[logical.Operation]framework.OperationFunc{
 				// 	logical.UpdateOperation: b.pathAeadDecrypt,
 				// },
 			},
+			// aead/decryptTyped
+			&framework.Path{
+				Pattern:         "decryptTyped",
+				HelpSynopsis:    "Decrypt data and convert it to the types supplied",
+				HelpDescription: "Decrypt data with the aead key held in config and convert each field to the string, int, float or bool type supplied in TYPES.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.withErrorCodes(b.withFieldLocks(b.pathAeadDecryptTyped)),
+					},
+				},
+			},
+			// aead/verifyDecrypt
+			&framework.Path{
+				Pattern:         "verifyDecrypt",
+				HelpSynopsis:    "Verify data decrypts with the aead key held in config",
+				HelpDescription: "Verify data decrypts with the aead key held in config, returning the key id used but never the plaintext.",
+				Fields: map[string]*framework.FieldSchema{
+					"aeadData": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Data to be verified",
+						Default:     "",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.withFieldLocks(b.pathAeadVerifyDecrypt),
+					},
+				},
+			},
+			// aead/selftest
+			&framework.Path{
+				Pattern:         "selftest",
+				HelpSynopsis:    "Encrypt and decrypt a canary with the key of each field",
+				HelpDescription: "Encrypt a known value with the key of each field in the request and decrypt it back, returning only whether it passed and the time taken. Nothing is stored.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.withFieldLocks(b.pathSelfTest),
+					},
+				},
+			},
+			// aead/decryptWithKey
+			&framework.Path{
+				Pattern:         "decryptWithKey",
+				HelpSynopsis:    "Decrypt data with a keyset supplied in the request",
+				HelpDescription: "Decrypt CIPHERTEXT with the KEYSET supplied in the request, ie a superseded keyset, without changing the config. Refused unless ALLOW_RAW_KEYS is true in the config.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.traced("decryptWithKey", b.withErrorCodes(b.pathDecryptWithKey)),
+					},
+				},
+			},
+			// aead/indexToken
+			&framework.Path{
+				Pattern:         "indexToken",
+				HelpSynopsis:    "Get the index tokens of plaintext",
+				HelpDescription: "Return the HMAC of the plaintext of each field under the index key of the field, a deterministic token to search on for fields encrypted non deterministically.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.traced("indexToken", b.withErrorCodes(b.pathIndexToken)),
+					},
+				},
+			},
+			// aead/derive
+			&framework.Path{
+				Pattern:         "derive",
+				HelpSynopsis:    "Derive bytes from a PRF keyset",
+				HelpDescription: "Return LENGTH bytes of the PRF of INPUT under the PRF keyset KEY, ie a sub-key derived from a master key. The same KEY and INPUT always give the same output.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.withErrorCodes(b.pathDerive),
+					},
+				},
+			},
+			// aead/rekeyData
+			&framework.Path{
+				Pattern:         "rekeyData",
+				HelpSynopsis:    "Rotate the keys and re-encrypt data.",
+				HelpDescription: "Decrypt the data, rotate the keysets of the fields supplied and re-encrypt the data with the new primary keys.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.pathAeadRekeyData,
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/rollKey
+			&framework.Path{
+				Pattern:         "rollKey",
+				HelpSynopsis:    "Rotate the keys, re-encrypt data and purge the old keys.",
+				HelpDescription: "Decrypt the data, rotate the keysets of the fields supplied, re-encrypt the data with the new primary keys and purge the DISABLED keys, and DESTROYED keys with INCLUDE_DESTROYED. Returns the new primary key id and the number of keys purged of each keyset.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathRollKey),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
 			// aead/rotate
 			&framework.Path{
 				Pattern:         "rotate",
@@ -188,7 +459,77 @@ func Backend(c *logical.BackendConfig) *backend {
 				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback:                    b.pathKeyRotate,
+						Callback:                    b.traced("rotate", b.pathKeyRotate),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/rotateAll
+			&framework.Path{
+				Pattern:         "rotateAll",
+				HelpSynopsis:    "rotate every keyset.",
+				HelpDescription: "Rotate every keyset, returning the new primary key id of each. A keyset that fails to rotate is reported as a warning and does not stop the rest.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.traced("rotateAll", b.pathKeyRotateAll),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/purgeKeys
+			&framework.Path{
+				Pattern:         "purgeKeys",
+				HelpSynopsis:    "remove disabled keys from keysets",
+				HelpDescription: "Remove the DISABLED (and optionally DESTROYED) keys from the keysets of the supplied fields, the primary and enabled keys are kept",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.pathPurgeKeys,
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/repairPrimary
+			&framework.Path{
+				Pattern:         "repairPrimary",
+				HelpSynopsis:    "check the primary key of keysets can encrypt",
+				HelpDescription: "Report keysets whose primary key is not ENABLED and, if REPAIR is true, promote the newest ENABLED key to primary",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.pathRepairPrimary,
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/renameKey
+			&framework.Path{
+				Pattern:         "renameKey",
+				HelpSynopsis:    "rename the keyset of a field",
+				HelpDescription: "Move the keyset, pointer and per field options of each field to its new name in one config write, failing if the new name is already configured",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathRenameKey),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/rewrapConfig
+			&framework.Path{
+				Pattern:         "rewrapConfig",
+				HelpSynopsis:    "Rewrap the stored keysets",
+				HelpDescription: "Unwrap every stored keyset, check it is still valid and store it wrapped again. Keysets are stored in plaintext so this only validates them for now.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.pathRewrapConfig,
 						ForwardPerformanceStandby:   true,
 						ForwardPerformanceSecondary: true,
 					},
@@ -274,15 +615,115 @@ func Backend(c *logical.BackendConfig) *backend {
 					},
 				},
 			},
+			// aead/createIndexKey
+			&framework.Path{
+				Pattern:         "createIndexKey",
+				HelpSynopsis:    "Create index keys",
+				HelpDescription: "Create the index key of each field, held in config as idx/<field>, for indexToken. An existing index key is never overwritten.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathCreateIndexKey),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/createPRFkey
+			&framework.Path{
+				Pattern:         "createPRFkey",
+				HelpSynopsis:    "Create PRF keys",
+				HelpDescription: "Create a PRF keyset for each name, held in config as prf/<name>, for derive. An existing PRF keyset is never overwritten.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathCreatePRFKey),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/capabilities
+			&framework.Path{
+				Pattern:         "capabilities",
+				HelpSynopsis:    "List the supported key types and templates",
+				HelpDescription: "Read the tink type urls this build supports, the templates createAEADkey, createDAEADkey and createPRFkey can use and which kinds of tink primitive are compiled in.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.pathCapabilities,
+					},
+				},
+			},
 			// aead/keytypes
 			&framework.Path{
 				Pattern:         "keytypes",
 				HelpSynopsis:    "Get the key types",
-				HelpDescription: "Read the key types.",
+				HelpDescription: "Read the key types, or the algorithm of each keyset with ALGORITHMS=true.",
 				Fields:          map[string]*framework.FieldSchema{},
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.ReadOperation: &framework.PathOperation{
-						Callback: b.pathReadKeyTypes,
+						Callback: b.withErrorCodes(b.pathReadKeyTypes),
+					},
+				},
+			},
+			// aead/keyinfo
+			&framework.Path{
+				Pattern:         "keyinfo",
+				HelpSynopsis:    "Return the key type of each field",
+				HelpDescription: "Return the key name, determinism and algorithm of each field in FIELDS or in the request, ie the fields of a bulk request, without the key material.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.pathKeyInfo,
+					},
+				},
+			},
+			// aead/estimate
+			&framework.Path{
+				Pattern:         "estimate",
+				HelpSynopsis:    "Estimate the size of a bulk encrypt response",
+				HelpDescription: "Estimate the bytes of the response to a bulk encrypt of ROWS rows, from FIELDS as a map of field name to the average bytes of its values, or as a number of fields with AVG_VALUE_BYTES, so a client can chunk a large payload. Nothing is encrypted.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.withErrorCodes(b.pathEstimate),
+					},
+				},
+			},
+			// aead/listKeys
+			&framework.Path{
+				Pattern:         "listKeys",
+				HelpSynopsis:    "List the keysets",
+				HelpDescription: "Read the sorted names of the config entries that hold a keyset, and whether each is deterministic, without any key material.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.pathListKeys,
+					},
+				},
+			},
+			// aead/fingerprint
+			&framework.Path{
+				Pattern:         "fingerprint",
+				HelpSynopsis:    "Get the keyset fingerprints",
+				HelpDescription: "Read a stable sha256 fingerprint of the keyset used by each field, to compare with the fingerprint in the BQ routine description.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.pathReadFingerprint,
+					},
+				},
+			},
+			// aead/validateConfig
+			&framework.Path{
+				Pattern:         "validateConfig",
+				HelpSynopsis:    "Check the config pointers",
+				HelpDescription: "Follow every field and family pointer to its keyset, reporting dangling pointers and keysets of the wrong type. Nothing is changed.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.pathValidateConfig,
 					},
 				},
 			},
@@ -294,7 +735,22 @@ func Backend(c *logical.BackendConfig) *backend {
 				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback:                    b.pathBQKeySync,
+						Callback:                    b.traced("bqsync", b.pathBQKeySync),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+
+			// aead/kmscheck
+			&framework.Path{
+				Pattern:         "kmscheck",
+				HelpSynopsis:    "Check the kms keys of bqsync can be used.",
+				HelpDescription: "Get each kms key bqsync would wrap the keysets with, in each region, and encrypt with it, without touching BQ. Reports ok or the error of each key per region.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.traced("kmscheck", b.withErrorCodes(b.pathKMSCheck)),
 						ForwardPerformanceStandby:   true,
 						ForwardPerformanceSecondary: true,
 					},
@@ -315,7 +771,7 @@ func Backend(c *logical.BackendConfig) *backend {
 				},
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback: b.pathAeadEncryptBulkCol,
+						Callback: b.traced("encryptcol", b.withErrorCodes(b.withFieldLocks(b.pathAeadEncryptBulkCol))),
 					},
 				},
 			},
@@ -333,7 +789,7 @@ func Backend(c *logical.BackendConfig) *backend {
 				},
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback: b.pathAeadDecryptBulkCol,
+						Callback: b.traced("decryptcol", b.withErrorCodes(b.withFieldLocks(b.pathAeadDecryptBulkCol))),
 					},
 				},
 			},
@@ -405,6 +861,34 @@ func Backend(c *logical.BackendConfig) *backend {
 					},
 				},
 			},
+			// aead/addKey
+			&framework.Path{
+				Pattern:         "addKey",
+				HelpSynopsis:    "Add a key without changing the primary.",
+				HelpDescription: "Add a new ENABLED key to the keyset of each field, keeping the current primary so the new key can be promoted later with updatePrimaryKeyID.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.traced("addKey", b.withErrorCodes(b.pathAddKey)),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/setPrimaryByMaterial
+			&framework.Path{
+				Pattern:         "setPrimaryByMaterial",
+				HelpSynopsis:    "Set the primary key by its key material.",
+				HelpDescription: "Promote the key whose key material matches the value supplied to the primary key of the field's keyset.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathSetPrimaryByMaterial),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
 			// aead/pathImportKey
 			&framework.Path{
 				Pattern:         "importKey",
@@ -416,7 +900,75 @@ func Backend(c *logical.BackendConfig) *backend {
 						Callback: b.pathConfigRead,
 					},
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback:                    b.pathImportKey,
+						Callback:                    b.traced("importKey", b.withErrorCodes(b.pathImportKey)),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/importKeyEncrypted
+			&framework.Path{
+				Pattern:         "importKeyEncrypted",
+				HelpSynopsis:    "Import a key wrapped by a kms key.",
+				HelpDescription: "Unwrap base64 keysets wrapped by the kms key in KMS_KEY, with the provider in BQ_KMS_PROVIDER, and import them as importKey does. The key material is not returned.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.traced("importKeyEncrypted", b.withErrorCodes(b.pathImportKeyEncrypted)),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/validateKey
+			&framework.Path{
+				Pattern:         "validateKey",
+				HelpSynopsis:    "Validate a key without importing it.",
+				HelpDescription: "Run the importKey validation over each keyset and return whether it is deterministic and its algorithm, without storing anything.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.pathValidateKey,
+					},
+				},
+			},
+			// aead/convertPrefix
+			&framework.Path{
+				Pattern:         "convertPrefix",
+				HelpSynopsis:    "Change the output prefix of a keyset.",
+				HelpDescription: "Rewrite the output prefix type (TINK, RAW, LEGACY or CRUNCHY) of every key in the keyset of a field. Existing cyphertext will no longer decrypt.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.pathConvertPrefix,
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/exportKey
+			&framework.Path{
+				Pattern:         "exportKey",
+				HelpSynopsis:    "Make the export keyset of a field.",
+				HelpDescription: "Copy the keyset of a field to export/<field> with the output prefix given (TINK, RAW, LEGACY or CRUNCHY), or EXPORT_PREFIX (default RAW) if empty, for encrypt and decrypt with MODE=export.",
+				Fields:          map[string]*framework.FieldSchema{},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.withErrorCodes(b.pathExportKey),
+						ForwardPerformanceStandby:   true,
+						ForwardPerformanceSecondary: true,
+					},
+				},
+			},
+			// aead/importTemplate
+			&framework.Path{
+				Pattern:         "importTemplate",
+				HelpSynopsis:    "Create keysets from key templates.",
+				HelpDescription: "Generate a fresh keyset for each field from a tink AEAD or DAEAD key template.",
+				Fields:          map[string]*framework.FieldSchema{}, // commented out as i do not want to define a schema as it is a map and i don't know what the keys will be called
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback:                    b.pathImportTemplate,
 						ForwardPerformanceStandby:   true,
 						ForwardPerformanceSecondary: true,
 					},
@@ -465,6 +1017,101 @@ func Backend(c *logical.BackendConfig) *backend {
 	return &b
 }
 
+// initialize runs once the backend is mounted and has storage, upgrading any config stored in an older layout and
+// logging any stored keyset that does not parse
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	s := b.prefixedStorage(req.Storage)
+	if err := b.migrateConfig(ctx, s); err != nil {
+		return err
+	}
+	// a keyset that does not parse is only logged, the other fields still work
+	if _, err := b.checkStoredKeysets(ctx, s); err != nil {
+		hclog.L().Error("failed to check the stored keysets: " + err.Error())
+	}
+	return nil
+}
+
+// HandleRequest handles the request with its storage under the STORAGE_PREFIX of the backend, if there is one
+func (b *backend) HandleRequest(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	if req != nil && req.Storage != nil && b.storagePrefix != "" {
+		storage := req.Storage
+		req.Storage = b.prefixedStorage(storage)
+		defer func() { req.Storage = storage }()
+	}
+	return b.Backend.HandleRequest(ctx, req)
+}
+
+// prefixedStorage is the view of the storage under the STORAGE_PREFIX of the backend, or the storage itself without one
+func (b *backend) prefixedStorage(s logical.Storage) logical.Storage {
+	if b.storagePrefix == "" {
+		return s
+	}
+	return logical.NewStorageView(s, b.storagePrefix)
+}
+
+// traced wraps a path callback in a span for the operation. Once the callback has run the span carries the field names
+// of the request, and the keyset of each field that has one is added as an event, with its primary key id when encrypting
+func (b *backend) traced(operation string, callback framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		ctx, span := aeadutils.StartSpan(ctx, operation, aeadutils.SpanOperation.String(operation))
+
+		resp, err := callback(ctx, req, data)
+
+		if span.IsRecording() {
+			// the callbacks remove the request options from data.Raw, so only the fields are left
+			isBulk, _ := isBulkData(data.Raw)
+			fieldNames := requestFieldNames(data.Raw)
+			span.SetAttributes(
+				aeadutils.SpanFields.StringSlice(fieldNames),
+				aeadutils.SpanBulk.Bool(isBulk),
+			)
+			for _, fieldName := range fieldNames {
+				keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+				if !ok {
+					continue
+				}
+				key, _ := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+				_, deterministic := aeadutils.IsKeyJsonDeterministic(key)
+				attrs := []attribute.KeyValue{
+					aeadutils.SpanField.String(fieldName),
+					aeadutils.SpanKeyName.String(keyName),
+					aeadutils.SpanDeterministic.Bool(deterministic),
+				}
+				if strings.HasPrefix(operation, "encrypt") {
+					var keySetStruct aeadutils.KeySetStruct
+					if json.Unmarshal([]byte(fmt.Sprintf("%v", key)), &keySetStruct) == nil {
+						attrs = append(attrs, aeadutils.SpanKeyID.Int(keySetStruct.PrimaryKeyID))
+					}
+				}
+				span.AddEvent("field", trace.WithAttributes(attrs...))
+			}
+		}
+		aeadutils.EndSpan(span, err)
+		return resp, err
+	}
+}
+
+// requestFieldNames returns the sorted field names of a request, the names in each row of a bulk request
+func requestFieldNames(data map[string]interface{}) []string {
+	names := map[string]bool{}
+	for k, v := range data {
+		row, ok := v.(map[string]interface{})
+		if !ok {
+			names[k] = true
+			continue
+		}
+		for fieldName := range row {
+			names[fieldName] = true
+		}
+	}
+	fieldNames := make([]string, 0, len(names))
+	for fieldName := range names {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	return fieldNames
+}
+
 const backendHelp = "The aead secrets engine generates aead tokens."
 
 // validateFields verifies that no bad arguments were given to the request.
@@ -4,25 +4,42 @@ import (
 	"bytes"
 	"context"
 	b64 "encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"github.com/Vodafone/vault-plugin-aead/bqutils"
 	"github.com/Vodafone/vault-plugin-aead/kvutils"
 
 	// "github.com/Vodafone/vault-plugin-aead/testutils"
 	version "github.com/Vodafone/vault-plugin-aead/version"
+	"github.com/google/tink/go/aead"
 	"github.com/google/tink/go/daead"
 	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/mac"
+	aesgcmpb "github.com/google/tink/go/proto/aes_gcm_go_proto"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+	hclog "github.com/hashicorp/go-hclog"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/logical"
+	cmap "github.com/orcaman/concurrent-map"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 /*
@@ -194,6 +211,12 @@ func TestBackend(t *testing.T) {
 		resp := readInfo(b, storage, t)
 
 		compareStrings(resp, "version", version.Version, t)
+		compareStrings(resp, "human_version", version.HumanVersion, t)
+		compareStrings(resp, "build_commit", version.Commit, t)
+		compareStrings(resp, "build_date", version.BuildDate, t)
+		if !reflect.DeepEqual(resp.Data["key_types"], aeadutils.SupportedKeyTypes) {
+			t.Errorf("expected key_types %v got %v", aeadutils.SupportedKeyTypes, resp.Data["key_types"])
+		}
 
 	})
 
@@ -317,9 +340,10 @@ func TestBackend(t *testing.T) {
 		resp := encryptDataDetermisticallyAndCreateKey(b, storage, data, false, t)
 
 		// retreive the encrypted data for field address
-		actualEncryptedValue := fmt.Sprintf("%v", resp.Data["test5-address2"]) // convert the cyphertext (=interface{}) received to a string
+		createResult := resp.Data["test5-address2"].(map[string]interface{})
+		actualEncryptedValue := fmt.Sprintf("%v", createResult["message"]) // convert the cyphertext (=interface{}) received to a string
 		keyAlreadyExistsMsg := "test5-address2 key exists"
-		if keyAlreadyExistsMsg != actualEncryptedValue {
+		if keyAlreadyExistsMsg != actualEncryptedValue || createResult["created"] != false {
 			t.Errorf("expected %q to be %q", actualEncryptedValue, keyAlreadyExistsMsg)
 		}
 		resp = encryptData(b, storage, data, t)
@@ -1660,212 +1684,5722 @@ func TestBackend(t *testing.T) {
 
 	})
 
-	t.Run("testkv1 ckv read", func(t *testing.T) {
-
-		// t.Parallel()
+	t.Run("test28 verifyDecrypt", func(t *testing.T) {
 		b, storage := testBackend(t)
 
-		if vault_kv_active == "false" {
-			t.SkipNow()
-		}
+		configMap := createVaultConfig()
 
-		resp := readKV(b, storage, t)
+		// store the config
+		saveConfig(b, storage, configMap, false, t)
 
-		if resp == nil || resp.Data == nil {
-			t.Error("nothing returned from KV")
+		importData := map[string]interface{}{
+			"test28-key": DeterministicKeyset,
 		}
-	})
+		importKey(b, storage, importData, t)
 
-	t.Run("testkv2 kv sync", func(t *testing.T) {
+		keyMap := map[string]interface{}{
+			"test28-key": "siv/test28-key",
+		}
+		saveConfig(b, storage, keyMap, false, t)
 
-		b, storage := testBackend(t)
+		data := map[string]interface{}{
+			"test28-key": "my secret value",
+		}
+		respEncrypt := encryptData(b, storage, data, t)
 
-		if vault_kv_active == "false" {
-			t.SkipNow()
+		resp := verifyDecrypt(b, storage, respEncrypt.Data, t)
+		result := resp.Data["test28-key"].(map[string]interface{})
+		if result["verified"] != true {
+			t.Errorf("expected the cyphertext to verify %v", result)
 		}
+		if result["keyId"] != 97978150 {
+			t.Errorf("expected key id 97978150 got %v", result["keyId"])
+		}
+		if strings.Contains(fmt.Sprintf("%v", resp.Data), "my secret value") {
+			t.Error("verifyDecrypt should never return the plaintext")
+		}
+
+		// tamper with the cyphertext
+		ct, _ := b64.StdEncoding.DecodeString(respEncrypt.Data["test28-key"].(string))
+		ct[len(ct)-1] ^= 0xff
+		resp = verifyDecrypt(b, storage, map[string]interface{}{"test28-key": b64.StdEncoding.EncodeToString(ct)}, t)
+		result = resp.Data["test28-key"].(map[string]interface{})
+		if result["verified"] != false {
+			t.Errorf("expected the tampered cyphertext to fail verification %v", result)
+		}
+		if _, ok := result["keyId"]; ok {
+			t.Errorf("expected no key id for a failed verification %v", result)
+		}
+	})
+
+	t.Run("test29 output prefix on key creation and import of a RAW key", func(t *testing.T) {
+		b, storage := testBackend(t)
 
 		configMap := createVaultConfig()
 
 		// store the config
 		saveConfig(b, storage, configMap, false, t)
 
-		// create a dynamic AEAD key for a field
-		// set some data to be encrypted using the keys
+		// create RAW prefixed keys dynamically
+		encryptDataNonDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test29-nondet": "junk", "OUTPUT_PREFIX": "RAW"}, false, t)
+		encryptDataDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test29-det": "junk", "OUTPUT_PREFIX": "RAW"}, false, t)
+
+		configResp := readConfig(b, storage, t)
+		if _, ok := configResp.Data["OUTPUT_PREFIX"]; ok {
+			t.Error("OUTPUT_PREFIX should not be treated as a field")
+		}
+		for _, fieldName := range []string{"gcm/test29-nondet", "siv/test29-det"} {
+			keyStr := fmt.Sprintf("%v", configResp.Data[fieldName])
+			if !strings.Contains(keyStr, "\"outputPrefixType\":\"RAW\"") {
+				t.Errorf("expected a RAW prefixed keyset for %s got %s", fieldName, keyStr)
+			}
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"test29-nondet": "gcm/test29-nondet", "test29-det": "siv/test29-det"}, false, t)
 		data := map[string]interface{}{
-			"testkv2-address": "my address",
+			"test29-nondet": "my nondet value",
+			"test29-det":    "my det value",
+		}
+		respDecrypt := decryptData(b, storage, encryptData(b, storage, data, t), t)
+		for k, v := range data {
+			assertEqual(fmt.Sprintf("%v", respDecrypt.Data[k]), v.(string), t)
 		}
 
-		// create a key - should get synced as gcm/testkv2-address
-		encryptDataNonDetermisticallyAndCreateKey(b, storage, data, false, t)
+		// an invalid prefix is rejected
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "createAEADkey",
+			Data:      map[string]interface{}{"test29-invalid": "junk", "OUTPUT_PREFIX": "NOTAPREFIX"},
+		})
+		if err == nil {
+			t.Error("expected an error for an invalid OUTPUT_PREFIX")
+		}
 
-		resp := readKV(b, storage, t)
+		// import a RAW prefixed key and check cyphertext is compatible with a raw consumer
+		kh, err := keyset.NewHandle(aead.AES256GCMNoPrefixKeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawKeyset, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(kh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importKey(b, storage, map[string]interface{}{"test29-raw": rawKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test29-raw": "gcm/test29-raw"}, false, t)
 
-		_, ok := resp.Data["gcm/testkv2-address"]
-		if !ok {
-			t.Error("did not find entry for gcm/testkv2-address")
+		respEncrypt := encryptData(b, storage, map[string]interface{}{"test29-raw": "raw value"}, t)
+		ct, _ := b64.StdEncoding.DecodeString(respEncrypt.Data["test29-raw"].(string))
+		// a RAW AES-GCM cyphertext is nonce(12) + plaintext + tag(16), no 5 byte tink prefix
+		if len(ct) != len("raw value")+28 {
+			t.Errorf("expected a RAW cyphertext of length %d got %d", len("raw value")+28, len(ct))
+		}
+		a, err := aead.New(kh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := a.Decrypt(ct, []byte("test29-raw"))
+		if err != nil {
+			t.Fatal(err)
 		}
+		assertEqual(string(pt), "raw value", t)
 
-		// OK its in KV and it looks ok, lets double -check the format by reading kv directly
+		respDecrypt = decryptData(b, storage, respEncrypt, t)
+		assertEqual(fmt.Sprintf("%v", respDecrypt.Data["test29-raw"]), "raw value", t)
+	})
 
-		// check kv secret
-		fullName := "gcm/testkv2-address"
+	t.Run("test30 rekeyData", func(t *testing.T) {
+		b, storage := testBackend(t)
 
-		checkKVSecret(fullName, t)
+		configMap := createVaultConfig()
 
-		// create a key - should get synced as gcm/testkv2-address
-		encryptDataDetermisticallyAndCreateKey(b, storage, data, false, t)
+		// store the config
+		saveConfig(b, storage, configMap, false, t)
 
-		resp = readKV(b, storage, t)
+		importKey(b, storage, map[string]interface{}{"test30-nondet": NonDeterministicKeyset, "test30-det": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test30-nondet": "gcm/test30-nondet", "test30-det": "siv/test30-det"}, false, t)
 
-		_, ok = resp.Data["siv/testkv2-address"]
-		if !ok {
-			t.Error("did not find entry for siv/testkv2-address")
+		data := map[string]interface{}{
+			"0": map[string]interface{}{"test30-nondet": "nondet value 0", "test30-det": "det value 0", "test30-nokey": "no key 0"},
+			"1": map[string]interface{}{"test30-nondet": "nondet value 1", "test30-det": "det value 1", "test30-nokey": "no key 1"},
+		}
+		respEncrypt := encryptData(b, storage, data, t)
+
+		respRekey, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "rekeyData",
+			Data:      respEncrypt.Data,
+		})
+		if err != nil {
+			t.Fatal("rekeyData", err)
 		}
 
-		// OK its in KV and it looks ok, lets double -check the format by reading kv directly
+		for _, keyName := range []string{"gcm/test30-nondet", "siv/test30-det"} {
+			keysetIntf, _ := AEAD_CONFIG.Get(keyName)
+			rawKeyset := keysetIntf.(string)
+			var keySetStruct aeadutils.KeySetStruct
+			if err := json.Unmarshal([]byte(rawKeyset), &keySetStruct); err != nil {
+				t.Fatal(err)
+			}
+			if keySetStruct.PrimaryKeyID == 3192631270 || keySetStruct.PrimaryKeyID == 97978150 {
+				t.Errorf("expected %s to have been rotated", keyName)
+			}
 
-		// check kv secret
-		fullName = "siv/testkv2-address"
+			fieldName := aeadutils.RemoveKeyPrefix(keyName)
+			for rowKey, row := range respRekey.Data {
+				rekeyed := row.(map[string]interface{})[fieldName].(string)
+				if rekeyed == respEncrypt.Data[rowKey].(map[string]interface{})[fieldName].(string) {
+					t.Errorf("expected %s row %s to be re-encrypted", fieldName, rowKey)
+				}
+				ct, _ := b64.StdEncoding.DecodeString(rekeyed)
+				_, keyID, err := aeadutils.DecryptWithKeyID(rawKeyset, ct, []byte(fieldName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if keyID != keySetStruct.PrimaryKeyID {
+					t.Errorf("expected %s row %s to use the new primary %d got %d", fieldName, rowKey, keySetStruct.PrimaryKeyID, keyID)
+				}
+			}
+		}
 
-		checkKVSecret(fullName, t)
+		respDecrypt := decryptData(b, storage, respRekey, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
 	})
 
-}
+	t.Run("test31 configurable mask string", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
 
-func TestBQ(t *testing.T) {
+		importKey(b, storage, map[string]interface{}{
+			"test31-key": NonDeterministicKeyset,
+		}, t)
 
-	// un comment this if you need to debug bqsync
-	t.Run("test-bqsync fake test to debug bqsync ", func(t *testing.T) {
+		// default mask
+		resp := readConfig(b, storage, t)
+		keySetStr := resp.Data["gcm/test31-key"].(string)
+		if strings.Count(keySetStr, `"value":"***"`) != 4 {
+			t.Errorf("expected all 4 keys to be masked with ***, got: %s", keySetStr)
+		}
 
-		if bq_active == "false" {
-			t.SkipNow()
+		// custom mask
+		saveConfig(b, storage, map[string]interface{}{"MASK_STRING": "<hidden>"}, false, t)
+		resp = readConfig(b, storage, t)
+		keySetStr = resp.Data["gcm/test31-key"].(string)
+		if strings.Count(keySetStr, `"value":"<hidden>"`) != 4 {
+			t.Errorf("expected all 4 keys to be masked with <hidden>, got: %s", keySetStr)
+		}
+		if strings.Contains(keySetStr, "***") {
+			t.Errorf("expected the default mask not to be used, got: %s", keySetStr)
 		}
+	})
 
-		// t.Parallel()
+	t.Run("test32 keytypes reports the algorithm", func(t *testing.T) {
 		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
 
-		configMap := map[string]interface{}{
-
-			"BQ_KMSKEY":                  "projects/vf-cis-rubik-tst-kms/locations/<region>/keyRings/hsm-key-tink-pf1-<region>/cryptoKeys/bq-key",
-			"BQ_PROJECT":                 "vf-pf1-datahub-b14b",
-			"BQ_DEFAULT_ENCRYPT_DATASET": "vfpf1_dh_lake_aead_encrypt_<region>_lv_s",
-			"BQ_DEFAULT_DECRYPT_DATASET": "vfpf1_dh_lake_<category>_aead_decrypt_<region>_lv_s",
-			"BQ_ROUTINE_DET_PREFIX":      "siv",
-			"BQ_ROUTINE_NONDET_PREFIX":   "gcm",
+		importKey(b, storage, map[string]interface{}{
+			"test32-nondet": NonDeterministicKeyset,
+			"test32-det":    DeterministicKeyset,
+		}, t)
+		kh, err := keyset.NewHandle(aead.ChaCha20Poly1305KeyTemplate())
+		if err != nil {
+			t.Fatal(err)
 		}
-		// store the config
-		saveConfig(b, storage, configMap, false, t)
-
-		key := "testbqsync-address"
-		value := "my address"
-
-		nondetkey := map[string]interface{}{
-			key: value,
+		rawKeyset, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(kh)
+		if err != nil {
+			t.Fatal(err)
 		}
+		importKey(b, storage, map[string]interface{}{"test32-chacha": rawKeyset}, t)
+		// a config entry named like the option is classified like any other entry
+		saveConfig(b, storage, map[string]interface{}{"ALGORITHMS": "an option"}, true, t)
 
-		encryptDataNonDetermisticallyAndCreateKey(b, storage, nondetkey, false, t)
+		resp := readKeyTypes(b, storage, t)
 
-		key = "testbqsync-postcode"
-		value = "my postcode"
-		key1 := "name"
-		value1 := "my name"
+		// the existing classification is unchanged
+		compareStrings(resp, "gcm/test32-nondet", "NON DETERMINISTIC", t)
+		compareStrings(resp, "siv/test32-det", "DETERMINISTIC", t)
+		compareStrings(resp, "gcm/test32-chacha", "NON DETERMINISTIC", t)
+		compareStrings(resp, "ALGORITHMS", "NON DETERMINISTIC", t)
 
-		detkey := map[string]interface{}{
-			key:  value,
-			key1: value1,
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "keytypes",
+			Data:      map[string]interface{}{"ALGORITHMS": "true"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareStrings(resp, "gcm/test32-nondet", "AesGcm", t)
+		compareStrings(resp, "siv/test32-det", "AesSiv", t)
+		compareStrings(resp, "gcm/test32-chacha", "ChaCha20Poly1305", t)
+		// non keysets do not have an algorithm
+		for _, k := range []string{"VAULT_KV_URL", "ALGORITHMS"} {
+			if _, ok := resp.Data[k]; ok {
+				t.Errorf("expected no algorithm for the non keyset config entry %s", k)
+			}
 		}
 
-		encryptDataDetermisticallyAndCreateKey(b, storage, detkey, false, t)
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "keytypes",
+			Data:      map[string]interface{}{"ALGORITHMS": "maybe"},
+		})
+		if err == nil || !strings.HasPrefix(err.Error(), "INVALID_REQUEST") {
+			t.Errorf("expected INVALID_REQUEST for an invalid ALGORITHMS got %v", err)
+		}
+	})
 
-		data := make(map[string]interface{})
+	t.Run("test33 bqsync rejects an unsupported kms provider", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
 
-		tn := time.Now()
+		saveConfig(b, storage, map[string]interface{}{
+			"BQ_KMS_PROVIDER": "azure",
+			"BQ_KMSKEY":       "https://myvault.vault.azure.net/keys/bq-key",
+			"BQ_PROJECT":      "your-bq-project",
+		}, false, t)
+		importKey(b, storage, map[string]interface{}{"test33-key": NonDeterministicKeyset}, t)
 
+		// BQ cannot use azure wrapped keysets so this must fail before anything is synced
 		_, err := b.HandleRequest(context.Background(), &logical.Request{
 			Storage:   storage,
 			Operation: logical.UpdateOperation,
 			Path:      "bqsync",
-			Data:      data,
+			Data:      map[string]interface{}{},
 		})
-		if err != nil {
-			t.Fatal("bqsync", err)
+		if err == nil || !strings.Contains(err.Error(), "unsupported combination") {
+			t.Errorf("expected an unsupported combination error, got: %v", err)
 		}
 
-		projectId := "vf-pf1-datahub-b14b"
-		datasetName := "vfpf1_dh_lake_aead_encrypt_eu_lv_s"
-		routineName := "testbqsync_postcode_siv_encrypt"
-		checkBQRoutine(projectId, t, datasetName, routineName, tn)
+		saveConfig(b, storage, map[string]interface{}{"BQ_KMS_PROVIDER": "notakms"}, true, t)
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "bqsync",
+			Data:      map[string]interface{}{},
+		})
+		if err == nil || !strings.Contains(err.Error(), "unknown kms provider") {
+			t.Errorf("expected an unknown kms provider error, got: %v", err)
+		}
 	})
 
-}
+	t.Run("test34 createAEADkey reports created", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
 
-func checkBQRoutine(projectId string, t *testing.T, datasetName string, routineName string, tn time.Time) {
-	ctx := context.Background()
-	bigqueryClient, err := bigquery.NewClient(ctx, projectId)
-	if err != nil {
-		t.Fatal("Failed to create a bigquery client: " + err.Error())
+		data := map[string]interface{}{"test34-nondet": "my value"}
+		resp := encryptDataNonDetermisticallyAndCreateKey(b, storage, data, false, t)
+		result := resp.Data["test34-nondet"].(map[string]interface{})
+		if result["created"] != true || result["ciphertext"] == nil {
+			t.Errorf("expected the key to be created, got: %v", result)
+		}
+		// the config read masks the material, so use the raw keyset
+		keySetIntf, _ := AEAD_CONFIG.Get("gcm/test34-nondet")
+		keySetStr := keySetIntf.(string)
+		ct, _ := b64.StdEncoding.DecodeString(result["ciphertext"].(string))
+		pt, _, err := aeadutils.DecryptWithKeyID(keySetStr, ct, []byte("test34-nondet"))
+		if err != nil || string(pt) != "my value" {
+			t.Errorf("expected the ciphertext to decrypt to %q got %q %v", "my value", pt, err)
+		}
 
-	}
-	defer bigqueryClient.Close()
-	routineEncryptRef := bigqueryClient.Dataset(datasetName).Routine(routineName)
-	var rm *bigquery.RoutineMetadata
-	rm, err = routineEncryptRef.Metadata(ctx)
-	if err != nil {
-		t.Fatal("Failed to find routine: " + datasetName + ":" + routineName + ": " + err.Error())
-	}
-	if tn.After(rm.LastModifiedTime) {
-		t.Error(datasetName + ":" + routineName + " did not change")
-	} else {
-		t.Log(datasetName + ":" + routineName + " did change")
-	}
-}
+		// a retry must not replace the key
+		resp = encryptDataNonDetermisticallyAndCreateKey(b, storage, data, false, t)
+		result = resp.Data["test34-nondet"].(map[string]interface{})
+		if result["created"] != false {
+			t.Errorf("expected the key to already exist, got: %v", result)
+		}
+		keySetIntf, _ = AEAD_CONFIG.Get("gcm/test34-nondet")
+		if keySetIntf.(string) != keySetStr {
+			t.Errorf("expected the existing key not to be replaced")
+		}
 
-// func TestKV(t *testing.T) {
+		// same for deterministic keys
+		data = map[string]interface{}{"test34-det": "my value"}
+		resp = encryptDataDetermisticallyAndCreateKey(b, storage, data, false, t)
+		if resp.Data["test34-det"].(map[string]interface{})["created"] != true {
+			t.Errorf("expected the key to be created, got: %v", resp.Data["test34-det"])
+		}
+		resp = encryptDataDetermisticallyAndCreateKey(b, storage, data, false, t)
+		if resp.Data["test34-det"].(map[string]interface{})["created"] != false {
+			t.Errorf("expected the key to already exist, got: %v", resp.Data["test34-det"])
+		}
 
-// t.Run("testkv1 ckv read", func(t *testing.T) {
+		// overwrite replaces the material and reports created
+		resp = encryptDataNonDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test34-nondet": "my value"}, true, t)
+		if resp.Data["test34-nondet"].(map[string]interface{})["created"] != true {
+			t.Errorf("expected the key to be replaced, got: %v", resp.Data["test34-nondet"])
+		}
+		keySetIntf, _ = AEAD_CONFIG.Get("gcm/test34-nondet")
+		if keySetIntf.(string) == keySetStr {
+			t.Errorf("expected the existing key to be replaced")
+		}
+	})
 
-// 	if vault_kv_active == "false" {
-// 		t.SkipNow()
-// 	}
+	t.Run("test35 decrypt with ENCODING auto", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
 
-// 	// t.Parallel()
-// 	b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test35-nondet": NonDeterministicKeyset,
+			"test35-det":    DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test35-nondet": "gcm/test35-nondet",
+			"test35-det":    "siv/test35-det",
+		}, false, t)
 
-// 	resp := readKV(b, storage, t)
+		data := map[string]interface{}{
+			"0": map[string]interface{}{"test35-nondet": "nondet value 0", "test35-det": "det value 0"},
+			"1": map[string]interface{}{"test35-nondet": "nondet value 1", "test35-det": "det value 1"},
+		}
+		respEncrypt := encryptData(b, storage, data, t)
 
-// 	if resp == nil || resp.Data == nil {
-// 		t.Error("nothing returned from KV")
-// 	}
-// })
+		// re-encode row 1 as hex so the request mixes both encodings
+		mixed := map[string]interface{}{}
+		for rowKey, row := range respEncrypt.Data {
+			mixedRow := map[string]interface{}{}
+			for fieldName, v := range row.(map[string]interface{}) {
+				mixedRow[fieldName] = v
+				if rowKey == "1" {
+					ct, _ := b64.StdEncoding.DecodeString(v.(string))
+					mixedRow[fieldName] = hex.EncodeToString(ct)
+				}
+			}
+			mixed[rowKey] = mixedRow
+		}
+		mixed["ENCODING"] = "auto"
 
-// t.Run("testkv2 kv sync", func(t *testing.T) {
+		respDecrypt := decryptData(b, storage, &logical.Response{Data: mixed}, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
 
-// 	if vault_kv_active == "false" {
-// 		t.SkipNow()
-// 	}
+		// a single row of hex
+		hexRow := mixed["1"].(map[string]interface{})
+		hexRow["ENCODING"] = "AUTO"
+		respDecrypt = decryptData(b, storage, &logical.Response{Data: hexRow}, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data["1"]) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data["1"])
+		}
 
-// 	b, storage := testBackend(t)
+		// neither base64 nor hex gives a plaintext
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "decrypt",
+			Data:      map[string]interface{}{"test35-nondet": "notbase64orhex!", "ENCODING": "auto"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "test35-nondet") {
+			t.Errorf("expected an error for the field, got: %v", err)
+		}
 
-// 	configMap := createVaultConfig()
+		// valid base64 and hex, but not a cyphertext
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "decrypt",
+			Data: map[string]interface{}{
+				"0":        map[string]interface{}{"test35-det": "deadbeef"},
+				"1":        map[string]interface{}{"test35-det": mixed["0"].(map[string]interface{})["test35-det"]},
+				"ENCODING": "auto",
+			},
+		})
+		if err == nil {
+			t.Errorf("expected an error for an invalid cyphertext")
+		}
 
-// 	// store the config
-// 	saveConfig(b, storage, configMap, false, t)
+		// unsupported encoding
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "decrypt",
+			Data:      map[string]interface{}{"test35-det": "deadbeef", "ENCODING": "base32"},
+		})
+		if err == nil {
+			t.Errorf("expected an error for an unsupported encoding")
+		}
+	})
 
-// 	// create a dynamic AEAD key for a field
-// 	// set some data to be encrypted using the keys
-// 	data := map[string]interface{}{
-// 		"testkv2-address": "my address",
-// 	}
+	t.Run("test36 purgeKeys", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
+
+		// one key DISABLED, one DESTROYED (no key material) and the primary kept
+		destroyedKeyset := `{"primaryKeyId":3987026049,"key":[` +
+			`{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiB5m/rHV+xmMiRngaWWi6zel8IjlOPCdEpGnEsb8RfrMQ==","keyMaterialType":"SYMMETRIC"},"status":"DISABLED","keyId":1456486908,"outputPrefixType":"TINK"},` +
+			`{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":3987026049,"outputPrefixType":"TINK"},` +
+			`{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiBa0wZ4ACjtW137qTVSY2ofQBCffdzkzhNkktlMtDFazA==","keyMaterialType":"SYMMETRIC"},"status":"DESTROYED","keyId":1416257722,"outputPrefixType":"TINK"}]}`
+		importKey(b, storage, map[string]interface{}{
+			"test36-nondet":    NonDeterministicKeyset,
+			"test36-destroyed": destroyedKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test36-nondet":    "gcm/test36-nondet",
+			"test36-destroyed": "gcm/test36-destroyed",
+		}, false, t)
+
+		data := map[string]interface{}{"test36-nondet": "my value"}
+		respEncrypt := encryptData(b, storage, data, t)
 
-// 	// create a key - should get synced as gcm/testkv2-address
-// 	encryptDataNonDetermisticallyAndCreateKey(b, storage, data, false, t)
+		// disable 2 of the 3 non primary keys
+		for _, keyID := range []string{"2832419897", "2233686170"} {
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "updateKeyStatus",
+				Data: map[string]interface{}{
+					"test36-nondet": map[string]interface{}{keyID: "DISABLED"},
+				},
+			})
+			if err != nil {
+				t.Fatal("updateKeyStatus", err)
+			}
+		}
 
-// 	resp := readKV(b, storage, t)
+		resp := purgeKeys(b, storage, map[string]interface{}{"test36-nondet": "", "test36-destroyed": ""}, t)
+		if resp.Data["test36-nondet"] != 2 || resp.Data["test36-destroyed"] != 1 {
+			t.Errorf("expected 2 and 1 keys to be purged, got: %v", resp.Data)
+		}
 
-// 	_, ok := resp.Data["gcm/testkv2-address"]
-// 	if !ok {
-// 		t.Error("did not find entry for gcm/testkv2-address")
-// 	}
+		keySetIntf, _ := AEAD_CONFIG.Get("gcm/test36-nondet")
+		var keySetStruct aeadutils.KeySetStruct
+		json.Unmarshal([]byte(keySetIntf.(string)), &keySetStruct)
+		if len(keySetStruct.Key) != 2 || keySetStruct.PrimaryKeyID != 3192631270 {
+			t.Errorf("expected 2 keys including the primary to remain, got: %v", keySetStruct)
+		}
+		for _, key := range keySetStruct.Key {
+			if key.Status != "ENABLED" {
+				t.Errorf("expected only enabled keys to remain, got: %v", key)
+			}
+		}
+		// the data encrypted with the primary still decrypts
+		respDecrypt := decryptData(b, storage, respEncrypt, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
+
+		// the DESTROYED key is only purged when asked
+		keySetIntf, _ = AEAD_CONFIG.Get("gcm/test36-destroyed")
+		if !strings.Contains(keySetIntf.(string), "1416257722") {
+			t.Errorf("expected the DESTROYED key to remain")
+		}
+		resp = purgeKeys(b, storage, map[string]interface{}{"test36-destroyed": "", "INCLUDE_DESTROYED": "true"}, t)
+		if resp.Data["test36-destroyed"] != 1 {
+			t.Errorf("expected 1 key to be purged, got: %v", resp.Data)
+		}
+		keySetIntf, _ = AEAD_CONFIG.Get("gcm/test36-destroyed")
+		if strings.Contains(keySetIntf.(string), "1416257722") || !strings.Contains(keySetIntf.(string), "3987026049") {
+			t.Errorf("expected only the DESTROYED key to be purged, got: %s", keySetIntf)
+		}
+
+		// nothing more to purge
+		resp = purgeKeys(b, storage, map[string]interface{}{"test36-nondet": ""}, t)
+		if resp.Data["test36-nondet"] != 0 {
+			t.Errorf("expected no keys to be purged, got: %v", resp.Data)
+		}
+
+		// unknown fields are an error
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "purgeKeys",
+			Data:      map[string]interface{}{"test36-unknown": ""},
+		})
+		if err == nil {
+			t.Errorf("expected an error for a field with no keyset")
+		}
+	})
+
+	t.Run("test37 encrypt with SKIP_ENCRYPTED", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
+
+		importKey(b, storage, map[string]interface{}{
+			"test37-nondet": NonDeterministicKeyset,
+			"test37-det":    DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test37-nondet": "gcm/test37-nondet",
+			"test37-det":    "siv/test37-det",
+		}, false, t)
+
+		data := map[string]interface{}{
+			"0": map[string]interface{}{"test37-nondet": "nondet value 0", "test37-det": "det value 0"},
+			"1": map[string]interface{}{"test37-nondet": "nondet value 1", "test37-det": "det value 1"},
+		}
+		respEncrypt := encryptData(b, storage, data, t)
+
+		// row 0 is already encrypted, row 1 is plaintext (one of which looks like base64)
+		mixed := map[string]interface{}{
+			"0":              respEncrypt.Data["0"],
+			"1":              map[string]interface{}{"test37-nondet": "bm9uZGV0IHZhbHVlIDE=", "test37-det": "det value 1"},
+			"SKIP_ENCRYPTED": "true",
+		}
+		respMixed := encryptData(b, storage, mixed, t)
+
+		// the already encrypted values are untouched
+		if !reflect.DeepEqual(respMixed.Data["0"], respEncrypt.Data["0"]) {
+			t.Errorf("expected %v to be unchanged %v", respMixed.Data["0"], respEncrypt.Data["0"])
+		}
+		// the plaintext is encrypted
+		respDecrypt := decryptData(b, storage, respMixed, t)
+		expected := map[string]interface{}{
+			"0": data["0"],
+			"1": map[string]interface{}{"test37-nondet": "bm9uZGV0IHZhbHVlIDE=", "test37-det": "det value 1"},
+		}
+		if !reflect.DeepEqual(respDecrypt.Data, expected) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, expected)
+		}
+
+		// without the flag the cyphertext is encrypted again
+		respTwice := encryptData(b, storage, map[string]interface{}{"test37-det": respEncrypt.Data["0"].(map[string]interface{})["test37-det"]}, t)
+		if respTwice.Data["test37-det"] == respEncrypt.Data["0"].(map[string]interface{})["test37-det"] {
+			t.Errorf("expected the cyphertext to be encrypted again without SKIP_ENCRYPTED")
+		}
+
+		// cyphertext made with different additional data is not detected
+		saveConfig(b, storage, map[string]interface{}{"ADDITIONAL_DATA_test37-det": "other aad"}, false, t)
+		respOtherAad := encryptData(b, storage, map[string]interface{}{"test37-det": respEncrypt.Data["0"].(map[string]interface{})["test37-det"], "SKIP_ENCRYPTED": "true"}, t)
+		if respOtherAad.Data["test37-det"] == respEncrypt.Data["0"].(map[string]interface{})["test37-det"] {
+			t.Errorf("expected cyphertext with different additional data to be encrypted")
+		}
+	})
+
+	t.Run("test38 importTemplate", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, createVaultConfig(), false, t)
+
+		gcmTemplate, err := protojson.Marshal(aead.AES256GCMKeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sivTemplate, err := protojson.Marshal(daead.AESSIVKeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the template can be a json string or an object
+		sivTemplateMap := map[string]interface{}{}
+		err = json.Unmarshal(sivTemplate, &sivTemplateMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := importTemplate(b, storage, map[string]interface{}{
+			"test38-nondet": string(gcmTemplate),
+			"test38-det":    sivTemplateMap,
+		}, t)
+		if resp == nil || resp.IsError() {
+			t.Fatalf("importTemplate failed %v", resp)
+		}
+		if _, ok := resp.Data["gcm/test38-nondet"]; !ok {
+			t.Errorf("expected gcm/test38-nondet in %v", resp.Data)
+		}
+		if _, ok := resp.Data["siv/test38-det"]; !ok {
+			t.Errorf("expected siv/test38-det in %v", resp.Data)
+		}
+		if !strings.Contains(fmt.Sprintf("%v", resp.Data["gcm/test38-nondet"]), `"value":"***"`) {
+			t.Errorf("expected the key material to be masked %v", resp.Data)
+		}
+
+		for keyName, expectedType := range map[string]string{"gcm/test38-nondet": "AesGcm", "siv/test38-det": "AesSiv"} {
+			keyStr, ok := AEAD_CONFIG.Get(keyName)
+			if !ok {
+				t.Fatalf("expected %s to be saved", keyName)
+			}
+			algorithms, err := aeadutils.GetKeySetAlgorithms(keyStr.(string))
+			if err != nil || algorithms != expectedType {
+				t.Errorf("expected %s to be %s got %s %v", keyName, expectedType, algorithms, err)
+			}
+		}
+
+		// the new keysets can be used
+		saveConfig(b, storage, map[string]interface{}{
+			"test38-nondet": "gcm/test38-nondet",
+			"test38-det":    "siv/test38-det",
+		}, false, t)
+		data := map[string]interface{}{
+			"test38-nondet": "nondet value",
+			"test38-det":    "det value",
+		}
+		respEncrypt := encryptData(b, storage, data, t)
+		respDecrypt := decryptData(b, storage, respEncrypt, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
+
+		// existing keysets are not replaced
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "importTemplate",
+			Data:      map[string]interface{}{"test38-nondet": string(gcmTemplate)},
+		})
+		if err == nil {
+			t.Errorf("expected an error importing a template over an existing key")
+		}
+
+		// non aead/daead templates are rejected
+		macTemplate, err := protojson.Marshal(mac.HMACSHA256Tag256KeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "importTemplate",
+			Data:      map[string]interface{}{"test38-mac": string(macTemplate)},
+		})
+		if err == nil {
+			t.Errorf("expected an error importing a mac template")
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test38-mac"); ok {
+			t.Errorf("expected the mac keyset not to be saved")
+		}
+	})
+
+	t.Run("test39 configDiff", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test39-setting":   "old",
+			"test39-unchanged": "same",
+		}, false, t)
+		importKey(b, storage, map[string]interface{}{
+			"test39-nondet": NonDeterministicKeyset,
+		}, t)
+		configBefore := fmt.Sprintf("%v", readConfig(b, storage, t).Data)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "configDiff",
+			Data: map[string]interface{}{
+				"test39-setting":    "new",
+				"test39-unchanged":  "same",
+				"test39-new":        "value",
+				"test39-nondet":     DeterministicKeyset,
+				"gcm/test39-nondet": NonDeterministicKeyset,
+			},
+		})
+		if err != nil {
+			t.Fatal("configDiff", err)
+		}
+
+		expected := map[string]interface{}{
+			"test39-setting":   map[string]interface{}{"status": "changed", "current": "old", "proposed": "new"},
+			"test39-unchanged": map[string]interface{}{"status": "unchanged"},
+			"test39-new":       map[string]interface{}{"status": "added"},
+			// a deterministic keyset is saved with the siv/ prefix
+			"siv/test39-nondet": map[string]interface{}{"status": "added"},
+			"gcm/test39-nondet": map[string]interface{}{"status": "unchanged"},
+		}
+		if !reflect.DeepEqual(resp.Data, expected) {
+			t.Errorf("expected %v to be %v", resp.Data, expected)
+		}
+
+		// a changed keyset does not reveal the material
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "configDiff",
+			Data: map[string]interface{}{
+				"gcm/test39-nondet": DeterministicSingleKey,
+			},
+		})
+		if err != nil {
+			t.Fatal("configDiff", err)
+		}
+		expected = map[string]interface{}{
+			"gcm/test39-nondet": map[string]interface{}{"status": "changed", "detail": "material would change"},
+		}
+		if !reflect.DeepEqual(resp.Data, expected) {
+			t.Errorf("expected %v to be %v", resp.Data, expected)
+		}
+
+		// nothing is saved
+		configAfter := fmt.Sprintf("%v", readConfig(b, storage, t).Data)
+		if configBefore != configAfter {
+			t.Errorf("expected config to be unchanged by configDiff")
+		}
+	})
+
+	t.Run("test40 fingerprint", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test40-nondet": NonDeterministicKeyset,
+			"test40-det":    DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test40-pointer": "gcm/test40-nondet",
+			"test40-setting": "not a keyset",
+		}, false, t)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "fingerprint",
+		})
+		if err != nil {
+			t.Fatal("fingerprint", err)
+		}
+
+		if _, ok := resp.Data["test40-setting"]; ok {
+			t.Errorf("expected no fingerprint for a setting %v", resp.Data)
+		}
+		nondetFingerprint := fmt.Sprintf("%v", resp.Data["gcm/test40-nondet"])
+		if !strings.HasPrefix(nondetFingerprint, "sha256:") || len(nondetFingerprint) != len("sha256:")+64 {
+			t.Errorf("unexpected fingerprint %s", nondetFingerprint)
+		}
+		if resp.Data["test40-pointer"] != nondetFingerprint {
+			t.Errorf("expected the pointer fingerprint %v to be %s", resp.Data["test40-pointer"], nondetFingerprint)
+		}
+		if resp.Data["siv/test40-det"] == nondetFingerprint {
+			t.Errorf("expected different keysets to have different fingerprints")
+		}
+
+		// the fingerprint is the same as bqsync puts in the routine description
+		kh, err := aeadutils.ValidateKeySetJson(NonDeterministicKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprint, err := aeadutils.KeySetFingerprint(kh)
+		if err != nil || fingerprint != nondetFingerprint {
+			t.Errorf("expected %s to be %s %v", fingerprint, nondetFingerprint, err)
+		}
+	})
+
+	t.Run("test41 composite additional data", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test41-nondet": NonDeterministicKeyset,
+			"test41-det":    DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test41-nondet":              "gcm/test41-nondet",
+			"test41-det":                 "siv/test41-det",
+			"AAD_PARTS_test41-nondet":    "table,FIELD",
+			"AAD_PARTS_test41-det":       "table, column, ADDITIONAL_DATA",
+			"ADDITIONAL_DATA_test41-det": "det-ad",
+			"AAD_SEPARATOR":              "|",
+			"test41-plain":               "not a keyset",
+		}, false, t)
+
+		data := map[string]interface{}{
+			"test41-nondet": "nondet value",
+			"test41-det":    "det value",
+		}
+		aadParts := map[string]interface{}{"table": "customers", "column": "email"}
+
+		// round trip, single row
+		encryptRequest := map[string]interface{}{"AAD_PARTS": aadParts}
+		for k, v := range data {
+			encryptRequest[k] = v
+		}
+		respEncrypt := encryptData(b, storage, encryptRequest, t)
+		decryptRequest := map[string]interface{}{"AAD_PARTS": aadParts}
+		for k, v := range respEncrypt.Data {
+			decryptRequest[k] = v
+		}
+		respDecrypt := decryptData(b, storage, &logical.Response{Data: decryptRequest}, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
+
+		// the additional data is composed of the parts with the separator
+		nondetKey, _ := AEAD_CONFIG.Get("gcm/test41-nondet")
+		cypherText, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", respEncrypt.Data["test41-nondet"]))
+		_, _, err := aeadutils.DecryptWithKeyID(fmt.Sprintf("%v", nondetKey), cypherText, []byte("customers|test41-nondet"))
+		if err != nil {
+			t.Errorf("expected to decrypt with the composite additional data: %v", err)
+		}
+		detKey, _ := AEAD_CONFIG.Get("siv/test41-det")
+		cypherText, _ = b64.StdEncoding.DecodeString(fmt.Sprintf("%v", respEncrypt.Data["test41-det"]))
+		_, _, err = aeadutils.DecryptWithKeyID(fmt.Sprintf("%v", detKey), cypherText, []byte("customers|email|det-ad"))
+		if err != nil {
+			t.Errorf("expected to decrypt with the composite additional data including ADDITIONAL_DATA_: %v", err)
+		}
+
+		// round trip, bulk with AAD_PARTS as a json string
+		bulkData := map[string]interface{}{
+			"0": map[string]interface{}{"test41-nondet": "nondet value 0", "test41-det": "det value 0"},
+			"1": map[string]interface{}{"test41-nondet": "nondet value 1", "test41-det": "det value 1"},
+		}
+		bulkRequest := map[string]interface{}{"AAD_PARTS": `{"table":"customers","column":"email"}`}
+		for k, v := range bulkData {
+			bulkRequest[k] = v
+		}
+		respBulkEncrypt := encryptData(b, storage, bulkRequest, t)
+		respBulkEncrypt.Data["AAD_PARTS"] = `{"table":"customers","column":"email"}`
+		respBulkDecrypt := decryptData(b, storage, respBulkEncrypt, t)
+		if !reflect.DeepEqual(respBulkDecrypt.Data, bulkData) {
+			t.Errorf("expected %v to be %v", respBulkDecrypt.Data, bulkData)
+		}
+
+		// different parts do not decrypt
+		decryptRequest["AAD_PARTS"] = map[string]interface{}{"table": "suppliers", "column": "email"}
+		respOther := decryptData(b, storage, &logical.Response{Data: decryptRequest}, t)
+		if reflect.DeepEqual(respOther.Data, data) {
+			t.Errorf("expected cyphertext not to decrypt with different additional data parts")
+		}
+
+		// a missing part is an error
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test41-det": "det value", "AAD_PARTS": map[string]interface{}{"table": "customers"}},
+		})
+		if err == nil || !strings.Contains(err.Error(), "column") {
+			t.Errorf("expected an error for the missing column part, got %v", err)
+		}
+
+		// a part containing the separator is an error, as a|b + c and a + b|c would be the same additional data
+		for _, parts := range []map[string]interface{}{{"table": "a|b", "column": "c"}, {"table": "a", "column": "b|c"}} {
+			for _, path := range []string{"encrypt", "decrypt"} {
+				_, err = b.HandleRequest(context.Background(), &logical.Request{
+					Storage:   storage,
+					Operation: logical.UpdateOperation,
+					Path:      path,
+					Data:      map[string]interface{}{"test41-det": respEncrypt.Data["test41-det"], "AAD_PARTS": parts},
+				})
+				if err == nil || !strings.Contains(err.Error(), ERROR_INVALID_REQUEST) || !strings.Contains(err.Error(), "AAD_SEPARATOR") {
+					t.Errorf("expected INVALID_REQUEST to %s with the parts %v got %v", path, parts, err)
+				}
+			}
+		}
+	})
+
+	t.Run("test42 convertPrefix", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test42-nondet": NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test42-nondet": "gcm/test42-nondet",
+		}, false, t)
+		data := map[string]interface{}{"test42-nondet": "nondet value"}
+		respTinkEncrypt := encryptData(b, storage, data, t)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "convertPrefix",
+			Data:      map[string]interface{}{"test42-nondet": "raw"},
+		})
+		if err != nil {
+			t.Fatal("convertPrefix", err)
+		}
+		// vault also warns about the unrecognized field parameters
+		if !strings.Contains(strings.Join(resp.Warnings, " "), "gcm/test42-nondet has changed, existing cyphertext made with this keyset will no longer decrypt") {
+			t.Errorf("expected a warning that existing cyphertext will no longer decrypt %v", resp.Warnings)
+		}
+		respKeyset := fmt.Sprintf("%v", resp.Data["test42-nondet"])
+		if !strings.Contains(respKeyset, `"value":"***"`) || strings.Contains(respKeyset, `"TINK"`) {
+			t.Errorf("expected a masked RAW keyset %s", respKeyset)
+		}
+
+		// every key is now RAW
+		rawKeyset, _ := AEAD_CONFIG.Get("gcm/test42-nondet")
+		if strings.Contains(fmt.Sprintf("%v", rawKeyset), `"TINK"`) || strings.Count(fmt.Sprintf("%v", rawKeyset), `"RAW"`) != 4 {
+			t.Errorf("expected every key to be RAW %v", rawKeyset)
+		}
+
+		// new cyphertext has no prefix and round trips, the old cyphertext does not decrypt
+		respRawEncrypt := encryptData(b, storage, data, t)
+		rawCypherText, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", respRawEncrypt.Data["test42-nondet"]))
+		tinkCypherText, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", respTinkEncrypt.Data["test42-nondet"]))
+		if len(tinkCypherText)-len(rawCypherText) != 5 {
+			t.Errorf("expected the RAW cyphertext to be 5 bytes shorter, got %d and %d", len(rawCypherText), len(tinkCypherText))
+		}
+		respDecrypt := decryptData(b, storage, respRawEncrypt, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
+		respDecrypt = decryptData(b, storage, respTinkEncrypt, t)
+		if reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected the TINK cyphertext not to decrypt after the conversion")
+		}
+
+		// converting to the same prefix changes nothing and has no warning
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "convertPrefix",
+			Data:      map[string]interface{}{"test42-nondet": "RAW"},
+		})
+		if err != nil || strings.Contains(strings.Join(resp.Warnings, " "), "no longer decrypt") {
+			t.Errorf("expected no warnings converting to the same prefix %v %v", resp, err)
+		}
+
+		// an invalid prefix is an error
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "convertPrefix",
+			Data:      map[string]interface{}{"test42-nondet": "NOTAPREFIX"},
+		})
+		if err == nil {
+			t.Errorf("expected an error for an invalid output prefix")
+		}
+	})
+
+	t.Run("test43 field name validation", func(t *testing.T) {
+		b, storage := testBackend(t)
+
+		createKey := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+
+		// names that can't be BQ routine names are rejected and nothing is created
+		for _, name := range []string{"test43 space", "test43.dot", "test43/slash", "gcm/"} {
+			_, err := createKey("createAEADkey", map[string]interface{}{name: "value", "test43-ok": "value"})
+			if err == nil || !strings.Contains(err.Error(), "invalid field name") {
+				t.Errorf("expected an invalid field name error for %q got %v", name, err)
+			}
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test43-ok"); ok {
+			t.Errorf("expected no keyset to be created when a field name is invalid")
+		}
+
+		// dashes are allowed and kept by default
+		_, err := createKey("createAEADkey", map[string]interface{}{"test43-dash": "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test43-dash"); !ok {
+			t.Errorf("expected gcm/test43-dash to be created")
+		}
+
+		// a name that syncs to the same BQ name as an existing keyset is rejected
+		_, err = createKey("createDAEADkey", map[string]interface{}{"test43_dash": "value"})
+		if err == nil || !strings.Contains(err.Error(), "test43_dash") {
+			t.Errorf("expected a BQ name clash error got %v", err)
+		}
+
+		// optionally the names are normalized so the config name matches the BQ name
+		resp, err := createKey("createDAEADkey", map[string]interface{}{"test43-normal": "value", "NORMALIZE_FIELD_NAMES": "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := resp.Data["test43_normal"]; !ok {
+			t.Errorf("expected the normalized field name in the response %v", resp.Data)
+		}
+		if _, ok := AEAD_CONFIG.Get("siv/test43_normal"); !ok {
+			t.Errorf("expected siv/test43_normal to be created")
+		}
+		if _, ok := AEAD_CONFIG.Get("siv/test43-normal"); ok {
+			t.Errorf("expected siv/test43-normal not to be created")
+		}
+	})
+
+	t.Run("test44 decryptTyped", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test44-int":   NonDeterministicKeyset,
+			"test44-float": NonDeterministicKeyset,
+			"test44-bool":  DeterministicKeyset,
+			"test44-str":   DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test44-int":   "gcm/test44-int",
+			"test44-float": "gcm/test44-float",
+			"test44-bool":  "siv/test44-bool",
+			"test44-str":   "siv/test44-str",
+		}, false, t)
+
+		decryptTyped := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "decryptTyped",
+				Data:      data,
+			})
+		}
+		types := map[string]interface{}{
+			"test44-int":   "int",
+			"test44-float": "float",
+			"test44-bool":  "bool",
+		}
+
+		// single row, untyped fields stay strings
+		respEncrypt := encryptData(b, storage, map[string]interface{}{
+			"test44-int":   "42",
+			"test44-float": "3.5",
+			"test44-bool":  "true",
+			"test44-str":   "17",
+		}, t)
+		respEncrypt.Data["TYPES"] = types
+		resp, err := decryptTyped(respEncrypt.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"test44-int":   int64(42),
+			"test44-float": 3.5,
+			"test44-bool":  true,
+			"test44-str":   "17",
+		}
+		if !reflect.DeepEqual(resp.Data, expected) {
+			t.Errorf("expected %v to be %v", resp.Data, expected)
+		}
+
+		// bulk with TYPES as a json string
+		respBulkEncrypt := encryptData(b, storage, map[string]interface{}{
+			"0": map[string]interface{}{"test44-int": "1", "test44-bool": "false"},
+			"1": map[string]interface{}{"test44-int": "-2", "test44-bool": "1"},
+		}, t)
+		respBulkEncrypt.Data["TYPES"] = `{"test44-int":"int","test44-bool":"bool"}`
+		resp, err = decryptTyped(respBulkEncrypt.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedBulk := map[string]interface{}{
+			"0": map[string]interface{}{"test44-int": int64(1), "test44-bool": false},
+			"1": map[string]interface{}{"test44-int": int64(-2), "test44-bool": true},
+		}
+		if !reflect.DeepEqual(resp.Data, expectedBulk) {
+			t.Errorf("expected %v to be %v", resp.Data, expectedBulk)
+		}
+
+		// a value that does not convert is an error naming the field but not the plaintext
+		respEncrypt = encryptData(b, storage, map[string]interface{}{
+			"test44-int":   "not a number",
+			"test44-float": "2.25",
+		}, t)
+		respEncrypt.Data["TYPES"] = types
+		_, err = decryptTyped(respEncrypt.Data)
+		if err == nil || !strings.Contains(err.Error(), "field test44-int is not a valid int") {
+			t.Errorf("expected a conversion error for test44-int got %v", err)
+		}
+		if err != nil && strings.Contains(err.Error(), "not a number") {
+			t.Errorf("expected the error not to include the plaintext %v", err)
+		}
+
+		// unknown types are rejected
+		_, err = decryptTyped(map[string]interface{}{"TYPES": map[string]interface{}{"test44-int": "date"}})
+		if err == nil || !strings.Contains(err.Error(), "unsupported type date") {
+			t.Errorf("expected an unsupported type error got %v", err)
+		}
+	})
+
+	t.Run("test45 mapFamily", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"TEST45_FAMILY": DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"TEST45_FAMILY":   "siv/TEST45_FAMILY",
+			"test45-existing": "TEST45_FAMILY",
+			"test45-other":    "siv/some-other-key",
+		}, false, t)
+
+		mapFamily := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "mapFamily",
+				Data:      data,
+			})
+		}
+
+		// the family must exist
+		_, err := mapFamily(map[string]interface{}{"FAMILY": "TEST45_MISSING", "FIELDS": []interface{}{"test45-a"}})
+		if err == nil || !strings.Contains(err.Error(), "no keyset found for family TEST45_MISSING") {
+			t.Errorf("expected a missing family error got %v", err)
+		}
+
+		// a field configured with something else fails the whole request
+		_, err = mapFamily(map[string]interface{}{"FAMILY": "TEST45_FAMILY", "FIELDS": []interface{}{"test45-a", "test45-other"}})
+		if err == nil || !strings.Contains(err.Error(), "test45-other is already configured") {
+			t.Errorf("expected an already configured error got %v", err)
+		}
+		if _, ok := AEAD_CONFIG.Get("test45-a"); ok {
+			t.Errorf("expected test45-a not to be mapped")
+		}
+
+		// fields as a list
+		resp, err := mapFamily(map[string]interface{}{"FAMILY": "TEST45_FAMILY", "FIELDS": []interface{}{"test45-a", "test45-b", "test45-existing"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{"test45-a": true, "test45-b": true, "test45-existing": false}
+		if !reflect.DeepEqual(resp.Data, expected) {
+			t.Errorf("expected %v to be %v", resp.Data, expected)
+		}
+
+		// fields as a comma separated string
+		resp, err = mapFamily(map[string]interface{}{"FAMILY": "TEST45_FAMILY", "FIELDS": "test45-c, test45-a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = map[string]interface{}{"test45-c": true, "test45-a": false}
+		if !reflect.DeepEqual(resp.Data, expected) {
+			t.Errorf("expected %v to be %v", resp.Data, expected)
+		}
+
+		// the mapped fields encrypt with the family keyset
+		familyKey, _ := AEAD_CONFIG.Get("siv/TEST45_FAMILY")
+		for _, fieldName := range []string{"test45-a", "test45-b", "test45-c"} {
+			key, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+			if !ok || key != familyKey {
+				t.Errorf("expected %s to use the family keyset", fieldName)
+			}
+		}
+		respEncrypt := encryptData(b, storage, map[string]interface{}{"test45-a": "value", "test45-b": "value"}, t)
+		if respEncrypt.Data["test45-a"] == "value" {
+			t.Errorf("expected test45-a to be encrypted")
+		}
+		respDecrypt := decryptData(b, storage, respEncrypt, t)
+		if respDecrypt.Data["test45-b"] != "value" {
+			t.Errorf("expected test45-b to decrypt got %v", respDecrypt.Data["test45-b"])
+		}
+	})
+
+	t.Run("test46 rotate with a template", func(t *testing.T) {
+		b, storage := testBackend(t)
+
+		// an AES128-GCM keyset to be upgraded
+		kh128, err := keyset.NewHandle(aead.AES128GCMKeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyset128, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(kh128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importKey(b, storage, map[string]interface{}{
+			"test46-nondet": keyset128,
+			"test46-det":    DeterministicSingleKey,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test46-nondet": "gcm/test46-nondet",
+			"test46-det":    "siv/test46-det",
+		}, false, t)
+
+		data := map[string]interface{}{"test46-nondet": "nondet value", "test46-det": "det value"}
+		respEncrypt := encryptData(b, storage, data, t)
+
+		// an invalid template fails
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "rotate",
+			Data:      map[string]interface{}{"TEMPLATE": `{"typeUrl":"type.googleapis.com/google.crypto.tink.HmacKey"}`},
+		})
+		if err == nil {
+			t.Errorf("expected an error for a template that is not AEAD or DAEAD")
+		}
+
+		templateJson, err := protojson.Marshal(aead.AES256GCMKeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotateConfigKeys(b, storage, map[string]interface{}{"TEMPLATE": string(templateJson)}, t)
+
+		// the new primary of the non deterministic keyset is AES256-GCM
+		nondetKey, _ := AEAD_CONFIG.Get("gcm/test46-nondet")
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", nondetKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ks := insecurecleartextkeyset.KeysetMaterial(kh)
+		if len(ks.Key) != 2 {
+			t.Fatalf("expected 2 keys got %d", len(ks.Key))
+		}
+		for _, key := range ks.Key {
+			if key.KeyId == ks.PrimaryKeyId {
+				gcmKey := &aesgcmpb.AesGcmKey{}
+				err = proto.Unmarshal(key.KeyData.Value, gcmKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(gcmKey.KeyValue) != 32 {
+					t.Errorf("expected a 32 byte primary key got %d", len(gcmKey.KeyValue))
+				}
+			}
+		}
+
+		// the deterministic keyset is rotated as before
+		detKey, _ := AEAD_CONFIG.Get("siv/test46-det")
+		_, deterministic := aeadutils.IsKeyJsonDeterministic(detKey)
+		if !deterministic || strings.Count(fmt.Sprintf("%v", detKey), "keyId") != 2 {
+			t.Errorf("expected the deterministic keyset to have 2 AES-SIV keys %v", muteKeyMaterial(fmt.Sprintf("%v", detKey)))
+		}
+
+		// old cyphertext still decrypts
+		respDecrypt := decryptData(b, storage, respEncrypt, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
+
+		// new cyphertext uses the new primary and round trips
+		respEncrypt = encryptData(b, storage, data, t)
+		respDecrypt = decryptData(b, storage, respEncrypt, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
+	})
+
+	t.Run("test47 validateConfig", func(t *testing.T) {
+		b, storage := testBackend(t)
+		AEAD_CONFIG.Clear()
+		importKey(b, storage, map[string]interface{}{
+			"TEST47_FAMILY": DeterministicKeyset,
+			"test47-field":  NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"MASK_STRING":      "***",
+			"BQ_PROJECT":       "a-project",
+			"TEST47_FAMILY":    "siv/TEST47_FAMILY",
+			"test47-field":     "gcm/test47-field",
+			"test47-member":    "TEST47_FAMILY",
+			"test47-dangling":  "TEST47_DELETED",
+			"test47-circular1": "test47-circular2",
+			"test47-circular2": "test47-circular1",
+			"test47-mismatch":  "gcm/test47-wrongtype",
+			// a deterministic keyset saved under a non-deterministic name
+			"gcm/test47-wrongtype": DeterministicKeyset,
+		}, false, t)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "validateConfig",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["valid"] != false {
+			t.Errorf("expected the config not to be valid")
+		}
+
+		dangling := resp.Data["dangling"].(map[string]interface{})
+		for _, k := range []string{"test47-dangling", "test47-circular1", "test47-circular2"} {
+			if _, ok := dangling[k]; !ok {
+				t.Errorf("expected %s to be dangling %v", k, dangling)
+			}
+		}
+		if !strings.Contains(fmt.Sprintf("%v", dangling["test47-dangling"]), "TEST47_DELETED which does not exist") {
+			t.Errorf("expected the missing family to be named %v", dangling["test47-dangling"])
+		}
+		mismatched := resp.Data["mismatched"].(map[string]interface{})
+		for _, k := range []string{"test47-mismatch", "gcm/test47-wrongtype"} {
+			if _, ok := mismatched[k]; !ok {
+				t.Errorf("expected %s to be mismatched %v", k, mismatched)
+			}
+		}
+		for _, k := range []string{"MASK_STRING", "BQ_PROJECT", "TEST47_FAMILY", "siv/TEST47_FAMILY", "test47-field", "gcm/test47-field", "test47-member"} {
+			_, isDangling := dangling[k]
+			_, isMismatched := mismatched[k]
+			if isDangling || isMismatched {
+				t.Errorf("expected %s to be valid", k)
+			}
+		}
+		if len(dangling) != 3 || len(mismatched) != 2 {
+			t.Errorf("expected 3 dangling and 2 mismatched got %v %v", dangling, mismatched)
+		}
+
+		// nothing was changed
+		if v, _ := AEAD_CONFIG.Get("test47-dangling"); v != "TEST47_DELETED" {
+			t.Errorf("expected the config to be unchanged")
+		}
+
+		// an entry deleted after the config was listed is reported, not followed
+		if problem, isMismatch := checkConfigPointer("test47-deleted"); problem != "test47-deleted does not exist" || isMismatch {
+			t.Errorf("expected a deleted entry to be reported as missing got %q %v", problem, isMismatch)
+		}
+	})
+
+	t.Run("test48 compression", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test48-nondet": NonDeterministicKeyset,
+			"test48-det":    DeterministicKeyset,
+			"test48-plain":  NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test48-nondet":          "gcm/test48-nondet",
+			"test48-det":             "siv/test48-det",
+			"test48-plain":           "gcm/test48-plain",
+			"COMPRESS_test48-nondet": "true",
+			"COMPRESS_test48-det":    "true",
+		}, false, t)
+
+		blob := strings.Repeat(`{"name":"a name","address":"an address"},`, 100)
+		data := map[string]interface{}{
+			"test48-nondet": blob,
+			"test48-det":    blob,
+			"test48-plain":  blob,
+		}
+
+		// round trip, compressed and uncompressed fields
+		respEncrypt := encryptData(b, storage, data, t)
+		compressedLen := len(fmt.Sprintf("%v", respEncrypt.Data["test48-nondet"]))
+		plainLen := len(fmt.Sprintf("%v", respEncrypt.Data["test48-plain"]))
+		if compressedLen >= plainLen/4 {
+			t.Errorf("expected the compressed cyphertext (%d) to be much smaller than the uncompressed (%d)", compressedLen, plainLen)
+		}
+		respDecrypt := decryptData(b, storage, respEncrypt, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected the round trip to return the original data")
+		}
+
+		// the compressed plaintext carries the marker
+		nondetKey, _ := AEAD_CONFIG.Get("gcm/test48-nondet")
+		cypherText, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", respEncrypt.Data["test48-nondet"]))
+		plainText, _, err := aeadutils.DecryptWithKeyID(fmt.Sprintf("%v", nondetKey), cypherText, []byte("test48-nondet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(plainText, compressedMarker) {
+			t.Errorf("expected the plaintext to start with the compressed marker")
+		}
+
+		// deterministic encryption of compressed values is still deterministic
+		respEncrypt2 := encryptData(b, storage, map[string]interface{}{"test48-det": blob}, t)
+		if respEncrypt2.Data["test48-det"] != respEncrypt.Data["test48-det"] {
+			t.Errorf("expected the same cyphertext for the same deterministic plaintext")
+		}
+
+		// column based, bulk round trip
+		bulkData := map[string]interface{}{
+			"0": map[string]interface{}{"test48-nondet": blob, "test48-plain": "plain 0"},
+			"1": map[string]interface{}{"test48-nondet": "short", "test48-plain": "plain 1"},
+		}
+		respBulkEncrypt := encryptDataCol(b, storage, bulkData, t)
+		respBulkDecrypt := decryptDataCol(b, storage, respBulkEncrypt, t)
+		if !reflect.DeepEqual(respBulkDecrypt.Data, bulkData) {
+			t.Errorf("expected %v to be %v", respBulkDecrypt.Data, bulkData)
+		}
+
+		// a plaintext that starts with the marker is only decompressed for a field with COMPRESS_ set
+		marked := string(compressedMarker) + "not gzip"
+		respDecrypt = decryptData(b, storage, encryptData(b, storage, map[string]interface{}{"test48-plain": marked}, t), t)
+		if respDecrypt.Data["test48-plain"] != marked {
+			t.Errorf("expected the marked plaintext of an uncompressed field to be returned as it is got %q", respDecrypt.Data["test48-plain"])
+		}
+
+		// the decompressed plaintext is limited to MAX_FIELD_BYTES
+		saveConfig(b, storage, map[string]interface{}{"MAX_FIELD_BYTES": "1000"}, true, t)
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "decrypt",
+			Data:      map[string]interface{}{"test48-nondet": respEncrypt.Data["test48-nondet"]},
+		})
+		if err == nil || resp.Data["error_code"] != ERROR_DECRYPT_FAILED || !strings.Contains(err.Error(), "MAX_FIELD_BYTES") {
+			t.Errorf("expected DECRYPT_FAILED for plaintext that decompresses past MAX_FIELD_BYTES got %v", err)
+		}
+		deleteConfig(b, storage, map[string]interface{}{"MAX_FIELD_BYTES": ""}, t)
+
+		// once COMPRESS_ is turned off the values compressed before are returned compressed
+		saveConfig(b, storage, map[string]interface{}{"COMPRESS_test48-nondet": "false"}, true, t)
+		respDecrypt = decryptData(b, storage, respEncrypt, t)
+		if respDecrypt.Data["test48-nondet"] == blob {
+			t.Errorf("expected the compressed value not to be decompressed after compression was turned off")
+		}
+		respEncrypt = encryptData(b, storage, map[string]interface{}{"test48-nondet": "not compressed"}, t)
+		cypherText, _ = b64.StdEncoding.DecodeString(fmt.Sprintf("%v", respEncrypt.Data["test48-nondet"]))
+		plainText, _, err = aeadutils.DecryptWithKeyID(fmt.Sprintf("%v", nondetKey), cypherText, []byte("test48-nondet"))
+		if err != nil || string(plainText) != "not compressed" {
+			t.Errorf("expected the value not to be compressed got %q %v", plainText, err)
+		}
+	})
+
+	t.Run("test49 rotateAll", func(t *testing.T) {
+		b, storage := testBackend(t)
+		AEAD_CONFIG.Clear()
+
+		// a keyset that is not AEAD or DAEAD can't be rotated
+		macKh, err := keyset.NewHandle(mac.HMACSHA256Tag256KeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		macKeyset, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(macKh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importKey(b, storage, map[string]interface{}{
+			"test49-nondet": NonDeterministicKeyset,
+			"test49-det":    DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test49-nondet":  "gcm/test49-nondet",
+			"test49-det":     "siv/test49-det",
+			"gcm/test49-mac": macKeyset,
+			"MASK_STRING":    "***",
+		}, false, t)
+
+		data := map[string]interface{}{"test49-nondet": "nondet value", "test49-det": "det value"}
+		respEncrypt := encryptData(b, storage, data, t)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "rotateAll",
+			Data:      map[string]interface{}{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every keyset but the mac keyset has a new primary key
+		if len(resp.Data) != 2 {
+			t.Errorf("expected 2 rotated keysets got %v", resp.Data)
+		}
+		for _, keyName := range []string{"gcm/test49-nondet", "siv/test49-det"} {
+			primaryKeyId, ok := resp.Data[keyName]
+			if !ok {
+				t.Errorf("expected %s to be rotated", keyName)
+				continue
+			}
+			encryptionKey, _ := AEAD_CONFIG.Get(keyName)
+			kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kh.KeysetInfo().PrimaryKeyId != primaryKeyId {
+				t.Errorf("expected the saved primary key of %s to be %v", keyName, primaryKeyId)
+			}
+			if primaryKeyId == uint32(3192631270) {
+				t.Errorf("expected the primary key of %s to change", keyName)
+			}
+		}
+		if !strings.Contains(strings.Join(resp.Warnings, " "), "failed to rotate gcm/test49-mac") {
+			t.Errorf("expected a warning for the mac keyset %v", resp.Warnings)
+		}
+		if v, _ := AEAD_CONFIG.Get("gcm/test49-mac"); v != macKeyset {
+			t.Errorf("expected the mac keyset to be unchanged")
+		}
+
+		// old cyphertext still decrypts
+		respDecrypt := decryptData(b, storage, respEncrypt, t)
+		if !reflect.DeepEqual(respDecrypt.Data, data) {
+			t.Errorf("expected %v to be %v", respDecrypt.Data, data)
+		}
+	})
+
+	t.Run("test50 log level", func(t *testing.T) {
+		b, storage := testBackend(t)
+		defer hclog.L().SetLevel(defaultLogLevel)
+
+		// takes effect when the config is written
+		saveConfig(b, storage, map[string]interface{}{"LOG_LEVEL": "error"}, false, t)
+		if hclog.L().GetLevel() != hclog.Error {
+			t.Errorf("expected the log level to be error got %v", hclog.L().GetLevel())
+		}
+		if hclog.L().IsInfo() {
+			t.Errorf("expected info logging to be off")
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"LOG_LEVEL": "DEBUG"}, true, t)
+		if hclog.L().GetLevel() != hclog.Debug {
+			t.Errorf("expected the log level to be debug got %v", hclog.L().GetLevel())
+		}
+
+		// an invalid level is ignored
+		saveConfig(b, storage, map[string]interface{}{"LOG_LEVEL": "loud"}, true, t)
+		if hclog.L().GetLevel() != defaultLogLevel {
+			t.Errorf("expected the default log level got %v", hclog.L().GetLevel())
+		}
+
+		// and when the config is read by any other path
+		saveConfig(b, storage, map[string]interface{}{"LOG_LEVEL": "warn"}, true, t)
+		hclog.L().SetLevel(hclog.Trace)
+		encryptData(b, storage, map[string]interface{}{"test50-field": "value"}, t)
+		if hclog.L().GetLevel() != hclog.Warn {
+			t.Errorf("expected the log level to be warn got %v", hclog.L().GetLevel())
+		}
+
+		// removing it restores the default
+		deleteConfig(b, storage, map[string]interface{}{"LOG_LEVEL": ""}, t)
+		if hclog.L().GetLevel() != defaultLogLevel {
+			t.Errorf("expected the default log level got %v", hclog.L().GetLevel())
+		}
+	})
+
+	t.Run("test51 BigQuery cyphertext compatibility", func(t *testing.T) {
+		b, storage := testBackend(t)
+
+		// BQ uses the keysets as they are, so cover TINK and RAW output prefixes for AES-GCM and AES-SIV
+		keysets := map[string]interface{}{
+			"test51-gcm": NonDeterministicKeyset,
+			"test51-siv": DeterministicKeyset,
+		}
+		for fieldName, ks := range map[string]string{"test51-gcm-raw": NonDeterministicKeyset, "test51-siv-raw": DeterministicKeyset} {
+			kh, err := aeadutils.ValidateKeySetJson(ks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rawKh, _, err := aeadutils.ConvertOutputPrefix(kh, "RAW")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keysets[fieldName], err = aeadutils.ExtractInsecureKeySetFromKeyhandle(rawKh)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		importKey(b, storage, keysets, t)
+		config := map[string]interface{}{}
+		for fieldName := range keysets {
+			_, deterministic := aeadutils.IsKeyJsonDeterministic(keysets[fieldName])
+			if deterministic {
+				config[fieldName] = "siv/" + fieldName
+			} else {
+				config[fieldName] = "gcm/" + fieldName
+			}
+		}
+		saveConfig(b, storage, config, false, t)
+
+		// the ways BQ BYTES get out of BQ
+		bytesLiteral := func(cypherText []byte) string {
+			var sb strings.Builder
+			sb.WriteString(`b"`)
+			for _, c := range cypherText {
+				switch {
+				case c == '"' || c == '\\':
+					sb.WriteString(`\` + string(c))
+				case c == '\n':
+					sb.WriteString(`\n`)
+				case c >= 0x20 && c < 0x7f:
+					sb.WriteByte(c)
+				default:
+					sb.WriteString(fmt.Sprintf(`\x%02x`, c))
+				}
+			}
+			sb.WriteString(`"`)
+			return sb.String()
+		}
+		formats := map[string]func([]byte) string{
+			"base64":         b64.StdEncoding.EncodeToString,
+			"raw base64":     b64.RawStdEncoding.EncodeToString,
+			"url base64":     b64.URLEncoding.EncodeToString,
+			"raw url base64": b64.RawURLEncoding.EncodeToString,
+			"hex":            hex.EncodeToString,
+			"upper hex":      func(c []byte) string { return strings.ToUpper(hex.EncodeToString(c)) },
+			"bytes literal":  bytesLiteral,
+			"padded base64":  func(c []byte) string { return " " + b64.StdEncoding.EncodeToString(c) + "\n" },
+		}
+
+		plainText := map[string]interface{}{}
+		for fieldName := range keysets {
+			plainText[fieldName] = "value for " + fieldName
+		}
+		respEncrypt := encryptData(b, storage, plainText, t)
+
+		for formatName, format := range formats {
+			decryptRequest := map[string]interface{}{"ENCODING": "bq"}
+			for fieldName, cypherTextB64 := range respEncrypt.Data {
+				cypherText, err := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", cypherTextB64))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decryptRequest[fieldName] = format(cypherText)
+			}
+			respDecrypt := decryptData(b, storage, &logical.Response{Data: decryptRequest}, t)
+			if !reflect.DeepEqual(respDecrypt.Data, plainText) {
+				t.Errorf("%s: expected %v to be %v", formatName, respDecrypt.Data, plainText)
+			}
+		}
+
+		// octal and single character escapes in a bytes literal
+		decoded, err := decodeBQBytesLiteral(`b'\001\x02\n\'\\a'`)
+		if err != nil || !bytes.Equal(decoded, []byte{0x01, 0x02, '\n', '\'', '\\', 'a'}) {
+			t.Errorf("expected the bytes literal to decode got %v %v", decoded, err)
+		}
+		for _, literal := range []string{`b"\x0"`, `b"\q"`, `b"abc`, `"abc"`, `b"abc\"`} {
+			if _, err := decodeBQBytesLiteral(literal); err == nil {
+				t.Errorf("expected %s not to decode", literal)
+			}
+		}
+
+		// cyphertext that does not decrypt in any format is an error
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "decrypt",
+			Data:      map[string]interface{}{"test51-siv": "bm90IGN5cGhlcnRleHQ=", "ENCODING": "bq"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "test51-siv") {
+			t.Errorf("expected an error naming the field got %v", err)
+		}
+	})
+
+	t.Run("test52 max field bytes", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test52-field": NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test52-field":    "gcm/test52-field",
+			"MAX_FIELD_BYTES": "100",
+		}, false, t)
+
+		encrypt := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+
+		// at the limit is fine
+		resp, err := encrypt("encrypt", map[string]interface{}{"test52-field": strings.Repeat("a", 100)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["test52-field"] == strings.Repeat("a", 100) {
+			t.Errorf("expected test52-field to be encrypted")
+		}
+
+		// over the limit is rejected naming the field
+		_, err = encrypt("encrypt", map[string]interface{}{"test52-field": strings.Repeat("a", 101)})
+		if err == nil || !strings.Contains(err.Error(), "field test52-field is 101 bytes, more than the MAX_FIELD_BYTES limit of 100") {
+			t.Errorf("expected a MAX_FIELD_BYTES error got %v", err)
+		}
+		_, err = encrypt("encryptcol", map[string]interface{}{
+			"0": map[string]interface{}{"test52-field": "small"},
+			"1": map[string]interface{}{"test52-field": strings.Repeat("a", 101)},
+		})
+		if err == nil || !strings.Contains(err.Error(), "test52-field") {
+			t.Errorf("expected a MAX_FIELD_BYTES error for encryptcol got %v", err)
+		}
+
+		// fields without a keyset are returned as they are
+		resp, err = encrypt("encrypt", map[string]interface{}{"test52-nokey": strings.Repeat("a", 101)})
+		if err != nil || resp.Data["test52-nokey"] != strings.Repeat("a", 101) {
+			t.Errorf("expected the field without a keyset to be returned as is %v", err)
+		}
+
+		// without MAX_FIELD_BYTES the default applies
+		deleteConfig(b, storage, map[string]interface{}{"MAX_FIELD_BYTES": ""}, t)
+		if err := checkFieldSize("test52-field", make([]byte, defaultMaxFieldBytes)); err != nil {
+			t.Errorf("expected the default limit to allow %d bytes: %v", defaultMaxFieldBytes, err)
+		}
+		if err := checkFieldSize("test52-field", make([]byte, defaultMaxFieldBytes+1)); err == nil {
+			t.Errorf("expected the default limit to reject %d bytes", defaultMaxFieldBytes+1)
+		}
+	})
+
+	t.Run("test53 config schema migration", func(t *testing.T) {
+		ctx := context.Background()
+		b, storage := testBackend(t)
+
+		// config stored before versioning has no version entry so is version 0
+		entry, err := logical.StorageEntryJSON("config", map[string]interface{}{
+			"test53-field": "gcm/test53-field",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+		if version, err := readConfigVersion(ctx, storage); err != nil || version != 0 {
+			t.Fatalf("expected version 0 got %v %v", version, err)
+		}
+
+		// v0 to v1 leaves the config as it was
+		if err := b.initialize(ctx, &logical.InitializationRequest{Storage: storage}); err != nil {
+			t.Fatal(err)
+		}
+		if version, err := readConfigVersion(ctx, storage); err != nil || version != 1 {
+			t.Errorf("expected version 1 got %v %v", version, err)
+		}
+		consulConfig, err := b.readConsulConfig(ctx, storage)
+		if err != nil || !reflect.DeepEqual(consulConfig, map[string]interface{}{"test53-field": "gcm/test53-field"}) {
+			t.Errorf("expected the config to be unchanged got %v %v", consulConfig, err)
+		}
+
+		// a later migration runs once, from the stored version only
+		defer func(migrations []func(map[string]interface{}) error) { configMigrations = migrations }(configMigrations)
+		runs := 0
+		configMigrations = append(configMigrations, func(config map[string]interface{}) error {
+			runs++
+			config["test53-field"] = "siv/test53-field"
+			return nil
+		})
+		for i := 0; i < 2; i++ {
+			if err := b.initialize(ctx, &logical.InitializationRequest{Storage: storage}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if runs != 1 {
+			t.Errorf("expected the migration to run once, ran %d times", runs)
+		}
+		if version, err := readConfigVersion(ctx, storage); err != nil || version != 2 {
+			t.Errorf("expected version 2 got %v %v", version, err)
+		}
+		consulConfig, err = b.readConsulConfig(ctx, storage)
+		if err != nil || consulConfig["test53-field"] != "siv/test53-field" {
+			t.Errorf("expected the migrated config got %v %v", consulConfig, err)
+		}
+
+		// a failed migration leaves the stored version as it was
+		configMigrations = append(configMigrations, func(config map[string]interface{}) error {
+			return fmt.Errorf("test53 failure")
+		})
+		if err := b.initialize(ctx, &logical.InitializationRequest{Storage: storage}); err == nil || !strings.Contains(err.Error(), "from version 2 to 3") {
+			t.Errorf("expected a migration error got %v", err)
+		}
+		if version, err := readConfigVersion(ctx, storage); err != nil || version != 2 {
+			t.Errorf("expected version 2 got %v %v", version, err)
+		}
+
+		// config newer than the plugin is refused
+		configMigrations = configMigrations[:1]
+		if err := b.initialize(ctx, &logical.InitializationRequest{Storage: storage}); err == nil || !strings.Contains(err.Error(), "newer than version 1") {
+			t.Errorf("expected a newer version error got %v", err)
+		}
+	})
+
+	t.Run("test54 binary additional data", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test54-gcm": NonDeterministicKeyset,
+			"test54-siv": DeterministicKeyset,
+		}, t)
+
+		// a raw tenant uuid, not valid utf-8
+		aad := []byte{0x9f, 0x3c, 0x00, 0xe1, 0x5a, 0xff, 0x41, 0x0b, 0x8c, 0x7d, 0x02, 0xc4, 0xfe, 0x10, 0x6e, 0x93}
+		saveConfig(b, storage, map[string]interface{}{
+			"test54-gcm":                 "gcm/test54-gcm",
+			"test54-siv":                 "siv/test54-siv",
+			"ADDITIONAL_DATA_test54-gcm": b64.StdEncoding.EncodeToString(aad),
+			"ADDITIONAL_DATA_test54-siv": b64.StdEncoding.EncodeToString(aad),
+			"AAD_IS_B64_test54-gcm":      "true",
+			"AAD_IS_B64_test54-siv":      "true",
+		}, false, t)
+
+		data := map[string]interface{}{
+			"test54-gcm": "some plaintext",
+			"test54-siv": "some plaintext",
+		}
+		encryptResp := encryptData(b, storage, data, t)
+		cypherTexts := map[string]interface{}{}
+		for k, v := range encryptResp.Data {
+			cypherTexts[k] = v
+		}
+		decryptResp := decryptData(b, storage, encryptResp, t)
+		if !reflect.DeepEqual(decryptResp.Data, data) {
+			t.Errorf("expected %v got %v", data, decryptResp.Data)
+		}
+
+		// the cyphertext is bound to the decoded bytes, not the base64 string
+		for fieldName, keysetJson := range map[string]string{"test54-gcm": NonDeterministicKeyset, "test54-siv": DeterministicKeyset} {
+			cypherText, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", cypherTexts[fieldName]))
+			plainText, _, err := aeadutils.DecryptWithKeyID(keysetJson, cypherText, aad)
+			if err != nil || string(plainText) != "some plaintext" {
+				t.Errorf("expected %s to decrypt with the binary aad %v", fieldName, err)
+			}
+		}
+
+		// column based, bulk round trip
+		bulkData := map[string]interface{}{
+			"0": map[string]interface{}{"test54-gcm": "row0", "test54-siv": "row0"},
+			"1": map[string]interface{}{"test54-gcm": "row1", "test54-siv": "row1"},
+		}
+		decryptColResp := decryptDataCol(b, storage, encryptDataCol(b, storage, bulkData, t), t)
+		if !reflect.DeepEqual(decryptColResp.Data, bulkData) {
+			t.Errorf("expected %v got %v", bulkData, decryptColResp.Data)
+		}
+
+		// without AAD_IS_B64_ the base64 string itself is the aad, so the cyphertext no longer decrypts
+		deleteConfig(b, storage, map[string]interface{}{"AAD_IS_B64_test54-gcm": ""}, t)
+		decryptResp = decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test54-gcm": cypherTexts["test54-gcm"]}}, t)
+		if decryptResp.Data["test54-gcm"] == "some plaintext" {
+			t.Errorf("expected the cyphertext not to decrypt with the base64 string as aad")
+		}
+
+		// invalid base64 is an error rather than falling back to the string
+		saveConfig(b, storage, map[string]interface{}{
+			"AAD_IS_B64_test54-gcm":      "true",
+			"ADDITIONAL_DATA_test54-gcm": "not base64!",
+		}, true, t)
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test54-gcm": "some plaintext"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "ADDITIONAL_DATA_test54-gcm is not valid base64") {
+			t.Errorf("expected an invalid base64 error got %v", err)
+		}
+	})
+
+	t.Run("test55 validateKey", func(t *testing.T) {
+		b, storage := testBackend(t)
+		validateKey := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "validateKey",
+				Data:      data,
+			})
+		}
+
+		resp, err := validateKey(map[string]interface{}{
+			"test55-nondet": NonDeterministicKeyset,
+			"test55-det":    DeterministicKeyset,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"test55-nondet": map[string]interface{}{"KEY_NAME": "gcm/test55-nondet", "TYPE": "NON DETERMINISTIC", "ALGORITHM": "AesGcm"},
+			"test55-det":    map[string]interface{}{"KEY_NAME": "siv/test55-det", "TYPE": "DETERMINISTIC", "ALGORITHM": "AesSiv"},
+		}
+		if !reflect.DeepEqual(resp.Data, expected) {
+			t.Errorf("expected %v got %v", expected, resp.Data)
+		}
+
+		// nothing is stored
+		entry, err := storage.Get(context.Background(), "config")
+		if err != nil || entry != nil {
+			t.Errorf("expected nothing to be stored %v %v", entry, err)
+		}
+
+		macKh, err := keyset.NewHandle(mac.HMACSHA256Tag256KeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		macKeyset, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(macKh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		detKey := DeterministicSingleKey[strings.Index(DeterministicSingleKey, `"key":[`)+len(`"key":[`) : len(DeterministicSingleKey)-2]
+
+		invalid := map[string]struct {
+			keyset   string
+			expected string
+		}{
+			"not a keyset":      {`{"key":"value"}`, "Not a key"},
+			"no enabled key":    {strings.ReplaceAll(DeterministicSingleKey, `"ENABLED"`, `"DISABLED"`), "at least one ENABLED key"},
+			"primary not a key": {strings.Replace(NonDeterministicKeyset, `"primaryKeyId":3192631270`, `"primaryKeyId":1234`, 1), "valid primary key"},
+			"primary disabled":  {strings.Replace(NonDeterministicKeyset, `"status":"ENABLED","keyId":3192631270`, `"status":"DISABLED","keyId":3192631270`, 1), "valid primary key"},
+			"unsupported type":  {macKeyset, "key type Hmac is not supported"},
+			"mixed determinism": {NonDeterministicKeyset[:len(NonDeterministicKeyset)-2] + "," + detKey + "]}", "mixes deterministic and non deterministic"},
+		}
+		for name, tc := range invalid {
+			_, err := validateKey(map[string]interface{}{"test55-field": tc.keyset})
+			if err == nil || !strings.Contains(err.Error(), "test55-field is not a valid keyset") || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("%s: expected an error containing %q got %v", name, tc.expected, err)
+			}
+			// importKey rejects the same keysets
+			_, err = b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "importKey",
+				Data:      map[string]interface{}{"test55-field": tc.keyset},
+			})
+			if err == nil {
+				t.Errorf("%s: expected importKey to fail", name)
+			}
+		}
+	})
+
+	t.Run("test56 family determinism", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"TEST56_FAMILY": DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"TEST56_FAMILY":               "siv/TEST56_FAMILY",
+			"DETERMINISTIC_test56-nondet": "false",
+		}, false, t)
+
+		mapFamily := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "mapFamily",
+				Data:      data,
+			})
+		}
+
+		// mapping records the kind of the family keyset against each field
+		_, err := mapFamily(map[string]interface{}{"FAMILY": "TEST56_FAMILY", "FIELDS": "test56-a,test56-b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := AEAD_CONFIG.Get("DETERMINISTIC_test56-a"); v != "true" {
+			t.Errorf("expected DETERMINISTIC_test56-a to be recorded as true got %v", v)
+		}
+
+		// a field that expects the other kind is not mapped
+		_, err = mapFamily(map[string]interface{}{"FAMILY": "TEST56_FAMILY", "FIELDS": "test56-nondet"})
+		if err == nil || !strings.Contains(err.Error(), "field test56-nondet expects a non deterministic keyset but siv/TEST56_FAMILY is deterministic") {
+			t.Errorf("expected a determinism error got %v", err)
+		}
+		if _, ok := AEAD_CONFIG.Get("test56-nondet"); ok {
+			t.Errorf("expected test56-nondet not to be mapped")
+		}
+
+		data := map[string]interface{}{"test56-a": "my address", "test56-b": "my postcode"}
+		encryptResp := encryptData(b, storage, data, t)
+		if encryptResp.Data["test56-a"] == "my address" {
+			t.Errorf("expected test56-a to be encrypted")
+		}
+
+		// the family keyset is replaced with a non deterministic one
+		saveConfig(b, storage, map[string]interface{}{"TEST56_FAMILY": "gcm/TEST56_FAMILY"}, true, t)
+		importKey(b, storage, map[string]interface{}{"TEST56_FAMILY": NonDeterministicKeyset}, t)
+
+		expectedErr := "field test56-a expects a deterministic keyset but gcm/TEST56_FAMILY is non deterministic"
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test56-a": "my address"},
+		})
+		if err == nil || !strings.Contains(err.Error(), expectedErr) {
+			t.Errorf("expected a determinism error got %v", err)
+		}
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encryptcol",
+			Data: map[string]interface{}{
+				"0": map[string]interface{}{"test56-a": "my address"},
+			},
+		})
+		if err == nil || !strings.Contains(err.Error(), expectedErr) {
+			t.Errorf("expected a determinism error for encryptcol got %v", err)
+		}
+
+		// and validateConfig reports it
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "validateConfig",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mismatched := resp.Data["mismatched"].(map[string]interface{})
+		if mismatched["DETERMINISTIC_test56-a"] != expectedErr || resp.Data["valid"] != false {
+			t.Errorf("expected DETERMINISTIC_test56-a to be mismatched got %v", resp.Data)
+		}
+	})
+
+	t.Run("test57 tracing spans", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		previous := otel.GetTracerProvider()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		defer otel.SetTracerProvider(previous)
+
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test57-field": NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test57-field": "gcm/test57-field",
+		}, false, t)
+
+		encryptResp := encryptData(b, storage, map[string]interface{}{"test57-field": "test57 secret plaintext"}, t)
+		cypherText := fmt.Sprintf("%v", encryptResp.Data["test57-field"])
+		decryptData(b, storage, encryptResp, t)
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "rotate",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+		for _, name := range []string{"importKey", "encrypt", "decrypt", "rotate"} {
+			if _, ok := spans[name]; !ok {
+				t.Errorf("expected a %s span got %v", name, spans)
+			}
+		}
+
+		// the encrypt span names the field, its keyset and the primary key id
+		encryptSpan := spans["encrypt"]
+		if !reflect.DeepEqual(encryptSpan.Attributes(), []attribute.KeyValue{
+			aeadutils.SpanOperation.String("encrypt"),
+			aeadutils.SpanFields.StringSlice([]string{"test57-field"}),
+			aeadutils.SpanBulk.Bool(false),
+		}) {
+			t.Errorf("unexpected encrypt span attributes %v", encryptSpan.Attributes())
+		}
+		if len(encryptSpan.Events()) != 1 || !reflect.DeepEqual(encryptSpan.Events()[0].Attributes, []attribute.KeyValue{
+			aeadutils.SpanField.String("test57-field"),
+			aeadutils.SpanKeyName.String("gcm/test57-field"),
+			aeadutils.SpanDeterministic.Bool(false),
+			aeadutils.SpanKeyID.Int(3192631270),
+		}) {
+			t.Errorf("unexpected encrypt span events %v", encryptSpan.Events())
+		}
+
+		// rotate records the new primary key id
+		rotateEvents := spans["rotate"].Events()
+		if len(rotateEvents) != 1 || rotateEvents[0].Name != "rotated" {
+			t.Fatalf("expected a rotated event got %v", rotateEvents)
+		}
+		for _, kv := range rotateEvents[0].Attributes {
+			if kv.Key == aeadutils.SpanKeyID && kv.Value.AsInt64() == 3192631270 {
+				t.Errorf("expected the new primary key id")
+			}
+		}
+
+		// no plaintext, cyphertext or key material in any span
+		var keySetStruct aeadutils.KeySetStruct
+		json.Unmarshal([]byte(NonDeterministicKeyset), &keySetStruct)
+		secrets := []string{"test57 secret plaintext", cypherText}
+		for _, key := range keySetStruct.Key {
+			secrets = append(secrets, key.KeyData.Value)
+		}
+		for _, span := range recorder.Ended() {
+			attrs := span.Attributes()
+			for _, event := range span.Events() {
+				attrs = append(attrs, event.Attributes...)
+			}
+			for _, kv := range attrs {
+				for _, secret := range secrets {
+					if strings.Contains(kv.Value.Emit(), secret) {
+						t.Errorf("span %s attribute %s contains %s", span.Name(), kv.Key, secret)
+					}
+				}
+			}
+			if strings.Contains(span.Status().Description, "test57") {
+				t.Errorf("span %s status contains request data", span.Name())
+			}
+		}
+	})
+
+	t.Run("test58 listKeys", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test58-nondet": NonDeterministicKeyset,
+			"test58-det":    DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test58-nondet": "gcm/test58-nondet",
+			"test58-det":    "siv/test58-det",
+			"test58-plain":  "just a string",
+			"MASK_STRING":   "***",
+		}, false, t)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "listKeys",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"keys": []string{"gcm/test58-nondet", "siv/test58-det"},
+			"types": map[string]interface{}{
+				"gcm/test58-nondet": "NON DETERMINISTIC",
+				"siv/test58-det":    "DETERMINISTIC",
+			},
+		}
+		if !reflect.DeepEqual(resp.Data, expected) {
+			t.Errorf("expected %v got %v", expected, resp.Data)
+		}
+	})
+
+	t.Run("test59 decryptWithKey", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test59-gcm": NonDeterministicKeyset,
+			"test59-siv": DeterministicKeyset,
+			"test59-zip": NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test59-gcm":          "gcm/test59-gcm",
+			"test59-siv":          "siv/test59-siv",
+			"test59-zip":          "gcm/test59-zip",
+			"COMPRESS_test59-zip": "true",
+		}, false, t)
+
+		encryptResp := encryptData(b, storage, map[string]interface{}{
+			"test59-gcm": "archived value",
+			"test59-siv": "archived det value",
+			"test59-zip": "archived compressed value",
+		}, t)
+		gcmCipherText := fmt.Sprintf("%v", encryptResp.Data["test59-gcm"])
+		sivCipherText := fmt.Sprintf("%v", encryptResp.Data["test59-siv"])
+		zipCipherText := fmt.Sprintf("%v", encryptResp.Data["test59-zip"])
+
+		decryptWithKey := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "decryptWithKey",
+				Data:      data,
+			})
+		}
+
+		// refused unless ALLOW_RAW_KEYS is set
+		_, err := decryptWithKey(map[string]interface{}{
+			"KEYSET":          NonDeterministicKeyset,
+			"CIPHERTEXT":      gcmCipherText,
+			"ADDITIONAL_DATA": "test59-gcm",
+		})
+		if err == nil {
+			t.Fatal("expected decryptWithKey to be refused without ALLOW_RAW_KEYS")
+		}
+
+		// supersede the keysets, the old ones are only held by the caller now
+		deleteConfig(b, storage, map[string]interface{}{"gcm/test59-gcm": "", "siv/test59-siv": ""}, t)
+		saveConfig(b, storage, map[string]interface{}{"ALLOW_RAW_KEYS": "true"}, false, t)
+		configBefore := readConfig(b, storage, t)
+
+		resp, err := decryptWithKey(map[string]interface{}{
+			"KEYSET":          NonDeterministicKeyset,
+			"CIPHERTEXT":      gcmCipherText,
+			"ADDITIONAL_DATA": "test59-gcm",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["plaintext"] != "archived value" || resp.Data["key_id"] != 3192631270 {
+			t.Errorf("unexpected response %v", resp.Data)
+		}
+
+		// the keyset as an object
+		var keySetObj map[string]interface{}
+		if err := json.Unmarshal([]byte(DeterministicKeyset), &keySetObj); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = decryptWithKey(map[string]interface{}{
+			"KEYSET":          keySetObj,
+			"CIPHERTEXT":      sivCipherText,
+			"ADDITIONAL_DATA": "test59-siv",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["plaintext"] != "archived det value" {
+			t.Errorf("expected archived det value got %v", resp.Data["plaintext"])
+		}
+
+		// the cyphertext of a compressed field is decompressed with COMPRESS
+		for compress, expected := range map[string]bool{"true": true, "false": false} {
+			resp, err = decryptWithKey(map[string]interface{}{
+				"KEYSET":          NonDeterministicKeyset,
+				"CIPHERTEXT":      zipCipherText,
+				"ADDITIONAL_DATA": "test59-zip",
+				"COMPRESS":        compress,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (resp.Data["plaintext"] == "archived compressed value") != expected {
+				t.Errorf("COMPRESS=%s: unexpected plaintext %q", compress, resp.Data["plaintext"])
+			}
+		}
+
+		// the wrong additional data or keyset does not decrypt
+		_, err = decryptWithKey(map[string]interface{}{
+			"KEYSET":          NonDeterministicKeyset,
+			"CIPHERTEXT":      gcmCipherText,
+			"ADDITIONAL_DATA": "test59-other",
+		})
+		if err == nil {
+			t.Error("expected the wrong additional data to fail")
+		}
+		_, err = decryptWithKey(map[string]interface{}{
+			"KEYSET":          "not a keyset",
+			"CIPHERTEXT":      gcmCipherText,
+			"ADDITIONAL_DATA": "test59-gcm",
+		})
+		if err == nil || err.Error() != "INVALID_KEYSET: KEYSET is not a valid keyset" {
+			t.Errorf("expected a generic invalid keyset error got %v", err)
+		}
+
+		// nothing was written
+		configAfter := readConfig(b, storage, t)
+		if !reflect.DeepEqual(configBefore.Data, configAfter.Data) {
+			t.Errorf("expected the config to be unchanged, before %v after %v", configBefore.Data, configAfter.Data)
+		}
+	})
+
+	t.Run("test60 setPrimaryByMaterial", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test60-gcm": NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test60-gcm":    "gcm/test60-gcm",
+			"test60-family": "gcm/test60-gcm",
+		}, false, t)
+
+		setPrimary := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "setPrimaryByMaterial",
+				Data:      data,
+			})
+		}
+
+		// key 2233686170 of NonDeterministicKeyset
+		resp, err := setPrimary(map[string]interface{}{"test60-family": "GiCW0m5ElDr8RznAl4ef3bXqgHgu9PL/js7K6NAZIjkDJw=="})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(fmt.Sprintf("%v", resp.Data["test60-family"]), "primaryKeyId\":2233686170") {
+			t.Errorf("primary id not changed %v", resp.Data)
+		}
+		key, _ := AEAD_CONFIG.Get("gcm/test60-gcm")
+		if !strings.Contains(fmt.Sprintf("%v", key), "primaryKeyId\":2233686170") {
+			t.Errorf("primary id not saved %v", key)
+		}
+
+		// no match fails and saves nothing
+		_, err = setPrimary(map[string]interface{}{"test60-gcm": "GiBQUDTlxVawIr3T1/dRvuF5CzBhTZtnnpuVsNZayxv1LQ=="})
+		if err == nil {
+			t.Error("expected an error as no key has the material")
+		}
+		key, _ = AEAD_CONFIG.Get("gcm/test60-gcm")
+		if !strings.Contains(fmt.Sprintf("%v", key), "primaryKeyId\":2233686170") {
+			t.Errorf("primary id changed by a failed request %v", key)
+		}
+
+		// new encryptions use the promoted key
+		encryptResp := encryptData(b, storage, map[string]interface{}{"test60-gcm": "hello"}, t)
+		ct, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", encryptResp.Data["test60-gcm"]))
+		_, keyID, err := aeadutils.DecryptWithKeyID(NonDeterministicKeyset, ct, []byte("test60-gcm"))
+		if err != nil || keyID != 2233686170 {
+			t.Errorf("expected key 2233686170 to encrypt got %d %v", keyID, err)
+		}
+	})
+
+	t.Run("test61 error codes", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test61-gcm": NonDeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test61-gcm":           "gcm/test61-gcm",
+			"test61-existing":      "foo",
+			"DETERMINISTIC_test61": "true",
+			"test61":               "gcm/test61-gcm",
+		}, false, t)
+
+		tests := []struct {
+			name string
+			path string
+			data map[string]interface{}
+			code string
+		}{
+			{"importKey invalid keyset", "importKey", map[string]interface{}{"test61-bad": "not a keyset"}, ERROR_INVALID_KEYSET},
+			{"encrypt determinism mismatch", "encrypt", map[string]interface{}{"test61": "hello"}, ERROR_INVALID_KEYSET},
+			{"encrypt bad option", "encrypt", map[string]interface{}{"test61-gcm": "hello", "SKIP_ENCRYPTED": "maybe"}, ERROR_INVALID_REQUEST},
+			{"decrypt bad encoding", "decrypt", map[string]interface{}{"test61-gcm": "AAAA", "ENCODING": "base32"}, ERROR_INVALID_REQUEST},
+			{"decrypt failed", "decrypt", map[string]interface{}{"test61-gcm": "AAAA", "ENCODING": "auto"}, ERROR_DECRYPT_FAILED},
+			{"mapFamily field exists", "mapFamily", map[string]interface{}{"FAMILY": "test61-gcm", "FIELDS": "test61-existing"}, ERROR_FIELD_EXISTS},
+			{"mapFamily key not found", "mapFamily", map[string]interface{}{"FAMILY": "test61-nofamily", "FIELDS": "test61-new"}, ERROR_KEY_NOT_FOUND},
+		}
+		for _, tt := range tests {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      tt.path,
+				Data:      tt.data,
+			})
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+				continue
+			}
+			if resp == nil || resp.Data["error_code"] != tt.code {
+				t.Errorf("%s: expected error_code %s got %v", tt.name, tt.code, resp)
+				continue
+			}
+			if !strings.HasPrefix(err.Error(), tt.code+": ") || resp.Data["error"] != err.Error() {
+				t.Errorf("%s: expected the error to start with the code, got %v", tt.name, err)
+			}
+		}
+
+		// the submitted keyset is never quoted back, whether or not it parses
+		for _, keySet := range []string{`{"primaryKeyId":1,"key":"secret material"}`, `secret material`} {
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "importKey",
+				Data:      map[string]interface{}{"test61-bad": keySet},
+			})
+			if err == nil || err.Error() != "INVALID_KEYSET: test61-bad is not a valid keyset" {
+				t.Errorf("expected the keyset not to be quoted got %v", err)
+			}
+		}
+	})
+
+	t.Run("test62 importKey from secret manager", func(t *testing.T) {
+		b, storage := testBackend(t)
+		defer func() { newSecretFetcher = aeadutils.NewSecretFetcher }()
+		secrets := fakeSecretFetcher{
+			"projects/p/secrets/test62/versions/1":  []byte(NonDeterministicKeyset),
+			"projects/p/secrets/notakey/versions/1": []byte("not a keyset"),
+		}
+		newSecretFetcher = func(ctx context.Context) (aeadutils.SecretFetcher, error) {
+			return secrets, nil
+		}
+
+		resp := importKey(b, storage, map[string]interface{}{
+			"test62-sm":     "sm://projects/p/secrets/test62/versions/1",
+			"test62-inline": DeterministicKeyset,
+		}, t)
+		if resp.Data["test62-sm"] != "sm://projects/p/secrets/test62/versions/1" {
+			t.Errorf("expected the reference to be returned, got %v", resp.Data["test62-sm"])
+		}
+		key, ok := AEAD_CONFIG.Get("gcm/test62-sm")
+		if !ok || key != NonDeterministicKeyset {
+			t.Errorf("expected the keyset from secret manager to be imported, got %v", key)
+		}
+		if _, ok := AEAD_CONFIG.Get("siv/test62-inline"); !ok {
+			t.Error("expected the inline keyset to be imported")
+		}
+
+		for ref, code := range map[string]string{
+			"sm://projects/p/secrets/missing/versions/1": ERROR_KEY_NOT_FOUND,
+			"sm://projects/p/secrets/notakey/versions/1": ERROR_INVALID_KEYSET,
+			"sm://projects/p/secrets/noversion":          ERROR_INVALID_REQUEST,
+		} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "importKey",
+				Data:      map[string]interface{}{"test62-bad": ref},
+			})
+			if err == nil || resp.Data["error_code"] != code {
+				t.Errorf("%s: expected %s got %v", ref, code, err)
+			}
+			if err != nil && strings.Contains(err.Error(), "not a keyset") {
+				t.Errorf("%s: the error quotes the secret: %v", ref, err)
+			}
+		}
+		if _, ok := AEAD_CONFIG.Get("test62-bad"); ok {
+			t.Error("expected nothing to be saved for a bad reference")
+		}
+	})
+
+	t.Run("test63 rewrapConfig", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test63-gcm":    NonDeterministicKeyset,
+			"test63-siv":    DeterministicKeyset,
+			"test63-single": DeterministicSingleKey,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test63-gcm":  "gcm/test63-gcm",
+			"MASK_STRING": "***",
+		}, false, t)
+		configBefore := readConfig(b, storage, t)
+
+		rewrap := func() (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "rewrapConfig",
+			})
+		}
+		resp, err := rewrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"gcm/test63-gcm", "siv/test63-single", "siv/test63-siv"}
+		if !reflect.DeepEqual(resp.Data["rewrapped"], expected) || resp.Data["wrapper"] != "plaintext" {
+			t.Errorf("expected %v got %v", expected, resp.Data)
+		}
+		configAfter := readConfig(b, storage, t)
+		if !reflect.DeepEqual(configBefore.Data, configAfter.Data) {
+			t.Errorf("expected the plaintext rewrap to leave the config unchanged, before %v after %v", configBefore.Data, configAfter.Data)
+		}
+
+		// a future wrapper, the keysets are rewrapped and the options left alone
+		config := map[string]interface{}{
+			"gcm/test63-gcm": NonDeterministicKeyset,
+			"test63-gcm":     "gcm/test63-gcm",
+		}
+		if _, err := rewrapKeysets(config, plaintextKeysetWrapper{}, b64KeysetWrapper{}); err != nil {
+			t.Fatal(err)
+		}
+		if config["gcm/test63-gcm"] != b64.StdEncoding.EncodeToString([]byte(NonDeterministicKeyset)) || config["test63-gcm"] != "gcm/test63-gcm" {
+			t.Errorf("unexpected rewrapped config %v", config)
+		}
+		if _, err := rewrapKeysets(config, b64KeysetWrapper{}, plaintextKeysetWrapper{}); err != nil {
+			t.Fatal(err)
+		}
+		if config["gcm/test63-gcm"] != NonDeterministicKeyset {
+			t.Errorf("expected the keyset back in plaintext got %v", config["gcm/test63-gcm"])
+		}
+
+		// an invalid keyset fails and nothing is saved
+		saveConfig(b, storage, map[string]interface{}{"gcm/test63-bad": "not a keyset"}, false, t)
+		configBefore = readConfig(b, storage, t)
+		_, err = rewrap()
+		if err == nil || strings.Contains(err.Error(), "not a keyset") {
+			t.Errorf("expected an error naming only gcm/test63-bad got %v", err)
+		}
+		configAfter = readConfig(b, storage, t)
+		if !reflect.DeepEqual(configBefore.Data, configAfter.Data) {
+			t.Error("expected a failed rewrap to leave the config unchanged")
+		}
+	})
+
+	t.Run("test64 default key templates", func(t *testing.T) {
+		b, storage := testBackend(t)
+
+		// the defaults
+		encryptDataNonDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test64-default": "hello"}, false, t)
+		key, _ := AEAD_CONFIG.Get("gcm/test64-default")
+		if !strings.Contains(fmt.Sprintf("%v", key), "type.googleapis.com/google.crypto.tink.AesGcmKey") {
+			t.Errorf("expected an AesGcm keyset got %v", key)
+		}
+
+		saveConfig(b, storage, map[string]interface{}{
+			"DEFAULT_AEAD_TEMPLATE":  "xchacha20_poly1305",
+			"DEFAULT_DAEAD_TEMPLATE": "AES256_SIV",
+		}, false, t)
+		encryptDataNonDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test64-gcm": "hello"}, false, t)
+		key, _ = AEAD_CONFIG.Get("gcm/test64-gcm")
+		if !strings.Contains(fmt.Sprintf("%v", key), "type.googleapis.com/google.crypto.tink.XChaCha20Poly1305Key") {
+			t.Errorf("expected an XChaCha20Poly1305 keyset got %v", key)
+		}
+		encryptDataDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test64-siv": "hello"}, false, t)
+		key, _ = AEAD_CONFIG.Get("siv/test64-siv")
+		if !strings.Contains(fmt.Sprintf("%v", key), "type.googleapis.com/google.crypto.tink.AesSivKey") {
+			t.Errorf("expected an AesSiv keyset got %v", key)
+		}
+
+		// only the templates of the right kind can be named
+		saveConfig(b, storage, map[string]interface{}{"DEFAULT_AEAD_TEMPLATE": "AES256_SIV"}, true, t)
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "createAEADkey",
+			Data:      map[string]interface{}{"test64-bad": "hello"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "DEFAULT_AEAD_TEMPLATE AES256_SIV is not supported") {
+			t.Errorf("expected the template to be refused got %v", err)
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test64-bad"); ok {
+			t.Error("expected no keyset to be created")
+		}
+	})
+
+	t.Run("test65 keyinfo", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test65-gcm":    NonDeterministicKeyset,
+			"test65-family": DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test65-gcm":    "gcm/test65-gcm",
+			"test65-family": "siv/test65-family",
+			"test65-member": "test65-family",
+		}, false, t)
+
+		keyInfo := func(data map[string]interface{}) map[string]interface{} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "keyinfo",
+				Data:      data,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp.Data
+		}
+		expected := map[string]interface{}{
+			"test65-gcm": map[string]interface{}{
+				"FOUND":     true,
+				"KEY_NAME":  "gcm/test65-gcm",
+				"TYPE":      "NON DETERMINISTIC",
+				"ALGORITHM": "AesGcm",
+				"KEY_COUNT": 4,
+			},
+			"test65-member": map[string]interface{}{
+				"FOUND":     true,
+				"KEY_NAME":  "siv/test65-family",
+				"TYPE":      "DETERMINISTIC",
+				"ALGORITHM": "AesSiv",
+				"KEY_COUNT": 6,
+			},
+			"test65-none": map[string]interface{}{
+				"FOUND": false,
+			},
+		}
+
+		got := keyInfo(map[string]interface{}{"FIELDS": []interface{}{"test65-gcm", "test65-member", "test65-none"}})
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v got %v", expected, got)
+		}
+		got = keyInfo(map[string]interface{}{"FIELDS": "test65-gcm, test65-member,test65-none"})
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v got %v", expected, got)
+		}
+
+		// the body of an encryptcol request
+		got = keyInfo(map[string]interface{}{
+			"test65-gcm":    map[string]interface{}{"0": "a", "1": "b"},
+			"test65-member": map[string]interface{}{"0": "c", "1": "d"},
+			"test65-none":   map[string]interface{}{"0": "e", "1": "f"},
+		})
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v got %v", expected, got)
+		}
+	})
+
+	t.Run("test66 payload shape", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{
+			"test66-a": NonDeterministicKeyset,
+			"test66-b": DeterministicKeyset,
+		}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test66-a": "gcm/test66-a",
+			"test66-b": "siv/test66-b",
+		}, false, t)
+
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		columns := func() map[string]interface{} {
+			return map[string]interface{}{
+				"test66-a": map[string]interface{}{"0": "a0", "1": "a1"},
+				"test66-b": map[string]interface{}{"0": "b0", "1": "b1"},
+			}
+		}
+
+		// encrypt takes the maps of fields with a keyset as json values, see test86
+		for _, path := range []string{"encryptcol", "decrypt", "decryptcol"} {
+			resp, err := request(path, columns())
+			if err == nil || !strings.Contains(err.Error(), "looks like columns") || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+				t.Errorf("%s: expected a columns error got %v", path, err)
+			}
+		}
+
+		_, err := request("encryptcol", map[string]interface{}{"test66-a": "a0", "test66-b": "b0"})
+		if err == nil || !strings.Contains(err.Error(), "send a single row to encrypt") {
+			t.Errorf("expected a single row error got %v", err)
+		}
+
+		_, err = request("encrypt", map[string]interface{}{"test66-a": "a0", "0": map[string]interface{}{"test66-b": "b0"}})
+		if err == nil || !strings.Contains(err.Error(), "not a mix of the two") {
+			t.Errorf("expected a mixed error got %v", err)
+		}
+
+		// rows are still encrypted by both paths
+		for _, path := range []string{"encrypt", "encryptcol"} {
+			resp, err := request(path, map[string]interface{}{
+				"0": map[string]interface{}{"test66-a": "a0", "test66-b": "b0"},
+				"1": map[string]interface{}{"test66-a": "a1", "test66-b": "b1"},
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			row := resp.Data["1"].(map[string]interface{})
+			if row["test66-a"] == "a1" || row["test66-b"] == "b1" {
+				t.Errorf("%s: expected the rows to be encrypted got %v", path, resp.Data)
+			}
+		}
+	})
+
+	t.Run("test67 index token", func(t *testing.T) {
+		b, storage := testBackend(t)
+		encryptDataNonDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test67": "hello world"}, false, t)
+		saveConfig(b, storage, map[string]interface{}{"test67": "gcm/test67"}, false, t)
+
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+
+		// no index key yet
+		resp, err := request("indexToken", map[string]interface{}{"test67": "hello world"})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected a KEY_NOT_FOUND error got %v", err)
+		}
+
+		resp, err = request("createIndexKey", map[string]interface{}{"test67": ""})
+		if err != nil || resp.Data["test67"] != "idx/test67" {
+			t.Fatalf("expected the index key to be created got %v %v", resp, err)
+		}
+		resp, err = request("createIndexKey", map[string]interface{}{"test67": ""})
+		if err == nil || resp.Data["error_code"] != ERROR_FIELD_EXISTS {
+			t.Errorf("expected a FIELD_EXISTS error got %v", err)
+		}
+
+		// equal plaintexts give equal tokens although the cyphertexts differ
+		resp1, err := request("indexToken", map[string]interface{}{"test67": "hello world"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp2, _ := request("indexToken", map[string]interface{}{"test67": "hello world"})
+		resp3, _ := request("indexToken", map[string]interface{}{"test67": "hello world2"})
+		if resp1.Data["test67"] != resp2.Data["test67"] || resp1.Data["test67"] == resp3.Data["test67"] {
+			t.Errorf("expected equal tokens for equal plaintexts only %v %v %v", resp1.Data, resp2.Data, resp3.Data)
+		}
+		enc1 := encryptData(b, storage, map[string]interface{}{"test67": "hello world"}, t)
+		enc2 := encryptData(b, storage, map[string]interface{}{"test67": "hello world"}, t)
+		if enc1.Data["test67"] == enc2.Data["test67"] {
+			t.Error("expected the cyphertexts to differ")
+		}
+
+		// the index key is masked and is not taken for a keyset
+		config := readConfig(b, storage, t)
+		if config.Data["idx/test67"] != "***" {
+			t.Errorf("expected the index key to be masked got %v", config.Data["idx/test67"])
+		}
+		resp, err = request("rotateAll", map[string]interface{}{})
+		if err != nil || len(resp.Warnings) != 0 {
+			t.Errorf("expected rotateAll to succeed got %v %v", resp, err)
+		}
+		resp4, _ := request("indexToken", map[string]interface{}{"test67": "hello world"})
+		if resp4.Data["test67"] != resp1.Data["test67"] {
+			t.Error("expected rotating the keyset not to change the token")
+		}
+	})
+
+	t.Run("test68 settings", func(t *testing.T) {
+		b, storage := testBackend(t)
+		saveConfig(b, storage, map[string]interface{}{
+			"BQ_PROJECT": "config-project",
+			"BQ_KMSKEY":  "config-kmskey",
+		}, true, t)
+
+		request := func(operation logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: operation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+
+		_, err := request(logical.UpdateOperation, "settings", map[string]interface{}{"BQ_PROJECT": "settings-project"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := request(logical.ReadOperation, "settings", nil)
+		if err != nil || resp.Data["BQ_PROJECT"] != "settings-project" || len(resp.Data) != 1 {
+			t.Errorf("expected the setting to be read back got %v %v", resp, err)
+		}
+		if readConfig(b, storage, t).Data["BQ_PROJECT"] != "config-project" {
+			t.Error("expected the config to be unchanged by the settings")
+		}
+
+		// the settings win over config, config is the fallback
+		options := bqOptions()
+		if project, _ := options.Get("BQ_PROJECT"); project != "settings-project" {
+			t.Errorf("expected the BQ_PROJECT setting got %v", project)
+		}
+		if kmsKey, _ := options.Get("BQ_KMSKEY"); kmsKey != "config-kmskey" {
+			t.Errorf("expected the BQ_KMSKEY config entry got %v", kmsKey)
+		}
+
+		resp, err = request(logical.UpdateOperation, "settings", map[string]interface{}{"test68": NonDeterministicKeyset})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected a keyset to be refused got %v", err)
+		}
+
+		_, err = request(logical.UpdateOperation, "settingsDelete", map[string]interface{}{"BQ_PROJECT": ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _ = request(logical.ReadOperation, "settings", nil)
+		if len(resp.Data) != 0 {
+			t.Errorf("expected no settings got %v", resp.Data)
+		}
+		if project, _ := bqOptions().Get("BQ_PROJECT"); project != "config-project" {
+			t.Errorf("expected the BQ_PROJECT config entry without the setting got %v", project)
+		}
+	})
+
+	t.Run("test69 overwrite key while encrypting", func(t *testing.T) {
+		b, storage := testBackend(t)
+		encryptDataNonDetermisticallyAndCreateKey(b, storage, map[string]interface{}{"test69": "hello world"}, false, t)
+		saveConfig(b, storage, map[string]interface{}{"test69": "gcm/test69"}, false, t)
+
+		// the stored keyset of the field, read straight from storage
+		storedKeySet := func() string {
+			entry, err := storage.Get(context.Background(), "config")
+			if err != nil || entry == nil {
+				t.Fatalf("failed to read the config %v", err)
+			}
+			config := map[string]interface{}{}
+			if err := entry.DecodeJSON(&config); err != nil {
+				t.Fatal(err)
+			}
+			return fmt.Sprintf("%v", config["gcm/test69"])
+		}
+		keySets := []string{storedKeySet()}
+
+		const overwrites = 20
+		const encrypts = 200
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			for i := 0; i < overwrites; i++ {
+				_, err := b.HandleRequest(context.Background(), &logical.Request{
+					Storage:   storage,
+					Operation: logical.UpdateOperation,
+					Path:      "createAEADkeyOverwrite",
+					Data:      map[string]interface{}{"test69": "hello world"},
+				})
+				if err != nil {
+					t.Errorf("createAEADkeyOverwrite failed %v", err)
+					return
+				}
+				keySets = append(keySets, storedKeySet())
+			}
+		}()
+
+		cypherTexts := make(chan string, encrypts)
+		errs := make(chan error, encrypts)
+		for i := 0; i < encrypts; i++ {
+			go func() {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Storage:   storage,
+					Operation: logical.UpdateOperation,
+					Path:      "encrypt",
+					Data:      map[string]interface{}{"test69": "hello world"},
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				cypherTexts <- fmt.Sprintf("%v", resp.Data["test69"])
+			}()
+		}
+		<-done
+
+		// every cyphertext must decrypt with one of the keysets the field has had
+		for i := 0; i < encrypts; i++ {
+			select {
+			case err := <-errs:
+				t.Errorf("encrypt failed %v", err)
+			case cypherText := <-cypherTexts:
+				cypherTextBytes, err := b64.StdEncoding.DecodeString(cypherText)
+				if err != nil {
+					t.Errorf("expected base64 cyphertext got %s", cypherText)
+					continue
+				}
+				decrypted := false
+				for _, keySet := range keySets {
+					_, tinkAead, err := aeadutils.CreateInsecureHandleAndAead(keySet)
+					if err != nil {
+						t.Fatal(err)
+					}
+					plainText, err := tinkAead.Decrypt(cypherTextBytes, []byte("test69"))
+					if err == nil && string(plainText) == "hello world" {
+						decrypted = true
+						break
+					}
+				}
+				if !decrypted {
+					t.Errorf("%s does not decrypt with any of the keysets", cypherText)
+				}
+			}
+		}
+	})
+
+	t.Run("test70 decrypt cache", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test70": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test70": "siv/test70"}, false, t)
+
+		cypherTexts := []string{}
+		for _, plainText := range []string{"value0", "value1", "value2"} {
+			resp := encryptData(b, storage, map[string]interface{}{"test70": plainText}, t)
+			cypherTexts = append(cypherTexts, fmt.Sprintf("%v", resp.Data["test70"]))
+		}
+		decrypt := func(cypherText string) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "decrypt",
+				Data:      map[string]interface{}{"test70": cypherText},
+			})
+		}
+
+		// off by default
+		decrypt(cypherTexts[0])
+		if _, ok := decryptCaches.Get("test70"); ok {
+			t.Error("expected no decrypt cache without DECRYPT_CACHE_test70")
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"DECRYPT_CACHE_test70": "2"}, false, t)
+		for i, cypherText := range cypherTexts {
+			resp, err := decrypt(cypherText)
+			if err != nil || resp.Data["test70"] != fmt.Sprintf("value%d", i) {
+				t.Errorf("expected value%d got %v %v", i, resp, err)
+			}
+		}
+		cacheIntf, ok := decryptCaches.Get("test70")
+		if !ok {
+			t.Fatal("expected a decrypt cache for test70")
+		}
+		cache := cacheIntf.(*decryptCache)
+		if cache.entries.Len() != 2 {
+			t.Errorf("expected the cache to hold 2 entries got %d", cache.entries.Len())
+		}
+		aad := []byte("test70")
+		if _, ok := cache.get(ENCODING_BASE64, aad, cypherTexts[0]); ok {
+			t.Error("expected the least recently used entry to be evicted")
+		}
+		if plainText, ok := cache.get(ENCODING_BASE64, aad, cypherTexts[2]); !ok || plainText != "value2" {
+			t.Errorf("expected value2 to be cached got %s", plainText)
+		}
+
+		// a cached entry is answered without decrypting, until the keyset changes
+		cache.add(ENCODING_BASE64, aad, "bm90IGN5cGhlcnRleHQ=", "from the cache")
+		resp, err := decrypt("bm90IGN5cGhlcnRleHQ=")
+		if err != nil || resp.Data["test70"] != "from the cache" {
+			t.Errorf("expected the cached plaintext got %v %v", resp, err)
+		}
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "rotate",
+			Data:      map[string]interface{}{"test70": ""},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _ = decrypt("bm90IGN5cGhlcnRleHQ=")
+		if resp != nil && resp.Data["test70"] == "from the cache" {
+			t.Error("expected the cache to be emptied by the rotate")
+		}
+
+		deleteConfig(b, storage, map[string]interface{}{"DECRYPT_CACHE_test70": ""}, t)
+		decrypt(cypherTexts[0])
+		if _, ok := decryptCaches.Get("test70"); ok {
+			t.Error("expected the decrypt cache to be dropped")
+		}
+	})
+
+	t.Run("test71 PRF keysets", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(operation logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: operation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+
+		resp, err := request(logical.UpdateOperation, "createPRFkey", map[string]interface{}{"test71": ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := resp.Data["test71"].(map[string]interface{})
+		if created["created"] != true || created["key_name"] != "prf/test71" {
+			t.Errorf("expected prf/test71 to be created got %v", resp.Data)
+		}
+		resp, _ = request(logical.UpdateOperation, "createPRFkey", map[string]interface{}{"test71": ""})
+		if resp.Data["test71"].(map[string]interface{})["created"] != false {
+			t.Errorf("expected the PRF keyset not to be overwritten got %v", resp.Data)
+		}
+		_, err = request(logical.UpdateOperation, "createPRFkey", map[string]interface{}{"test71-cmac": "", "TEMPLATE": "AES_CMAC_PRF"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the same input gives the same output
+		derive := func(data map[string]interface{}) (*logical.Response, error) {
+			return request(logical.UpdateOperation, "derive", data)
+		}
+		resp1, err := derive(map[string]interface{}{"KEY": "test71", "INPUT": "tenant-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp2, _ := derive(map[string]interface{}{"KEY": "test71", "INPUT": "tenant-1"})
+		resp3, _ := derive(map[string]interface{}{"KEY": "test71", "INPUT": "tenant-2"})
+		if resp1.Data["output"] != resp2.Data["output"] || resp1.Data["output"] == resp3.Data["output"] {
+			t.Errorf("expected the same output for the same input only %v %v %v", resp1.Data, resp2.Data, resp3.Data)
+		}
+		output, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", resp1.Data["output"]))
+		if len(output) != 32 {
+			t.Errorf("expected 32 bytes by default got %d", len(output))
+		}
+		resp, err = derive(map[string]interface{}{"KEY": "test71-cmac", "INPUT": "tenant-1", "LENGTH": 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, _ = b64.StdEncoding.DecodeString(fmt.Sprintf("%v", resp.Data["output"]))
+		if len(output) != 16 {
+			t.Errorf("expected 16 bytes got %d", len(output))
+		}
+		resp, err = derive(map[string]interface{}{"KEY": "test71-cmac", "INPUT": "tenant-1", "LENGTH": 32})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected AES_CMAC_PRF to refuse 32 bytes got %v", err)
+		}
+		resp, err = derive(map[string]interface{}{"KEY": "test71-missing", "INPUT": "tenant-1"})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected a KEY_NOT_FOUND error got %v", err)
+		}
+
+		// masked, classified and not rotated
+		config := readConfig(b, storage, t)
+		if !strings.Contains(fmt.Sprintf("%v", config.Data["prf/test71"]), `"value":"***"`) {
+			t.Errorf("expected the PRF keyset to be masked got %v", config.Data["prf/test71"])
+		}
+		resp, _ = request(logical.ReadOperation, "keytypes", nil)
+		if resp.Data["prf/test71"] != "PRF" {
+			t.Errorf("expected prf/test71 to be a PRF keyset got %v", resp.Data["prf/test71"])
+		}
+		resp, err = request(logical.UpdateOperation, "rotateAll", map[string]interface{}{})
+		if err != nil || len(resp.Warnings) != 0 {
+			t.Errorf("expected rotateAll to leave the PRF keysets alone got %v %v", resp, err)
+		}
+		resp4, _ := derive(map[string]interface{}{"KEY": "test71", "INPUT": "tenant-1"})
+		if resp4.Data["output"] != resp1.Data["output"] {
+			t.Error("expected the output to be unchanged by rotateAll")
+		}
+	})
+
+	t.Run("test72 repair a primary pointing at a disabled key", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+
+		// the primary 3192631270 is DISABLED so the keyset cannot encrypt
+		broken := strings.Replace(NonDeterministicKeyset, `"status":"ENABLED","keyId":3192631270`, `"status":"DISABLED","keyId":3192631270`, 1)
+		saveConfig(b, storage, map[string]interface{}{"gcm/test72": broken, "test72": "gcm/test72", "test72-ok": NonDeterministicKeyset}, false, t)
+
+		// by default the problem is only reported
+		resp, err := request("repairPrimary", map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, ok := resp.Data["broken"].(map[string]interface{})["gcm/test72"].(map[string]interface{})
+		if !ok || found["problem"] != "primary key 3192631270 is DISABLED" || found["repaired"] != false {
+			t.Fatalf("expected gcm/test72 to be reported and not repaired got %v", resp.Data)
+		}
+		if len(resp.Data["broken"].(map[string]interface{})) != 1 {
+			t.Errorf("expected only gcm/test72 to be broken got %v", resp.Data)
+		}
+		stored, _ := AEAD_CONFIG.Get("gcm/test72")
+		if !strings.Contains(fmt.Sprintf("%v", stored), `"primaryKeyId":3192631270`) {
+			t.Error("expected the keyset not to change without REPAIR")
+		}
+
+		// the newest enabled key, the third key, is promoted
+		resp, err = request("repairPrimary", map[string]interface{}{"test72": "", "REPAIR": "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = resp.Data["broken"].(map[string]interface{})["gcm/test72"].(map[string]interface{})
+		if found["repaired"] != true || found["primary"] != 1532149397 || resp.Data["checked"] != 1 {
+			t.Errorf("expected key 1532149397 to be promoted got %v", resp.Data)
+		}
+		stored, _ = AEAD_CONFIG.Get("gcm/test72")
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", stored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kh.KeysetInfo().GetPrimaryKeyId() != 1532149397 {
+			t.Errorf("expected the stored primary to be 1532149397 got %d", kh.KeysetInfo().GetPrimaryKeyId())
+		}
+
+		// the repaired keyset encrypts and decrypts again
+		resp, err = request("encrypt", map[string]interface{}{"test72": "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct := fmt.Sprintf("%v", resp.Data["test72"])
+		if ct == "hello" {
+			t.Fatal("expected test72 to be encrypted")
+		}
+		resp, err = request("decrypt", map[string]interface{}{"test72": ct})
+		if err != nil || resp.Data["test72"] != "hello" {
+			t.Errorf("expected hello got %v %v", resp, err)
+		}
+
+		resp, _ = request("repairPrimary", map[string]interface{}{})
+		if len(resp.Data["broken"].(map[string]interface{})) != 0 {
+			t.Errorf("expected nothing broken after the repair got %v", resp.Data)
+		}
+	})
+
+	t.Run("test73 importKeyEncrypted with a kms", func(t *testing.T) {
+		b, storage := testBackend(t)
+		defer func() { newKMSWrapper = bqutils.NewKMSWrapper }()
+		newKMSWrapper = func(ctx context.Context, envOptions cmap.ConcurrentMap) (bqutils.KMSWrapper, error) {
+			return &fakeKMSWrapper{}, nil
+		}
+		request := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "importKeyEncrypted",
+				Data:      data,
+			})
+		}
+		wrap := func(keyset []byte) string {
+			wrapped := make([]byte, len(keyset))
+			for i, b := range keyset {
+				wrapped[len(keyset)-1-i] = b
+			}
+			return b64.StdEncoding.EncodeToString(wrapped)
+		}
+
+		// one keyset wrapped as json, the other as tink binary
+		kh, err := aeadutils.ValidateKeySetJson(DeterministicKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := insecurecleartextkeyset.Write(kh, keyset.NewBinaryWriter(buf)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := request(map[string]interface{}{
+			"test73-json":   wrap([]byte(NonDeterministicKeyset)),
+			"test73-binary": wrap(buf.Bytes()),
+			"KMS_KEY":       "import-key",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["test73-json"] != "gcm/test73-json" || resp.Data["test73-binary"] != "siv/test73-binary" {
+			t.Errorf("expected the stored key names got %v", resp.Data)
+		}
+		if key, _ := AEAD_CONFIG.Get("gcm/test73-json"); key != NonDeterministicKeyset {
+			t.Errorf("expected the unwrapped keyset to be imported got %v", key)
+		}
+		key, _ := AEAD_CONFIG.Get("siv/test73-binary")
+		importedKh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", key))
+		if err != nil || importedKh.KeysetInfo().GetPrimaryKeyId() != kh.KeysetInfo().GetPrimaryKeyId() {
+			t.Errorf("expected the binary keyset to be imported as json got %v", err)
+		}
+
+		for _, tc := range []struct {
+			data map[string]interface{}
+			code string
+		}{
+			{map[string]interface{}{"test73-bad": wrap([]byte(NonDeterministicKeyset))}, ERROR_INVALID_REQUEST},
+			{map[string]interface{}{"test73-bad": "not base64!", "KMS_KEY": "import-key"}, ERROR_INVALID_REQUEST},
+			{map[string]interface{}{"test73-bad": wrap([]byte(NonDeterministicKeyset)), "KMS_KEY": "other-key"}, ERROR_INVALID_KEYSET},
+			{map[string]interface{}{"test73-bad": wrap([]byte("not a keyset")), "KMS_KEY": "import-key"}, ERROR_INVALID_KEYSET},
+		} {
+			resp, err := request(tc.data)
+			if err == nil || resp.Data["error_code"] != tc.code {
+				t.Errorf("expected %s for %v got %v", tc.code, tc.data, err)
+			}
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test73-bad"); ok {
+			t.Error("expected nothing to be imported when unwrapping fails")
+		}
+	})
+
+	t.Run("test74 encrypt DEBUG_CACHE reports the handle cache", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test74-gcm": NonDeterministicKeyset, "test74-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test74-gcm": "gcm/test74-gcm", "test74-siv": "siv/test74-siv"}, false, t)
+
+		debugEncrypt := func() map[string]interface{} {
+			resp := encryptData(b, storage, map[string]interface{}{"test74-gcm": "hello", "test74-siv": "hello", "test74-nokey": "hello", "DEBUG_CACHE": "true"}, t)
+			if resp.Data["test74-nokey"] != "hello" || resp.Data["test74-gcm"] == "hello" || resp.Data["test74-siv"] == "hello" {
+				t.Errorf("expected only the fields with a keyset to be encrypted got %v", resp.Data)
+			}
+			hits, ok := resp.Data["DEBUG_CACHE"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("expected DEBUG_CACHE in the response got %v", resp.Data)
+			}
+			if _, ok := hits["test74-nokey"]; ok {
+				t.Errorf("expected no DEBUG_CACHE for a field without a keyset got %v", hits)
+			}
+			return hits
+		}
+
+		resp := encryptData(b, storage, map[string]interface{}{"test74-gcm": "hello"}, t)
+		if _, ok := resp.Data["DEBUG_CACHE"]; ok {
+			t.Errorf("expected no DEBUG_CACHE by default got %v", resp.Data)
+		}
+		hits := debugEncrypt()
+		if hits["test74-gcm"] != true || hits["test74-siv"] != false {
+			t.Errorf("expected a hit for the field already encrypted and a miss for the other got %v", hits)
+		}
+		hits = debugEncrypt()
+		if hits["test74-gcm"] != true || hits["test74-siv"] != true {
+			t.Errorf("expected hits for both fields got %v", hits)
+		}
+
+		// a rotate changes the keysets so the cached primitives are not used
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "rotate",
+			Data:      map[string]interface{}{"test74-gcm": "", "test74-siv": ""},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits = debugEncrypt()
+		if hits["test74-gcm"] != false || hits["test74-siv"] != false {
+			t.Errorf("expected misses after the rotate got %v", hits)
+		}
+		resp = decryptData(b, storage, encryptData(b, storage, map[string]interface{}{"test74-gcm": "hello", "test74-siv": "hello"}, t), t)
+		if resp.Data["test74-gcm"] != "hello" || resp.Data["test74-siv"] != "hello" {
+			t.Errorf("expected the cyphertext of a cached primitive to decrypt got %v", resp.Data)
+		}
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test74-gcm": "hello", "DEBUG_CACHE": "maybe"},
+		})
+		if err == nil {
+			t.Error("expected an error for a DEBUG_CACHE that is not true or false")
+		}
+	})
+
+	t.Run("test75 KEY_PREFIXES config option", func(t *testing.T) {
+		b, storage := testBackend(t)
+		defer aeadutils.SetKeyPrefixes(nil)
+
+		saveConfig(b, storage, map[string]interface{}{"KEY_PREFIXES": "chacha/,team-a/"}, false, t)
+		if aeadutils.BQFieldName("chacha/phone-number") != "phone_number" || aeadutils.RemoveKeyPrefix("team-a/email") != "email" {
+			t.Errorf("expected the configured prefixes to be stripped got %v", aeadutils.KeyPrefixes())
+		}
+
+		deleteConfig(b, storage, map[string]interface{}{"KEY_PREFIXES": ""}, t)
+		readConfig(b, storage, t)
+		if aeadutils.RemoveKeyPrefix("chacha/phone-number") != "chacha/phone-number" {
+			t.Errorf("expected the prefixes to be restored once KEY_PREFIXES is deleted got %v", aeadutils.KeyPrefixes())
+		}
+	})
+
+	t.Run("test76 renameKey", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test76-old": NonDeterministicKeyset, "test76-taken": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test76-old":                 "gcm/test76-old",
+			"test76-member":              "gcm/test76-old",
+			"COMPRESS_test76-old":        "true",
+			"test76-other":               "hello",
+			"test76-taken":               "siv/test76-taken",
+			"test76-aad":                 "gcm/test76-old",
+			"ADDITIONAL_DATA_test76-aad": "custom",
+		}, false, t)
+		cypherText := fmt.Sprintf("%v", encryptData(b, storage, map[string]interface{}{"test76-old": "hello"}, t).Data["test76-old"])
+		memberCypherText := fmt.Sprintf("%v", encryptData(b, storage, map[string]interface{}{"test76-member": "hello"}, t).Data["test76-member"])
+
+		// the new name must not be configured and the old name must be
+		resp, err := request("renameKey", map[string]interface{}{"test76-old": "test76-taken"})
+		if err == nil || resp.Data["error_code"] != ERROR_FIELD_EXISTS {
+			t.Errorf("expected FIELD_EXISTS renaming to a configured name got %v", err)
+		}
+		resp, err = request("renameKey", map[string]interface{}{"test76-missing": "test76-anything"})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected KEY_NOT_FOUND renaming a field with no config got %v", err)
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test76-old"); !ok {
+			t.Fatal("expected a failed rename to leave the keyset")
+		}
+
+		resp, err = request("renameKey", map[string]interface{}{"test76-old": "test76-new", "KEEP_ADDITIONAL_DATA": "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		renamed := resp.Data["test76-old"].(map[string]interface{})
+		if renamed["key_name"] != "gcm/test76-new" || !reflect.DeepEqual(renamed["pointers"], []string{"test76-aad", "test76-member"}) {
+			t.Errorf("expected gcm/test76-new with its family pointers got %v", renamed)
+		}
+
+		// the old name is gone, from the cached and the stored config
+		for _, k := range []string{"gcm/test76-old", "test76-old", "COMPRESS_test76-old"} {
+			if _, ok := AEAD_CONFIG.Get(k); ok {
+				t.Errorf("expected %s to be gone", k)
+			}
+		}
+		stored := readConfig(b, storage, t)
+		if _, ok := stored.Data["gcm/test76-old"]; ok {
+			t.Error("expected gcm/test76-old to be gone from storage")
+		}
+		for k, expected := range map[string]string{
+			"test76-new":                 "gcm/test76-new",
+			"test76-member":              "gcm/test76-new",
+			"COMPRESS_test76-new":        "true",
+			"ADDITIONAL_DATA_test76-new": "test76-old",
+			"test76-other":               "hello",
+		} {
+			if v, _ := AEAD_CONFIG.Get(k); v != expected {
+				t.Errorf("expected %s to be %s got %v", k, expected, v)
+			}
+		}
+
+		// the old cyphertext decrypts under the new name as the additional data was kept
+		decrypted := decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test76-new": cypherText, "test76-member": memberCypherText}}, t)
+		if decrypted.Data["test76-new"] != "hello" || decrypted.Data["test76-member"] != "hello" {
+			t.Errorf("expected the cyphertext from before the rename to decrypt got %v", decrypted.Data)
+		}
+		decrypted = decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test76-old": cypherText}}, t)
+		if decrypted.Data["test76-old"] == "hello" {
+			t.Error("expected the old name to no longer decrypt")
+		}
+
+		// additional data of its own moves with the field when it is renamed again
+		_, err = request("renameKey", map[string]interface{}{"test76-new": "test76-newer"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := AEAD_CONFIG.Get("ADDITIONAL_DATA_test76-newer"); v != "test76-old" {
+			t.Errorf("expected the kept additional data to move with the field got %v", v)
+		}
+
+		// so does the AAD_HISTORY_ of a field whose additional data was rotated
+		saveConfig(b, storage, map[string]interface{}{"ADDITIONAL_DATA_test76-newer": "test76-rotated", "AAD_HISTORY_test76-newer": "test76-old"}, true, t)
+		_, err = request("renameKey", map[string]interface{}{"test76-newer": "test76-newest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := AEAD_CONFIG.Get("AAD_HISTORY_test76-newer"); ok {
+			t.Error("expected AAD_HISTORY_test76-newer to be gone")
+		}
+		decrypted = decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test76-newest": cypherText}}, t)
+		if decrypted.Data["test76-newest"] != "hello" {
+			t.Errorf("expected the cyphertext from before the additional data was rotated to decrypt with the history after a rename got %v", decrypted.Data)
+		}
+
+		// the index key moves too, so the index tokens of the field do not change
+		if _, err = request("createIndexKey", map[string]interface{}{"test76-newest": ""}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = request("indexToken", map[string]interface{}{"test76-newest": "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := resp.Data["test76-newest"]
+		if _, err = request("renameKey", map[string]interface{}{"test76-newest": "test76-indexed"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := AEAD_CONFIG.Get(INDEX_KEY_PREFIX + "test76-newest"); ok {
+			t.Error("expected the index key of test76-newest to be gone")
+		}
+		resp, err = request("indexToken", map[string]interface{}{"test76-indexed": "hello"})
+		if err != nil || resp.Data["test76-indexed"] != token {
+			t.Errorf("expected the index token from before the rename %v got %v %v", token, resp, err)
+		}
+	})
+
+	t.Run("test77 decryptcol BULK_WORKERS matches the serial decrypt", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test77-gcm": NonDeterministicKeyset, "test77-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test77-gcm": "gcm/test77-gcm", "test77-siv": "siv/test77-siv"}, false, t)
+
+		bulkData := wideBulkData(200, "test77-gcm", "test77-siv", "test77-nokey")
+		encrypted := encryptDataCol(b, storage, bulkData, t)
+		decryptWith := func(workers string) (*logical.Response, error) {
+			data := make(map[string]interface{}, len(encrypted.Data)+1)
+			for k, v := range encrypted.Data {
+				data[k] = v
+			}
+			if workers != "" {
+				data["BULK_WORKERS"] = workers
+			}
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "decryptcol",
+				Data:      data,
+			})
+		}
+
+		serial, err := decryptWith("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(serial.Data, bulkData) {
+			t.Fatal("expected the serial decrypt to return the plaintext")
+		}
+		for _, workers := range []string{"1", "4", "64"} {
+			resp, err := decryptWith(workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Data, serial.Data) {
+				t.Errorf("expected BULK_WORKERS=%s to match the serial decrypt", workers)
+			}
+		}
+
+		for _, workers := range []string{"0", "65", "many"} {
+			resp, err := decryptWith(workers)
+			if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+				t.Errorf("expected an INVALID_REQUEST for BULK_WORKERS=%s got %v", workers, err)
+			}
+		}
+
+		// a row that fails to decrypt fails the request with workers too
+		encrypted.Data["7"].(map[string]interface{})["test77-gcm"] = b64.StdEncoding.EncodeToString([]byte("not cyphertext"))
+		if _, err := decryptWith("4"); err == nil {
+			t.Error("expected an error for a row that does not decrypt")
+		}
+	})
+
+	t.Run("test78 MIN_AEAD_BITS rejects weak keys", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		weakKh, err := keyset.NewHandle(aead.AES128GCMKeyTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		weakKeyset, _ := aeadutils.ExtractInsecureKeySetFromKeyhandle(weakKh)
+
+		// without a policy a 128 bit key can be imported
+		importKey(b, storage, map[string]interface{}{"test78-before": weakKeyset}, t)
+
+		saveConfig(b, storage, map[string]interface{}{"MIN_AEAD_BITS": "256"}, false, t)
+		defer deleteConfig(b, storage, map[string]interface{}{"MIN_AEAD_BITS": ""}, t)
+
+		resp, err := request("importKey", map[string]interface{}{"test78-weak": weakKeyset})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_KEYSET || !strings.Contains(err.Error(), "test78-weak has a 128 bit key") {
+			t.Errorf("expected the 128 bit keyset to be rejected got %v", err)
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test78-weak"); ok {
+			t.Error("expected the 128 bit keyset not to be imported")
+		}
+		if _, err := request("validateKey", map[string]interface{}{"test78-weak": weakKeyset}); err == nil {
+			t.Error("expected validateKey to reject the 128 bit keyset")
+		}
+		importKey(b, storage, map[string]interface{}{"test78-strong": NonDeterministicKeyset, "test78-siv": DeterministicKeyset}, t)
+		if _, ok := AEAD_CONFIG.Get("gcm/test78-strong"); !ok {
+			t.Error("expected the 256 bit keyset to be imported")
+		}
+
+		// the templates of the create and rotate paths
+		saveConfig(b, storage, map[string]interface{}{"DEFAULT_AEAD_TEMPLATE": "AES128_GCM"}, false, t)
+		_, err = request("createAEADkey", map[string]interface{}{"test78-new": ""})
+		if err == nil || !strings.Contains(err.Error(), "creates 128 bit keys") {
+			t.Errorf("expected createAEADkey to refuse a 128 bit template got %v", err)
+		}
+		deleteConfig(b, storage, map[string]interface{}{"DEFAULT_AEAD_TEMPLATE": ""}, t)
+		if _, err = request("createAEADkey", map[string]interface{}{"test78-new": ""}); err != nil {
+			t.Errorf("expected createAEADkey to create a 256 bit keyset got %v", err)
+		}
+		_, err = request("rotate", map[string]interface{}{"TEMPLATE": `{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"EBA=","outputPrefixType":"TINK"}`})
+		if err == nil {
+			t.Error("expected rotate to refuse a 128 bit template")
+		}
+		_, err = request("importTemplate", map[string]interface{}{"test78-template": `{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"EBA=","outputPrefixType":"TINK"}`})
+		if err == nil {
+			t.Error("expected importTemplate to refuse a 128 bit template")
+		}
+	})
+
+	t.Run("test79 addKey keeps the primary", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		storedKeyset := func(keyName string) *keyset.Handle {
+			keySet, ok := AEAD_CONFIG.Get(keyName)
+			if !ok {
+				t.Fatalf("expected a keyset for %s", keyName)
+			}
+			kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", keySet))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kh
+		}
+		importKey(b, storage, map[string]interface{}{"test79-key": NonDeterministicKeyset, "test79-det": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test79-key": "gcm/test79-key", "test79-det": "siv/test79-det"}, false, t)
+		detPrimary := storedKeyset("siv/test79-det").KeysetInfo().GetPrimaryKeyId()
+
+		resp, err := request("addKey", map[string]interface{}{"test79-key": "", "test79-det": ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		added := resp.Data["test79-key"].(map[string]interface{})
+		newKeyID := added["key_id"].(uint32)
+		if added["key_name"] != "gcm/test79-key" || added["primary_key_id"] != uint32(3192631270) {
+			t.Errorf("expected the key added to gcm/test79-key with the primary unchanged got %v", added)
+		}
+
+		info := storedKeyset("gcm/test79-key").KeysetInfo()
+		if info.GetPrimaryKeyId() != 3192631270 {
+			t.Errorf("expected the primary to stay 3192631270 got %d", info.GetPrimaryKeyId())
+		}
+		if len(info.GetKeyInfo()) != 5 {
+			t.Errorf("expected 5 keys after addKey got %d", len(info.GetKeyInfo()))
+		}
+		found := false
+		for _, keyInfo := range info.GetKeyInfo() {
+			if keyInfo.GetKeyId() == newKeyID {
+				found = true
+				if keyInfo.GetStatus() != tinkpb.KeyStatusType_ENABLED || keyInfo.GetTypeUrl() != "type.googleapis.com/google.crypto.tink.AesGcmKey" {
+					t.Errorf("expected an ENABLED AesGcmKey got %v", keyInfo)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("expected key %d in the keyset", newKeyID)
+		}
+		detInfo := storedKeyset("siv/test79-det").KeysetInfo()
+		if detInfo.GetPrimaryKeyId() != detPrimary || detInfo.GetKeyInfo()[len(detInfo.GetKeyInfo())-1].GetTypeUrl() != "type.googleapis.com/google.crypto.tink.AesSivKey" {
+			t.Errorf("expected an AesSivKey added to siv/test79-det with the primary unchanged got %v", detInfo)
+		}
+
+		// data encrypted before and after the flip still decrypts
+		encryptResp := encryptData(b, storage, map[string]interface{}{"test79-key": "before the flip"}, t)
+		_, err = request("updatePrimaryKeyID", map[string]interface{}{"test79-key": strconv.FormatUint(uint64(newKeyID), 10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if primary := storedKeyset("gcm/test79-key").KeysetInfo().GetPrimaryKeyId(); primary != newKeyID {
+			t.Errorf("expected the added key %d to be the primary after updatePrimaryKeyID got %d", newKeyID, primary)
+		}
+		decryptResp := decryptData(b, storage, encryptResp, t)
+		if decryptResp.Data["test79-key"] != "before the flip" {
+			t.Errorf("expected the data encrypted before the flip to decrypt got %v", decryptResp.Data)
+		}
+
+		resp, err = request("addKey", map[string]interface{}{"test79-missing": ""})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected KEY_NOT_FOUND for a field with no keyset got %v", err)
+		}
+		resp, err = request("addKey", map[string]interface{}{"test79-key": "", "TEMPLATE": `{"typeUrl":"type.googleapis.com/google.crypto.tink.AesSivKey","value":"EEA=","outputPrefixType":"TINK"}`})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for a deterministic template on a gcm keyset got %v", err)
+		}
+		if keys := len(storedKeyset("gcm/test79-key").KeysetInfo().GetKeyInfo()); keys != 5 {
+			t.Errorf("expected no key added by the failed requests got %d keys", keys)
+		}
+	})
+
+	t.Run("test80 TRY_ALL_KEYS decrypts cyphertext without its key id prefix", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test80-key": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test80-key": "gcm/test80-key"}, false, t)
+
+		// cyphertext from two keys of a RAW keyset, which has no key id prefix
+		if _, err := request("convertPrefix", map[string]interface{}{"test80-key": "RAW"}); err != nil {
+			t.Fatal(err)
+		}
+		primaryCypherText := encryptData(b, storage, map[string]interface{}{"test80-key": "primary key"}, t).Data["test80-key"]
+		if _, err := request("updatePrimaryKeyID", map[string]interface{}{"test80-key": "1532149397"}); err != nil {
+			t.Fatal(err)
+		}
+		otherCypherText := encryptData(b, storage, map[string]interface{}{"test80-key": "other key"}, t).Data["test80-key"]
+
+		// the keyset goes back to TINK so tink looks for a prefix the cyphertext does not have
+		if _, err := request("convertPrefix", map[string]interface{}{"test80-key": "TINK"}); err != nil {
+			t.Fatal(err)
+		}
+		resp := decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test80-key": primaryCypherText}}, t)
+		if resp.Data["test80-key"] == "primary key" {
+			t.Error("expected the RAW cyphertext not to decrypt without TRY_ALL_KEYS")
+		}
+		if _, ok := resp.Data["TRY_ALL_KEYS"]; ok {
+			t.Error("expected no TRY_ALL_KEYS in the response without the option")
+		}
+
+		for cypherText, expected := range map[interface{}]struct {
+			plainText string
+			keyID     int
+		}{primaryCypherText: {"primary key", 3192631270}, otherCypherText: {"other key", 1532149397}} {
+			resp, err := request("decrypt", map[string]interface{}{"test80-key": cypherText, "TRY_ALL_KEYS": "true"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyIDs := resp.Data["TRY_ALL_KEYS"].(map[string]interface{})
+			if resp.Data["test80-key"] != expected.plainText || keyIDs["test80-key"] != expected.keyID {
+				t.Errorf("expected %q decrypted by key %d got %v", expected.plainText, expected.keyID, resp.Data)
+			}
+		}
+
+		// cyphertext that decrypts normally is not reported
+		tinkCypherText := encryptData(b, storage, map[string]interface{}{"test80-key": "tink"}, t).Data["test80-key"]
+		resp, err := request("decrypt", map[string]interface{}{"test80-key": tinkCypherText, "TRY_ALL_KEYS": "true"})
+		if err != nil || resp.Data["test80-key"] != "tink" || len(resp.Data["TRY_ALL_KEYS"].(map[string]interface{})) != 0 {
+			t.Errorf("expected tink to decrypt without the fallback got %v %v", resp, err)
+		}
+
+		resp, err = request("decrypt", map[string]interface{}{"test80-key": tinkCypherText, "TRY_ALL_KEYS": "sometimes"})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for a TRY_ALL_KEYS that is not a bool got %v", err)
+		}
+	})
+
+	t.Run("test81 capabilities lists the supported key types", func(t *testing.T) {
+		b, storage := testBackend(t)
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "capabilities",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		contains := func(values []string, value string) bool {
+			for _, v := range values {
+				if v == value {
+					return true
+				}
+			}
+			return false
+		}
+		typeURLs := resp.Data["type_urls"].(map[string]interface{})["keysets"].([]string)
+		for _, expected := range []string{"type.googleapis.com/google.crypto.tink.AesGcmKey", "type.googleapis.com/google.crypto.tink.AesSivKey"} {
+			if !contains(typeURLs, expected) {
+				t.Errorf("expected %s in the type urls got %v", expected, typeURLs)
+			}
+		}
+		templates := resp.Data["templates"].(map[string]interface{})
+		if !contains(templates["createAEADkey"].([]string), "AES256_GCM") || !contains(templates["createDAEADkey"].([]string), "AES256_SIV") {
+			t.Errorf("expected the AES256_GCM and AES256_SIV templates got %v", templates)
+		}
+		defaults := resp.Data["default_templates"].(map[string]interface{})
+		if defaults["createAEADkey"] != "AES256_GCM" || defaults["createDAEADkey"] != "AES256_SIV" {
+			t.Errorf("expected the default templates got %v", defaults)
+		}
+		features := resp.Data["features"].(map[string]interface{})
+		if features["aead"] != true || features["daead"] != true || features["streaming"] != false {
+			t.Errorf("expected aead and daead but not streaming got %v", features)
+		}
+
+		// the default templates follow the config
+		saveConfig(b, storage, map[string]interface{}{"DEFAULT_AEAD_TEMPLATE": "chacha20_poly1305"}, false, t)
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "capabilities",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if defaults := resp.Data["default_templates"].(map[string]interface{}); defaults["createAEADkey"] != "CHACHA20_POLY1305" {
+			t.Errorf("expected the configured DEFAULT_AEAD_TEMPLATE got %v", defaults)
+		}
+	})
+
+	t.Run("test82 NO_AAD decrypts legacy cyphertext with no additional data", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "decrypt",
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test82-gcm": NonDeterministicKeyset, "test82-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test82-gcm": "gcm/test82-gcm", "test82-siv": "siv/test82-siv"}, false, t)
+
+		// legacy cyphertext made by the same keysets with no additional data
+		_, tinkAead, err := aeadutils.CreateInsecureHandleAndAead(NonDeterministicKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacyGcm, err := tinkAead.Encrypt([]byte("legacy gcm"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, tinkDetAead, err := aeadutils.CreateInsecureHandleAndDeterministicAead(DeterministicKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacySiv, err := tinkDetAead.EncryptDeterministically([]byte("legacy siv"), []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy := map[string]interface{}{
+			"test82-gcm": b64.StdEncoding.EncodeToString(legacyGcm),
+			"test82-siv": b64.StdEncoding.EncodeToString(legacySiv),
+		}
+
+		resp := decryptData(b, storage, &logical.Response{Data: legacy}, t)
+		if resp.Data["test82-gcm"] == "legacy gcm" || resp.Data["test82-siv"] == "legacy siv" {
+			t.Errorf("expected the legacy cyphertext not to decrypt with the field name as additional data got %v", resp.Data)
+		}
+
+		legacy["NO_AAD"] = "true"
+		resp, err = request(legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["test82-gcm"] != "legacy gcm" || resp.Data["test82-siv"] != "legacy siv" {
+			t.Errorf("expected the legacy cyphertext to decrypt with NO_AAD got %v", resp.Data)
+		}
+
+		// the default is unaffected, cyphertext bound to the field name only decrypts without NO_AAD
+		encryptResp := encryptData(b, storage, map[string]interface{}{"test82-gcm": "current"}, t)
+		resp = decryptData(b, storage, encryptResp, t)
+		if resp.Data["test82-gcm"] != "current" {
+			t.Errorf("expected the current cyphertext to decrypt got %v", resp.Data)
+		}
+		resp, err = request(map[string]interface{}{"test82-gcm": encryptResp.Data["test82-gcm"], "NO_AAD": "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["test82-gcm"] == "current" {
+			t.Error("expected cyphertext bound to the field name not to decrypt with NO_AAD")
+		}
+
+		resp, err = request(map[string]interface{}{"test82-gcm": encryptResp.Data["test82-gcm"], "NO_AAD": "true", "AAD_PARTS": map[string]interface{}{"tenant": "a"}})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST || !strings.Contains(err.Error(), "NO_AAD cannot be used with AAD_PARTS") {
+			t.Errorf("expected INVALID_REQUEST for NO_AAD with AAD_PARTS got %v", err)
+		}
+		resp, err = request(map[string]interface{}{"test82-gcm": encryptResp.Data["test82-gcm"], "NO_AAD": "maybe"})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for a NO_AAD that is not a bool got %v", err)
+		}
+	})
+
+	t.Run("test83 malformed bulk payloads", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test83-a": NonDeterministicKeyset, "test83-b": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test83-a": "gcm/test83-a", "test83-b": "siv/test83-b"}, false, t)
+
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+
+		tests := []struct {
+			name     string
+			paths    []string
+			payload  map[string]interface{}
+			expected string
+		}{
+			// encrypt takes the maps and lists of fields with a keyset as json values, see test86
+			{
+				name:  "a row nested a level too deep",
+				paths: []string{"encryptcol", "decrypt", "decryptcol"},
+				payload: map[string]interface{}{
+					"0": map[string]interface{}{"test83-a": "a0", "test83-b": "b0"},
+					"1": map[string]interface{}{"test83-a": map[string]interface{}{"test83-b": "b1"}},
+				},
+				expected: "row 1 field test83-a is a map",
+			},
+			{
+				name:  "a list in a row",
+				paths: []string{"encryptcol", "decrypt", "decryptcol"},
+				payload: map[string]interface{}{
+					"0": map[string]interface{}{"test83-a": "a0"},
+					"1": map[string]interface{}{"test83-b": []interface{}{"b1", "b2"}},
+				},
+				expected: "row 1 field test83-b is a list",
+			},
+			{
+				name:     "a list in a single row",
+				paths:    []string{"decrypt"},
+				payload:  map[string]interface{}{"test83-a": "a0", "test83-b": []interface{}{"b0"}},
+				expected: "field test83-b is a list",
+			},
+			{
+				name:  "a list in a row for a field without a keyset",
+				paths: []string{"encrypt", "encryptcol", "decrypt", "decryptcol"},
+				payload: map[string]interface{}{
+					"0": map[string]interface{}{"test83-a": "a0"},
+					"1": map[string]interface{}{"test83-c": []interface{}{"c1", "c2"}},
+				},
+				expected: "row 1 field test83-c is a list",
+			},
+			{
+				name:  "a scalar among rows",
+				paths: []string{"encrypt", "encryptcol", "decrypt", "decryptcol"},
+				payload: map[string]interface{}{
+					"0": map[string]interface{}{"test83-a": "a0"},
+					"1": map[string]interface{}{"test83-a": "a1"},
+					"2": "a2",
+				},
+				expected: "row 2 is not a map of fields",
+			},
+			{
+				name:     "a map in a single row",
+				paths:    []string{"encrypt", "decrypt"},
+				payload:  map[string]interface{}{"test83-a": "a0", "test83-b": "b0", "test83-c": map[string]interface{}{"0": "c0"}},
+				expected: "field test83-c is a map in a single row",
+			},
+		}
+		for _, tt := range tests {
+			for _, path := range tt.paths {
+				resp, err := request(path, tt.payload)
+				if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST || !strings.Contains(err.Error(), tt.expected) {
+					t.Errorf("%s %s: expected INVALID_REQUEST naming %q got %v", tt.name, path, tt.expected, err)
+				}
+			}
+		}
+
+		// well formed numbers and bools are still single values
+		resp, err := request("encrypt", map[string]interface{}{
+			"0": map[string]interface{}{"test83-a": 1, "test83-b": true},
+			"1": map[string]interface{}{"test83-a": 2.5, "test83-b": nil},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row := resp.Data["0"].(map[string]interface{}); row["test83-a"] == 1 {
+			t.Errorf("expected the number to be encrypted got %v", row)
+		}
+	})
+
+	t.Run("test84 storage prefix isolates engines", func(t *testing.T) {
+		storage := &logical.InmemStorage{}
+		prefixedBackend := func(prefix string) *backend {
+			config := logical.TestBackendConfig()
+			config.StorageView = storage
+			config.Config = map[string]string{"STORAGE_PREFIX": prefix}
+			b, err := Factory(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b.(*backend)
+		}
+		bA := prefixedBackend("test84-a/")
+		bB := prefixedBackend("test84-b/")
+		bDefault := prefixedBackend("")
+
+		saveConfig(bA, storage, map[string]interface{}{"test84-field-a": "gcm/test84-field-a"}, false, t)
+		saveConfig(bB, storage, map[string]interface{}{"test84-field-b": "gcm/test84-field-b"}, false, t)
+
+		for _, tc := range []struct {
+			b        *backend
+			expected string
+			other    string
+		}{{bA, "test84-field-a", "test84-field-b"}, {bB, "test84-field-b", "test84-field-a"}} {
+			resp := readConfig(tc.b, storage, t)
+			if _, ok := resp.Data[tc.expected]; !ok {
+				t.Errorf("expected %s in the config of %s got %v", tc.expected, tc.b.storagePrefix, resp.Data)
+			}
+			if _, ok := resp.Data[tc.other]; ok {
+				t.Errorf("expected no %s in the config of %s got %v", tc.other, tc.b.storagePrefix, resp.Data)
+			}
+		}
+		resp := readConfig(bDefault, storage, t)
+		if _, ok := resp.Data["test84-field-a"]; ok {
+			t.Errorf("expected no prefixed config without a prefix got %v", resp.Data)
+		}
+
+		for _, key := range []string{"test84-a/config", "test84-b/config"} {
+			entry, err := storage.Get(context.Background(), key)
+			if err != nil || entry == nil {
+				t.Errorf("expected the config stored under %s got %v %v", key, entry, err)
+			}
+		}
+		entry, err := storage.Get(context.Background(), "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != nil && strings.Contains(string(entry.Value), "test84-field") {
+			t.Errorf("expected no prefixed config under config got %s", entry.Value)
+		}
+	})
+
+	t.Run("test85 keyinfo warns on bloated keysets", func(t *testing.T) {
+		b, storage := testBackend(t)
+
+		// a keyset after many rotations
+		kh, err := aeadutils.ValidateKeySetJson(NonDeterministicKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			if _, err := aeadutils.RotateKeySet(kh, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bigKeyset, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(kh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importKey(b, storage, map[string]interface{}{"test85-big": bigKeyset, "test85-small": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test85-big": "gcm/test85-big", "test85-small": "gcm/test85-small"}, false, t)
+
+		keyInfo := func() *logical.Response {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "keyinfo",
+				Data:      map[string]interface{}{"FIELDS": []interface{}{"test85-big", "test85-small"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		// without MAX_KEYS_WARN the keys are counted but nothing is flagged
+		resp := keyInfo()
+		if got := resp.Data["test85-big"].(map[string]interface{})["KEY_COUNT"]; got != 24 {
+			t.Errorf("expected 24 keys got %v", got)
+		}
+		keysWarnings := func(resp *logical.Response) []string {
+			var warnings []string
+			for _, warning := range resp.Warnings {
+				if strings.Contains(warning, "MAX_KEYS_WARN") {
+					warnings = append(warnings, warning)
+				}
+			}
+			return warnings
+		}
+		if _, ok := resp.Data["test85-big"].(map[string]interface{})["KEYS_WARNING"]; ok || len(keysWarnings(resp)) != 0 {
+			t.Errorf("expected no warning without MAX_KEYS_WARN got %v %v", resp.Data, resp.Warnings)
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"MAX_KEYS_WARN": "10"}, false, t)
+		resp = keyInfo()
+		if got := resp.Data["test85-big"].(map[string]interface{})["KEYS_WARNING"]; got != true {
+			t.Errorf("expected the 24 key keyset to be flagged got %v", got)
+		}
+		if got := resp.Data["test85-small"].(map[string]interface{})["KEYS_WARNING"]; got != false {
+			t.Errorf("expected the 4 key keyset not to be flagged got %v", got)
+		}
+		if warnings := keysWarnings(resp); len(warnings) != 1 || !strings.Contains(warnings[0], "gcm/test85-big has 24 keys, more than MAX_KEYS_WARN 10") {
+			t.Errorf("expected a warning for gcm/test85-big got %v", resp.Warnings)
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"MAX_KEYS_WARN": "lots"}, true, t)
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "keyinfo",
+			Data:      map[string]interface{}{"FIELDS": "test85-big"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "MAX_KEYS_WARN must be a number of keys") {
+			t.Errorf("expected an invalid MAX_KEYS_WARN to fail got %v", err)
+		}
+	})
+
+	t.Run("test86 encrypt map and list values as json", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test86-object": NonDeterministicKeyset, "test86-array": DeterministicKeyset, "test86-name": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test86-object": "gcm/test86-object", "test86-array": "siv/test86-array", "test86-name": "gcm/test86-name"}, false, t)
+
+		object := map[string]interface{}{"street": "1 High St", "postcode": "AB1 2CD", "floor": json.Number("3"), "tags": []interface{}{"home", "billing"}}
+		array := []interface{}{"a", json.Number("1"), true, map[string]interface{}{"b": "c"}}
+
+		// a single row
+		encryptResp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test86-object": object, "test86-array": array, "test86-name": "bob"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fieldName := range []string{"test86-object", "test86-array", "test86-name"} {
+			if _, ok := encryptResp.Data[fieldName].(string); !ok {
+				t.Errorf("expected %s to be encrypted to a string got %v", fieldName, encryptResp.Data[fieldName])
+			}
+		}
+		decryptResp := decryptData(b, storage, encryptResp, t)
+		expected := map[string]interface{}{"test86-object": object, "test86-array": array, "test86-name": "bob"}
+		if !reflect.DeepEqual(decryptResp.Data, expected) {
+			t.Errorf("expected %v got %v", expected, decryptResp.Data)
+		}
+
+		// the json of a deterministic field is deterministic
+		encryptAgain, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test86-array": array, "test86-name": "bob"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encryptAgain.Data["test86-array"] != encryptResp.Data["test86-array"] {
+			t.Errorf("expected the same deterministic cyphertext got %v and %v", encryptAgain.Data["test86-array"], encryptResp.Data["test86-array"])
+		}
+
+		// bulk rows
+		encryptResp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data: map[string]interface{}{
+				"0": map[string]interface{}{"test86-object": object, "test86-name": "bob"},
+				"1": map[string]interface{}{"test86-array": array, "test86-name": "alice"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptResp = decryptData(b, storage, encryptResp, t)
+		expected = map[string]interface{}{
+			"0": map[string]interface{}{"test86-object": object, "test86-name": "bob"},
+			"1": map[string]interface{}{"test86-array": array, "test86-name": "alice"},
+		}
+		if !reflect.DeepEqual(decryptResp.Data, expected) {
+			t.Errorf("expected %v got %v", expected, decryptResp.Data)
+		}
+
+		// a single row whose only field is a map, which would otherwise look like a column
+		onlyObject := map[string]interface{}{"test86-object": map[string]interface{}{"street": "1 High St", "city": "London"}}
+		encryptResp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      onlyObject,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := encryptResp.Data["test86-object"].(string); !ok {
+			t.Errorf("expected test86-object to be encrypted to a string got %v", encryptResp.Data["test86-object"])
+		}
+		decryptResp = decryptData(b, storage, encryptResp, t)
+		if !reflect.DeepEqual(decryptResp.Data, onlyObject) {
+			t.Errorf("expected %v got %v", onlyObject, decryptResp.Data)
+		}
+
+		// a map for a field without a keyset is still a mis-shaped request
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test86-name": "bob", "test86-none": map[string]interface{}{"a": "b"}},
+		})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST || !strings.Contains(err.Error(), "not a mix of the two") {
+			t.Errorf("expected INVALID_REQUEST for a map without a keyset got %v", err)
+		}
+	})
+
+	t.Run("test87 CANDIDATE_AADS decrypts cyphertext from before the additional data changed", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test87-gcm": NonDeterministicKeyset, "test87-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test87-gcm":                 "gcm/test87-gcm",
+			"test87-siv":                 "siv/test87-siv",
+			"ADDITIONAL_DATA_test87-gcm": "aad1",
+			"ADDITIONAL_DATA_test87-siv": "aad1",
+		}, false, t)
+
+		encryptResp, err := request("encrypt", map[string]interface{}{"test87-gcm": "hello gcm", "test87-siv": "hello siv"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cypherText := func() map[string]interface{} {
+			return map[string]interface{}{"test87-gcm": encryptResp.Data["test87-gcm"], "test87-siv": encryptResp.Data["test87-siv"]}
+		}
+
+		// the additional data is rotated
+		saveConfig(b, storage, map[string]interface{}{"ADDITIONAL_DATA_test87-gcm": "aad2", "ADDITIONAL_DATA_test87-siv": "aad2"}, true, t)
+		resp := decryptData(b, storage, &logical.Response{Data: cypherText()}, t)
+		if resp.Data["test87-gcm"] == "hello gcm" || resp.Data["test87-siv"] == "hello siv" {
+			t.Errorf("expected the cyphertext not to decrypt with the new additional data got %v", resp.Data)
+		}
+
+		// as a list or a comma separated string
+		for _, candidates := range []interface{}{
+			map[string]interface{}{"test87-gcm": []interface{}{"aad0", "aad1"}, "test87-siv": []interface{}{"aad1"}},
+			`{"test87-gcm":"aad0,aad1","test87-siv":"aad1"}`,
+		} {
+			data := cypherText()
+			data["CANDIDATE_AADS"] = candidates
+			resp, err := request("decrypt", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data["test87-gcm"] != "hello gcm" || resp.Data["test87-siv"] != "hello siv" {
+				t.Errorf("expected the cyphertext to decrypt with the candidate additional data got %v", resp.Data)
+			}
+		}
+
+		// the history in config
+		saveConfig(b, storage, map[string]interface{}{"AAD_HISTORY_test87-gcm": "aad0,aad1", "AAD_HISTORY_test87-siv": "aad1"}, false, t)
+		resp = decryptData(b, storage, &logical.Response{Data: cypherText()}, t)
+		if resp.Data["test87-gcm"] != "hello gcm" || resp.Data["test87-siv"] != "hello siv" {
+			t.Errorf("expected the cyphertext to decrypt with AAD_HISTORY_ got %v", resp.Data)
+		}
+
+		// cyphertext made with the current additional data still decrypts
+		encryptResp, err = request("encrypt", map[string]interface{}{"test87-gcm": "new gcm", "test87-siv": "new siv"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = decryptData(b, storage, encryptResp, t)
+		if resp.Data["test87-gcm"] != "new gcm" || resp.Data["test87-siv"] != "new siv" {
+			t.Errorf("expected the current additional data to decrypt got %v", resp.Data)
+		}
+
+		data := cypherText()
+		data["NO_AAD"] = "true"
+		data["CANDIDATE_AADS"] = map[string]interface{}{"test87-gcm": "aad1"}
+		resp, err = request("decrypt", data)
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST || !strings.Contains(err.Error(), "NO_AAD cannot be used with CANDIDATE_AADS") {
+			t.Errorf("expected INVALID_REQUEST for NO_AAD with CANDIDATE_AADS got %v", err)
+		}
+		data = cypherText()
+		data["CANDIDATE_AADS"] = "aad1"
+		resp, err = request("decrypt", data)
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for CANDIDATE_AADS that is not a map got %v", err)
+		}
+	})
+
+	t.Run("test88 estimate the size of a bulk encrypt response", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test88-gcm": NonDeterministicKeyset, "test88-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test88-gcm": "gcm/test88-gcm", "test88-siv": "siv/test88-siv"}, false, t)
+
+		resp, err := request("estimate", map[string]interface{}{
+			"ROWS":   100,
+			"FIELDS": map[string]interface{}{"test88-gcm": 20, "test88-siv": 30, "test88-plain": 100},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := resp.Data["fields"].(map[string]interface{})
+		expected := map[string]map[string]interface{}{
+			"test88-gcm":   {"encrypted": true, "cyphertext_bytes": 53, "encoded_bytes": 72},
+			"test88-siv":   {"encrypted": true, "cyphertext_bytes": 51, "encoded_bytes": 68},
+			"test88-plain": {"encrypted": false, "cyphertext_bytes": 100, "encoded_bytes": 100},
+		}
+		if !reflect.DeepEqual(fmt.Sprint(fields), fmt.Sprint(expected)) {
+			t.Errorf("expected the fields %v got %v", expected, fields)
+		}
+		// 10+72+6 + 10+68+6 + 12+100+6 for the fields and 2+6 for the row key
+		if resp.Data["bytes_per_row"] != 298 || resp.Data["estimated_bytes"] != 200+100*298 {
+			t.Errorf("expected 298 bytes per row got %v and %v", resp.Data["bytes_per_row"], resp.Data["estimated_bytes"])
+		}
+
+		// the estimate of each field is the size of its real cyphertext
+		encryptResp, err := request("encrypt", map[string]interface{}{"test88-gcm": strings.Repeat("a", 20), "test88-siv": strings.Repeat("b", 30)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encryptResp.Data["test88-gcm"].(string)) != 72 || len(encryptResp.Data["test88-siv"].(string)) != 68 {
+			t.Errorf("expected the estimated cyphertext sizes got %v", encryptResp.Data)
+		}
+
+		// a number of fields is sized as AesGcm
+		resp, err = request("estimate", map[string]interface{}{"ROWS": 10, "FIELDS": 3, "AVG_VALUE_BYTES": 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["bytes_per_row"] != 3*(10+72+6)+1+6 || resp.Data["fields"] != nil {
+			t.Errorf("expected 3 AesGcm fields per row got %v", resp.Data)
+		}
+
+		for _, data := range []map[string]interface{}{
+			{"ROWS": 10},
+			{"FIELDS": 3},
+			{"ROWS": 0, "FIELDS": 3, "AVG_VALUE_BYTES": 20},
+			{"FIELDS": "three", "AVG_VALUE_BYTES": 20},
+			{"FIELDS": map[string]interface{}{"test88-gcm": -1}},
+		} {
+			resp, err = request("estimate", data)
+			if err == nil || resp == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+				t.Errorf("expected an invalid request for %v got %v", data, err)
+			}
+		}
+	})
+
+	t.Run("test89 MODE picks the internal or export keyset", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test89-siv": DeterministicKeyset, "test89-gcm": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test89-siv": "siv/test89-siv", "test89-gcm": "gcm/test89-gcm"}, false, t)
+
+		// a field without an export keyset fails in export mode
+		_, err := request("encrypt", map[string]interface{}{"test89-siv": "hello", "MODE": "export"})
+		if err == nil || !strings.Contains(err.Error(), "test89-siv has no export keyset") {
+			t.Errorf("expected an error for a field without an export keyset got %v", err)
+		}
+
+		// the export keyset defaults to RAW, the field's own keyset is unchanged
+		resp, err := request("exportKey", map[string]interface{}{"test89-siv": ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if respKeyset := fmt.Sprintf("%v", resp.Data["test89-siv"]); !strings.Contains(respKeyset, `"value":"***"`) {
+			t.Errorf("expected a masked keyset %s", respKeyset)
+		}
+		exportKeyset, _ := AEAD_CONFIG.Get("export/test89-siv")
+		if strings.Count(fmt.Sprintf("%v", exportKeyset), `"RAW"`) != 6 {
+			t.Errorf("expected every key of the export keyset to be RAW %v", exportKeyset)
+		}
+		if internalKeyset, _ := AEAD_CONFIG.Get("siv/test89-siv"); internalKeyset != DeterministicKeyset {
+			t.Errorf("expected the keyset of the field to be unchanged %v", internalKeyset)
+		}
+
+		cypherText := func(mode string) []byte {
+			resp, err := request("encrypt", map[string]interface{}{"test89-siv": "hello", "MODE": mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", resp.Data["test89-siv"]))
+			return decoded
+		}
+		internal := cypherText("internal")
+		export := cypherText("EXPORT")
+		if len(internal) == 0 || internal[0] != 0x01 || len(internal)-len(export) != 5 || !bytes.Equal(internal[5:], export) {
+			t.Errorf("expected TINK cyphertext internally and the same RAW cyphertext for export got %x and %x", internal, export)
+		}
+		noMode, err := request("encrypt", map[string]interface{}{"test89-siv": "hello"})
+		if err != nil || noMode.Data["test89-siv"] != b64.StdEncoding.EncodeToString(internal) {
+			t.Errorf("expected internal to be the default got %v %v", noMode, err)
+		}
+
+		// each mode decrypts its own cyphertext
+		for mode, c := range map[string][]byte{"internal": internal, "export": export} {
+			resp, err := request("decrypt", map[string]interface{}{"test89-siv": b64.StdEncoding.EncodeToString(c), "MODE": mode})
+			if err != nil || resp.Data["test89-siv"] != "hello" {
+				t.Errorf("expected %s cyphertext to decrypt in %s mode got %v %v", mode, mode, resp, err)
+			}
+		}
+		resp, err = request("decrypt", map[string]interface{}{"test89-siv": b64.StdEncoding.EncodeToString(export)})
+		if err == nil && resp.Data["test89-siv"] == "hello" {
+			t.Errorf("expected the export cyphertext not to decrypt with the internal keyset")
+		}
+
+		// EXPORT_PREFIX sets the prefix of an export keyset with no prefix given, fields without a keyset are returned as they are
+		saveConfig(b, storage, map[string]interface{}{"EXPORT_PREFIX": "LEGACY"}, true, t)
+		if _, err := request("exportKey", map[string]interface{}{"test89-gcm": ""}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test89-gcm": "hello", "test89-plain": "plain", "MODE": "export"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", resp.Data["test89-gcm"]))
+		if len(legacy) == 0 || legacy[0] != 0x00 || resp.Data["test89-plain"] != "plain" {
+			t.Errorf("expected LEGACY cyphertext and the plain field as it is got %v", resp.Data)
+		}
+
+		_, err = request("encrypt", map[string]interface{}{"test89-siv": "hello", "MODE": "external"})
+		if err == nil || !strings.Contains(err.Error(), ERROR_INVALID_REQUEST) {
+			t.Errorf("expected an invalid MODE to fail got %v", err)
+		}
+		_, err = request("exportKey", map[string]interface{}{"test89-nokey": ""})
+		if err == nil || !strings.Contains(err.Error(), ERROR_KEY_NOT_FOUND) {
+			t.Errorf("expected a field without a keyset to fail got %v", err)
+		}
+
+		// a rotate does not rotate the export keysets on their own, they are made again from the rotated keysets and
+		// keep their output prefix
+		if _, err := request("rotate", map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range []string{"test89-siv", "test89-gcm"} {
+			keyName, _ := aeadutils.GetEncryptionKeyName(field, AEAD_CONFIG)
+			internalKeyset, _ := AEAD_CONFIG.Get(keyName)
+			exportKeyset, _ := AEAD_CONFIG.Get("export/" + field)
+			var internalStruct, exportStruct aeadutils.KeySetStruct
+			json.Unmarshal([]byte(fmt.Sprintf("%v", internalKeyset)), &internalStruct)
+			json.Unmarshal([]byte(fmt.Sprintf("%v", exportKeyset)), &exportStruct)
+			if internalStruct.PrimaryKeyID != exportStruct.PrimaryKeyID || strings.Count(fmt.Sprintf("%v", exportKeyset), `"keyId"`) != strings.Count(fmt.Sprintf("%v", internalKeyset), `"keyId"`) {
+				t.Errorf("expected the export keyset of %s to follow the rotated keyset got %v", field, exportKeyset)
+			}
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test89-gcm": "rotated", "MODE": "export"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotated, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", resp.Data["test89-gcm"]))
+		if len(rotated) == 0 || rotated[0] != 0x00 {
+			t.Errorf("expected the export keyset to stay LEGACY after the rotate got %x", rotated)
+		}
+		for _, c := range []string{fmt.Sprintf("%v", resp.Data["test89-gcm"]), b64.StdEncoding.EncodeToString(legacy)} {
+			resp, err := request("decrypt", map[string]interface{}{"test89-gcm": c, "MODE": "export"})
+			if err != nil || (resp.Data["test89-gcm"] != "rotated" && resp.Data["test89-gcm"] != "hello") {
+				t.Errorf("expected the export cyphertext from before and after the rotate to decrypt got %v %v", resp, err)
+			}
+		}
+	})
+
+	t.Run("test90 importKey returns the type of each keyset", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := map[string]interface{}{"test90-gcm": NonDeterministicKeyset, "test90-siv": DeterministicKeyset}
+		resp := importKey(b, storage, request, t)
+		expected := map[string]interface{}{
+			"test90-gcm": map[string]interface{}{"KEY_NAME": "gcm/test90-gcm", "TYPE": "NON DETERMINISTIC", "ALGORITHM": "AesGcm"},
+			"test90-siv": map[string]interface{}{"KEY_NAME": "siv/test90-siv", "TYPE": "DETERMINISTIC", "ALGORITHM": "AesSiv"},
+		}
+		if !reflect.DeepEqual(resp.Data["KEY_TYPES"], expected) {
+			t.Errorf("expected the key types %v got %v", expected, resp.Data["KEY_TYPES"])
+		}
+		if resp.Data["test90-gcm"] != NonDeterministicKeyset || resp.Data["test90-siv"] != DeterministicKeyset {
+			t.Errorf("expected the keysets to still be returned got %v", resp.Data)
+		}
+		if _, ok := request["KEY_TYPES"]; ok {
+			t.Errorf("expected the request not to be changed got %v", request)
+		}
+		if _, ok := AEAD_CONFIG.Get("KEY_TYPES"); ok {
+			t.Errorf("expected KEY_TYPES not to be saved to config")
+		}
+
+		// a field cannot be called KEY_TYPES as the response could not tell it from the key types
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "importKey",
+			Data:      map[string]interface{}{"KEY_TYPES": NonDeterministicKeyset},
+		})
+		if err == nil || !strings.HasPrefix(err.Error(), "INVALID_REQUEST") {
+			t.Errorf("expected INVALID_REQUEST importing a field called KEY_TYPES got %v", err)
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/KEY_TYPES"); ok {
+			t.Errorf("expected gcm/KEY_TYPES not to be imported")
+		}
+	})
+
+	t.Run("test91 rollKey rotates, re-encrypts and purges", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test91-gcm": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test91-gcm": "gcm/test91-gcm"}, false, t)
+		encryptResp := encryptData(b, storage, map[string]interface{}{"test91-gcm": "hello"}, t)
+		for _, keyID := range []string{"2832419897", "2233686170"} {
+			if _, err := request("updateKeyStatus", map[string]interface{}{"test91-gcm": map[string]interface{}{keyID: "DISABLED"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// nothing is saved if a value does not decrypt
+		_, err := request("rollKey", map[string]interface{}{"test91-gcm": "bm90IGN5cGhlcnRleHQ="})
+		if err == nil {
+			t.Errorf("expected rollKey to fail for cyphertext that does not decrypt")
+		}
+		keySet, _ := AEAD_CONFIG.Get("gcm/test91-gcm")
+		if strings.Count(fmt.Sprintf("%v", keySet), `"keyId"`) != 4 {
+			t.Errorf("expected the keyset to be unchanged %v", keySet)
+		}
+
+		resp, err := request("rollKey", map[string]interface{}{"test91-gcm": encryptResp.Data["test91-gcm"]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rolled := resp.Data["ROLLED"].(map[string]interface{})["gcm/test91-gcm"].(map[string]interface{})
+		if rolled["PURGED"] != 2 {
+			t.Errorf("expected the 2 disabled keys to be purged got %v", rolled)
+		}
+		keySet, _ = AEAD_CONFIG.Get("gcm/test91-gcm")
+		var keySetStruct aeadutils.KeySetStruct
+		if err := json.Unmarshal([]byte(fmt.Sprintf("%v", keySet)), &keySetStruct); err != nil {
+			t.Fatal(err)
+		}
+		keyIDs := map[int]bool{}
+		for _, key := range keySetStruct.Key {
+			keyIDs[key.KeyID] = true
+		}
+		// the new primary, the old primary that decrypted the cyphertext and the other enabled key
+		if len(keyIDs) != 3 || !keyIDs[3192631270] || !keyIDs[1532149397] || uint32(keySetStruct.PrimaryKeyID) != rolled["PRIMARY_KEY_ID"] || keyIDs[2832419897] {
+			t.Errorf("expected the new primary %v and the enabled keys got %v", rolled["PRIMARY_KEY_ID"], keySet)
+		}
+
+		// the new cyphertext is made with the new primary and the old cyphertext still decrypts
+		newCypherText := fmt.Sprintf("%v", resp.Data["test91-gcm"])
+		decoded, _ := b64.StdEncoding.DecodeString(newCypherText)
+		if len(decoded) < 5 || binary.BigEndian.Uint32(decoded[1:5]) != rolled["PRIMARY_KEY_ID"] {
+			t.Errorf("expected the cyphertext to be re-encrypted with the new primary %x", decoded)
+		}
+		for _, cypherText := range []interface{}{newCypherText, encryptResp.Data["test91-gcm"]} {
+			decryptResp := decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test91-gcm": cypherText}}, t)
+			if decryptResp.Data["test91-gcm"] != "hello" {
+				t.Errorf("expected %v to decrypt got %v", cypherText, decryptResp.Data)
+			}
+		}
+	})
+
+	t.Run("test92 RATE_LIMIT_ throttles encrypt of a field", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "encrypt",
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test92-limited": NonDeterministicKeyset, "test92-free": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test92-limited":            "gcm/test92-limited",
+			"test92-free":               "siv/test92-free",
+			"RATE_LIMIT_test92-limited": "3",
+		}, false, t)
+
+		// a burst of the limit is allowed, the next is throttled
+		for i := 0; i < 3; i++ {
+			if _, err := request(map[string]interface{}{"test92-limited": "hello"}); err != nil {
+				t.Fatalf("expected encrypt %d to be within the limit got %v", i, err)
+			}
+		}
+		resp, err := request(map[string]interface{}{"test92-limited": "hello", "test92-free": "hello"})
+		if err == nil || resp.Data["error_code"] != ERROR_RATE_LIMITED || !strings.Contains(err.Error(), "test92-limited is over its limit of 3 encrypts a second") {
+			t.Errorf("expected the burst above the limit to be throttled got %v", err)
+		}
+
+		// a field without a limit is not throttled
+		for i := 0; i < 10; i++ {
+			if _, err := request(map[string]interface{}{"test92-free": "hello"}); err != nil {
+				t.Fatalf("expected a field without RATE_LIMIT_ to be unlimited got %v", err)
+			}
+		}
+
+		// each value of a bulk request takes a token, more values than the bucket holds always fail
+		bulk := map[string]interface{}{}
+		for i := 0; i < 4; i++ {
+			bulk[strconv.Itoa(i)] = map[string]interface{}{"test92-limited": "hello"}
+		}
+		time.Sleep(time.Second)
+		_, err = request(bulk)
+		if err == nil || !strings.Contains(err.Error(), "the request has 4 values") {
+			t.Errorf("expected a bulk request above the limit to fail got %v", err)
+		}
+		// the tokens of a request that failed are not taken
+		delete(bulk, "3")
+		if _, err := request(bulk); err != nil {
+			t.Errorf("expected the bucket to be full after a second got %v", err)
+		}
+
+		// the bucket refills
+		time.Sleep(400 * time.Millisecond)
+		if _, err := request(map[string]interface{}{"test92-limited": "hello"}); err != nil {
+			t.Errorf("expected a token after a third of a second got %v", err)
+		}
+
+		// encryptcol and rekeyData encrypt too, so take from the same bucket
+		importKey(b, storage, map[string]interface{}{"test92-col": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test92-col": "gcm/test92-col", "RATE_LIMIT_test92-col": "2"}, false, t)
+		cypherText := encryptData(b, storage, map[string]interface{}{"test92-col": "hello"}, t).Data["test92-col"]
+		column := func(rows int) map[string]interface{} {
+			data := map[string]interface{}{}
+			for i := 0; i < rows; i++ {
+				data[strconv.Itoa(i)] = map[string]interface{}{"test92-col": "hello"}
+			}
+			return data
+		}
+		colRequest := func(path string, data map[string]interface{}) error {
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+			return err
+		}
+		if err := colRequest("encryptcol", column(3)); err == nil || !strings.Contains(err.Error(), ERROR_RATE_LIMITED) || !strings.Contains(err.Error(), "the request has 3 values") {
+			t.Errorf("expected an encryptcol above the limit to fail got %v", err)
+		}
+		if err := colRequest("encryptcol", column(2)); err == nil || !strings.Contains(err.Error(), "test92-col is over its limit of 2 encrypts a second") {
+			t.Errorf("expected an encryptcol above the tokens left to be throttled got %v", err)
+		}
+		encryptDataCol(b, storage, column(1), t)
+		keyset, _ := AEAD_CONFIG.Get("gcm/test92-col")
+		if err := colRequest("rekeyData", map[string]interface{}{"test92-col": cypherText}); err == nil || !strings.Contains(err.Error(), "test92-col is over its limit of 2 encrypts a second") {
+			t.Errorf("expected a rekeyData with no tokens left to be throttled got %v", err)
+		}
+		if rekeyed, _ := AEAD_CONFIG.Get("gcm/test92-col"); rekeyed != keyset {
+			t.Error("expected a throttled rekeyData not to rotate the keyset")
+		}
+	})
+
+	t.Run("test93 selftest roundtrips a canary", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test93-gcm": NonDeterministicKeyset, "test93-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test93-gcm": "gcm/test93-gcm",
+			"test93-siv": "siv/test93-siv",
+			// a keyset whose primary key is disabled cannot encrypt
+			"gcm/test93-bad": strings.Replace(NonDeterministicKeyset, `"status":"ENABLED","keyId":3192631270`, `"status":"DISABLED","keyId":3192631270`, 1),
+			"test93-bad":     "gcm/test93-bad",
+		}, false, t)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "selftest",
+			Data:      map[string]interface{}{"test93-gcm": "", "test93-siv": "", "test93-bad": "", "test93-nokey": ""},
+		})
+		if err != nil {
+			t.Fatal("selftest", err)
+		}
+		for fieldName, passed := range map[string]bool{"test93-gcm": true, "test93-siv": true, "test93-bad": false, "test93-nokey": false} {
+			result := resp.Data[fieldName].(map[string]interface{})
+			if result["PASSED"] != passed {
+				t.Errorf("expected selftest of %s to have PASSED %v got %v", fieldName, passed, result)
+			}
+			if _, ok := result["ENCRYPT_MS"]; ok != (fieldName != "test93-nokey") {
+				t.Errorf("expected selftest of %s to be timed only if it has a key got %v", fieldName, result)
+			}
+			for k, v := range result {
+				if fmt.Sprintf("%v", v) == selfTestCanary {
+					t.Errorf("expected selftest of %s not to return the canary in %s", fieldName, k)
+				}
+			}
+		}
+
+		// the canary is not persisted
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "config",
+		})
+		if err != nil {
+			t.Fatal("read config", err)
+		}
+		if _, ok := resp.Data["test93-gcm"]; !ok || strings.Contains(fmt.Sprintf("%v", resp.Data), "canary") {
+			t.Errorf("expected the config to be unchanged by selftest got %v", resp.Data)
+		}
+	})
+
+	t.Run("test94 VERSION_TAG_ tags cyphertext and decrypt strips it", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test94-gcm": NonDeterministicKeyset, "test94-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test94-gcm": "gcm/test94-gcm", "test94-siv": "siv/test94-siv"}, false, t)
+		plain := map[string]interface{}{"test94-gcm": "hello", "test94-siv": "world"}
+
+		// legacy cyphertext from before the tag was turned on
+		legacy := encryptData(b, storage, plain, t)
+		for fieldName, v := range legacy.Data {
+			if strings.HasPrefix(fmt.Sprintf("%v", v), versionTag) {
+				t.Errorf("expected %s not to be tagged without VERSION_TAG_ got %v", fieldName, v)
+			}
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"VERSION_TAG_test94-gcm": "true", "VERSION_TAG_test94-siv": true}, false, t)
+		tagged := encryptData(b, storage, plain, t)
+		for fieldName, v := range tagged.Data {
+			if !strings.HasPrefix(fmt.Sprintf("%v", v), "v1b:") {
+				t.Errorf("expected %s to be tagged v1b: got %v", fieldName, v)
+			}
+		}
+		if !reflect.DeepEqual(decryptData(b, storage, tagged, t).Data, plain) {
+			t.Errorf("expected the tagged cyphertext to roundtrip")
+		}
+		if !reflect.DeepEqual(decryptData(b, storage, legacy, t).Data, plain) {
+			t.Errorf("expected the untagged legacy cyphertext to still decrypt")
+		}
+		// the tag is outside the cyphertext, a deterministic field is still deterministic
+		if siv := strings.TrimPrefix(fmt.Sprintf("%v", tagged.Data["test94-siv"]), versionTag); siv != legacy.Data["test94-siv"] {
+			t.Errorf("expected the tagged deterministic cyphertext %v to be the legacy %v behind the tag", siv, legacy.Data["test94-siv"])
+		}
+
+		// the tag names the encoding, so hex behind a v1h: tag decrypts whatever the request encoding is
+		gcmBytes, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", legacy.Data["test94-gcm"]))
+		resp := decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test94-gcm": "v1h:" + hex.EncodeToString(gcmBytes)}}, t)
+		if resp.Data["test94-gcm"] != "hello" {
+			t.Errorf("expected hex behind a v1h: tag to decrypt got %v", resp.Data)
+		}
+
+		// a future format is refused rather than decrypted as this one
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "decrypt",
+			Data:      map[string]interface{}{"test94-gcm": "v2b:" + fmt.Sprintf("%v", legacy.Data["test94-gcm"])},
+		})
+		if err == nil || resp.Data["error_code"] != ERROR_DECRYPT_FAILED || !strings.Contains(err.Error(), "only format 1") {
+			t.Errorf("expected a v2 tag to fail with DECRYPT_FAILED got %v", err)
+		}
+
+		// encryptcol and decryptcol tag and strip too
+		cols := map[string]interface{}{"0": map[string]interface{}{"test94-gcm": "a"}, "1": map[string]interface{}{"test94-gcm": "b"}}
+		colResp := encryptDataCol(b, storage, cols, t)
+		if !strings.Contains(fmt.Sprintf("%v", colResp.Data), "v1b:") {
+			t.Errorf("expected encryptcol to tag the cyphertext got %v", colResp.Data)
+		}
+		if !reflect.DeepEqual(decryptDataCol(b, storage, colResp, t).Data, cols) {
+			t.Errorf("expected the tagged columns to roundtrip")
+		}
+
+		// tagged cyphertext still decrypts once the tag is turned off
+		saveConfig(b, storage, map[string]interface{}{"VERSION_TAG_test94-gcm": "false", "VERSION_TAG_test94-siv": "false"}, false, t)
+		if !reflect.DeepEqual(decryptData(b, storage, tagged, t).Data, plain) {
+			t.Errorf("expected the tagged cyphertext to decrypt after VERSION_TAG_ is off")
+		}
+	})
+
+	t.Run("test95 AAD_INHERIT_ members of a family inherit its ADDITIONAL_DATA", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test95-family": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test95-line1":  "gcm/test95-family",
+			"test95-line2":  "gcm/test95-family",
+			"test95-line3":  "gcm/test95-family",
+			"test95-nested": "test95-line3",
+		}, false, t)
+		decryptWithAAD := func(cypherText interface{}, additionalData string) error {
+			kh, err := aeadutils.ValidateKeySetJson(NonDeterministicKeyset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cypherTextBytes, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", cypherText))
+			_, err = aeadutils.DecryptWithKeyHandle(kh, cypherTextBytes, []byte(additionalData))
+			return err
+		}
+		plain := map[string]interface{}{"test95-line1": "a", "test95-line2": "b", "test95-line3": "c", "test95-nested": "d"}
+
+		// without AAD_INHERIT_ each member has its own name as additional data
+		resp := encryptData(b, storage, plain, t)
+		for fieldName, v := range resp.Data {
+			if err := decryptWithAAD(v, fieldName); err != nil {
+				t.Errorf("expected %s to have its name as additional data got %v", fieldName, err)
+			}
+		}
+
+		// with AAD_INHERIT_ the members have the family's, unless they have their own
+		saveConfig(b, storage, map[string]interface{}{
+			"AAD_INHERIT_gcm/test95-family":     "true",
+			"ADDITIONAL_DATA_gcm/test95-family": "address",
+			"ADDITIONAL_DATA_test95-line2":      "line2-override",
+		}, false, t)
+		expected := map[string]string{"test95-line1": "address", "test95-line2": "line2-override", "test95-line3": "address", "test95-nested": "test95-nested"}
+		resp = encryptData(b, storage, plain, t)
+		for fieldName, v := range resp.Data {
+			if err := decryptWithAAD(v, expected[fieldName]); err != nil {
+				t.Errorf("expected %s to have additional data %s got %v", fieldName, expected[fieldName], err)
+			}
+		}
+		if !reflect.DeepEqual(decryptData(b, storage, resp, t).Data, plain) {
+			t.Errorf("expected the inherited additional data to roundtrip")
+		}
+
+		// a family of families inherits too, once the inner family inherits
+		saveConfig(b, storage, map[string]interface{}{"AAD_INHERIT_test95-line3": "true"}, false, t)
+		resp = encryptData(b, storage, map[string]interface{}{"test95-nested": "d"}, t)
+		if err := decryptWithAAD(resp.Data["test95-nested"], "address"); err != nil {
+			t.Errorf("expected test95-nested to inherit through test95-line3 got %v", err)
+		}
+
+		// the family's AAD_IS_B64_ applies to the additional data it passes on
+		saveConfig(b, storage, map[string]interface{}{
+			"ADDITIONAL_DATA_gcm/test95-family": b64.StdEncoding.EncodeToString([]byte("binary")),
+			"AAD_IS_B64_gcm/test95-family":      "true",
+		}, true, t)
+		resp = encryptData(b, storage, map[string]interface{}{"test95-line1": "a"}, t)
+		if err := decryptWithAAD(resp.Data["test95-line1"], "binary"); err != nil {
+			t.Errorf("expected test95-line1 to inherit the decoded family additional data got %v", err)
+		}
+	})
+
+	t.Run("test96 importKey rejects duplicate key ids", func(t *testing.T) {
+		b, storage := testBackend(t)
+
+		// 1532149397 renumbered to the id of another key, tink itself accepts it
+		duplicate := strings.Replace(NonDeterministicKeyset, `"keyId":1532149397`, `"keyId":2233686170`, 1)
+		if _, err := aeadutils.ValidateKeySetJson(duplicate); err != nil {
+			t.Fatalf("expected tink to parse the duplicate key id keyset got %v", err)
+		}
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "importKey",
+			Data:      map[string]interface{}{"test96-dup": duplicate},
+		})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_KEYSET || !strings.Contains(err.Error(), "key id 2233686170 is used by more than one key") {
+			t.Errorf("expected importKey to reject the duplicate key id got %v", err)
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test96-dup"); ok {
+			t.Error("expected the keyset with a duplicate key id not to be saved")
+		}
+
+		// the same keyset with distinct ids imports
+		importKey(b, storage, map[string]interface{}{"test96-dup": NonDeterministicKeyset}, t)
+	})
+
+	t.Run("test97 ENCODING_ base64url cyphertext roundtrips", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test97-gcm": NonDeterministicKeyset, "test97-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test97-gcm":          "gcm/test97-gcm",
+			"test97-siv":          "siv/test97-siv",
+			"ENCODING_test97-gcm": "base64url",
+			"ENCODING_test97-siv": "BASE64URL",
+		}, false, t)
+
+		// encrypt until the standard base64 of the cyphertext would have both + and /
+		var stdEncoded string
+		var resp *logical.Response
+		for i := 0; i < 1000 && !(strings.Contains(stdEncoded, "+") && strings.Contains(stdEncoded, "/")); i++ {
+			resp = encryptData(b, storage, map[string]interface{}{"test97-gcm": "hello " + strconv.Itoa(i), "test97-siv": "world " + strconv.Itoa(i)}, t)
+			cypherText, err := b64.RawURLEncoding.DecodeString(fmt.Sprintf("%v", resp.Data["test97-gcm"]))
+			if err != nil {
+				t.Fatalf("expected url safe base64 without padding got %v %v", resp.Data["test97-gcm"], err)
+			}
+			stdEncoded = b64.StdEncoding.EncodeToString(cypherText)
+		}
+		if !strings.Contains(stdEncoded, "+") || !strings.Contains(stdEncoded, "/") {
+			t.Fatal("expected a cyphertext whose standard base64 has + and /")
+		}
+		for fieldName, v := range resp.Data {
+			if strings.ContainsAny(fmt.Sprintf("%v", v), "+/=") {
+				t.Errorf("expected %s to be url safe base64 without padding got %v", fieldName, v)
+			}
+		}
+		plain := decryptData(b, storage, resp, t).Data
+		if !strings.HasPrefix(fmt.Sprintf("%v", plain["test97-gcm"]), "hello ") || !strings.HasPrefix(fmt.Sprintf("%v", plain["test97-siv"]), "world ") {
+			t.Errorf("expected the url safe cyphertext to roundtrip got %v", plain)
+		}
+
+		// the request ENCODING overrides the field's, and auto and padded url safe base64 decrypt too
+		decrypt := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "decrypt",
+				Data:      data,
+			})
+		}
+		urlEncoded := fmt.Sprintf("%v", resp.Data["test97-gcm"])
+		for name, data := range map[string]map[string]interface{}{
+			"base64":    {"test97-gcm": stdEncoded, "ENCODING": "base64"},
+			"auto":      {"test97-gcm": urlEncoded, "ENCODING": "auto"},
+			"base64url": {"test97-gcm": strings.ReplaceAll(strings.ReplaceAll(strings.TrimRight(stdEncoded, "="), "+", "-"), "/", "_") + strings.Repeat("=", strings.Count(stdEncoded, "=")), "ENCODING": "base64url"},
+		} {
+			got, err := decrypt(data)
+			if err != nil || got.Data["test97-gcm"] != plain["test97-gcm"] {
+				t.Errorf("%s: expected %v got %v %v", name, plain["test97-gcm"], got, err)
+			}
+		}
+		// standard base64 with + and / is not url safe base64
+		got, err := decrypt(map[string]interface{}{"test97-gcm": stdEncoded})
+		if err == nil && got.Data["test97-gcm"] == plain["test97-gcm"] {
+			t.Error("expected standard base64 not to decrypt as the field's base64url")
+		}
+
+		// encryptcol and decryptcol use the field's encoding too
+		cols := map[string]interface{}{"0": map[string]interface{}{"test97-gcm": "a"}, "1": map[string]interface{}{"test97-gcm": "b"}}
+		colResp := encryptDataCol(b, storage, cols, t)
+		if !reflect.DeepEqual(decryptDataCol(b, storage, colResp, t).Data, cols) {
+			t.Errorf("expected the url safe columns to roundtrip")
+		}
+
+		// a version tag names the url safe encoding
+		saveConfig(b, storage, map[string]interface{}{"VERSION_TAG_test97-gcm": "true"}, false, t)
+		resp = encryptData(b, storage, map[string]interface{}{"test97-gcm": "tagged"}, t)
+		if !strings.HasPrefix(fmt.Sprintf("%v", resp.Data["test97-gcm"]), "v1u:") {
+			t.Errorf("expected a v1u: tag got %v", resp.Data["test97-gcm"])
+		}
+		if got, err := decrypt(map[string]interface{}{"test97-gcm": resp.Data["test97-gcm"], "ENCODING": "hex"}); err != nil || got.Data["test97-gcm"] != "tagged" {
+			t.Errorf("expected the tag to override the request ENCODING got %v %v", got, err)
+		}
+
+		// an unknown ENCODING_ fails rather than encrypting in the wrong encoding
+		saveConfig(b, storage, map[string]interface{}{"ENCODING_test97-gcm": "base32"}, true, t)
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt",
+			Data:      map[string]interface{}{"test97-gcm": "hello"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "ENCODING_test97-gcm must be base64, base64url, hex or bqbytes") {
+			t.Errorf("expected an unknown ENCODING_ to fail got %v", err)
+		}
+	})
+
+	t.Run("test98 KEY_IDS reports the key that decrypted each field", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test98-key": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test98-key": "gcm/test98-key"}, false, t)
+
+		primaryCypherText := encryptData(b, storage, map[string]interface{}{"test98-key": "primary key"}, t).Data["test98-key"]
+		if _, err := request("updatePrimaryKeyID", map[string]interface{}{"test98-key": "1532149397"}); err != nil {
+			t.Fatal(err)
+		}
+		otherCypherText := encryptData(b, storage, map[string]interface{}{"test98-key": "other key"}, t).Data["test98-key"]
+
+		resp, err := request("decrypt", map[string]interface{}{"test98-key": primaryCypherText, "KEY_IDS": "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyIDs := resp.Data["KEY_IDS"].(map[string]interface{})
+		if resp.Data["test98-key"] != "primary key" || keyIDs["test98-key"] != 3192631270 {
+			t.Errorf("expected the cyphertext decrypted by key 3192631270 got %v", resp.Data)
+		}
+		resp = decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test98-key": primaryCypherText}}, t)
+		if _, ok := resp.Data["KEY_IDS"]; ok {
+			t.Error("expected no KEY_IDS in the response without the option")
+		}
+
+		// the rows of a bulk request are added up by key name and key id
+		resp, err = request("decrypt", map[string]interface{}{
+			"0":       map[string]interface{}{"test98-key": primaryCypherText},
+			"1":       map[string]interface{}{"test98-key": otherCypherText},
+			"2":       map[string]interface{}{"test98-key": otherCypherText},
+			"KEY_IDS": "true",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for row, expected := range map[string]int{"0": 3192631270, "1": 1532149397, "2": 1532149397} {
+			rowKeyIDs := resp.Data[row].(map[string]interface{})["KEY_IDS"].(map[string]interface{})
+			if rowKeyIDs["test98-key"] != expected {
+				t.Errorf("expected row %s decrypted by key %d got %v", row, expected, resp.Data[row])
+			}
+			if _, ok := resp.Data[row].(map[string]interface{})["KEY_ID_COUNTS"]; ok {
+				t.Errorf("expected KEY_ID_COUNTS only for the whole request got %v", resp.Data[row])
+			}
+		}
+		counts := resp.Data["KEY_ID_COUNTS"].(map[string]interface{})
+		expectedCounts := map[string]int{"3192631270": 1, "1532149397": 2}
+		if !reflect.DeepEqual(counts["gcm/test98-key"], expectedCounts) {
+			t.Errorf("expected counts %v for gcm/test98-key got %v", expectedCounts, counts)
+		}
+
+		// RAW cyphertext has no key id prefix, so its key is found by decrypting
+		if _, err := request("convertPrefix", map[string]interface{}{"test98-key": "RAW"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := request("updatePrimaryKeyID", map[string]interface{}{"test98-key": "2832419897"}); err != nil {
+			t.Fatal(err)
+		}
+		rawCypherText := encryptData(b, storage, map[string]interface{}{"test98-key": "raw key"}, t).Data["test98-key"]
+		resp, err = request("decrypt", map[string]interface{}{"test98-key": rawCypherText, "KEY_IDS": "true"})
+		if err != nil || resp.Data["test98-key"] != "raw key" || resp.Data["KEY_IDS"].(map[string]interface{})["test98-key"] != 2832419897 {
+			t.Errorf("expected the RAW cyphertext decrypted by key 2832419897 got %v %v", resp, err)
+		}
+
+		resp, err = request("decrypt", map[string]interface{}{"test98-key": rawCypherText, "KEY_IDS": "sometimes"})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for a KEY_IDS that is not a bool got %v", err)
+		}
+	})
+
+	t.Run("test99 kmscheck gets and encrypts with the kms keys of each region", func(t *testing.T) {
+		b, storage := testBackend(t)
+		defer func() { newKMSWrapper = bqutils.NewKMSWrapper }()
+		newKMSWrapper = func(ctx context.Context, envOptions cmap.ConcurrentMap) (bqutils.KMSWrapper, error) {
+			return &fakeKMSWrapper{}, nil
+		}
+		request := func(data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      "kmscheck",
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test99-key": NonDeterministicKeyset, "test99-other": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"BQ_KMSKEY": "import-key", "BQ_KMSKEY_test99_other": "other-key"}, true, t)
+
+		resp, err := request(map[string]interface{}{"gcm/test99-key": ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		regions := resp.Data["regions"].(map[string]interface{})
+		if resp.Data["valid"] != true || len(regions) != 4 {
+			t.Errorf("expected the kms key of test99-key to be usable in 4 regions got %v", resp.Data)
+		}
+		for region, keys := range regions {
+			if !reflect.DeepEqual(keys, map[string]interface{}{"import-key": "ok"}) {
+				t.Errorf("%s: expected import-key ok got %v", region, keys)
+			}
+		}
+
+		resp, err = request(map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["valid"] != false {
+			t.Errorf("expected the kms key of test99-other not to be usable got %v", resp.Data)
+		}
+		keys := resp.Data["regions"].(map[string]interface{})["eu"].(map[string]interface{})
+		if keys["import-key"] != "ok" || !strings.Contains(fmt.Sprintf("%v", keys["other-key"]), "kms key other-key not found") {
+			t.Errorf("expected import-key ok and other-key not found in eu got %v", keys)
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"BQ_KMS_PROVIDER": "azure"}, true, t)
+		resp, err = request(map[string]interface{}{})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for a kms provider BQ cannot use got %v", err)
+		}
+	})
+
+	t.Run("test100 ARCHIVE_ON_DELETE archives keysets for restoreArchived", func(t *testing.T) {
+		b, storage := testBackend(t)
+		now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		defer func() { archiveNow = time.Now }()
+		archiveNow = func() time.Time { return now }
+		request := func(operation logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: operation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test100-key": NonDeterministicKeyset, "test100-other": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test100-key": "gcm/test100-key"}, false, t)
+		cypherText := encryptData(b, storage, map[string]interface{}{"test100-key": "archived"}, t).Data["test100-key"]
+
+		// without ARCHIVE_ON_DELETE a deleted keyset is gone
+		if _, err := request(logical.UpdateOperation, "configDelete", map[string]interface{}{"siv/test100-other": ""}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := request(logical.ReadOperation, "restoreArchived", nil)
+		if err != nil || len(resp.Data) != 0 {
+			t.Errorf("expected no archives got %v %v", resp, err)
+		}
+
+		saveConfig(b, storage, map[string]interface{}{"ARCHIVE_ON_DELETE": "true", "ARCHIVE_RETENTION_DAYS": "7"}, true, t)
+		if _, err := request(logical.UpdateOperation, "configDelete", map[string]interface{}{"gcm/test100-key": ""}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := AEAD_CONFIG.Get("gcm/test100-key"); ok {
+			t.Fatal("expected the keyset to be deleted from the config")
+		}
+		// the keyset is archived once per delete, restoreArchived restores the latest
+		now = now.Add(time.Hour)
+		if _, err := request(logical.UpdateOperation, "config", map[string]interface{}{"gcm/test100-key": DeterministicKeyset}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := request(logical.UpdateOperation, "configDelete", map[string]interface{}{"gcm/test100-key": ""}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = request(logical.ReadOperation, "restoreArchived", nil)
+		expected := []string{"2026-01-01T01:00:00Z", "2026-01-01T00:00:00Z"}
+		if err != nil || !reflect.DeepEqual(resp.Data["gcm/test100-key"], expected) {
+			t.Errorf("expected the archives %v got %v %v", expected, resp, err)
+		}
+
+		// a name in the config is not restored over
+		saveConfig(b, storage, map[string]interface{}{"gcm/test100-key": DeterministicKeyset}, true, t)
+		resp, err = request(logical.UpdateOperation, "restoreArchived", map[string]interface{}{"gcm/test100-key": ""})
+		if err == nil || resp.Data["error_code"] != ERROR_FIELD_EXISTS {
+			t.Errorf("expected FIELD_EXISTS for a name in the config got %v", err)
+		}
+		now = now.Add(time.Minute)
+		if _, err := request(logical.UpdateOperation, "configDelete", map[string]interface{}{"gcm/test100-key": ""}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the first archive is restored by its archived_at and decrypts what it encrypted
+		now = now.Add(time.Hour)
+		resp, err = request(logical.UpdateOperation, "restoreArchived", map[string]interface{}{"gcm/test100-key": "2026-01-01T00:00:00Z"})
+		if err != nil || resp.Data["gcm/test100-key"] != "2026-01-01T00:00:00Z" {
+			t.Fatalf("expected the first archive restored got %v %v", resp, err)
+		}
+		resp = decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test100-key": cypherText}}, t)
+		if resp.Data["test100-key"] != "archived" {
+			t.Errorf("expected the restored keyset to decrypt got %v", resp.Data)
+		}
+		resp, err = request(logical.ReadOperation, "restoreArchived", nil)
+		if err != nil || len(resp.Data["gcm/test100-key"].([]string)) != 2 {
+			t.Errorf("expected the restored archive to be removed and the two later deletes archived got %v %v", resp, err)
+		}
+
+		// archives older than ARCHIVE_RETENTION_DAYS expire
+		if _, err := request(logical.UpdateOperation, "configDelete", map[string]interface{}{"gcm/test100-key": ""}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(8 * 24 * time.Hour)
+
+		// a read skips them without deleting, as on a performance standby the storage is read only
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   readOnlyStorage{Storage: storage},
+			Operation: logical.ReadOperation,
+			Path:      "restoreArchived",
+		})
+		if err != nil || len(resp.Data) != 0 {
+			t.Errorf("expected the expired archives not to be listed got %v %v", resp, err)
+		}
+		keys, err := storage.List(context.Background(), archivePrefix)
+		if err != nil || len(keys) == 0 {
+			t.Errorf("expected a read to leave the expired archives in storage got %v %v", keys, err)
+		}
+
+		// a restore deletes them
+		resp, err = request(logical.UpdateOperation, "restoreArchived", map[string]interface{}{"gcm/test100-key": ""})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected KEY_NOT_FOUND for an expired archive got %v", err)
+		}
+		resp, err = request(logical.ReadOperation, "restoreArchived", nil)
+		if err != nil || len(resp.Data) != 0 {
+			t.Errorf("expected the expired archives to be deleted got %v %v", resp, err)
+		}
+		keys, err = storage.List(context.Background(), archivePrefix)
+		if err != nil || len(keys) != 0 {
+			t.Errorf("expected nothing left in the archive storage got %v %v", keys, err)
+		}
+
+		resp, err = request(logical.UpdateOperation, "restoreArchived", map[string]interface{}{"gcm/test100-missing": "yesterday"})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected KEY_NOT_FOUND for a name with no archive got %v", err)
+		}
+	})
+
+	t.Run("test101 ENCODING bqbytes cyphertext roundtrips", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test101-gcm": NonDeterministicKeyset, "test101-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test101-gcm": "gcm/test101-gcm", "test101-siv": "siv/test101-siv"}, false, t)
+		isBQBytes := func(cypherText interface{}) bool {
+			return regexp.MustCompile(`^(\\x[0-9a-f]{2})+$`).MatchString(fmt.Sprintf("%v", cypherText))
+		}
+
+		resp, err := request("encrypt", map[string]interface{}{"test101-gcm": "hello", "test101-siv": "world", "ENCODING": "bqbytes"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isBQBytes(resp.Data["test101-gcm"]) || !isBQBytes(resp.Data["test101-siv"]) {
+			t.Fatalf("expected escaped bytestrings got %v", resp.Data)
+		}
+		// the deterministic cyphertext is the same bytes as its base64
+		base64Resp := encryptData(b, storage, map[string]interface{}{"test101-siv": "world"}, t)
+		decoded, err := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", base64Resp.Data["test101-siv"]))
+		if err != nil || resp.Data["test101-siv"] != bqutils.EscapeBytes(decoded) {
+			t.Errorf("expected the bqbytes of the base64 cyphertext got %v", resp.Data["test101-siv"])
+		}
+
+		// decrypt reads it with ENCODING bqbytes, auto or bq, but not as the base64 of the fields
+		for _, encoding := range []string{"bqbytes", "auto", "bq"} {
+			decrypted, err := request("decrypt", map[string]interface{}{"test101-gcm": resp.Data["test101-gcm"], "test101-siv": resp.Data["test101-siv"], "ENCODING": encoding})
+			if err != nil || decrypted.Data["test101-gcm"] != "hello" || decrypted.Data["test101-siv"] != "world" {
+				t.Errorf("%s: expected hello and world got %v %v", encoding, decrypted, err)
+			}
+		}
+		decrypted := decryptData(b, storage, &logical.Response{Data: map[string]interface{}{"test101-gcm": resp.Data["test101-gcm"]}}, t)
+		if decrypted.Data["test101-gcm"] == "hello" {
+			t.Error("expected bqbytes not to decrypt as base64")
+		}
+
+		// bulk rows, and ENCODING_<field> bqbytes with a version tag, also roundtrip
+		saveConfig(b, storage, map[string]interface{}{"ENCODING_test101-gcm": "bqbytes", "VERSION_TAG_test101-gcm": "true"}, true, t)
+		bulk, err := request("encrypt", map[string]interface{}{
+			"0": map[string]interface{}{"test101-gcm": "row0"},
+			"1": map[string]interface{}{"test101-gcm": "row1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tagged := fmt.Sprintf("%v", bulk.Data["0"].(map[string]interface{})["test101-gcm"])
+		if !strings.HasPrefix(tagged, "v1x:") || !isBQBytes(strings.TrimPrefix(tagged, "v1x:")) {
+			t.Errorf("expected tagged bqbytes got %s", tagged)
+		}
+		decrypted = decryptData(b, storage, bulk, t)
+		for row, expected := range map[string]string{"0": "row0", "1": "row1"} {
+			if decrypted.Data[row].(map[string]interface{})["test101-gcm"] != expected {
+				t.Errorf("expected row %s to decrypt to %s got %v", row, expected, decrypted.Data[row])
+			}
+		}
+
+		for _, cypherText := range []string{`\x0`, `\xzz\x01`, `x01\x02`} {
+			resp, err := request("decrypt", map[string]interface{}{"test101-siv": cypherText, "ENCODING": "bqbytes"})
+			if err == nil && resp.Data["test101-siv"] == "world" {
+				t.Errorf("expected %s not to decrypt", cypherText)
+			}
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test101-gcm": "hello", "ENCODING": "auto"})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for an encrypt ENCODING of auto got %v", err)
+		}
+	})
+
+	t.Run("test102 DEFAULT_ADDITIONAL_DATA is the additional data of fields without their own", func(t *testing.T) {
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test102-family": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test102-plain":     "gcm/test102-family",
+			"test102-own":       "gcm/test102-family",
+			"test102-inherited": "test102-member",
+			"test102-member":    "gcm/test102-family",
+			"test102-parts":     "gcm/test102-family",
+		}, false, t)
+		decryptWithAAD := func(cypherText interface{}, additionalData []byte) error {
+			kh, err := aeadutils.ValidateKeySetJson(NonDeterministicKeyset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cypherTextBytes, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", cypherText))
+			_, err = aeadutils.DecryptWithKeyHandle(kh, cypherTextBytes, additionalData)
+			return err
+		}
+		plain := map[string]interface{}{"test102-plain": "a", "test102-own": "b", "test102-inherited": "c", "test102-parts": "d"}
+		before := encryptData(b, storage, map[string]interface{}{"test102-plain": "a"}, t)
+
+		// the field's own ADDITIONAL_DATA_, then the family's with AAD_INHERIT_, then the default, and the request's
+		// AAD_PARTS compose over whichever of them applies
+		saveConfig(b, storage, map[string]interface{}{
+			"DEFAULT_ADDITIONAL_DATA":        "env-salt",
+			"ADDITIONAL_DATA_test102-own":    "own",
+			"AAD_INHERIT_test102-member":     "true",
+			"ADDITIONAL_DATA_test102-member": "member",
+			"AAD_PARTS_test102-parts":        "table,ADDITIONAL_DATA",
+		}, false, t)
+		resp := encryptData(b, storage, map[string]interface{}{"test102-plain": "a", "test102-own": "b", "test102-inherited": "c", "test102-parts": "d", "AAD_PARTS": map[string]interface{}{"table": "customers"}}, t)
+		expected := map[string]string{"test102-plain": "env-salt", "test102-own": "own", "test102-inherited": "member", "test102-parts": "customers:env-salt"}
+		for fieldName, v := range resp.Data {
+			if err := decryptWithAAD(v, []byte(expected[fieldName])); err != nil {
+				t.Errorf("expected %s to have additional data %s got %v", fieldName, expected[fieldName], err)
+			}
+		}
+		resp.Data["AAD_PARTS"] = map[string]interface{}{"table": "customers"}
+		if !reflect.DeepEqual(decryptData(b, storage, resp, t).Data, plain) {
+			t.Errorf("expected the default additional data to roundtrip")
+		}
+
+		// cyphertext from before the default has the field name, so needs it as a candidate
+		if decryptData(b, storage, before, t).Data["test102-plain"] == "a" {
+			t.Error("expected cyphertext with the field name as additional data not to decrypt with the default")
+		}
+		candidates := &logical.Response{Data: map[string]interface{}{"test102-plain": before.Data["test102-plain"], "CANDIDATE_AADS": map[string]interface{}{"test102-plain": "test102-plain"}}}
+		if decryptData(b, storage, candidates, t).Data["test102-plain"] != "a" {
+			t.Error("expected the field name as a candidate to decrypt cyphertext from before the default")
+		}
+
+		// NO_AAD on the request still overrides the default
+		_, tinkAead, err := aeadutils.CreateInsecureHandleAndAead(NonDeterministicKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy, err := tinkAead.Encrypt([]byte("legacy"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		noAAD := &logical.Response{Data: map[string]interface{}{"test102-plain": b64.StdEncoding.EncodeToString(legacy), "NO_AAD": "true"}}
+		if decryptData(b, storage, noAAD, t).Data["test102-plain"] != "legacy" {
+			t.Error("expected NO_AAD to decrypt with no additional data despite the default")
+		}
+
+		// with a default the renamed field keeps it, so KEEP_ADDITIONAL_DATA does not add the old name
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "renameKey",
+			Data:      map[string]interface{}{"test102-plain": "test102-renamed", "KEEP_ADDITIONAL_DATA": "true"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := AEAD_CONFIG.Get("ADDITIONAL_DATA_test102-renamed"); ok {
+			t.Error("expected no ADDITIONAL_DATA_ for a field renamed with a default")
+		}
+		renamed := &logical.Response{Data: map[string]interface{}{"test102-renamed": resp.Data["test102-plain"]}}
+		if decryptData(b, storage, renamed, t).Data["test102-renamed"] != "a" {
+			t.Error("expected the renamed field to decrypt with the default")
+		}
+	})
+
+	t.Run("test103 rotate writes every keyset at once and broken stored keysets are logged at startup", func(t *testing.T) {
+		ctx := context.Background()
+		b, storage := testBackend(t)
+		importKey(b, storage, map[string]interface{}{"test103-gcm": NonDeterministicKeyset, "test103-siv": DeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{"test103-gcm": "gcm/test103-gcm", "test103-siv": "siv/test103-siv"}, false, t)
+		request := func(s logical.Storage, path string) error {
+			_, err := b.HandleRequest(ctx, &logical.Request{
+				Storage:   s,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      map[string]interface{}{},
+			})
+			return err
+		}
+		keyCount := func(keyName string) int {
+			stored, err := b.readConsulConfig(ctx, storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keySetStruct aeadutils.KeySetStruct
+			if err := json.Unmarshal([]byte(fmt.Sprintf("%v", stored[keyName])), &keySetStruct); err != nil {
+				t.Fatalf("expected %s to be a stored keyset got %v", keyName, err)
+			}
+			return len(keySetStruct.Key)
+		}
+		gcmKeys, sivKeys := keyCount("gcm/test103-gcm"), keyCount("siv/test103-siv")
+
+		// rotate and rotateAll each write all the keysets in one put
+		for i, path := range []string{"rotate", "rotateAll"} {
+			counting := &failingPutStorage{Storage: storage}
+			if err := request(counting, path); err != nil {
+				t.Fatal(err)
+			}
+			if counting.puts != 1 {
+				t.Errorf("%s: expected one config write got %d", path, counting.puts)
+			}
+			if keyCount("gcm/test103-gcm") != gcmKeys+i+1 || keyCount("siv/test103-siv") != sivKeys+i+1 {
+				t.Errorf("%s: expected both keysets to be rotated", path)
+			}
+		}
+
+		// a failed write leaves every stored keyset as it was, and the cache follows the storage again
+		before, err := b.readConsulConfig(ctx, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := request(&failingPutStorage{Storage: storage, fail: true}, "rotate"); err == nil {
+			t.Error("expected rotate to fail when the config cannot be written")
+		}
+		after, err := b.readConsulConfig(ctx, storage)
+		if err != nil || !reflect.DeepEqual(before, after) {
+			t.Errorf("expected the stored config to be unchanged by the failed rotate got %v", err)
+		}
+		readConfig(b, storage, t)
+		if cached, _ := AEAD_CONFIG.Get("gcm/test103-gcm"); cached != before["gcm/test103-gcm"] {
+			t.Error("expected the cache to be the stored keyset after the failed rotate")
+		}
+
+		// keysets that no longer parse are logged at startup, and the plugin still starts
+		broken := fmt.Sprintf("%v", before["gcm/test103-gcm"])
+		before["gcm/test103-broken"] = broken[:len(broken)/2]
+		before["siv/test103-garbage"] = "not a keyset"
+		entry, err := logical.StorageEntryJSON("config", before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		defer hclog.SetDefault(hclog.SetDefault(hclog.New(&hclog.LoggerOptions{Output: &logs, Level: hclog.Info})))
+		if err := b.initialize(ctx, &logical.InitializationRequest{Storage: storage}); err != nil {
+			t.Fatalf("expected a broken keyset not to stop the startup got %v", err)
+		}
+		for _, keyName := range []string{"gcm/test103-broken", "siv/test103-garbage"} {
+			if !strings.Contains(logs.String(), "the stored keyset "+keyName+" does not parse") {
+				t.Errorf("expected %s to be logged got %s", keyName, logs.String())
+			}
+		}
+		if strings.Contains(logs.String(), "the stored keyset gcm/test103-gcm does not parse") {
+			t.Errorf("expected only the broken keysets to be logged got %s", logs.String())
+		}
+		invalid, err := b.checkStoredKeysets(ctx, storage)
+		if err != nil || !reflect.DeepEqual(invalid, []string{"gcm/test103-broken", "siv/test103-garbage"}) {
+			t.Errorf("expected the two broken keysets got %v %v", invalid, err)
+		}
+		// only the names are logged, never the key material of the broken keyset
+		keyValue := broken[strings.Index(broken, `"value":"`)+len(`"value":"`):]
+		keyValue = keyValue[:strings.Index(keyValue, `"`)]
+		if strings.Contains(logs.String(), keyValue) || strings.Contains(logs.String(), "primaryKeyId") {
+			t.Errorf("expected no key material to be logged got %s", logs.String())
+		}
+
+		// the broken keysets are skipped by rotate, the valid ones still rotate
+		if err := request(storage, "rotate"); err != nil {
+			t.Fatal(err)
+		}
+		if keyCount("gcm/test103-gcm") != gcmKeys+3 {
+			t.Error("expected the valid keyset to rotate beside the broken ones")
+		}
+	})
+
+	t.Run("test104 KEY_KIND det and nondet choose the keyset of a key family with both", func(t *testing.T) {
+		b, storage := testBackend(t)
+		request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		importKey(b, storage, map[string]interface{}{"test104-family": NonDeterministicKeyset}, t)
+		importKey(b, storage, map[string]interface{}{"test104-family": DeterministicKeyset}, t)
+		importKey(b, storage, map[string]interface{}{"test104-single": NonDeterministicKeyset}, t)
+		saveConfig(b, storage, map[string]interface{}{
+			"test104-email":               "gcm/test104-family",
+			"test104-msisdn":              "siv/test104-family",
+			"test104-plain":               "gcm/test104-single",
+			"DETERMINISTIC_test104-email": "false",
+		}, false, t)
+		if _, ok := AEAD_CONFIG.Get("siv/test104-family"); !ok {
+			t.Fatal("expected the family to have a deterministic keyset too")
+		}
+		encrypt := func(keyKind string) map[string]interface{} {
+			data := map[string]interface{}{"test104-email": "me@example.com", "test104-msisdn": "0123"}
+			if keyKind != "" {
+				data["KEY_KIND"] = keyKind
+			}
+			resp, err := request("encrypt", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp.Data
+		}
+
+		// det is the same cyphertext every time, from either member of the family, and nondet is not
+		det1, det2 := encrypt("det"), encrypt("det")
+		nondet1, nondet2 := encrypt("nondet"), encrypt("nondet")
+		for _, fieldName := range []string{"test104-email", "test104-msisdn"} {
+			if det1[fieldName] != det2[fieldName] {
+				t.Errorf("%s: expected det to be deterministic got %v and %v", fieldName, det1[fieldName], det2[fieldName])
+			}
+			if nondet1[fieldName] == nondet2[fieldName] {
+				t.Errorf("%s: expected nondet not to be deterministic", fieldName)
+			}
+		}
+		_, tinkDetAead, err := aeadutils.CreateInsecureHandleAndDeterministicAead(DeterministicKeyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := tinkDetAead.EncryptDeterministically([]byte("me@example.com"), []byte("test104-email"))
+		if err != nil || det1["test104-email"] != b64.StdEncoding.EncodeToString(expected) {
+			t.Errorf("expected det to use siv/test104-family got %v", det1["test104-email"])
+		}
+		// without a KEY_KIND each field uses the keyset it points at
+		internal := encrypt("")
+		if internal["test104-msisdn"] != det1["test104-msisdn"] || internal["test104-email"] == det1["test104-email"] {
+			t.Errorf("expected the keyset each field points at without a KEY_KIND got %v", internal)
+		}
+
+		// decrypt without a KEY_KIND finds the keyset of either kind, bulk rows included
+		for _, cypherTexts := range []map[string]interface{}{det1, nondet1, internal} {
+			resp, err := request("decrypt", map[string]interface{}{"test104-email": cypherTexts["test104-email"], "test104-msisdn": cypherTexts["test104-msisdn"]})
+			if err != nil || resp.Data["test104-email"] != "me@example.com" || resp.Data["test104-msisdn"] != "0123" {
+				t.Errorf("expected both fields to decrypt got %v %v", resp, err)
+			}
+		}
+		resp, err := request("decrypt", map[string]interface{}{
+			"0": map[string]interface{}{"test104-email": det1["test104-email"]},
+			"1": map[string]interface{}{"test104-email": nondet1["test104-email"]},
+		})
+		if err != nil || resp.Data["0"].(map[string]interface{})["test104-email"] != "me@example.com" || resp.Data["1"].(map[string]interface{})["test104-email"] != "me@example.com" {
+			t.Errorf("expected both bulk rows to decrypt got %v %v", resp, err)
+		}
+
+		// decrypt with a KEY_KIND only uses that kind
+		resp, err = request("decrypt", map[string]interface{}{"test104-email": det1["test104-email"], "KEY_KIND": "det"})
+		if err != nil || resp.Data["test104-email"] != "me@example.com" {
+			t.Errorf("expected KEY_KIND det to decrypt det cyphertext got %v %v", resp, err)
+		}
+		resp, err = request("decrypt", map[string]interface{}{"test104-email": det1["test104-email"], "KEY_KIND": "nondet"})
+		if err == nil && resp.Data["test104-email"] == "me@example.com" {
+			t.Error("expected KEY_KIND nondet not to decrypt det cyphertext")
+		}
+
+		// a field without a keyset of the kind asked for fails, a field without any keyset is returned as it is
+		resp, err = request("encrypt", map[string]interface{}{"test104-plain": "hello", "KEY_KIND": "det"})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected KEY_NOT_FOUND for a field without a deterministic keyset got %v", err)
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test104-nokey": "hello", "KEY_KIND": "nondet"})
+		if err != nil || resp.Data["test104-nokey"] != "hello" {
+			t.Errorf("expected a field without a keyset to be returned as it is got %v %v", resp, err)
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test104-email": "hello", "KEY_KIND": "both"})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for an unknown KEY_KIND got %v", err)
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test104-email": "hello", "MODE": "det"})
+		if err == nil || resp.Data["error_code"] != ERROR_INVALID_REQUEST {
+			t.Errorf("expected INVALID_REQUEST for det as a MODE got %v", err)
+		}
+
+		// KEY_KIND is used with MODE, an export keyset is of the kind of the keyset it was made from
+		if _, err := request("exportKey", map[string]interface{}{"test104-email": ""}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test104-email": "me@example.com", "MODE": "export", "KEY_KIND": "nondet"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported := resp.Data["test104-email"]
+		resp, err = request("decrypt", map[string]interface{}{"test104-email": exported, "MODE": "export", "KEY_KIND": "nondet"})
+		if err != nil || resp.Data["test104-email"] != "me@example.com" {
+			t.Errorf("expected MODE export with KEY_KIND nondet to decrypt got %v %v", resp, err)
+		}
+		resp, err = request("encrypt", map[string]interface{}{"test104-email": "me@example.com", "MODE": "export", "KEY_KIND": "det"})
+		if err == nil || resp.Data["error_code"] != ERROR_KEY_NOT_FOUND {
+			t.Errorf("expected KEY_NOT_FOUND for a non deterministic export keyset with KEY_KIND det got %v", err)
+		}
+	})
+
+	t.Run("testkv1 ckv read", func(t *testing.T) {
+
+		// t.Parallel()
+		b, storage := testBackend(t)
+
+		if vault_kv_active == "false" {
+			t.SkipNow()
+		}
+
+		resp := readKV(b, storage, t)
+
+		if resp == nil || resp.Data == nil {
+			t.Error("nothing returned from KV")
+		}
+	})
+
+	t.Run("testkv2 kv sync", func(t *testing.T) {
+
+		b, storage := testBackend(t)
+
+		if vault_kv_active == "false" {
+			t.SkipNow()
+		}
+
+		configMap := createVaultConfig()
+
+		// store the config
+		saveConfig(b, storage, configMap, false, t)
+
+		// create a dynamic AEAD key for a field
+		// set some data to be encrypted using the keys
+		data := map[string]interface{}{
+			"testkv2-address": "my address",
+		}
+
+		// create a key - should get synced as gcm/testkv2-address
+		encryptDataNonDetermisticallyAndCreateKey(b, storage, data, false, t)
+
+		resp := readKV(b, storage, t)
+
+		_, ok := resp.Data["gcm/testkv2-address"]
+		if !ok {
+			t.Error("did not find entry for gcm/testkv2-address")
+		}
+
+		// OK its in KV and it looks ok, lets double -check the format by reading kv directly
+
+		// check kv secret
+		fullName := "gcm/testkv2-address"
+
+		checkKVSecret(fullName, t)
+
+		// create a key - should get synced as gcm/testkv2-address
+		encryptDataDetermisticallyAndCreateKey(b, storage, data, false, t)
+
+		resp = readKV(b, storage, t)
+
+		_, ok = resp.Data["siv/testkv2-address"]
+		if !ok {
+			t.Error("did not find entry for siv/testkv2-address")
+		}
+
+		// OK its in KV and it looks ok, lets double -check the format by reading kv directly
+
+		// check kv secret
+		fullName = "siv/testkv2-address"
+
+		checkKVSecret(fullName, t)
+	})
+
+}
+
+func BenchmarkDecryptCache(b *testing.B) {
+	for _, cacheSize := range []string{"", "1000"} {
+		name := "off"
+		if cacheSize != "" {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			backend, storage := testBackend(b)
+			request := func(path string, data map[string]interface{}) *logical.Response {
+				resp, err := backend.HandleRequest(context.Background(), &logical.Request{
+					Storage:   storage,
+					Operation: logical.UpdateOperation,
+					Path:      path,
+					Data:      data,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				return resp
+			}
+			request("importKey", map[string]interface{}{"bench-cache": DeterministicKeyset})
+			config := map[string]interface{}{"bench-cache": "siv/bench-cache"}
+			if cacheSize != "" {
+				config["DECRYPT_CACHE_bench-cache"] = cacheSize
+			}
+			request("config", config)
+			cypherText := request("encrypt", map[string]interface{}{"bench-cache": "a value decrypted over and over"}).Data["bench-cache"]
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				request("decrypt", map[string]interface{}{"bench-cache": cypherText})
+			}
+		})
+	}
+}
+
+// wideBulkData is bulk rows of the fields, each value unique to its row and field
+func wideBulkData(rows int, fieldNames ...string) map[string]interface{} {
+	bulkData := make(map[string]interface{}, rows)
+	for i := 0; i < rows; i++ {
+		row := make(map[string]interface{}, len(fieldNames))
+		for _, fieldName := range fieldNames {
+			row[fieldName] = fmt.Sprintf("%s value of row %d", fieldName, i)
+		}
+		bulkData[strconv.Itoa(i)] = row
+	}
+	return bulkData
+}
+
+func BenchmarkDecryptColWorkers(b *testing.B) {
+	backend, storage := testBackend(b)
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := backend.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return resp
+	}
+
+	// a wide payload, 20 columns of 1000 rows
+	fieldNames := []string{}
+	config := map[string]interface{}{}
+	for i := 0; i < 20; i++ {
+		fieldName := fmt.Sprintf("bench-col%d", i)
+		fieldNames = append(fieldNames, fieldName)
+		config[fieldName] = "gcm/bench-cols"
+	}
+	request("importKey", map[string]interface{}{"bench-cols": NonDeterministicKeyset})
+	request("config", config)
+	encrypted := request("encryptcol", wideBulkData(1000, fieldNames...)).Data
+
+	for _, workers := range []string{"", "4", "16"} {
+		name := "serial"
+		if workers != "" {
+			name = workers + " workers"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				data := make(map[string]interface{}, len(encrypted)+1)
+				for k, v := range encrypted {
+					data[k] = v
+				}
+				if workers != "" {
+					data["BULK_WORKERS"] = workers
+				}
+				request("decryptcol", data)
+			}
+		})
+	}
+}
+
+func TestBQ(t *testing.T) {
+
+	// un comment this if you need to debug bqsync
+	t.Run("test-bqsync fake test to debug bqsync ", func(t *testing.T) {
+
+		if bq_active == "false" {
+			t.SkipNow()
+		}
+
+		// t.Parallel()
+		b, storage := testBackend(t)
+
+		configMap := map[string]interface{}{
+
+			"BQ_KMSKEY":                  "projects/vf-cis-rubik-tst-kms/locations/<region>/keyRings/hsm-key-tink-pf1-<region>/cryptoKeys/bq-key",
+			"BQ_PROJECT":                 "vf-pf1-datahub-b14b",
+			"BQ_DEFAULT_ENCRYPT_DATASET": "vfpf1_dh_lake_aead_encrypt_<region>_lv_s",
+			"BQ_DEFAULT_DECRYPT_DATASET": "vfpf1_dh_lake_<category>_aead_decrypt_<region>_lv_s",
+			"BQ_ROUTINE_DET_PREFIX":      "siv",
+			"BQ_ROUTINE_NONDET_PREFIX":   "gcm",
+		}
+		// store the config
+		saveConfig(b, storage, configMap, false, t)
+
+		key := "testbqsync-address"
+		value := "my address"
+
+		nondetkey := map[string]interface{}{
+			key: value,
+		}
+
+		encryptDataNonDetermisticallyAndCreateKey(b, storage, nondetkey, false, t)
+
+		key = "testbqsync-postcode"
+		value = "my postcode"
+		key1 := "name"
+		value1 := "my name"
+
+		detkey := map[string]interface{}{
+			key:  value,
+			key1: value1,
+		}
+
+		encryptDataDetermisticallyAndCreateKey(b, storage, detkey, false, t)
+
+		data := make(map[string]interface{})
+
+		tn := time.Now()
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "bqsync",
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal("bqsync", err)
+		}
+
+		projectId := "vf-pf1-datahub-b14b"
+		datasetName := "vfpf1_dh_lake_aead_encrypt_eu_lv_s"
+		routineName := "testbqsync_postcode_siv_encrypt"
+		checkBQRoutine(projectId, t, datasetName, routineName, tn)
+	})
+
+}
+
+func checkBQRoutine(projectId string, t *testing.T, datasetName string, routineName string, tn time.Time) {
+	ctx := context.Background()
+	bigqueryClient, err := bigquery.NewClient(ctx, projectId)
+	if err != nil {
+		t.Fatal("Failed to create a bigquery client: " + err.Error())
+
+	}
+	defer bigqueryClient.Close()
+	routineEncryptRef := bigqueryClient.Dataset(datasetName).Routine(routineName)
+	var rm *bigquery.RoutineMetadata
+	rm, err = routineEncryptRef.Metadata(ctx)
+	if err != nil {
+		t.Fatal("Failed to find routine: " + datasetName + ":" + routineName + ": " + err.Error())
+	}
+	if tn.After(rm.LastModifiedTime) {
+		t.Error(datasetName + ":" + routineName + " did not change")
+	} else {
+		t.Log(datasetName + ":" + routineName + " did change")
+	}
+}
+
+// func TestKV(t *testing.T) {
+
+// t.Run("testkv1 ckv read", func(t *testing.T) {
+
+// 	if vault_kv_active == "false" {
+// 		t.SkipNow()
+// 	}
+
+// 	// t.Parallel()
+// 	b, storage := testBackend(t)
+
+// 	resp := readKV(b, storage, t)
+
+// 	if resp == nil || resp.Data == nil {
+// 		t.Error("nothing returned from KV")
+// 	}
+// })
+
+// t.Run("testkv2 kv sync", func(t *testing.T) {
+
+// 	if vault_kv_active == "false" {
+// 		t.SkipNow()
+// 	}
+
+// 	b, storage := testBackend(t)
+
+// 	configMap := createVaultConfig()
+
+// 	// store the config
+// 	saveConfig(b, storage, configMap, false, t)
+
+// 	// create a dynamic AEAD key for a field
+// 	// set some data to be encrypted using the keys
+// 	data := map[string]interface{}{
+// 		"testkv2-address": "my address",
+// 	}
+
+// 	// create a key - should get synced as gcm/testkv2-address
+// 	encryptDataNonDetermisticallyAndCreateKey(b, storage, data, false, t)
+
+// 	resp := readKV(b, storage, t)
+
+// 	_, ok := resp.Data["gcm/testkv2-address"]
+// 	if !ok {
+// 		t.Error("did not find entry for gcm/testkv2-address")
+// 	}
 
 // 	// OK its in KV and it looks ok, lets double -check the format by reading kv directly
 
@@ -2216,6 +7750,60 @@ func encryptDataNonDetermisticallyAndCreateKey(b *backend, storage logical.Stora
 	return resp
 }
 
+func verifyDecrypt(b *backend, storage logical.Storage, data map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "verifyDecrypt",
+		Data:      data,
+	})
+
+	if err != nil {
+		t.Fatal("verifyDecrypt", err)
+	}
+	return resp
+}
+
+func importKey(b *backend, storage logical.Storage, data map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "importKey",
+		Data:      data,
+	})
+
+	if err != nil {
+		t.Fatal("importKey", err)
+	}
+	return resp
+}
+
+func importTemplate(b *backend, storage logical.Storage, data map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "importTemplate",
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal("importTemplate", err)
+	}
+	return resp
+}
+
+func purgeKeys(b *backend, storage logical.Storage, data map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "purgeKeys",
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal("purgeKeys", err)
+	}
+	return resp
+}
+
 func readConfig(b *backend, storage logical.Storage, t *testing.T) *logical.Response {
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
 		Storage:   storage,
@@ -2363,3 +7951,91 @@ func createVaultConfig() map[string]interface{} {
 	return configMap
 
 }
+
+// fakeSecretFetcher is secret manager, a map of secret version name to payload
+type fakeSecretFetcher map[string][]byte
+
+func (f fakeSecretFetcher) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	payload, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("secret %s not found", name)
+	}
+	return payload, nil
+}
+
+// fakeKMSWrapper is a kms that wraps by reversing the keyset, and has only the key import-key
+type fakeKMSWrapper struct {
+	bqutils.KMSWrapper
+}
+
+func (w *fakeKMSWrapper) UnwrapKeyset(ctx context.Context, keyName string, wrappedKeyset []byte) ([]byte, error) {
+	if keyName != "import-key" {
+		return nil, fmt.Errorf("kms key %s not found", keyName)
+	}
+	keyset := make([]byte, len(wrappedKeyset))
+	for i, b := range wrappedKeyset {
+		keyset[len(wrappedKeyset)-1-i] = b
+	}
+	return keyset, nil
+}
+
+func (w *fakeKMSWrapper) KeyExists(ctx context.Context, keyName string) error {
+	if keyName != "import-key" {
+		return fmt.Errorf("kms key %s not found", keyName)
+	}
+	return nil
+}
+
+func (w *fakeKMSWrapper) WrapKeyset(ctx context.Context, keyName string, binaryKeyset []byte) ([]byte, error) {
+	return w.UnwrapKeyset(ctx, keyName, binaryKeyset)
+}
+
+func (w *fakeKMSWrapper) Close() error {
+	return nil
+}
+
+// b64KeysetWrapper stands in for a master key, storing keysets base64 encoded
+type b64KeysetWrapper struct{}
+
+func (b64KeysetWrapper) Name() string {
+	return "b64"
+}
+
+func (b64KeysetWrapper) Unwrap(stored string) (string, error) {
+	keySetJson, err := b64.StdEncoding.DecodeString(stored)
+	return string(keySetJson), err
+}
+
+func (b64KeysetWrapper) Wrap(keySetJson string) (string, error) {
+	return b64.StdEncoding.EncodeToString([]byte(keySetJson)), nil
+}
+
+// failingPutStorage is storage that counts the puts of the config, failing them once fail is set
+type failingPutStorage struct {
+	logical.Storage
+	fail bool
+	puts int
+}
+
+func (s *failingPutStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if entry.Key == "config" {
+		s.puts++
+		if s.fail {
+			return fmt.Errorf("storage unavailable")
+		}
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+// readOnlyStorage is storage as a performance standby sees it, where writes fail
+type readOnlyStorage struct {
+	logical.Storage
+}
+
+func (readOnlyStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	return logical.ErrReadOnly
+}
+
+func (readOnlyStorage) Delete(ctx context.Context, key string) error {
+	return logical.ErrReadOnly
+}
@@ -4,12 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"cloud.google.com/go/bigquery"
-	kms "cloud.google.com/go/kms/apiv1"
 	"google.golang.org/api/iterator"
 
 	"github.com/Vodafone/vault-plugin-aead/aeadutils"
@@ -17,9 +16,7 @@ import (
 	"github.com/google/tink/go/keyset"
 	hclog "github.com/hashicorp/go-hclog"
 	cmap "github.com/orcaman/concurrent-map"
-
-	// kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
-	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type Options struct {
@@ -30,8 +27,55 @@ type Options struct {
 	decryptRoutineId    string
 	detRoutinePrefix    string
 	nondetRoutinePrefix string
+	routineNameTemplate string
 	kmsKeyName          string
+	kmsKeyURI           string
 	fieldName           string
+	keysetFingerprint   string
+	maxAttempts         int
+	maxConcurrency      int
+	ciphertextType      string
+}
+
+// the BQ_CIPHERTEXT_TYPE of the decrypt routines, ie the type of the column holding the cyphertext
+const (
+	ciphertextTypeBytes  = "BYTES"
+	ciphertextTypeString = "STRING"
+)
+
+// defaultRoutineNameTemplate is the BQ_ROUTINE_NAME_TEMPLATE of the routines, ie address_siv_encrypt. <field> is the
+// field name, <prefix> the BQ_ROUTINE_DET_PREFIX or BQ_ROUTINE_NONDET_PREFIX, <direction> encrypt or decrypt and <dir>
+// enc or dec
+const defaultRoutineNameTemplate = "<field>_<prefix>_<direction>"
+
+// maxRoutineIdLength is the longest routine id BQ allows
+const maxRoutineIdLength = 256
+
+// routineName substitutes the placeholders of the template for the routine of the field in the direction, encrypt or
+// decrypt, failing if the result is not a valid BQ routine id: letters, digits and underscores, not starting with a
+// digit, and at most 256 long
+func routineName(template string, fieldName string, prefix string, direction string) (string, error) {
+	name := strings.NewReplacer(
+		"<field>", fieldName,
+		"<prefix>", prefix,
+		"<direction>", direction,
+		"<dir>", direction[:3],
+	).Replace(template)
+	if name == "" {
+		return "", fmt.Errorf("routine name template %q gives an empty name", template)
+	}
+	if len(name) > maxRoutineIdLength {
+		return "", fmt.Errorf("routine name %s is longer than %d", name, maxRoutineIdLength)
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		return "", fmt.Errorf("routine name %s starts with a digit", name)
+	}
+	for _, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return "", fmt.Errorf("routine name %s has %q, only letters, digits and underscores are allowed", name, c)
+		}
+	}
+	return name, nil
 }
 
 func GetBQDatasets(ctx context.Context, projectId string) (map[string]*bigquery.Dataset, error) {
@@ -61,214 +105,353 @@ func GetBQDatasets(ctx context.Context, projectId string) (map[string]*bigquery.
 	return datasets, nil
 }
 
-func DoBQSync(ctx context.Context, kh *keyset.Handle, fieldName string, deterministic bool, envOptions cmap.ConcurrentMap, datasets map[string]*bigquery.Dataset) {
+// newKMSWrapper creates the kms client of a sync, a variable so tests can sync without a kms
+var newKMSWrapper = NewKMSWrapper
 
-	// fieldName might have a "-" in it, but "-" are not allowed in BQ, so translate them to "_"
-	fieldName = strings.Replace(fieldName, "-", "_", -1)
-	fieldName = aeadutils.RemoveKeyPrefix(fieldName)
+// DoBQSync creates or replaces the encrypt and decrypt routines for the keyset in each matching dataset
+// it returns how many routines were created, updated and skipped in each region, the datasets that were skipped,
+// with the reason, so operators can fix kms permissions, and the errors creating or updating routines
+func DoBQSync(ctx context.Context, kh *keyset.Handle, fieldName string, deterministic bool, snapshot *OptionsSnapshot, datasets map[string]*bigquery.Dataset) (result *SyncResult, err error) {
+
+	// the options are looked up with the field name as it is in vault, the routines use its BQ name
+	options, err := snapshot.resolve(fieldName, deterministic)
+	if err != nil {
+		hclog.L().Error(err.Error())
+		return nil, err
+	}
+	fieldName = options.fieldName
 
-	var options Options
-	resolveOptions(&options, fieldName, deterministic, envOptions)
+	ctx, span := aeadutils.StartSpan(ctx, "bqsync.field",
+		aeadutils.SpanField.String(fieldName),
+		aeadutils.SpanDeterministic.Bool(deterministic),
+		aeadutils.SpanKeyID.Int64(int64(kh.KeysetInfo().GetPrimaryKeyId())),
+	)
+	defer func() { aeadutils.EndSpan(span, err) }()
 
 	// 0. Initate clients
-	kmsClient, err := kms.NewKeyManagementClient(ctx)
-
+	err = CheckKMSProvider(snapshot.kmsProvider, WAREHOUSE_BIGQUERY)
+	if err != nil {
+		hclog.L().Error(err.Error())
+		return nil, err
+	}
+	var kmsWrapper KMSWrapper
+	kmsWrapper, err = newKMSWrapper(ctx, snapshot.envOptions)
 	if err != nil {
 		hclog.L().Error("failed to setup client:  %v", err)
+		return nil, err
 	}
-	defer kmsClient.Close()
+	defer kmsWrapper.Close()
+	kmsWrapper = &tracedKMSWrapper{kmsWrapper}
 
 	binaryKeyset := new(bytes.Buffer)
 	insecurecleartextkeyset.Write(kh, keyset.NewBinaryWriter(binaryKeyset))
 
-	// loop through possible permeatations
-	regionlist := [5]string{"unspecified", "eu", "europe_west1", "europe_west2", "europe_west3"} // note that these map to expected dataset names so EU is lower case and europe-west1 has underscore instead of dash
+	// the fingerprint is embedded in the routine description so drift from the keyset in vault can be detected
+	options.keysetFingerprint, err = aeadutils.KeySetFingerprint(kh)
+	if err != nil {
+		hclog.L().Error("failed to fingerprint keyset:  %v", err)
+		return nil, err
+	}
+	hclog.L().Info("keyset fingerprint for " + fieldName + " is " + options.keysetFingerprint)
 
 	var wg sync.WaitGroup
+	result = newSyncResult()
 
-	for _, region := range regionlist {
-
-		newOptions := Options(options)
-		// options.encryptDatasetId = "vf<lm>_dh_lake_aead_encrypt_<region>_lv_s"
-		// options.decryptDatasetId = "vf<lm>_dh_lake_<category>_aead_decrypt_<region>_lv_s"
-
-		// first a simple substitution for <category>
-		if strings.Contains(options.encryptDatasetId, "_<category>") {
-			newOptions.encryptDatasetId = strings.Replace(options.encryptDatasetId, "<category>", fieldName, -1)
-		}
-		if strings.Contains(options.decryptDatasetId, "_<category>") {
-			newOptions.decryptDatasetId = strings.Replace(options.decryptDatasetId, "<category>", fieldName, -1)
-		}
+	for _, region := range bqRegions {
+		region := region
 
-		if region == "unspecified" {
-			newOptions.encryptDatasetId = strings.Replace(newOptions.encryptDatasetId, "_<region>", "", -1)
-			newOptions.decryptDatasetId = strings.Replace(newOptions.decryptDatasetId, "_<region>", "", -1)
-		} else {
-			newOptions.encryptDatasetId = strings.Replace(newOptions.encryptDatasetId, "<region>", region, -1)
-			newOptions.decryptDatasetId = strings.Replace(newOptions.decryptDatasetId, "<region>", region, -1)
-		}
+		newOptions := regionOptions(options, fieldName, region)
 
 		encryptDataset, encryptDatasetExists := datasets[newOptions.encryptDatasetId]
 		decryptDataset, decryptDatasetExists := datasets[newOptions.decryptDatasetId]
 
+		// once cancelled no more routines are started, the ones in flight abort with the context
+		if ctx.Err() != nil {
+			if encryptDatasetExists {
+				result.cancel(newOptions.encryptDatasetId, newOptions.encryptRoutineId)
+			}
+			if decryptDatasetExists {
+				result.cancel(newOptions.decryptDatasetId, newOptions.decryptRoutineId)
+			}
+			continue
+		}
+
 		if encryptDatasetExists {
+			ctx, datasetSpan := aeadutils.StartSpan(ctx, "bqsync.dataset",
+				aeadutils.SpanOperation.String("encrypt"),
+				aeadutils.SpanRegion.String(region),
+				aeadutils.SpanDataset.String(newOptions.encryptDatasetId),
+			)
 			// search for the ENCRYPT dataset
-			md, err := encryptDataset.Metadata(ctx)
+			var md *bigquery.DatasetMetadata
+			err := retryBQ(ctx, newOptions.maxAttempts, func() (err error) {
+				md, err = encryptDataset.Metadata(ctx)
+				return err
+			})
 			if err == nil {
-				actualDatasetRegion := strings.ToLower(md.Location)
-
-				// infer the kms name
-				// kms has the form:
-				// projects/<project>/locations/<region>/keyRings/hsm-key-tink-<lm>-<region>/cryptoKeys/bq-key
-				// and needs to be translated into
-				// projects/<project>/locations/europe/keyRings/hsm-key-tink-<lm>-europe/cryptoKeys/bq-key
-				// or
-				// projects/<project>/locations/europe-west1/keyRings/hsm-key-tink-<lm>-europe-west1/cryptoKeys/bq-key
-
-				expectedKMSRegion := actualDatasetRegion
-				if actualDatasetRegion == "eu" {
-					expectedKMSRegion = "europe"
-				}
-				newOptions.kmsKeyName = strings.Replace(newOptions.kmsKeyName, "<region>", expectedKMSRegion, -1)
+				// a copy per dataset, as the encrypt and decrypt datasets may be in different locations and the
+				// routine is created in a goroutine
+				encryptOptions := datasetOptions(newOptions, md.Location)
 
 				// // does the kms exist
-				req := &kmspb.GetCryptoKeyRequest{
-					Name: newOptions.kmsKeyName,
-				}
-				_, err := kmsClient.GetCryptoKey(ctx, req)
+				err := kmsWrapper.KeyExists(ctx, encryptOptions.kmsKeyName)
 
 				if err == nil {
 					// now we have a valid dataset and a valid kms (this doesn't mean we have access though)
 					// 2. Wrap the binary keyset with KMS.
+					encryptOptions.kmsKeyURI, _ = kmsWrapper.KeysetChainURI(encryptOptions.kmsKeyName, WAREHOUSE_BIGQUERY)
 
-					encryptReq := &kmspb.EncryptRequest{
-						Name:      newOptions.kmsKeyName,
-						Plaintext: binaryKeyset.Bytes(),
-					}
-
-					encryptResp, err := kmsClient.Encrypt(ctx, encryptReq)
+					wrappedKeyset, err := kmsWrapper.WrapKeyset(ctx, encryptOptions.kmsKeyName, binaryKeyset.Bytes())
 					if err != nil {
+						// most likely missing IAM permission on the kms key, don't create a routine with no keyset
 						hclog.L().Error("Failed to encrypt keyset:  %v", err)
+						result.skip(region, encryptOptions.encryptDatasetId, fmt.Sprintf("failed to wrap the keyset with kms key %s: %v", encryptOptions.kmsKeyName, err))
+					} else {
+						// 3. Format the wrapped keyset as an escaped bytestring (like '\x00\x01\xAD') so BQ can accept it.
+						escapedWrappedKeyset := EscapeBytes(wrappedKeyset)
+
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							bqRoutineLimiter.acquire(encryptOptions.maxConcurrency)
+							defer bqRoutineLimiter.release()
+							if ctx.Err() != nil {
+								result.cancel(encryptOptions.encryptDatasetId, encryptOptions.encryptRoutineId)
+								return
+							}
+							updated, err := doBQRoutineCreateOrUpdate(ctx, encryptOptions, escapedWrappedKeyset, deterministic, "encrypt", encryptDataset)
+							result.routine(region, encryptOptions.encryptDatasetId, encryptOptions.encryptRoutineId, updated, err)
+						}()
 					}
-
-					// 3. Format the wrapped keyset as an escaped bytestring (like '\x00\x01\xAD') so BQ can accept it.
-					escapedWrappedKeyset := ""
-					for _, cbyte := range encryptResp.Ciphertext {
-						escapedWrappedKeyset += fmt.Sprintf("\\x%02x", cbyte)
-					}
-
-					wg.Add(1)
-					go func() {
-						defer wg.Done()
-						doBQRoutineCreateOrUpdate(ctx, newOptions, escapedWrappedKeyset, deterministic, "encrypt", encryptDataset)
-					}()
 				} else {
-					hclog.L().Info("Failed to find kms key: " + newOptions.kmsKeyName)
+					hclog.L().Info("Failed to find kms key: " + encryptOptions.kmsKeyName)
+					result.skip(region, encryptOptions.encryptDatasetId, fmt.Sprintf("failed to find kms key %s: %v", encryptOptions.kmsKeyName, err))
 				}
 			} else {
 				hclog.L().Info("Failed to find dataset: " + newOptions.encryptDatasetId)
+				result.fail("failed to read dataset %s: %v", newOptions.encryptDatasetId, err)
 			}
-
+			result.mu.Lock()
+			_, wasSkipped := result.Skipped[newOptions.encryptDatasetId]
+			result.mu.Unlock()
+			if wasSkipped {
+				datasetSpan.SetStatus(codes.Error, "skipped")
+			}
+			aeadutils.EndSpan(datasetSpan, err)
 		}
 		if decryptDatasetExists {
+			ctx, datasetSpan := aeadutils.StartSpan(ctx, "bqsync.dataset",
+				aeadutils.SpanOperation.String("decrypt"),
+				aeadutils.SpanRegion.String(region),
+				aeadutils.SpanDataset.String(newOptions.decryptDatasetId),
+			)
 			// search for the DECRYPT dataset
-			md, err := decryptDataset.Metadata(ctx)
+			var md *bigquery.DatasetMetadata
+			err := retryBQ(ctx, newOptions.maxAttempts, func() (err error) {
+				md, err = decryptDataset.Metadata(ctx)
+				return err
+			})
 			if err == nil {
-				actualDatasetRegion := strings.ToLower(md.Location)
-
-				// infer the kms name
-				// kms has the form:
-				// projects/<project>/locations/<region>/keyRings/hsm-key-tink-<lm>-<region>/cryptoKeys/bq-key
-				// and needs to be translated into
-				// projects/<project>/locations/europe/keyRings/hsm-key-tink-<lm>-europe/cryptoKeys/bq-key
-				// or
-				// projects/<project>/locations/europe-west1/keyRings/hsm-key-tink-<lm>-europe-west1/cryptoKeys/bq-key
-
-				expectedKMSRegion := actualDatasetRegion
-				if actualDatasetRegion == "eu" {
-					expectedKMSRegion = "europe"
-				}
-				newOptions.kmsKeyName = strings.Replace(newOptions.kmsKeyName, "<region>", expectedKMSRegion, -1)
+				// a copy per dataset, as the encrypt and decrypt datasets may be in different locations and the
+				// routine is created in a goroutine
+				decryptOptions := datasetOptions(newOptions, md.Location)
 
 				// // does the kms exist
-				req := &kmspb.GetCryptoKeyRequest{
-					Name: newOptions.kmsKeyName,
-				}
-				_, err := kmsClient.GetCryptoKey(ctx, req)
+				err := kmsWrapper.KeyExists(ctx, decryptOptions.kmsKeyName)
 
 				if err == nil {
 					// now we have a valid dataset and a valid kms (this doesn't mean we have access though)
 					// 2. Wrap the binary keyset with KMS.
+					decryptOptions.kmsKeyURI, _ = kmsWrapper.KeysetChainURI(decryptOptions.kmsKeyName, WAREHOUSE_BIGQUERY)
 
-					encryptReq := &kmspb.EncryptRequest{
-						Name:      newOptions.kmsKeyName,
-						Plaintext: binaryKeyset.Bytes(),
-					}
-
-					encryptResp, err := kmsClient.Encrypt(ctx, encryptReq)
+					wrappedKeyset, err := kmsWrapper.WrapKeyset(ctx, decryptOptions.kmsKeyName, binaryKeyset.Bytes())
 					if err != nil {
+						// most likely missing IAM permission on the kms key, don't create a routine with no keyset
 						hclog.L().Error("Failed to encrypt keyset:  %v", err)
+						result.skip(region, decryptOptions.decryptDatasetId, fmt.Sprintf("failed to wrap the keyset with kms key %s: %v", decryptOptions.kmsKeyName, err))
+					} else {
+						// 3. Format the wrapped keyset as an escaped bytestring (like '\x00\x01\xAD') so BQ can accept it.
+						escapedWrappedKeyset := EscapeBytes(wrappedKeyset)
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							bqRoutineLimiter.acquire(decryptOptions.maxConcurrency)
+							defer bqRoutineLimiter.release()
+							if ctx.Err() != nil {
+								result.cancel(decryptOptions.decryptDatasetId, decryptOptions.decryptRoutineId)
+								return
+							}
+							updated, err := doBQRoutineCreateOrUpdate(ctx, decryptOptions, escapedWrappedKeyset, deterministic, "decrypt", decryptDataset)
+							result.routine(region, decryptOptions.decryptDatasetId, decryptOptions.decryptRoutineId, updated, err)
+						}()
 					}
-
-					// 3. Format the wrapped keyset as an escaped bytestring (like '\x00\x01\xAD') so BQ can accept it.
-					escapedWrappedKeyset := ""
-					for _, cbyte := range encryptResp.Ciphertext {
-						escapedWrappedKeyset += fmt.Sprintf("\\x%02x", cbyte)
-					}
-					wg.Add(1)
-					go func() {
-						defer wg.Done()
-						doBQRoutineCreateOrUpdate(ctx, newOptions, escapedWrappedKeyset, deterministic, "decrypt", decryptDataset)
-					}()
 				} else {
-					hclog.L().Info("Failed to find kms key: " + newOptions.kmsKeyName)
+					hclog.L().Info("Failed to find kms key: " + decryptOptions.kmsKeyName)
+					result.skip(region, decryptOptions.decryptDatasetId, fmt.Sprintf("failed to find kms key %s: %v", decryptOptions.kmsKeyName, err))
 				}
 			} else {
 				hclog.L().Info("Failed to find dataset: " + newOptions.decryptDatasetId)
+				result.fail("failed to read dataset %s: %v", newOptions.decryptDatasetId, err)
 			}
-
+			result.mu.Lock()
+			_, wasSkipped := result.Skipped[newOptions.decryptDatasetId]
+			result.mu.Unlock()
+			if wasSkipped {
+				datasetSpan.SetStatus(codes.Error, "skipped")
+			}
+			aeadutils.EndSpan(datasetSpan, err)
 		}
 
 	}
 	wg.Wait()
+	return result, nil
 }
 
-func doBQRoutineCreateOrUpdate(ctx context.Context, options Options, escapedWrappedKeyset string, deterministic bool, routineType string, dataset *bigquery.Dataset) {
+// the regions to look for datasets in, these map to expected dataset names so EU is lower case and europe-west1 has underscore instead of dash
+var bqRegions = []string{"unspecified", "eu", "europe_west1", "europe_west2", "europe_west3"}
 
-	var err error
+// regionOptions returns a copy of the options with the <category> and <region> placeholders of the dataset ids
+// substituted, always from the templates in options so no region can see another region's substitution
+func regionOptions(options Options, fieldName string, region string) Options {
+	newOptions := options
+	// options.encryptDatasetId = "vf<lm>_dh_lake_aead_encrypt_<region>_lv_s"
+	// options.decryptDatasetId = "vf<lm>_dh_lake_<category>_aead_decrypt_<region>_lv_s"
+
+	// first a simple substitution for <category>
+	if strings.Contains(options.encryptDatasetId, "_<category>") {
+		newOptions.encryptDatasetId = strings.Replace(options.encryptDatasetId, "<category>", fieldName, -1)
+	}
+	if strings.Contains(options.decryptDatasetId, "_<category>") {
+		newOptions.decryptDatasetId = strings.Replace(options.decryptDatasetId, "<category>", fieldName, -1)
+	}
+
+	if region == "unspecified" {
+		newOptions.encryptDatasetId = strings.Replace(newOptions.encryptDatasetId, "_<region>", "", -1)
+		newOptions.decryptDatasetId = strings.Replace(newOptions.decryptDatasetId, "_<region>", "", -1)
+	} else {
+		newOptions.encryptDatasetId = strings.Replace(newOptions.encryptDatasetId, "<region>", region, -1)
+		newOptions.decryptDatasetId = strings.Replace(newOptions.decryptDatasetId, "<region>", region, -1)
+	}
+	return newOptions
+}
+
+// datasetOptions returns a copy of the region options with the <region> placeholder of the kms key name
+// substituted for the location of the dataset the routine goes in
+func datasetOptions(options Options, datasetLocation string) Options {
+	newOptions := options
+
+	// infer the kms name
+	// kms has the form:
+	// projects/<project>/locations/<region>/keyRings/hsm-key-tink-<lm>-<region>/cryptoKeys/bq-key
+	// and needs to be translated into
+	// projects/<project>/locations/europe/keyRings/hsm-key-tink-<lm>-europe/cryptoKeys/bq-key
+	// or
+	// projects/<project>/locations/europe-west1/keyRings/hsm-key-tink-<lm>-europe-west1/cryptoKeys/bq-key
+	expectedKMSRegion := strings.ToLower(datasetLocation)
+	if expectedKMSRegion == "eu" {
+		expectedKMSRegion = "europe"
+	}
+	newOptions.kmsKeyName = strings.Replace(options.kmsKeyName, "<region>", expectedKMSRegion, -1)
+	return newOptions
+}
+
+const hexDigits = "0123456789abcdef"
+
+// EscapeBytes formats bytes as an escaped bytestring ie '\x00\x01\xad', as the wrapped keysets are embedded in the
+// routines and as encrypt writes cyphertext with ENCODING bqbytes
+func EscapeBytes(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(b) * 4)
+	for _, cbyte := range b {
+		sb.WriteByte('\\')
+		sb.WriteByte('x')
+		sb.WriteByte(hexDigits[cbyte>>4])
+		sb.WriteByte(hexDigits[cbyte&0x0f])
+	}
+	return sb.String()
+}
+
+// NewRoutineOptions returns the options to build routine bodies with outside a sync, ie to check the bodies a sync
+// would create for a keyset wrapped by the kms key, with the BQ_CIPHERTEXT_TYPE (BYTES or STRING) of the decrypt routine
+func NewRoutineOptions(kmsKeyURI string, ciphertextType string) Options {
+	return Options{kmsKeyURI: kmsKeyURI, ciphertextType: ciphertextType}
+}
+
+// BuildEncryptRoutineBody returns the SQL body of the encrypt routine of the wrapped keyset, escaped with EscapeBytes
+func BuildEncryptRoutineBody(options Options, escapedWrappedKeyset string, deterministic bool) string {
+	if deterministic {
+		return fmt.Sprintf("DETERMINISTIC_ENCRYPT(KEYS.KEYSET_CHAIN(\"%s\", b\"%s\"), plaintext, aad)", options.kmsKeyURI, escapedWrappedKeyset)
+	}
+	return fmt.Sprintf("AEAD.ENCRYPT(KEYS.KEYSET_CHAIN(\"%s\", b\"%s\"), plaintext, aad)", options.kmsKeyURI, escapedWrappedKeyset)
+}
+
+// BuildDecryptRoutineBody returns the SQL body of the decrypt routine of the wrapped keyset, escaped with EscapeBytes.
+// A STRING cyphertext is base64 and decoded in the body
+func BuildDecryptRoutineBody(options Options, escapedWrappedKeyset string, deterministic bool) string {
+	ciphertext := "ciphertext"
+	if options.ciphertextType == ciphertextTypeString {
+		ciphertext = "FROM_BASE64(ciphertext)"
+	}
+	if deterministic {
+		//return fmt.Sprintf("DETERMINISTIC_DECRYPT_BYTES(KEYS.KEYSET_CHAIN(\"%s\", b\"%s\"), %s, aad)", options.kmsKeyURI, escapedWrappedKeyset, ciphertext)
+		return fmt.Sprintf("DETERMINISTIC_DECRYPT_STRING(KEYS.KEYSET_CHAIN(\"%s\", b\"%s\"), %s, aad)", options.kmsKeyURI, escapedWrappedKeyset, ciphertext)
+	}
+	return fmt.Sprintf("AEAD.DECRYPT_STRING(KEYS.KEYSET_CHAIN(\"%s\", b\"%s\"), %s, aad)", options.kmsKeyURI, escapedWrappedKeyset, ciphertext)
+}
+
+// ciphertextArgumentType is the type of the ciphertext argument of the decrypt routine
+func ciphertextArgumentType(options Options) string {
+	if options.ciphertextType == ciphertextTypeString {
+		return ciphertextTypeString
+	}
+	return ciphertextTypeBytes
+}
+
+// doBQRoutineCreateOrUpdate creates the routine, or updates it if it exists, returning whether it was updated
+func doBQRoutineCreateOrUpdate(ctx context.Context, options Options, escapedWrappedKeyset string, deterministic bool, routineType string, dataset *bigquery.Dataset) (updated bool, err error) {
+
+	routineId := options.encryptRoutineId
+	if routineType != "encrypt" {
+		routineId = options.decryptRoutineId
+	}
+	ctx, span := aeadutils.StartSpan(ctx, "bigquery.routine",
+		aeadutils.SpanOperation.String(routineType),
+		aeadutils.SpanDataset.String(dataset.DatasetID),
+		aeadutils.SpanRoutine.String(routineId),
+	)
+	defer func() { aeadutils.EndSpan(span, err) }()
 
 	if routineType == "encrypt" {
 		// 4. Create a BigQuery Routine. You'll likely want to create one Routine each for encryption/decryption.
-		routineEncryptBody := fmt.Sprintf("AEAD.ENCRYPT(KEYS.KEYSET_CHAIN(\"gcp-kms://%s\", b\"%s\"), plaintext, aad)", options.kmsKeyName, escapedWrappedKeyset)
-		if deterministic {
-			routineEncryptBody = fmt.Sprintf("DETERMINISTIC_ENCRYPT(KEYS.KEYSET_CHAIN(\"gcp-kms://%s\", b\"%s\"), plaintext, aad)", options.kmsKeyName, escapedWrappedKeyset)
-		}
+		routineEncryptBody := BuildEncryptRoutineBody(options, escapedWrappedKeyset, deterministic)
 
 		routineEncryptRef := dataset.Routine(options.encryptRoutineId)
 		routineExists := true
 		var rm *bigquery.RoutineMetadata
-		rm, err = routineEncryptRef.Metadata(ctx)
-		if err != nil {
-			// try again - api's seem a bit flakey
-			time.Sleep(1 * time.Second)
-			routineEncryptRef := dataset.Routine(options.encryptRoutineId)
+		// retry as the api's seem a bit flakey
+		err = retryBQ(ctx, options.maxAttempts, func() (err error) {
 			rm, err = routineEncryptRef.Metadata(ctx)
-			if err != nil {
-				routineExists = false
-			}
+			return err
+		})
+		if err != nil {
+			routineExists = false
 		}
+		updated = routineExists
 
 		if !routineExists {
 			metadataEncrypt := &bigquery.RoutineMetadata{
-				Type:     "SCALAR_FUNCTION",
-				Language: "SQL",
-				Body:     routineEncryptBody,
+				Type:        "SCALAR_FUNCTION",
+				Language:    "SQL",
+				Body:        routineEncryptBody,
+				Description: "keyset fingerprint " + options.keysetFingerprint,
 				Arguments: []*bigquery.RoutineArgument{
 					{Name: "plaintext", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 					{Name: "aad", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 				},
 			}
-			err := routineEncryptRef.Create(ctx, metadataEncrypt)
+			err = retryBQ(ctx, options.maxAttempts, func() error {
+				return routineEncryptRef.Create(ctx, metadataEncrypt)
+			})
 			if err != nil {
 				hclog.L().Error("Failed to create encrypt routine: " + options.encryptDatasetId + ":" + options.encryptRoutineId + " Error:" + err.Error())
 			} else {
@@ -276,15 +459,19 @@ func doBQRoutineCreateOrUpdate(ctx context.Context, options Options, escapedWrap
 			}
 		} else {
 			metadataUpdatetoUpdate := &bigquery.RoutineMetadataToUpdate{
-				Type:     "SCALAR_FUNCTION",
-				Language: "SQL",
-				Body:     routineEncryptBody,
+				Type:        "SCALAR_FUNCTION",
+				Language:    "SQL",
+				Body:        routineEncryptBody,
+				Description: "keyset fingerprint " + options.keysetFingerprint,
 				Arguments: []*bigquery.RoutineArgument{
 					{Name: "plaintext", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 					{Name: "aad", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 				},
 			}
-			_, err = routineEncryptRef.Update(ctx, metadataUpdatetoUpdate, rm.ETag)
+			err = retryBQ(ctx, options.maxAttempts, func() error {
+				_, err := routineEncryptRef.Update(ctx, metadataUpdatetoUpdate, rm.ETag)
+				return err
+			})
 			if err != nil {
 				hclog.L().Error("Failed to update encrypt routine: " + options.encryptDatasetId + ":" + options.encryptRoutineId + " Error:" + err.Error())
 			} else {
@@ -293,19 +480,20 @@ func doBQRoutineCreateOrUpdate(ctx context.Context, options Options, escapedWrap
 		}
 	} else {
 		// we are doing a decrypt routine
-		routineDecryptBody := fmt.Sprintf("AEAD.DECRYPT_STRING(KEYS.KEYSET_CHAIN(\"gcp-kms://%s\", b\"%s\"), ciphertext, aad)", options.kmsKeyName, escapedWrappedKeyset)
-		if deterministic {
-			//routineDecryptBody = fmt.Sprintf("DETERMINISTIC_DECRYPT_BYTES(KEYS.KEYSET_CHAIN(\"gcp-kms://%s\", b\"%s\"), ciphertext, aad)", options.kmsKeyName, escapedWrappedKeyset)
-			routineDecryptBody = fmt.Sprintf("DETERMINISTIC_DECRYPT_STRING(KEYS.KEYSET_CHAIN(\"gcp-kms://%s\", b\"%s\"), ciphertext, aad)", options.kmsKeyName, escapedWrappedKeyset)
-		}
+		routineDecryptBody := BuildDecryptRoutineBody(options, escapedWrappedKeyset, deterministic)
 
 		routineDecryptRef := dataset.Routine(options.decryptRoutineId)
 
 		routineExists := true
-		rm, err := routineDecryptRef.Metadata(ctx)
+		var rm *bigquery.RoutineMetadata
+		err = retryBQ(ctx, options.maxAttempts, func() (err error) {
+			rm, err = routineDecryptRef.Metadata(ctx)
+			return err
+		})
 		if err != nil {
 			routineExists = false
 		}
+		updated = routineExists
 		//	fmt.Printf("routineExists=%v", routineExists)
 
 		if !routineExists {
@@ -314,27 +502,31 @@ func doBQRoutineCreateOrUpdate(ctx context.Context, options Options, escapedWrap
 			if deterministic {
 				// deterministic
 				metadataDecrypt = &bigquery.RoutineMetadata{
-					Type:     "SCALAR_FUNCTION",
-					Language: "SQL",
-					Body:     routineDecryptBody,
+					Type:        "SCALAR_FUNCTION",
+					Language:    "SQL",
+					Body:        routineDecryptBody,
+					Description: "keyset fingerprint " + options.keysetFingerprint,
 					Arguments: []*bigquery.RoutineArgument{
-						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: "BYTES"}},
+						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: ciphertextArgumentType(options)}},
 						{Name: "aad", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 					},
 				}
 			} else {
 				// non deterministic
 				metadataDecrypt = &bigquery.RoutineMetadata{
-					Type:     "SCALAR_FUNCTION",
-					Language: "SQL",
-					Body:     routineDecryptBody,
+					Type:        "SCALAR_FUNCTION",
+					Language:    "SQL",
+					Body:        routineDecryptBody,
+					Description: "keyset fingerprint " + options.keysetFingerprint,
 					Arguments: []*bigquery.RoutineArgument{
-						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: "BYTES"}},
+						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: ciphertextArgumentType(options)}},
 						{Name: "aad", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 					},
 				}
 			}
-			err = routineDecryptRef.Create(ctx, metadataDecrypt)
+			err = retryBQ(ctx, options.maxAttempts, func() error {
+				return routineDecryptRef.Create(ctx, metadataDecrypt)
+			})
 			if err != nil {
 				hclog.L().Error("Failed to create decrypt routine: " + options.decryptDatasetId + ":" + options.decryptRoutineId + " Error:" + err.Error())
 			} else {
@@ -345,26 +537,31 @@ func doBQRoutineCreateOrUpdate(ctx context.Context, options Options, escapedWrap
 			var metadataUpdatetoUpdate *bigquery.RoutineMetadataToUpdate
 			if deterministic {
 				metadataUpdatetoUpdate = &bigquery.RoutineMetadataToUpdate{
-					Type:     "SCALAR_FUNCTION",
-					Language: "SQL",
-					Body:     routineDecryptBody,
+					Type:        "SCALAR_FUNCTION",
+					Language:    "SQL",
+					Body:        routineDecryptBody,
+					Description: "keyset fingerprint " + options.keysetFingerprint,
 					Arguments: []*bigquery.RoutineArgument{
-						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: "BYTES"}},
+						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: ciphertextArgumentType(options)}},
 						{Name: "aad", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 					},
 				}
 			} else {
 				metadataUpdatetoUpdate = &bigquery.RoutineMetadataToUpdate{
-					Type:     "SCALAR_FUNCTION",
-					Language: "SQL",
-					Body:     routineDecryptBody,
+					Type:        "SCALAR_FUNCTION",
+					Language:    "SQL",
+					Body:        routineDecryptBody,
+					Description: "keyset fingerprint " + options.keysetFingerprint,
 					Arguments: []*bigquery.RoutineArgument{
-						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: "BYTES"}},
+						{Name: "ciphertext", DataType: &bigquery.StandardSQLDataType{TypeKind: ciphertextArgumentType(options)}},
 						{Name: "aad", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
 					},
 				}
 			}
-			_, err = routineDecryptRef.Update(ctx, metadataUpdatetoUpdate, rm.ETag)
+			err = retryBQ(ctx, options.maxAttempts, func() error {
+				_, err := routineDecryptRef.Update(ctx, metadataUpdatetoUpdate, rm.ETag)
+				return err
+			})
 			if err != nil {
 				hclog.L().Error("Failed to update decrypt routine: " + options.decryptDatasetId + ":" + options.decryptRoutineId + " Error:" + err.Error())
 			} else {
@@ -372,9 +569,43 @@ func doBQRoutineCreateOrUpdate(ctx context.Context, options Options, escapedWrap
 			}
 		}
 	}
+	return updated, err
 }
 
-func resolveOptions(options *Options, fieldName string, deterministic bool, envOptions cmap.ConcurrentMap) {
+// WithSettings returns the options to resolve from, the settings overlaid on the env options. The settings are the
+// plugin's non key options held apart from the keysets, config written before there were settings still holds them
+// alongside the keysets so any option that is not a setting falls back to the env options
+func WithSettings(settings cmap.ConcurrentMap, envOptions cmap.ConcurrentMap) cmap.ConcurrentMap {
+	merged := cmap.New()
+	merged.MSet(envOptions.Items())
+	merged.MSet(settings.Items())
+	return merged
+}
+
+// OptionsSnapshot is the env options of a sync read once at its start, so the options of each field are resolved from
+// plain maps and structs rather than taking the locks of the concurrent map for every field of a large sync
+type OptionsSnapshot struct {
+	// base is the options before the field is known, ie the defaults with the BQ_ overrides
+	base Options
+	// values is every env option, for the options named after a field or routine
+	values map[string]string
+	// kmsProvider is the BQ_KMS_PROVIDER, default gcp
+	kmsProvider string
+	// envOptions creates the kms client of each field, which only reads the kms provider options
+	envOptions cmap.ConcurrentMap
+}
+
+// NewOptionsSnapshot reads the env options into an OptionsSnapshot, logging any invalid option once for the sync
+func NewOptionsSnapshot(envOptions cmap.ConcurrentMap) *OptionsSnapshot {
+	snapshot := &OptionsSnapshot{
+		values:      make(map[string]string),
+		kmsProvider: ResolveKMSProvider(envOptions),
+		envOptions:  envOptions,
+	}
+	for k, v := range envOptions.Items() {
+		snapshot.values[k] = fmt.Sprintf("%v", v)
+	}
+	options := &snapshot.base
 
 	// set the defaults
 	options.kmsKeyName = "projects/your-kms-project/locations/<region>/keyRings/hsm-key-tink-<lm>-<region>/cryptoKeys/bq-key" // Format: 'projects/.../locations/.../keyRings/.../cryptoKeys/...'
@@ -383,50 +614,117 @@ func resolveOptions(options *Options, fieldName string, deterministic bool, envO
 	options.decryptDatasetId = "vf<lm>_dh_lake_<category>_aead_decrypt_<region>_lv_s"
 	options.detRoutinePrefix = "siv"
 	options.nondetRoutinePrefix = "gcm"
+	options.routineNameTemplate = defaultRoutineNameTemplate
+	options.maxAttempts = defaultBQMaxAttempts
+	options.maxConcurrency = defaultBQMaxConcurrency
+	options.ciphertextType = ciphertextTypeBytes
 
 	// set any overrides
-	kmsKeyInterface, ok := envOptions.Get("BQ_KMSKEY")
-	if ok {
-		options.kmsKeyName = fmt.Sprintf("%s", kmsKeyInterface)
+	if kmsKey, ok := snapshot.values["BQ_KMSKEY"]; ok {
+		options.kmsKeyName = kmsKey
 	}
-	projectIdInterface, ok := envOptions.Get("BQ_PROJECT")
-	if ok {
-		options.projectId = fmt.Sprintf("%s", projectIdInterface)
+	if projectId, ok := snapshot.values["BQ_PROJECT"]; ok {
+		options.projectId = projectId
 	}
-	encryptDatasetIdInterface, ok := envOptions.Get("BQ_DEFAULT_ENCRYPT_DATASET")
-	if ok {
-		options.encryptDatasetId = fmt.Sprintf("%s", encryptDatasetIdInterface)
+	if encryptDatasetId, ok := snapshot.values["BQ_DEFAULT_ENCRYPT_DATASET"]; ok {
+		options.encryptDatasetId = encryptDatasetId
 	}
-	decryptDatasetIdInterface, ok := envOptions.Get("BQ_DEFAULT_DECRYPT_DATASET")
-	if ok {
-		options.decryptDatasetId = fmt.Sprintf("%s", decryptDatasetIdInterface)
+	if decryptDatasetId, ok := snapshot.values["BQ_DEFAULT_DECRYPT_DATASET"]; ok {
+		options.decryptDatasetId = decryptDatasetId
 	}
-	detRoutinePrefixInterface, ok := envOptions.Get("BQ_ROUTINE_DET_PREFIX")
-	if ok {
-		options.detRoutinePrefix = fmt.Sprintf("%s", detRoutinePrefixInterface)
+	if detRoutinePrefix, ok := snapshot.values["BQ_ROUTINE_DET_PREFIX"]; ok {
+		options.detRoutinePrefix = detRoutinePrefix
+	}
+	if nondetRoutinePrefix, ok := snapshot.values["BQ_ROUTINE_NONDET_PREFIX"]; ok {
+		options.nondetRoutinePrefix = nondetRoutinePrefix
+	}
+	if routineNameTemplate, ok := snapshot.values["BQ_ROUTINE_NAME_TEMPLATE"]; ok {
+		options.routineNameTemplate = routineNameTemplate
+	}
+	if maxAttemptsStr, ok := snapshot.values["BQ_MAX_ATTEMPTS"]; ok {
+		maxAttempts, err := strconv.Atoi(maxAttemptsStr)
+		if err == nil && maxAttempts > 0 {
+			options.maxAttempts = maxAttempts
+		} else {
+			hclog.L().Error("invalid BQ_MAX_ATTEMPTS, using the default")
+		}
+	}
+	if maxConcurrencyStr, ok := snapshot.values["BQ_MAX_CONCURRENCY"]; ok {
+		maxConcurrency, err := strconv.Atoi(maxConcurrencyStr)
+		if err == nil && maxConcurrency > 0 {
+			options.maxConcurrency = maxConcurrency
+		} else {
+			hclog.L().Error("invalid BQ_MAX_CONCURRENCY, using the default")
+		}
+	}
+	if ciphertextTypeStr, ok := snapshot.values["BQ_CIPHERTEXT_TYPE"]; ok {
+		ciphertextType := strings.ToUpper(ciphertextTypeStr)
+		if ciphertextType == ciphertextTypeBytes || ciphertextType == ciphertextTypeString {
+			options.ciphertextType = ciphertextType
+		} else {
+			hclog.L().Error("invalid BQ_CIPHERTEXT_TYPE, using the default")
+		}
+	}
+	return snapshot
+}
+
+// resolve returns the options of the routines of the field, failing if the BQ_ROUTINE_NAME_TEMPLATE does not give
+// valid routine names for the field. The kms key is resolved even then
+func (snapshot *OptionsSnapshot) resolve(fieldName string, deterministic bool) (Options, error) {
+	options := snapshot.base
+
+	// fieldName might have a "-" in it, but "-" are not allowed in BQ, so translate them to "_" for the routines
+	fieldName = aeadutils.RemoveKeyPrefix(fieldName)
+	options.fieldName = aeadutils.BQFieldName(fieldName)
+
+	// a field can wrap under its own kms key, BQ_KMSKEY_<field> overrides BQ_KMSKEY and can use the <region> placeholder.
+	// <field> is the name in vault, the BQ name is still accepted
+	fieldKmsKey, ok := snapshot.values["BQ_KMSKEY_"+fieldName]
+	if !ok {
+		fieldKmsKey, ok = snapshot.values["BQ_KMSKEY_"+options.fieldName]
 	}
-	nondetRoutinePrefixInterface, ok := envOptions.Get("BQ_ROUTINE_NONDET_PREFIX")
 	if ok {
-		options.nondetRoutinePrefix = fmt.Sprintf("%s", nondetRoutinePrefixInterface)
+		options.kmsKeyName = fieldKmsKey
 	}
 
-	// fieldName might have a "-" in it, but "-" are not allowed in BQ, so translate them to "_"
-	options.fieldName = strings.Replace(fieldName, "-", "_", -1)
+	routinePrefix := options.nondetRoutinePrefix
 	if deterministic {
-		options.encryptRoutineId = options.fieldName + "_" + options.detRoutinePrefix + "_encrypt" // ie routine name = address_siv_encrypt
-		options.decryptRoutineId = options.fieldName + "_" + options.detRoutinePrefix + "_decrypt" // ie routine name = address_siv_decrypt
-	} else {
-		options.encryptRoutineId = options.fieldName + "_" + options.nondetRoutinePrefix + "_encrypt" // ie routine name = address_gcm_encrypt
-		options.decryptRoutineId = options.fieldName + "_" + options.nondetRoutinePrefix + "_decrypt" // ie routine name = address_gcm_encrypt
+		routinePrefix = options.detRoutinePrefix
+	}
+	// ie routine names = address_siv_encrypt and address_siv_decrypt by default. A template without <field> would give
+	// every field the same routines, so it is rejected along with one that does not give valid names for the field
+	var err error
+	if !strings.Contains(options.routineNameTemplate, "<field>") {
+		err = fmt.Errorf("routine name template %q has no <field>", options.routineNameTemplate)
+	}
+	if err == nil {
+		options.encryptRoutineId, err = routineName(options.routineNameTemplate, options.fieldName, routinePrefix, "encrypt")
+	}
+	if err == nil {
+		options.decryptRoutineId, err = routineName(options.routineNameTemplate, options.fieldName, routinePrefix, "decrypt")
+	}
+	if err == nil && options.encryptRoutineId == options.decryptRoutineId {
+		err = fmt.Errorf("routine name template %q gives the same name to the encrypt and decrypt routines", options.routineNameTemplate)
+	}
+	if err != nil {
+		options.encryptRoutineId = ""
+		options.decryptRoutineId = ""
+		return options, fmt.Errorf("invalid BQ_ROUTINE_NAME_TEMPLATE for field %s: %w", fieldName, err)
 	}
 
 	// if we have a config entry for the encrypt or decrypt routine then use that as the dataset
-	overrideBQDatasetInterface, ok := envOptions.Get(options.encryptRoutineId)
-	if ok {
-		options.encryptDatasetId = fmt.Sprintf("%s", overrideBQDatasetInterface)
+	if overrideBQDataset, ok := snapshot.values[options.encryptRoutineId]; ok {
+		options.encryptDatasetId = overrideBQDataset
 	}
-	overrideBQDatasetInterface, ok = envOptions.Get(options.decryptRoutineId)
-	if ok {
-		options.decryptDatasetId = fmt.Sprintf("%s", overrideBQDatasetInterface)
+	if overrideBQDataset, ok := snapshot.values[options.decryptRoutineId]; ok {
+		options.decryptDatasetId = overrideBQDataset
 	}
+	return options, nil
+}
+
+// resolveOptions resolves the options of one field straight from the env options, a sync of many fields takes an
+// OptionsSnapshot once instead
+func resolveOptions(options *Options, fieldName string, deterministic bool, envOptions cmap.ConcurrentMap) (err error) {
+	*options, err = NewOptionsSnapshot(envOptions).resolve(fieldName, deterministic)
+	return err
 }
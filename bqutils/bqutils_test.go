@@ -0,0 +1,353 @@
+package bqutils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// the original per byte formatting, kept to check EscapeBytes is identical
+func escapeBytesSprintf(b []byte) string {
+	escaped := ""
+	for _, cbyte := range b {
+		escaped += fmt.Sprintf("\\x%02x", cbyte)
+	}
+	return escaped
+}
+
+func TestEscapeBytes(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	random := make([]byte, 1024)
+	_, err := rand.Read(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range [][]byte{nil, {}, {0x00, 0x01, 0xad}, all, random} {
+		got := EscapeBytes(b)
+		expected := escapeBytesSprintf(b)
+		if got != expected {
+			t.Errorf("expected %s to be %s", got, expected)
+		}
+	}
+}
+
+func BenchmarkEscapeBytes(b *testing.B) {
+	wrappedKeyset := make([]byte, 4096)
+	_, err := rand.Read(wrappedKeyset)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("sprintf", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			escapeBytesSprintf(wrappedKeyset)
+		}
+	})
+	b.Run("builder", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			EscapeBytes(wrappedKeyset)
+		}
+	})
+}
+
+func BenchmarkResolveOptions(b *testing.B) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_PROJECT", "p")
+	envOptions.Set("BQ_KMSKEY", "projects/p/locations/<region>/keyRings/r/cryptoKeys/bq-key")
+	envOptions.Set("BQ_DEFAULT_ENCRYPT_DATASET", "enc_<region>")
+	envOptions.Set("BQ_DEFAULT_DECRYPT_DATASET", "dec_<region>")
+	// a config with many keysets alongside the options, as bqsync resolves from
+	for i := 0; i < 1000; i++ {
+		envOptions.Set(fmt.Sprintf("field%d", i), "gcm/keyset")
+	}
+	// the options of each field read from the concurrent map, against one snapshot shared by every field of a sync
+	b.Run("perField", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			var options Options
+			for pb.Next() {
+				resolveOptions(&options, "address", false, envOptions)
+			}
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		snapshot := NewOptionsSnapshot(envOptions)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				snapshot.resolve("address", false)
+			}
+		})
+	})
+}
+
+func TestOptionsSnapshot(t *testing.T) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_PROJECT", "p")
+	envOptions.Set("BQ_KMSKEY_address", "address-key")
+	envOptions.Set("address_gcm_decrypt", "address_dataset")
+	snapshot := NewOptionsSnapshot(envOptions)
+
+	// a snapshot is not changed by later changes to the env options
+	envOptions.Set("BQ_PROJECT", "other")
+	for _, fieldName := range []string{"address", "email"} {
+		var expected Options
+		resolveOptions(&expected, fieldName, false, envOptions)
+		expected.projectId = "p"
+		if options, _ := snapshot.resolve(fieldName, false); options != expected {
+			t.Errorf("%s: expected %v got %v", fieldName, expected, options)
+		}
+	}
+	if options, _ := snapshot.resolve("address", false); options.kmsKeyName != "address-key" || options.decryptDatasetId != "address_dataset" {
+		t.Errorf("expected the options of the field got %v", options)
+	}
+}
+
+func TestRegionOptions(t *testing.T) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_KMSKEY", "projects/kms-project/locations/<region>/keyRings/tink-<region>/cryptoKeys/bq-key")
+	envOptions.Set("BQ_DEFAULT_ENCRYPT_DATASET", "lake_aead_encrypt_<region>")
+	envOptions.Set("BQ_DEFAULT_DECRYPT_DATASET", "lake_<category>_aead_decrypt_<region>")
+
+	var options Options
+	resolveOptions(&options, "address", false, envOptions)
+	original := options
+
+	// the kms region expected for each dataset location
+	locations := map[string]string{
+		"EU":           "europe",
+		"europe-west1": "europe-west1",
+		"europe-west2": "europe-west2",
+	}
+
+	for _, region := range bqRegions {
+		newOptions := regionOptions(options, "address", region)
+
+		expectedEncryptDatasetId := "lake_aead_encrypt_" + region
+		expectedDecryptDatasetId := "lake_address_aead_decrypt_" + region
+		if region == "unspecified" {
+			expectedEncryptDatasetId = "lake_aead_encrypt"
+			expectedDecryptDatasetId = "lake_address_aead_decrypt"
+		}
+		if newOptions.encryptDatasetId != expectedEncryptDatasetId {
+			t.Errorf("expected %s to be %s", newOptions.encryptDatasetId, expectedEncryptDatasetId)
+		}
+		if newOptions.decryptDatasetId != expectedDecryptDatasetId {
+			t.Errorf("expected %s to be %s", newOptions.decryptDatasetId, expectedDecryptDatasetId)
+		}
+
+		// the encrypt and decrypt datasets of a region can be in different locations, each gets its own kms key
+		for location, kmsRegion := range locations {
+			encryptOptions := datasetOptions(newOptions, location)
+			decryptOptions := datasetOptions(newOptions, "europe-west3")
+
+			expectedKmsKeyName := "projects/kms-project/locations/" + kmsRegion + "/keyRings/tink-" + kmsRegion + "/cryptoKeys/bq-key"
+			if encryptOptions.kmsKeyName != expectedKmsKeyName {
+				t.Errorf("%s %s: expected %s to be %s", region, location, encryptOptions.kmsKeyName, expectedKmsKeyName)
+			}
+			expectedKmsKeyName = "projects/kms-project/locations/europe-west3/keyRings/tink-europe-west3/cryptoKeys/bq-key"
+			if decryptOptions.kmsKeyName != expectedKmsKeyName {
+				t.Errorf("%s %s: expected %s to be %s", region, location, decryptOptions.kmsKeyName, expectedKmsKeyName)
+			}
+		}
+	}
+
+	if options != original {
+		t.Errorf("expected the options template to be unchanged %v", options)
+	}
+}
+
+func TestWithSettings(t *testing.T) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_PROJECT", "config-project")
+	envOptions.Set("BQ_ROUTINE_DET_PREFIX", "det")
+	settings := cmap.New()
+	settings.Set("BQ_PROJECT", "settings-project")
+
+	var options Options
+	resolveOptions(&options, "address", true, WithSettings(settings, envOptions))
+	if options.projectId != "settings-project" {
+		t.Errorf("expected the setting to be used got %s", options.projectId)
+	}
+	if options.encryptRoutineId != "address_det_encrypt" {
+		t.Errorf("expected the config entry to be used without a setting got %s", options.encryptRoutineId)
+	}
+	if envOptions.Count() != 2 || settings.Count() != 1 {
+		t.Error("expected the settings and env options to be unchanged")
+	}
+}
+
+func TestRoutineNameTemplate(t *testing.T) {
+	longField := strings.Repeat("a", 250)
+	for _, test := range []struct {
+		template      string
+		fieldName     string
+		deterministic bool
+		encrypt       string
+		decrypt       string
+	}{
+		{"", "address", true, "address_siv_encrypt", "address_siv_decrypt"},
+		{"<dir>_<field>", "address", true, "enc_address", "dec_address"},
+		{"<prefix>_<direction>_<field>", "post-code", false, "gcm_encrypt_post_code", "gcm_decrypt_post_code"},
+		// a field name that starts with a digit is fine after a prefix, and a long field name with a short template
+		{"<dir>_<field>", "2fa", false, "enc_2fa", "dec_2fa"},
+		{"<dir>_<field>", longField, true, "enc_" + longField, "dec_" + longField},
+	} {
+		envOptions := cmap.New()
+		if test.template != "" {
+			envOptions.Set("BQ_ROUTINE_NAME_TEMPLATE", test.template)
+		}
+		var options Options
+		if err := resolveOptions(&options, test.fieldName, test.deterministic, envOptions); err != nil {
+			t.Errorf("%q %s: %v", test.template, test.fieldName, err)
+		}
+		if options.encryptRoutineId != test.encrypt || options.decryptRoutineId != test.decrypt {
+			t.Errorf("%q %s: expected %s and %s got %s and %s", test.template, test.fieldName, test.encrypt, test.decrypt, options.encryptRoutineId, options.decryptRoutineId)
+		}
+	}
+
+	// characters BQ does not allow, the same name for both routines, a template without <field>, a name starting with
+	// a digit and a name that is too long fail the field rather than fall back to the default
+	for _, test := range []struct {
+		template  string
+		fieldName string
+	}{
+		{"<field>-<dir>", "address"},
+		{"<field>_routine", "address"},
+		{"<prefix>_<direction>", "address"},
+		{"<field>_<dir>", "2fa"},
+		{"<field>_<prefix>_<direction>_routine", longField},
+	} {
+		envOptions := cmap.New()
+		envOptions.Set("BQ_ROUTINE_NAME_TEMPLATE", test.template)
+		envOptions.Set("BQ_KMSKEY", "bq-key")
+		var options Options
+		err := resolveOptions(&options, test.fieldName, true, envOptions)
+		if err == nil || !strings.Contains(err.Error(), "BQ_ROUTINE_NAME_TEMPLATE") {
+			t.Errorf("%q: expected an invalid BQ_ROUTINE_NAME_TEMPLATE got %v", test.template, err)
+		}
+		if options.encryptRoutineId != "" || options.decryptRoutineId != "" || options.kmsKeyName != "bq-key" {
+			t.Errorf("%q: expected no routines and the kms key got %v", test.template, options)
+		}
+	}
+
+	// the dataset override of a routine is looked up by its templated name
+	envOptions := cmap.New()
+	envOptions.Set("BQ_ROUTINE_NAME_TEMPLATE", "<dir>_<field>")
+	envOptions.Set("dec_address", "address_decrypt_dataset")
+	var options Options
+	resolveOptions(&options, "address", true, envOptions)
+	if options.decryptDatasetId != "address_decrypt_dataset" {
+		t.Errorf("expected the dataset of dec_address got %s", options.decryptDatasetId)
+	}
+
+	if _, err := routineName("<field>_<dir>", longField, "siv", "encrypt"); err != nil {
+		t.Errorf("expected a name of %d to be valid got %v", len(longField)+4, err)
+	}
+	if _, err := routineName("<field>_<direction>_x", longField, "siv", "encrypt"); err == nil {
+		t.Error("expected a name longer than 256 to be invalid")
+	}
+	if _, err := routineName("<prefix>", "address", "", "encrypt"); err == nil {
+		t.Error("expected an empty name to be invalid")
+	}
+}
+
+func TestFieldKMSKey(t *testing.T) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_KMSKEY", "projects/kms-project/locations/<region>/keyRings/tink-<region>/cryptoKeys/bq-key")
+	envOptions.Set("BQ_KMSKEY_msisdn", "projects/kms-project/locations/<region>/keyRings/tink-<region>/cryptoKeys/msisdn-key")
+	envOptions.Set("BQ_KMSKEY_home_address", "projects/kms-project/locations/<region>/keyRings/tink-<region>/cryptoKeys/address-key")
+
+	expected := map[string]string{
+		"msisdn":       "projects/kms-project/locations/europe-west1/keyRings/tink-europe-west1/cryptoKeys/msisdn-key",
+		"home-address": "projects/kms-project/locations/europe-west1/keyRings/tink-europe-west1/cryptoKeys/address-key",
+		"postcode":     "projects/kms-project/locations/europe-west1/keyRings/tink-europe-west1/cryptoKeys/bq-key",
+	}
+	for fieldName, expectedKmsKeyName := range expected {
+		var options Options
+		resolveOptions(&options, fieldName, false, envOptions)
+		options = datasetOptions(regionOptions(options, fieldName, "europe-west1"), "europe-west1")
+		if options.kmsKeyName != expectedKmsKeyName {
+			t.Errorf("%s: expected %s to be %s", fieldName, options.kmsKeyName, expectedKmsKeyName)
+		}
+	}
+}
+
+func TestFieldKMSKeyHyphenated(t *testing.T) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_KMSKEY", "projects/kms-project/locations/<region>/keyRings/tink-<region>/cryptoKeys/bq-key")
+	envOptions.Set("BQ_KMSKEY_post-code", "projects/kms-project/locations/<region>/keyRings/tink-<region>/cryptoKeys/postcode-key")
+	snapshot := NewOptionsSnapshot(envOptions)
+
+	// the option is looked up with the name in vault, with or without its prefix, the routines use the BQ name
+	for _, fieldName := range []string{"post-code", "gcm/post-code"} {
+		options, err := snapshot.resolve(fieldName, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options.fieldName != "post_code" || options.encryptRoutineId != "post_code_gcm_encrypt" || options.decryptRoutineId != "post_code_gcm_decrypt" {
+			t.Errorf("%s: expected the post_code routines got %s %s %s", fieldName, options.fieldName, options.encryptRoutineId, options.decryptRoutineId)
+		}
+		options = datasetOptions(regionOptions(options, options.fieldName, "europe-west1"), "europe-west1")
+		if options.kmsKeyName != "projects/kms-project/locations/europe-west1/keyRings/tink-europe-west1/cryptoKeys/postcode-key" {
+			t.Errorf("%s: expected the BQ_KMSKEY_post-code got %s", fieldName, options.kmsKeyName)
+		}
+	}
+
+	// kmscheck checks the key bqsync wraps with
+	expected := []string{"projects/kms-project/locations/europe-west1/keyRings/tink-europe-west1/cryptoKeys/postcode-key"}
+	if keys := RegionKMSKeys([]string{"post-code"}, envOptions)["europe_west1"]; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v got %v", expected, keys)
+	}
+}
+
+func TestBuildRoutineBody(t *testing.T) {
+	options := NewRoutineOptions("gcp-kms://projects/p/locations/eu/keyRings/r/cryptoKeys/bq-key", "BYTES")
+	stringOptions := NewRoutineOptions("gcp-kms://projects/p/locations/eu/keyRings/r/cryptoKeys/bq-key", "STRING")
+	escaped := EscapeBytes([]byte{0x00, 0x01, 0xad})
+	chain := `KEYS.KEYSET_CHAIN("gcp-kms://projects/p/locations/eu/keyRings/r/cryptoKeys/bq-key", b"\x00\x01\xad")`
+
+	tests := []struct {
+		name          string
+		build         func(Options, string, bool) string
+		options       Options
+		deterministic bool
+		expected      string
+	}{
+		{"nondet encrypt", BuildEncryptRoutineBody, options, false, "AEAD.ENCRYPT(" + chain + ", plaintext, aad)"},
+		{"det encrypt", BuildEncryptRoutineBody, options, true, "DETERMINISTIC_ENCRYPT(" + chain + ", plaintext, aad)"},
+		{"nondet decrypt", BuildDecryptRoutineBody, options, false, "AEAD.DECRYPT_STRING(" + chain + ", ciphertext, aad)"},
+		{"det decrypt", BuildDecryptRoutineBody, options, true, "DETERMINISTIC_DECRYPT_STRING(" + chain + ", ciphertext, aad)"},
+		{"string encrypt", BuildEncryptRoutineBody, stringOptions, false, "AEAD.ENCRYPT(" + chain + ", plaintext, aad)"},
+		{"nondet string decrypt", BuildDecryptRoutineBody, stringOptions, false, "AEAD.DECRYPT_STRING(" + chain + ", FROM_BASE64(ciphertext), aad)"},
+		{"det string decrypt", BuildDecryptRoutineBody, stringOptions, true, "DETERMINISTIC_DECRYPT_STRING(" + chain + ", FROM_BASE64(ciphertext), aad)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.build(tt.options, escaped, tt.deterministic)
+			if got != tt.expected {
+				t.Errorf("expected %s got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCiphertextType(t *testing.T) {
+	for value, expected := range map[string]string{"": "BYTES", "BYTES": "BYTES", "string": "STRING", "STRING": "STRING", "base64": "BYTES"} {
+		envOptions := cmap.New()
+		if value != "" {
+			envOptions.Set("BQ_CIPHERTEXT_TYPE", value)
+		}
+		var options Options
+		resolveOptions(&options, "email", false, envOptions)
+		if got := ciphertextArgumentType(options); got != expected {
+			t.Errorf("expected BQ_CIPHERTEXT_TYPE %q to give a %s ciphertext argument got %s", value, expected, got)
+		}
+	}
+}
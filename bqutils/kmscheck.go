@@ -0,0 +1,76 @@
+package bqutils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// kmsCheckPlaintext is encrypted with each kms key by CheckKMSKeys, to show the key can wrap a keyset
+var kmsCheckPlaintext = []byte("kmscheck")
+
+// regionLocation is the BQ location of the datasets of a region, ie europe_west1 is europe-west1
+func regionLocation(region string) string {
+	return strings.Replace(region, "_", "-", -1)
+}
+
+// RegionKMSKeys returns the kms keys bqsync would wrap the keysets of the fields with in each region, with the
+// BQ_KMSKEY_<field> of each field and the <region> placeholder substituted. The unspecified region is left out as the
+// location of its datasets is only known from BQ. With no fields it is the BQ_KMSKEY of each region
+func RegionKMSKeys(fieldNames []string, envOptions cmap.ConcurrentMap) map[string][]string {
+	if len(fieldNames) == 0 {
+		fieldNames = []string{""}
+	}
+	snapshot := NewOptionsSnapshot(envOptions)
+	regionKeys := make(map[string][]string)
+	for _, region := range bqRegions {
+		if region == "unspecified" {
+			continue
+		}
+		keyNames := make(map[string]bool)
+		for _, fieldName := range fieldNames {
+			// the kms key does not depend on the routine names, a bad BQ_ROUTINE_NAME_TEMPLATE fails the bqsync of the field
+			options, _ := snapshot.resolve(fieldName, false)
+			keyNames[datasetOptions(options, regionLocation(region)).kmsKeyName] = true
+		}
+		for keyName := range keyNames {
+			regionKeys[region] = append(regionKeys[region], keyName)
+		}
+		sort.Strings(regionKeys[region])
+	}
+	return regionKeys
+}
+
+// CheckKMSKeys checks each kms key of RegionKMSKeys can be found and can encrypt, without touching BQ. It returns the
+// error of each key in each region, nil if the key is usable. A key used in more than one region is checked once
+func CheckKMSKeys(ctx context.Context, kmsWrapper KMSWrapper, fieldNames []string, envOptions cmap.ConcurrentMap) map[string]map[string]error {
+	kmsWrapper = &tracedKMSWrapper{kmsWrapper}
+	checked := make(map[string]error)
+	results := make(map[string]map[string]error)
+	for region, keyNames := range RegionKMSKeys(fieldNames, envOptions) {
+		results[region] = make(map[string]error)
+		for _, keyName := range keyNames {
+			err, ok := checked[keyName]
+			if !ok {
+				err = checkKMSKey(ctx, kmsWrapper, keyName)
+				checked[keyName] = err
+			}
+			results[region][keyName] = err
+		}
+	}
+	return results
+}
+
+// checkKMSKey gets the kms key and encrypts kmsCheckPlaintext with it
+func checkKMSKey(ctx context.Context, kmsWrapper KMSWrapper, keyName string) error {
+	if err := kmsWrapper.KeyExists(ctx, keyName); err != nil {
+		return fmt.Errorf("failed to get kms key %s: %w", keyName, err)
+	}
+	if _, err := kmsWrapper.WrapKeyset(ctx, keyName, kmsCheckPlaintext); err != nil {
+		return fmt.Errorf("failed to encrypt with kms key %s: %w", keyName, err)
+	}
+	return nil
+}
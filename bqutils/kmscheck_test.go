@@ -0,0 +1,103 @@
+package bqutils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// checkKMSWrapper is a kms that counts the calls for each key, where keys with missing in the name cannot be found
+// and keys with denied in the name cannot encrypt
+type checkKMSWrapper struct {
+	KMSWrapper
+	calls map[string]int
+}
+
+func (w *checkKMSWrapper) KeyExists(ctx context.Context, keyName string) error {
+	w.calls[keyName]++
+	if strings.Contains(keyName, "missing") {
+		return errors.New("key not found")
+	}
+	return nil
+}
+
+func (w *checkKMSWrapper) WrapKeyset(ctx context.Context, keyName string, binaryKeyset []byte) ([]byte, error) {
+	w.calls[keyName]++
+	if strings.Contains(keyName, "denied") {
+		return nil, errors.New("permission denied")
+	}
+	return binaryKeyset, nil
+}
+
+func TestRegionKMSKeys(t *testing.T) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_KMSKEY", "projects/p/locations/<region>/keyRings/tink-<region>/cryptoKeys/bq-key")
+	envOptions.Set("BQ_KMSKEY_msisdn", "projects/p/locations/europe/keyRings/tink/cryptoKeys/msisdn-key")
+
+	regionKeys := RegionKMSKeys([]string{"address", "msisdn", "postcode"}, envOptions)
+	expected := map[string][]string{
+		"eu":           {"projects/p/locations/europe/keyRings/tink-europe/cryptoKeys/bq-key", "projects/p/locations/europe/keyRings/tink/cryptoKeys/msisdn-key"},
+		"europe_west1": {"projects/p/locations/europe-west1/keyRings/tink-europe-west1/cryptoKeys/bq-key", "projects/p/locations/europe/keyRings/tink/cryptoKeys/msisdn-key"},
+		"europe_west2": {"projects/p/locations/europe-west2/keyRings/tink-europe-west2/cryptoKeys/bq-key", "projects/p/locations/europe/keyRings/tink/cryptoKeys/msisdn-key"},
+		"europe_west3": {"projects/p/locations/europe-west3/keyRings/tink-europe-west3/cryptoKeys/bq-key", "projects/p/locations/europe/keyRings/tink/cryptoKeys/msisdn-key"},
+	}
+	if !reflect.DeepEqual(regionKeys, expected) {
+		t.Errorf("expected %v got %v", expected, regionKeys)
+	}
+
+	if keys := RegionKMSKeys(nil, envOptions)["eu"]; !reflect.DeepEqual(keys, []string{"projects/p/locations/europe/keyRings/tink-europe/cryptoKeys/bq-key"}) {
+		t.Errorf("expected the BQ_KMSKEY with no fields got %v", keys)
+	}
+}
+
+func TestCheckKMSKeys(t *testing.T) {
+	envOptions := cmap.New()
+	envOptions.Set("BQ_KMSKEY", "projects/p/locations/<region>/keyRings/tink/cryptoKeys/bq-key")
+	envOptions.Set("BQ_KMSKEY_msisdn", "projects/p/locations/europe/keyRings/tink/cryptoKeys/shared-key")
+	envOptions.Set("BQ_KMSKEY_imsi", "projects/p/locations/<region>/keyRings/tink/cryptoKeys/denied-key")
+	envOptions.Set("BQ_KMSKEY_imei", "projects/p/locations/<region>/keyRings/tink/cryptoKeys/missing-key")
+
+	kmsWrapper := &checkKMSWrapper{calls: make(map[string]int)}
+	results := CheckKMSKeys(context.Background(), kmsWrapper, []string{"address", "msisdn", "imsi", "imei"}, envOptions)
+	if len(results) != 4 {
+		t.Fatalf("expected results for 4 regions got %v", results)
+	}
+	for region, keyResults := range results {
+		location := regionLocation(region)
+		if region == "eu" {
+			location = "europe"
+		}
+		expected := map[string]string{
+			"projects/p/locations/" + location + "/keyRings/tink/cryptoKeys/bq-key":      "",
+			"projects/p/locations/europe/keyRings/tink/cryptoKeys/shared-key":            "",
+			"projects/p/locations/" + location + "/keyRings/tink/cryptoKeys/denied-key":  "failed to encrypt",
+			"projects/p/locations/" + location + "/keyRings/tink/cryptoKeys/missing-key": "failed to get",
+		}
+		if len(keyResults) != len(expected) {
+			t.Errorf("%s: expected %d keys got %v", region, len(expected), keyResults)
+		}
+		for keyName, expectedErr := range expected {
+			err, ok := keyResults[keyName]
+			if !ok {
+				t.Errorf("%s: expected %s to be checked got %v", region, keyName, keyResults)
+			} else if expectedErr == "" && err != nil {
+				t.Errorf("%s: expected %s to be usable got %v", region, keyName, err)
+			} else if expectedErr != "" && (err == nil || !strings.Contains(err.Error(), expectedErr)) {
+				t.Errorf("%s: expected %s to fail with %q got %v", region, keyName, expectedErr, err)
+			}
+		}
+	}
+
+	// a key used in every region is only checked once, with a get and an encrypt
+	if calls := kmsWrapper.calls["projects/p/locations/europe/keyRings/tink/cryptoKeys/shared-key"]; calls != 2 {
+		t.Errorf("expected the shared key to be got and encrypted with once got %d calls", calls)
+	}
+	// a key that cannot be found is not encrypted with
+	if calls := kmsWrapper.calls["projects/p/locations/europe/keyRings/tink/cryptoKeys/missing-key"]; calls != 1 {
+		t.Errorf("expected only a get of the missing key got %d calls", calls)
+	}
+}
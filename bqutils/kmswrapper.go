@@ -0,0 +1,386 @@
+package bqutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+const (
+	KMS_PROVIDER_GCP   = "gcp"
+	KMS_PROVIDER_AZURE = "azure"
+
+	WAREHOUSE_BIGQUERY = "bigquery"
+)
+
+// which warehouses can natively unwrap a keyset wrapped by each kms provider
+var kmsProviderWarehouses = map[string][]string{
+	KMS_PROVIDER_GCP:   {WAREHOUSE_BIGQUERY},
+	KMS_PROVIDER_AZURE: {},
+}
+
+// KMSWrapper wraps (encrypts) a binary keyset with a key held in a kms so it can be embedded in a warehouse routine
+type KMSWrapper interface {
+	// Provider returns the name of the kms provider ie gcp
+	Provider() string
+	// KeyExists returns an error if the kms key cannot be found
+	KeyExists(ctx context.Context, keyName string) error
+	// WrapKeyset encrypts the binary keyset with the kms key
+	WrapKeyset(ctx context.Context, keyName string, binaryKeyset []byte) ([]byte, error)
+	// UnwrapKeyset decrypts a keyset wrapped with the kms key, ie a keyset supplied wrapped to importKeyEncrypted
+	UnwrapKeyset(ctx context.Context, keyName string, wrappedKeyset []byte) ([]byte, error)
+	// KeysetChainURI returns the kms key reference used in the routine, ie gcp-kms://projects/...
+	KeysetChainURI(keyName string, warehouse string) (string, error)
+	Close() error
+}
+
+// tracedKMSWrapper adds a span around each kms call, carrying the kms key name but never the keyset
+type tracedKMSWrapper struct {
+	KMSWrapper
+}
+
+func (w *tracedKMSWrapper) KeyExists(ctx context.Context, keyName string) error {
+	ctx, span := aeadutils.StartSpan(ctx, "kms.KeyExists", aeadutils.SpanKMSKey.String(keyName))
+	err := w.KMSWrapper.KeyExists(ctx, keyName)
+	aeadutils.EndSpan(span, err)
+	return err
+}
+
+func (w *tracedKMSWrapper) WrapKeyset(ctx context.Context, keyName string, binaryKeyset []byte) ([]byte, error) {
+	ctx, span := aeadutils.StartSpan(ctx, "kms.WrapKeyset", aeadutils.SpanKMSKey.String(keyName))
+	wrappedKeyset, err := w.KMSWrapper.WrapKeyset(ctx, keyName, binaryKeyset)
+	aeadutils.EndSpan(span, err)
+	return wrappedKeyset, err
+}
+
+func (w *tracedKMSWrapper) UnwrapKeyset(ctx context.Context, keyName string, wrappedKeyset []byte) ([]byte, error) {
+	ctx, span := aeadutils.StartSpan(ctx, "kms.UnwrapKeyset", aeadutils.SpanKMSKey.String(keyName))
+	keyset, err := w.KMSWrapper.UnwrapKeyset(ctx, keyName, wrappedKeyset)
+	aeadutils.EndSpan(span, err)
+	return keyset, err
+}
+
+// ResolveKMSProvider returns the kms provider from BQ_KMS_PROVIDER, default gcp
+func ResolveKMSProvider(envOptions cmap.ConcurrentMap) string {
+	providerInterface, ok := envOptions.Get("BQ_KMS_PROVIDER")
+	if !ok {
+		return KMS_PROVIDER_GCP
+	}
+	return strings.ToLower(fmt.Sprintf("%v", providerInterface))
+}
+
+// CheckKMSProvider returns an error if the kms provider is unknown or the warehouse cannot use keysets wrapped by it
+func CheckKMSProvider(provider string, warehouse string) error {
+	warehouses, ok := kmsProviderWarehouses[provider]
+	if !ok {
+		return fmt.Errorf("unknown kms provider %s", provider)
+	}
+	for _, w := range warehouses {
+		if w == warehouse {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported combination: keysets wrapped by kms provider %s cannot be used by %s", provider, warehouse)
+}
+
+// NewKMSWrapper creates the KMSWrapper for the kms provider in BQ_KMS_PROVIDER
+func NewKMSWrapper(ctx context.Context, envOptions cmap.ConcurrentMap) (KMSWrapper, error) {
+	provider := ResolveKMSProvider(envOptions)
+	switch provider {
+	case KMS_PROVIDER_GCP:
+		kmsClient, err := kms.NewKeyManagementClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &gcpKMSWrapper{kmsClient: kmsClient}, nil
+	case KMS_PROVIDER_AZURE:
+		algorithm := "RSA-OAEP-256"
+		algorithmInterface, ok := envOptions.Get("BQ_AZURE_WRAP_ALGORITHM")
+		if ok {
+			algorithm = fmt.Sprintf("%v", algorithmInterface)
+		}
+		return &azureKMSWrapper{
+			client:    &http.Client{Timeout: 30 * time.Second},
+			algorithm: algorithm,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown kms provider %s", provider)
+}
+
+// gcpKMSWrapper wraps keysets with GCP cloud kms
+type gcpKMSWrapper struct {
+	kmsClient *kms.KeyManagementClient
+}
+
+func (w *gcpKMSWrapper) Provider() string {
+	return KMS_PROVIDER_GCP
+}
+
+func (w *gcpKMSWrapper) KeyExists(ctx context.Context, keyName string) error {
+	req := &kmspb.GetCryptoKeyRequest{
+		Name: keyName,
+	}
+	_, err := w.kmsClient.GetCryptoKey(ctx, req)
+	return err
+}
+
+func (w *gcpKMSWrapper) WrapKeyset(ctx context.Context, keyName string, binaryKeyset []byte) ([]byte, error) {
+	encryptReq := &kmspb.EncryptRequest{
+		Name:      keyName,
+		Plaintext: binaryKeyset,
+	}
+	encryptResp, err := w.kmsClient.Encrypt(ctx, encryptReq)
+	if err != nil {
+		return nil, err
+	}
+	return encryptResp.Ciphertext, nil
+}
+
+func (w *gcpKMSWrapper) UnwrapKeyset(ctx context.Context, keyName string, wrappedKeyset []byte) ([]byte, error) {
+	decryptReq := &kmspb.DecryptRequest{
+		Name:       keyName,
+		Ciphertext: wrappedKeyset,
+	}
+	decryptResp, err := w.kmsClient.Decrypt(ctx, decryptReq)
+	if err != nil {
+		return nil, err
+	}
+	return decryptResp.Plaintext, nil
+}
+
+func (w *gcpKMSWrapper) KeysetChainURI(keyName string, warehouse string) (string, error) {
+	err := CheckKMSProvider(KMS_PROVIDER_GCP, warehouse)
+	if err != nil {
+		return "", err
+	}
+	return "gcp-kms://" + keyName, nil
+}
+
+func (w *gcpKMSWrapper) Close() error {
+	return w.kmsClient.Close()
+}
+
+// azureKMSWrapper wraps keysets with an azure key vault key, using the managed identity of the host
+// the key name is the key identifier ie https://myvault.vault.azure.net/keys/bq-key/<version>
+// an RSA key can only wrap a few hundred bytes, so the keyset is sealed with a random data key and only the data key
+// is wrapped by key vault, see WrapKeyset
+type azureKMSWrapper struct {
+	client    *http.Client
+	algorithm string
+
+	// the managed identity token, shared by the fields of a sync
+	mu    sync.Mutex
+	token string
+}
+
+// azureDataKeySize is the size of the AES-256-GCM data key a keyset is sealed with
+const azureDataKeySize = 32
+
+var (
+	azureIMDSTokenURL   = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fvault.azure.net"
+	azureKeyVaultAPIVer = "7.4"
+)
+
+func (w *azureKMSWrapper) Provider() string {
+	return KMS_PROVIDER_AZURE
+}
+
+func (w *azureKMSWrapper) KeyExists(ctx context.Context, keyName string) error {
+	_, err := w.call(ctx, "GET", keyName, nil)
+	return err
+}
+
+// WrapKeyset seals the keyset with a random AES-256-GCM data key and wraps the data key with the key vault key. The
+// result is the 4 byte big endian length of the wrapped data key, the wrapped data key, the 12 byte nonce and the
+// sealed keyset
+func (w *azureKMSWrapper) WrapKeyset(ctx context.Context, keyName string, binaryKeyset []byte) ([]byte, error) {
+	dataKey := make([]byte, azureDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	gcm, err := newDataKeyGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrappedDataKey, err := w.keyOperation(ctx, keyName, "wrapkey", dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKeyset := binary.BigEndian.AppendUint32(nil, uint32(len(wrappedDataKey)))
+	wrappedKeyset = append(wrappedKeyset, wrappedDataKey...)
+	wrappedKeyset = append(wrappedKeyset, nonce...)
+	return gcm.Seal(wrappedKeyset, nonce, binaryKeyset, nil), nil
+}
+
+// UnwrapKeyset unwraps the data key of a keyset wrapped by WrapKeyset with the key vault key and opens the keyset
+func (w *azureKMSWrapper) UnwrapKeyset(ctx context.Context, keyName string, wrappedKeyset []byte) ([]byte, error) {
+	if len(wrappedKeyset) < 4 {
+		return nil, errors.New("the wrapped keyset is too short")
+	}
+	dataKeyLen := int(binary.BigEndian.Uint32(wrappedKeyset))
+	wrappedKeyset = wrappedKeyset[4:]
+	if dataKeyLen == 0 || dataKeyLen > len(wrappedKeyset) {
+		return nil, errors.New("the wrapped keyset has an invalid data key length")
+	}
+	dataKey, err := w.keyOperation(ctx, keyName, "unwrapkey", wrappedKeyset[:dataKeyLen])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newDataKeyGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := wrappedKeyset[dataKeyLen:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("the wrapped keyset is too short")
+	}
+	binaryKeyset, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the wrapped keyset: %w", err)
+	}
+	return binaryKeyset, nil
+}
+
+// newDataKeyGCM returns the AES-256-GCM cipher of a data key
+func newDataKeyGCM(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != azureDataKeySize {
+		return nil, fmt.Errorf("the data key is %d bytes, expected %d", len(dataKey), azureDataKeySize)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyOperation calls the wrapkey or unwrapkey operation of the key with the value
+func (w *azureKMSWrapper) keyOperation(ctx context.Context, keyName string, operation string, value []byte) ([]byte, error) {
+	reqBody, err := json.Marshal(map[string]string{
+		"alg":   w.algorithm,
+		"value": b64.RawURLEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := w.call(ctx, "POST", strings.TrimSuffix(keyName, "/")+"/"+operation, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	var operationResp struct {
+		Value string `json:"value"`
+	}
+	err = json.Unmarshal(respBody, &operationResp)
+	if err != nil {
+		return nil, err
+	}
+	return b64.RawURLEncoding.DecodeString(operationResp.Value)
+}
+
+func (w *azureKMSWrapper) KeysetChainURI(keyName string, warehouse string) (string, error) {
+	err := CheckKMSProvider(KMS_PROVIDER_AZURE, warehouse)
+	if err != nil {
+		return "", err
+	}
+	return "azure-keyvault://" + strings.TrimPrefix(keyName, "https://"), nil
+}
+
+func (w *azureKMSWrapper) Close() error {
+	return nil
+}
+
+// call invokes the key vault rest api with a managed identity token
+func (w *azureKMSWrapper) call(ctx context.Context, method string, url string, body []byte) ([]byte, error) {
+	token, err := w.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url+"?api-version="+azureKeyVaultAPIVer, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("azure key vault %s %s returned %d: %s", method, url, resp.StatusCode, string(respBody))
+	}
+	return respBody, nil
+}
+
+// accessToken returns the cached managed identity token, getting it on first use. The lock is held while it is got so
+// the fields of a sync calling at once only ask the metadata service once
+func (w *azureKMSWrapper) accessToken(ctx context.Context) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.token == "" {
+		token, err := w.getManagedIdentityToken(ctx)
+		if err != nil {
+			return "", err
+		}
+		w.token = token
+	}
+	return w.token, nil
+}
+
+func (w *azureKMSWrapper) getManagedIdentityToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", azureIMDSTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error: unable to contact the azure instance metadata service: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("the azure instance metadata service returned %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return "", err
+	}
+	if tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("no access token returned by the azure instance metadata service")
+	}
+	return tokenResp.AccessToken, nil
+}
@@ -0,0 +1,232 @@
+package bqutils
+
+import (
+	"bytes"
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeKMSWrapper wraps by reversing the keyset, and fails for the key name missing
+type fakeKMSWrapper struct {
+	KMSWrapper
+}
+
+func (w *fakeKMSWrapper) KeyExists(ctx context.Context, keyName string) error {
+	if keyName == "missing" {
+		return errors.New("key not found")
+	}
+	return nil
+}
+
+func (w *fakeKMSWrapper) WrapKeyset(ctx context.Context, keyName string, binaryKeyset []byte) ([]byte, error) {
+	wrapped := make([]byte, len(binaryKeyset))
+	for i, b := range binaryKeyset {
+		wrapped[len(binaryKeyset)-1-i] = b
+	}
+	return wrapped, nil
+}
+
+func (w *fakeKMSWrapper) UnwrapKeyset(ctx context.Context, keyName string, wrappedKeyset []byte) ([]byte, error) {
+	return w.WrapKeyset(ctx, keyName, wrappedKeyset)
+}
+
+func TestTracedKMSWrapper(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	ctx := context.Background()
+	wrapper := &tracedKMSWrapper{&fakeKMSWrapper{}}
+	binaryKeyset := []byte("keyset material")
+
+	if err := wrapper.KeyExists(ctx, "projects/p/locations/europe/keyRings/r/cryptoKeys/bq-key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapper.KeyExists(ctx, "missing"); err == nil {
+		t.Errorf("expected the error of the wrapped kms")
+	}
+	wrapped, err := wrapper.WrapKeyset(ctx, "projects/p/locations/europe/keyRings/r/cryptoKeys/bq-key", binaryKeyset)
+	if err != nil || !bytes.Equal(wrapped, []byte("lairetam tesyek")) {
+		t.Errorf("expected the wrapped keyset of the wrapped kms got %s %v", wrapped, err)
+	}
+
+	unwrapped, err := wrapper.UnwrapKeyset(ctx, "projects/p/locations/europe/keyRings/r/cryptoKeys/bq-key", wrapped)
+	if err != nil || !bytes.Equal(unwrapped, binaryKeyset) {
+		t.Errorf("expected the unwrapped keyset of the wrapped kms got %s %v", unwrapped, err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans got %d", len(spans))
+	}
+	expected := []struct {
+		name    string
+		keyName string
+		status  codes.Code
+	}{
+		{"kms.KeyExists", "projects/p/locations/europe/keyRings/r/cryptoKeys/bq-key", codes.Unset},
+		{"kms.KeyExists", "missing", codes.Error},
+		{"kms.WrapKeyset", "projects/p/locations/europe/keyRings/r/cryptoKeys/bq-key", codes.Unset},
+		{"kms.UnwrapKeyset", "projects/p/locations/europe/keyRings/r/cryptoKeys/bq-key", codes.Unset},
+	}
+	for i, span := range spans {
+		if span.Name() != expected[i].name || span.Status().Code != expected[i].status {
+			t.Errorf("expected span %s with status %v got %s %v", expected[i].name, expected[i].status, span.Name(), span.Status())
+		}
+		attrs := span.Attributes()
+		if len(attrs) != 1 || attrs[0] != aeadutils.SpanKMSKey.String(expected[i].keyName) {
+			t.Errorf("expected only the kms key name got %v", attrs)
+		}
+	}
+}
+
+// fakeAzure is an azure instance metadata service and key vault, wrapping by reversing the value, which must be a data
+// key. The metadata service returns imdsStatus and counts its requests in tokenRequests, and the key vault only knows
+// the key bq-key
+func fakeAzure(t *testing.T, imdsStatus int, tokenRequests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(tokenRequests, 1)
+			if r.Header.Get("Metadata") != "true" {
+				t.Errorf("expected the Metadata header on the token request")
+			}
+			w.WriteHeader(imdsStatus)
+			if imdsStatus != http.StatusOK {
+				w.Write([]byte(`{"error":"invalid_request","error_description":"Identity not found"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"test-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer test-token" || r.URL.Query().Get("api-version") != azureKeyVaultAPIVer {
+			t.Errorf("expected the token and api version got %s %s", r.Header.Get("Authorization"), r.URL.RawQuery)
+		}
+		switch r.URL.Path {
+		case "/keys/bq-key/1":
+			w.Write([]byte(`{"key":{}}`))
+		case "/keys/bq-key/1/wrapkey", "/keys/bq-key/1/unwrapkey":
+			var req struct {
+				Alg   string `json:"alg"`
+				Value string `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Alg != "RSA-OAEP-256" {
+				t.Errorf("expected the value and the algorithm got %v %v", req, err)
+			}
+			value, _ := b64.RawURLEncoding.DecodeString(req.Value)
+			if len(value) != azureDataKeySize {
+				t.Errorf("expected only a data key to be sent to key vault got %d bytes", len(value))
+			}
+			reversed := make([]byte, len(value))
+			for i, b := range value {
+				reversed[len(value)-1-i] = b
+			}
+			json.NewEncoder(w).Encode(map[string]string{"value": b64.RawURLEncoding.EncodeToString(reversed)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"KeyNotFound"}}`))
+		}
+	}))
+}
+
+func TestAzureKMSWrapper(t *testing.T) {
+	defer func(previous string) { azureIMDSTokenURL = previous }(azureIMDSTokenURL)
+	ctx := context.Background()
+
+	var tokenRequests int32
+	server := fakeAzure(t, http.StatusOK, &tokenRequests)
+	defer server.Close()
+	azureIMDSTokenURL = server.URL + "/token"
+	wrapper := &azureKMSWrapper{client: server.Client(), algorithm: "RSA-OAEP-256"}
+	keyName := server.URL + "/keys/bq-key/1"
+
+	if err := wrapper.KeyExists(ctx, keyName); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapper.KeyExists(ctx, server.URL+"/keys/missing/1"); err == nil || !strings.Contains(err.Error(), "returned 404") {
+		t.Errorf("expected the status of a missing key got %v", err)
+	}
+	// the keyset is sealed with a data key, so one larger than an RSA key can wrap round trips
+	binaryKeyset := bytes.Repeat([]byte("keyset material"), 100)
+	wrapped, err := wrapper.WrapKeyset(ctx, keyName, binaryKeyset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrapped, []byte("keyset material")) || len(wrapped) != 4+azureDataKeySize+12+len(binaryKeyset)+16 {
+		t.Errorf("expected the sealed keyset and its wrapped data key got %d bytes", len(wrapped))
+	}
+	unwrapped, err := wrapper.UnwrapKeyset(ctx, keyName, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, binaryKeyset) {
+		t.Errorf("expected the unwrapped keyset got %s %v", unwrapped, err)
+	}
+	// each wrap has its own data key
+	if again, err := wrapper.WrapKeyset(ctx, keyName, binaryKeyset); err != nil || bytes.Equal(again, wrapped) {
+		t.Errorf("expected a different data key for each wrap got %v", err)
+	}
+	tampered := append([]byte{}, wrapped...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := wrapper.UnwrapKeyset(ctx, keyName, tampered); err == nil || !strings.Contains(err.Error(), "failed to open the wrapped keyset") {
+		t.Errorf("expected a tampered keyset to fail got %v", err)
+	}
+	for _, truncated := range [][]byte{wrapped[:3], wrapped[:4+azureDataKeySize-1], wrapped[:4+azureDataKeySize+5]} {
+		if _, err := wrapper.UnwrapKeyset(ctx, keyName, truncated); err == nil {
+			t.Errorf("expected a truncated keyset of %d bytes to fail", len(truncated))
+		}
+	}
+	if _, err := wrapper.KeysetChainURI(keyName, WAREHOUSE_BIGQUERY); err == nil {
+		t.Errorf("expected bigquery not to unwrap an azure key")
+	}
+
+	// an error from the metadata service is reported, rather than calling the key vault without a token
+	failing := fakeAzure(t, http.StatusBadRequest, &tokenRequests)
+	defer failing.Close()
+	azureIMDSTokenURL = failing.URL + "/token"
+	wrapper = &azureKMSWrapper{client: failing.Client(), algorithm: "RSA-OAEP-256"}
+	if _, err := wrapper.WrapKeyset(ctx, failing.URL+"/keys/bq-key/1", binaryKeyset); err == nil || !strings.Contains(err.Error(), "metadata service returned 400") {
+		t.Errorf("expected the metadata service error got %v", err)
+	}
+	if wrapper.token != "" {
+		t.Errorf("expected no token to be kept got %q", wrapper.token)
+	}
+}
+
+func TestAzureKMSWrapperConcurrent(t *testing.T) {
+	defer func(previous string) { azureIMDSTokenURL = previous }(azureIMDSTokenURL)
+	ctx := context.Background()
+
+	var tokenRequests int32
+	server := fakeAzure(t, http.StatusOK, &tokenRequests)
+	defer server.Close()
+	azureIMDSTokenURL = server.URL + "/token"
+	wrapper := &azureKMSWrapper{client: server.Client(), algorithm: "RSA-OAEP-256"}
+
+	// the fields of a sync share the wrapper, and its token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := wrapper.WrapKeyset(ctx, server.URL+"/keys/bq-key/1", []byte("keyset material")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if tokenRequests != 1 {
+		t.Errorf("expected one token request got %d", tokenRequests)
+	}
+}
@@ -0,0 +1,42 @@
+package bqutils
+
+import "sync"
+
+const defaultBQMaxConcurrency = 4
+
+// routineLimiter bounds the number of routine operations running at once, across all the fields being synced, so
+// a bqsync of many fields and regions does not hit the BQ and KMS rate limits
+type routineLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+}
+
+var bqRoutineLimiter = newRoutineLimiter()
+
+func newRoutineLimiter() *routineLimiter {
+	l := &routineLimiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until fewer than limit operations are running. The limit is passed on each call as BQ_MAX_CONCURRENCY
+// can change in the config between syncs
+func (l *routineLimiter) acquire(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+func (l *routineLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Broadcast()
+}
@@ -0,0 +1,43 @@
+package bqutils
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoutineLimiter(t *testing.T) {
+	for _, limit := range []int{1, 3} {
+		l := newRoutineLimiter()
+		var mu sync.Mutex
+		running, maxRunning := 0, 0
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.acquire(limit)
+				defer l.release()
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+				time.Sleep(2 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		if maxRunning > limit {
+			t.Errorf("limit %d: expected at most %d running, got %d", limit, limit, maxRunning)
+		}
+		if maxRunning < 1 {
+			t.Errorf("limit %d: nothing ran", limit)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package bqutils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"google.golang.org/api/googleapi"
+)
+
+const defaultBQMaxAttempts = 3
+
+// the first wait between attempts, doubling each attempt
+var bqRetryInitialInterval = 1 * time.Second
+
+// retryBQ calls operation up to maxAttempts times with an exponential backoff between attempts, as the BQ apis
+// can be flakey. Errors that will not change on a retry, ie not found or a failed etag precondition, are returned at once
+func retryBQ(ctx context.Context, maxAttempts int, operation func() error) error {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	xbo := backoff.NewExponentialBackOff()
+	xbo.InitialInterval = bqRetryInitialInterval
+	xbo.MaxElapsedTime = 0
+
+	return backoff.Retry(func() error {
+		err := operation()
+		if err != nil && !isRetryableBQError(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(backoff.WithMaxRetries(xbo, uint64(maxAttempts-1)), ctx))
+}
+
+// isRetryableBQError is true for rate limiting, server errors and errors that are not from the api (ie the network)
+func isRetryableBQError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
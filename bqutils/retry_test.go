@@ -0,0 +1,77 @@
+package bqutils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// flakyCall fails the first failures calls with err then succeeds
+type flakyCall struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyCall) do() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func TestRetryBQ(t *testing.T) {
+	bqRetryInitialInterval = 1 * time.Millisecond
+	defer func() { bqRetryInitialInterval = 1 * time.Second }()
+	ctx := context.Background()
+	unavailable := &googleapi.Error{Code: 503}
+
+	t.Run("succeeds after failures", func(t *testing.T) {
+		call := flakyCall{failures: 2, err: unavailable}
+		err := retryBQ(ctx, 3, call.do)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if call.calls != 3 {
+			t.Errorf("expected 3 calls, got %d", call.calls)
+		}
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		call := flakyCall{failures: 5, err: unavailable}
+		err := retryBQ(ctx, 3, call.do)
+		if !errors.Is(err, unavailable) {
+			t.Errorf("expected %v, got %v", unavailable, err)
+		}
+		if call.calls != 3 {
+			t.Errorf("expected 3 calls, got %d", call.calls)
+		}
+	})
+
+	t.Run("does not retry not found", func(t *testing.T) {
+		notFound := &googleapi.Error{Code: 404}
+		call := flakyCall{failures: 5, err: notFound}
+		err := retryBQ(ctx, 3, call.do)
+		if !errors.Is(err, notFound) {
+			t.Errorf("expected %v, got %v", notFound, err)
+		}
+		if call.calls != 1 {
+			t.Errorf("expected 1 call, got %d", call.calls)
+		}
+	})
+
+	t.Run("retries network errors", func(t *testing.T) {
+		call := flakyCall{failures: 1, err: errors.New("connection reset")}
+		err := retryBQ(ctx, 2, call.do)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if call.calls != 2 {
+			t.Errorf("expected 2 calls, got %d", call.calls)
+		}
+	})
+}
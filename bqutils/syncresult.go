@@ -0,0 +1,94 @@
+package bqutils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RegionSyncResult counts the routines of a keyset created, updated and skipped in one region
+type RegionSyncResult struct {
+	Created int
+	Updated int
+	Skipped int
+}
+
+// SyncResult is what DoBQSync did for one keyset: the routines created, updated and skipped in each region, the
+// datasets skipped with the reason, the errors met creating or updating the routines, and the routines not created
+// or updated because the sync was cancelled
+type SyncResult struct {
+	mu        sync.Mutex
+	Regions   map[string]*RegionSyncResult
+	Skipped   map[string]string
+	Errors    []string
+	Cancelled []string
+}
+
+func newSyncResult() *SyncResult {
+	return &SyncResult{
+		Regions: make(map[string]*RegionSyncResult),
+		Skipped: make(map[string]string),
+	}
+}
+
+// region returns the counts of the region, the caller must hold the lock
+func (r *SyncResult) region(region string) *RegionSyncResult {
+	regionResult, ok := r.Regions[region]
+	if !ok {
+		regionResult = &RegionSyncResult{}
+		r.Regions[region] = regionResult
+	}
+	return regionResult
+}
+
+// skip records a dataset that got no routine, and why
+func (r *SyncResult) skip(region string, datasetId string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.region(region).Skipped++
+	r.Skipped[datasetId] = reason
+}
+
+// fail records an error that is not a skipped dataset, ie the dataset could not be read
+func (r *SyncResult) fail(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// cancel records a routine left alone as the sync was cancelled before it was started
+func (r *SyncResult) cancel(datasetId string, routineId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Cancelled = append(r.Cancelled, datasetId+":"+routineId)
+}
+
+// routine records the outcome of creating or updating one routine
+func (r *SyncResult) routine(region string, datasetId string, routineId string, updated bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case err != nil:
+		action := "create"
+		if updated {
+			action = "update"
+		}
+		r.Errors = append(r.Errors, fmt.Sprintf("failed to %s routine %s:%s: %v", action, datasetId, routineId, err))
+	case updated:
+		r.region(region).Updated++
+	default:
+		r.region(region).Created++
+	}
+}
+
+// Totals is the sum of the counts of all the regions
+func (r *SyncResult) Totals() RegionSyncResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var totals RegionSyncResult
+	for _, regionResult := range r.Regions {
+		totals.Created += regionResult.Created
+		totals.Updated += regionResult.Updated
+		totals.Skipped += regionResult.Skipped
+	}
+	return totals
+}
@@ -0,0 +1,229 @@
+package bqutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	cmap "github.com/orcaman/concurrent-map"
+	"google.golang.org/api/option"
+)
+
+// syncKMSWrapper is the fake kms of a sync, with no key in europe-west1
+type syncKMSWrapper struct {
+	fakeKMSWrapper
+}
+
+func (w *syncKMSWrapper) KeyExists(ctx context.Context, keyName string) error {
+	if strings.Contains(keyName, "europe-west1") {
+		return errors.New("key not found")
+	}
+	return nil
+}
+
+func (w *syncKMSWrapper) KeysetChainURI(keyName string, warehouse string) (string, error) {
+	return "gcp-kms://" + keyName, nil
+}
+
+func (w *syncKMSWrapper) Close() error {
+	return nil
+}
+
+// fakeBigQuery serves the dataset and routine calls of a sync. Datasets are in the location of their region, the
+// routines in existing already exist and creating a routine in dec_europe_west2 fails
+type fakeBigQuery struct {
+	mu       sync.Mutex
+	existing map[string]bool
+	created  []string
+	updated  []string
+}
+
+func (f *fakeBigQuery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// /bigquery/v2/projects/<project>/datasets/<dataset>[/routines[/<routine>]]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/bigquery/v2/"), "/")
+	w.Header().Set("Content-Type", "application/json")
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":404,"message":"not found"}}`))
+	}
+	if len(parts) < 4 {
+		notFound()
+		return
+	}
+	datasetId := parts[3]
+	switch {
+	case len(parts) == 4 && r.Method == http.MethodGet:
+		location := "EU"
+		if i := strings.Index(datasetId, "_europe_"); i >= 0 {
+			location = strings.Replace(datasetId[i+1:], "_", "-", -1)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"datasetReference": map[string]string{"projectId": parts[1], "datasetId": datasetId},
+			"location":         location,
+		})
+	case len(parts) == 6 && r.Method == http.MethodGet:
+		if !f.existing[datasetId+":"+parts[5]] {
+			notFound()
+			return
+		}
+		w.Write([]byte(`{"etag":"etag1"}`))
+	case len(parts) == 5 && r.Method == http.MethodPost:
+		if datasetId == "dec_europe_west2" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"message":"invalid routine"}}`))
+			return
+		}
+		var routine struct {
+			RoutineReference struct {
+				RoutineId string `json:"routineId"`
+			} `json:"routineReference"`
+		}
+		json.NewDecoder(r.Body).Decode(&routine)
+		f.created = append(f.created, datasetId+":"+routine.RoutineReference.RoutineId)
+		w.Write([]byte(`{}`))
+	case len(parts) == 6 && r.Method == http.MethodPut:
+		f.updated = append(f.updated, datasetId+":"+parts[5])
+		w.Write([]byte(`{}`))
+	default:
+		notFound()
+	}
+}
+
+func TestDoBQSyncResult(t *testing.T) {
+	newKMSWrapper = func(ctx context.Context, envOptions cmap.ConcurrentMap) (KMSWrapper, error) {
+		return &syncKMSWrapper{}, nil
+	}
+	defer func() { newKMSWrapper = NewKMSWrapper }()
+
+	fake := &fakeBigQuery{existing: map[string]bool{"dec_eu:email_gcm_decrypt": true}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, "p", option.WithEndpoint(server.URL+"/bigquery/v2/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	datasets := map[string]*bigquery.Dataset{}
+	for _, datasetId := range []string{"enc_eu", "dec_eu", "enc_europe_west1", "dec_europe_west2"} {
+		datasets[datasetId] = client.Dataset(datasetId)
+	}
+
+	envOptions := cmap.New()
+	envOptions.Set("BQ_PROJECT", "p")
+	envOptions.Set("BQ_KMSKEY", "projects/p/locations/<region>/keyRings/r/cryptoKeys/bq-key")
+	envOptions.Set("BQ_DEFAULT_ENCRYPT_DATASET", "enc_<region>")
+	envOptions.Set("BQ_DEFAULT_DECRYPT_DATASET", "dec_<region>")
+	envOptions.Set("BQ_MAX_ATTEMPTS", "1")
+
+	kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := DoBQSync(ctx, kh, "email", false, NewOptionsSnapshot(envOptions), datasets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]RegionSyncResult{
+		"eu":           {Created: 1, Updated: 1},
+		"europe_west1": {Skipped: 1},
+	}
+	if len(result.Regions) != len(expected) {
+		t.Errorf("expected the regions %v got %v", expected, result.Regions)
+	}
+	for region, counts := range expected {
+		if got, ok := result.Regions[region]; !ok || *got != counts {
+			t.Errorf("expected %v for region %s got %v", counts, region, got)
+		}
+	}
+	if totals := result.Totals(); totals != (RegionSyncResult{Created: 1, Updated: 1, Skipped: 1}) {
+		t.Errorf("expected 1 routine created, updated and skipped got %v", totals)
+	}
+	if reason, ok := result.Skipped["enc_europe_west1"]; !ok || !strings.Contains(reason, "failed to find kms key projects/p/locations/europe-west1") {
+		t.Errorf("expected enc_europe_west1 to be skipped for its kms key got %v", result.Skipped)
+	}
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0], "failed to create routine dec_europe_west2:email_gcm_decrypt") {
+		t.Errorf("expected the failed create in dec_europe_west2 got %v", result.Errors)
+	}
+	if len(fake.created) != 1 || fake.created[0] != "enc_eu:email_gcm_encrypt" {
+		t.Errorf("expected the encrypt routine to be created in enc_eu got %v", fake.created)
+	}
+	if len(fake.updated) != 1 || fake.updated[0] != "dec_eu:email_gcm_decrypt" {
+		t.Errorf("expected the decrypt routine to be updated in dec_eu got %v", fake.updated)
+	}
+
+	// an invalid routine name template fails the field without touching BQ
+	envOptions.Set("BQ_ROUTINE_NAME_TEMPLATE", "<prefix>_<direction>")
+	result, err = DoBQSync(ctx, kh, "email", false, NewOptionsSnapshot(envOptions), datasets)
+	if err == nil || !strings.Contains(err.Error(), "invalid BQ_ROUTINE_NAME_TEMPLATE for field email") || result != nil {
+		t.Errorf("expected the sync to fail for the template got %v %v", result, err)
+	}
+	if len(fake.created) != 1 || len(fake.updated) != 1 {
+		t.Errorf("expected no more routines got %v %v", fake.created, fake.updated)
+	}
+}
+
+func TestDoBQSyncCancelled(t *testing.T) {
+	newKMSWrapper = func(ctx context.Context, envOptions cmap.ConcurrentMap) (KMSWrapper, error) {
+		return &syncKMSWrapper{}, nil
+	}
+	defer func() { newKMSWrapper = NewKMSWrapper }()
+
+	fake := &fakeBigQuery{existing: map[string]bool{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := bigquery.NewClient(context.Background(), "p", option.WithEndpoint(server.URL+"/bigquery/v2/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	datasets := map[string]*bigquery.Dataset{}
+	for _, datasetId := range []string{"enc_eu", "dec_eu"} {
+		datasets[datasetId] = client.Dataset(datasetId)
+	}
+
+	envOptions := cmap.New()
+	envOptions.Set("BQ_PROJECT", "p")
+	envOptions.Set("BQ_KMSKEY", "projects/p/locations/<region>/keyRings/r/cryptoKeys/bq-key")
+	envOptions.Set("BQ_DEFAULT_ENCRYPT_DATASET", "enc_<region>")
+	envOptions.Set("BQ_DEFAULT_DECRYPT_DATASET", "dec_<region>")
+
+	kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a sync cancelled, ie by a SIGTERM to kv2bq, starts no routines and reports what it left alone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := DoBQSync(ctx, kh, "email", false, NewOptionsSnapshot(envOptions), datasets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"dec_eu:email_gcm_decrypt", "enc_eu:email_gcm_encrypt"}
+	sort.Strings(result.Cancelled)
+	if !reflect.DeepEqual(result.Cancelled, expected) {
+		t.Errorf("expected the cancelled routines %v got %v", expected, result.Cancelled)
+	}
+	if len(fake.created) != 0 || len(fake.updated) != 0 {
+		t.Errorf("expected no routines to be synced got %v %v", fake.created, fake.updated)
+	}
+	if totals := result.Totals(); totals != (RegionSyncResult{}) {
+		t.Errorf("expected nothing synced got %v", totals)
+	}
+}
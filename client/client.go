@@ -0,0 +1,247 @@
+// Package client is a typed go client for the aead secrets engine, over the vault api
+//
+// It saves consumers building the request maps by hand, base64 encodes and decodes the cyphertext
+// and maps vault errors to ErrPermissionDenied, ErrNotFound or *Error
+package client
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrNotFound         = errors.New("not found")
+)
+
+// Error is a vault error response that is not permission denied or not found
+type Error struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("aead engine returned %d: %s", e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+// Client calls the aead secrets engine mounted at mount, ie aead-secrets
+type Client struct {
+	vault *vault.Client
+	mount string
+}
+
+// New creates a client for the engine mounted at mount using an authenticated vault client
+func New(vaultClient *vault.Client, mount string) *Client {
+	return &Client{
+		vault: vaultClient,
+		mount: strings.Trim(mount, "/"),
+	}
+}
+
+// KeyTypes is the response of the keytypes path
+type KeyTypes struct {
+	// Types is DETERMINISTIC or NON DETERMINISTIC for each config entry
+	Types map[string]string
+	// Algorithms is the algorithm of each keyset, ie AesGcm
+	Algorithms map[string]string
+}
+
+// Encrypt encrypts the value of each field that has a keyset and returns the cyphertext of each, with the fields that
+// have no keyset, which the engine does not encrypt, returned apart as they were sent. Decrypt the cyphertexts to get the
+// values back. Which fields have a keyset comes from the keyinfo path, so the token needs update on it too
+func (c *Client) Encrypt(ctx context.Context, fields map[string]string) (map[string][]byte, map[string]string, error) {
+	keyed, err := c.keyedFields(ctx, fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := make(map[string]interface{}, len(fields))
+	unencrypted := make(map[string]string)
+	for k, v := range fields {
+		if !keyed[k] {
+			unencrypted[k] = v
+			continue
+		}
+		data[k] = v
+	}
+	cypherTexts := make(map[string][]byte, len(data))
+	if len(data) == 0 {
+		return cypherTexts, unencrypted, nil
+	}
+	respData, err := c.write(ctx, "encrypt", data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for k, v := range respData {
+		cypherText, err := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", v))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode the cyphertext of %s: %w", k, err)
+		}
+		cypherTexts[k] = cypherText
+	}
+	return cypherTexts, unencrypted, nil
+}
+
+// keyedFields returns whether each of the fields has a keyset, following field and family pointers
+func (c *Client) keyedFields(ctx context.Context, fields map[string]string) (map[string]bool, error) {
+	names := make([]interface{}, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	respData, err := c.write(ctx, "keyinfo", map[string]interface{}{"FIELDS": names})
+	if err != nil {
+		return nil, err
+	}
+
+	keyed := make(map[string]bool, len(respData))
+	for k, v := range respData {
+		if info, ok := v.(map[string]interface{}); ok {
+			keyed[k] = info["FOUND"] == true
+		}
+	}
+	return keyed, nil
+}
+
+// Decrypt decrypts the cyphertext of each field and returns the plaintext of each field
+func (c *Client) Decrypt(ctx context.Context, fields map[string][]byte) (map[string]string, error) {
+	data := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		data[k] = b64.StdEncoding.EncodeToString(v)
+	}
+	respData, err := c.write(ctx, "decrypt", data)
+	if err != nil {
+		return nil, err
+	}
+	return toStringMap(respData), nil
+}
+
+// CreateAEADKey creates a non deterministic keyset for each field that does not already have one.
+// It returns whether a keyset was created for each field
+func (c *Client) CreateAEADKey(ctx context.Context, fields ...string) (map[string]bool, error) {
+	return c.createKey(ctx, "createAEADkey", fields)
+}
+
+// CreateDAEADKey creates a deterministic keyset for each field that does not already have one.
+// It returns whether a keyset was created for each field
+func (c *Client) CreateDAEADKey(ctx context.Context, fields ...string) (map[string]bool, error) {
+	return c.createKey(ctx, "createDAEADkey", fields)
+}
+
+// Rotate adds a new primary key to every keyset
+func (c *Client) Rotate(ctx context.Context) error {
+	_, err := c.write(ctx, "rotate", map[string]interface{}{})
+	return err
+}
+
+// ImportKey imports a json keyset for each field, replacing any existing keyset
+func (c *Client) ImportKey(ctx context.Context, keysets map[string]string) error {
+	data := make(map[string]interface{}, len(keysets))
+	for k, v := range keysets {
+		data[k] = v
+	}
+	_, err := c.write(ctx, "importKey", data)
+	return err
+}
+
+// ReadConfig returns the config, keysets have their key material masked
+func (c *Client) ReadConfig(ctx context.Context) (map[string]interface{}, error) {
+	return c.read(ctx, "config")
+}
+
+// KeyTypes returns whether each keyset is deterministic and its algorithm
+func (c *Client) KeyTypes(ctx context.Context) (*KeyTypes, error) {
+	types, err := c.read(ctx, "keytypes")
+	if err != nil {
+		return nil, err
+	}
+	algorithms, err := c.readWithData(ctx, "keytypes", map[string][]string{"ALGORITHMS": {"true"}})
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyTypes{
+		Types:      toStringMap(types),
+		Algorithms: toStringMap(algorithms),
+	}, nil
+}
+
+func (c *Client) createKey(ctx context.Context, path string, fields []string) (map[string]bool, error) {
+	data := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		data[field] = ""
+	}
+	respData, err := c.write(ctx, path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	created := make(map[string]bool, len(respData))
+	for k, v := range respData {
+		result, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected %s response for %s: %v", path, k, v)
+		}
+		created[k] = result["created"] == true
+	}
+	return created, nil
+}
+
+func (c *Client) write(ctx context.Context, path string, data map[string]interface{}) (map[string]interface{}, error) {
+	secret, err := c.vault.Logical().WriteWithContext(ctx, c.mount+"/"+path, data)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if secret == nil {
+		return map[string]interface{}{}, nil
+	}
+	return secret.Data, nil
+}
+
+func (c *Client) read(ctx context.Context, path string) (map[string]interface{}, error) {
+	return c.readWithData(ctx, path, nil)
+}
+
+// readWithData reads the path with the request options in data as query parameters
+func (c *Client) readWithData(ctx context.Context, path string, data map[string][]string) (map[string]interface{}, error) {
+	secret, err := c.vault.Logical().ReadWithDataWithContext(ctx, c.mount+"/"+path, data)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, c.mount+"/"+path)
+	}
+	return secret.Data, nil
+}
+
+// mapError maps a vault response error to ErrPermissionDenied, ErrNotFound or *Error
+func mapError(err error) error {
+	var respErr *vault.ResponseError
+	if !errors.As(err, &respErr) {
+		return err
+	}
+	switch respErr.StatusCode {
+	case http.StatusForbidden:
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, strings.Join(respErr.Errors, ", "))
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrNotFound, strings.Join(respErr.Errors, ", "))
+	}
+	return &Error{
+		StatusCode: respErr.StatusCode,
+		Errors:     respErr.Errors,
+	}
+}
+
+func toStringMap(m map[string]interface{}) map[string]string {
+	strMap := make(map[string]string, len(m))
+	for k, v := range m {
+		strMap[k] = fmt.Sprintf("%v", v)
+	}
+	return strMap
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// mockTransport records the request and returns a canned vault response
+type mockTransport struct {
+	statusCode  int
+	respBody    string
+	bodies      map[string]string
+	lastMethod  string
+	lastPath    string
+	lastRequest map[string]interface{}
+}
+
+func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.lastMethod = req.Method
+	m.lastPath = req.URL.Path
+	m.lastRequest = nil
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &m.lastRequest)
+	}
+	respBody := m.respBody
+	// a response for the path, or the path and query, overrides respBody
+	if body, ok := m.bodies[req.URL.Path]; ok {
+		respBody = body
+	}
+	if body, ok := m.bodies[req.URL.Path+"?"+req.URL.RawQuery]; ok {
+		respBody = body
+	}
+	return &http.Response{
+		StatusCode: m.statusCode,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewBufferString(respBody)),
+		Request:    req,
+	}, nil
+}
+
+func testClient(t *testing.T, statusCode int, respBody string) (*Client, *mockTransport) {
+	transport := &mockTransport{statusCode: statusCode, respBody: respBody}
+	config := vault.DefaultConfig()
+	config.Address = "http://vault.test:8200"
+	config.HttpClient = &http.Client{Transport: transport}
+	config.MaxRetries = 0
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultClient.SetToken("test-token")
+	return New(vaultClient, "/aead-secrets/"), transport
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	cypherText := []byte{0x01, 0x02, 0x03, 0xff}
+	cypherTextB64 := b64.StdEncoding.EncodeToString(cypherText)
+
+	t.Run("encrypt", func(t *testing.T) {
+		c, transport := testClient(t, 200, `{"data":{"address":"`+cypherTextB64+`"}}`)
+		transport.bodies = map[string]string{"/v1/aead-secrets/keyinfo": `{"data":{"address":{"FOUND":true,"KEY_NAME":"siv/address"},"nokey":{"FOUND":false}}}`}
+		cypherTexts, unencrypted, err := c.Encrypt(ctx, map[string]string{"address": "my address", "nokey": "plain value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.lastMethod != "PUT" || transport.lastPath != "/v1/aead-secrets/encrypt" {
+			t.Errorf("unexpected request %s %s", transport.lastMethod, transport.lastPath)
+		}
+		// only the fields with a keyset are sent to encrypt
+		if !reflect.DeepEqual(transport.lastRequest, map[string]interface{}{"address": "my address"}) {
+			t.Errorf("unexpected request body %v", transport.lastRequest)
+		}
+		if !reflect.DeepEqual(cypherTexts, map[string][]byte{"address": cypherText}) {
+			t.Errorf("expected the cyphertexts %v to be only address", cypherTexts)
+		}
+		if !reflect.DeepEqual(unencrypted, map[string]string{"nokey": "plain value"}) {
+			t.Errorf("expected the unencrypted fields %v to be only nokey", unencrypted)
+		}
+	})
+
+	t.Run("decrypt", func(t *testing.T) {
+		c, transport := testClient(t, 200, `{"data":{"address":"my address"}}`)
+		resp, err := c.Decrypt(ctx, map[string][]byte{"address": cypherText})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.lastPath != "/v1/aead-secrets/decrypt" || transport.lastRequest["address"] != cypherTextB64 {
+			t.Errorf("unexpected request %s %v", transport.lastPath, transport.lastRequest)
+		}
+		if resp["address"] != "my address" {
+			t.Errorf("unexpected response %v", resp)
+		}
+	})
+
+	t.Run("round trip with a field without a keyset", func(t *testing.T) {
+		// the value of the field without a keyset is one that is also valid base64, which the cyphertext of a field is
+		fields := map[string]string{"address": "my address", "nokey": "AQID"}
+		c, transport := testClient(t, 200, `{"data":{"address":"`+cypherTextB64+`"}}`)
+		transport.bodies = map[string]string{"/v1/aead-secrets/keyinfo": `{"data":{"address":{"FOUND":true},"nokey":{"FOUND":false}}}`}
+		cypherTexts, unencrypted, err := c.Encrypt(ctx, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transport.bodies = nil
+		transport.respBody = `{"data":{"address":"my address"}}`
+		plainTexts, err := c.Decrypt(ctx, cypherTexts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := transport.lastRequest["nokey"]; ok {
+			t.Errorf("expected only cyphertext to be sent to decrypt got %v", transport.lastRequest)
+		}
+		for k, v := range unencrypted {
+			plainTexts[k] = v
+		}
+		if !reflect.DeepEqual(plainTexts, fields) {
+			t.Errorf("expected the round trip %v to be %v", plainTexts, fields)
+		}
+	})
+
+	t.Run("encrypt without a keyset", func(t *testing.T) {
+		c, transport := testClient(t, 200, `{"data":{"nokey":{"FOUND":false}}}`)
+		cypherTexts, unencrypted, err := c.Encrypt(ctx, map[string]string{"nokey": "plain value"})
+		if err != nil || len(cypherTexts) != 0 || unencrypted["nokey"] != "plain value" {
+			t.Errorf("expected nokey to be returned unencrypted got %v %v %v", cypherTexts, unencrypted, err)
+		}
+		if transport.lastPath != "/v1/aead-secrets/keyinfo" {
+			t.Errorf("expected encrypt not to be called got %s", transport.lastPath)
+		}
+	})
+
+	t.Run("create keys", func(t *testing.T) {
+		c, transport := testClient(t, 200, `{"data":{"address":{"created":true,"ciphertext":"abc"},"email":{"created":false,"message":"email key exists"}}}`)
+		resp, err := c.CreateDAEADKey(ctx, "address", "email")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.lastPath != "/v1/aead-secrets/createDAEADkey" || len(transport.lastRequest) != 2 {
+			t.Errorf("unexpected request %s %v", transport.lastPath, transport.lastRequest)
+		}
+		expected := map[string]bool{"address": true, "email": false}
+		if !reflect.DeepEqual(resp, expected) {
+			t.Errorf("expected %v to be %v", resp, expected)
+		}
+
+		_, err = c.CreateAEADKey(ctx, "address")
+		if err != nil || transport.lastPath != "/v1/aead-secrets/createAEADkey" {
+			t.Errorf("unexpected request %s %v", transport.lastPath, err)
+		}
+	})
+
+	t.Run("rotate and import", func(t *testing.T) {
+		c, transport := testClient(t, 204, ``)
+		err := c.Rotate(ctx)
+		if err != nil || transport.lastPath != "/v1/aead-secrets/rotate" {
+			t.Errorf("unexpected request %s %v", transport.lastPath, err)
+		}
+		err = c.ImportKey(ctx, map[string]string{"address": `{"primaryKeyId":1}`})
+		if err != nil || transport.lastPath != "/v1/aead-secrets/importKey" || transport.lastRequest["address"] != `{"primaryKeyId":1}` {
+			t.Errorf("unexpected request %s %v %v", transport.lastPath, transport.lastRequest, err)
+		}
+	})
+
+	t.Run("read config and key types", func(t *testing.T) {
+		c, transport := testClient(t, 200, `{"data":{"BQ_PROJECT":"my-project"}}`)
+		config, err := c.ReadConfig(ctx)
+		if err != nil || transport.lastMethod != "GET" || transport.lastPath != "/v1/aead-secrets/config" || config["BQ_PROJECT"] != "my-project" {
+			t.Errorf("unexpected request %s %s %v %v", transport.lastMethod, transport.lastPath, config, err)
+		}
+
+		c, transport = testClient(t, 200, `{"data":{"gcm/address":"NON DETERMINISTIC"}}`)
+		transport.bodies = map[string]string{"/v1/aead-secrets/keytypes?ALGORITHMS=true": `{"data":{"gcm/address":"AesGcm"}}`}
+		keyTypes, err := c.KeyTypes(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &KeyTypes{
+			Types:      map[string]string{"gcm/address": "NON DETERMINISTIC"},
+			Algorithms: map[string]string{"gcm/address": "AesGcm"},
+		}
+		if !reflect.DeepEqual(keyTypes, expected) {
+			t.Errorf("expected %v to be %v", keyTypes, expected)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		c, _ := testClient(t, 403, `{"errors":["permission denied"]}`)
+		_, err := c.Decrypt(ctx, map[string][]byte{"address": cypherText})
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("expected ErrPermissionDenied got %v", err)
+		}
+
+		c, _ = testClient(t, 404, `{"errors":[]}`)
+		_, err = c.ReadConfig(ctx)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound got %v", err)
+		}
+
+		c, _ = testClient(t, 500, `{"errors":["1 error occurred:\n\t* failed to decrypt"]}`)
+		_, _, err = c.Encrypt(ctx, map[string]string{"address": "my address"})
+		var clientErr *Error
+		if !errors.As(err, &clientErr) || clientErr.StatusCode != 500 || len(clientErr.Errors) != 1 {
+			t.Errorf("expected *Error got %v", err)
+		}
+	})
+}
@@ -0,0 +1,34 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Vodafone/vault-plugin-aead/client"
+	vault "github.com/hashicorp/vault/api"
+)
+
+func Example() {
+	// uses VAULT_ADDR and VAULT_TOKEN from the environment
+	vaultClient, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	aeadClient := client.New(vaultClient, "aead-secrets")
+	ctx := context.Background()
+
+	_, err = aeadClient.CreateDAEADKey(ctx, "email")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cypherTexts, _, err := aeadClient.Encrypt(ctx, map[string]string{"email": "me@example.com"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	plainTexts, err := aeadClient.Decrypt(ctx, cypherTexts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(plainTexts["email"])
+}
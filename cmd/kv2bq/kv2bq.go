@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"reflect"
 	"strings"
 	"sync"
+	"syscall"
 
 	"gopkg.in/yaml.v2"
 
@@ -20,9 +24,27 @@ import (
 
 func main() {
 
+	// the conf files are read in order, a later file overriding the fields an earlier one set
+	confPaths := flag.String("config", "./conf.yaml", "comma separated conf files, later files override earlier ones")
+	validateOnly := flag.Bool("validate-only", false, "report whether each KV path is a valid aead keyset, without any BQ or KMS calls")
+	flag.Parse()
+
 	var c conf
 
-	c.getConf()
+	c.getConf(strings.Split(*confPaths, ","), os.LookupEnv)
+	aeadutils.SetKeyPrefixes(c.KeyPrefixes)
+
+	// SIGINT or SIGTERM cancels the sync, no more routines are started and the calls in flight abort
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *validateOnly {
+		if invalid := validateOnlyKV(ctx, c); invalid != 0 {
+			stop()
+			os.Exit(1)
+		}
+		return
+	}
 
 	var envMap = cmap.New()
 	envMap.Set("BQ_KMSKEY", c.KmsKeyName)
@@ -31,42 +53,78 @@ func main() {
 	envMap.Set("BQ_DEFAULT_DECRYPT_DATASET", c.DecryptDatasetId)
 	envMap.Set("BQ_ROUTINE_DET_PREFIX", c.DetRoutinePrefix)
 	envMap.Set("BQ_ROUTINE_NONDET_PREFIX", c.NondetRoutinePrefix)
+	if c.RoutineNameTemplate != "" {
+		envMap.Set("BQ_ROUTINE_NAME_TEMPLATE", c.RoutineNameTemplate)
+	}
 
-	readKV(c, envMap)
+	readKV(ctx, c, envMap)
 
 }
 
+// conf is read from the conf files, then each field is overridden by the environment variable in its env tag if it is
+// set, ie for a container that is given its config in the environment
 type conf struct {
-	VaultUrl            string   `yaml:"vaultUrl"`
-	ApproleId           string   `yaml:"approleId"`
-	SecretId            string   `yaml:"secretId"`
-	Engine              string   `yaml:"engine"`
-	EngineVersion       string   `yaml:"engineVersion"`
-	ProjectId           string   `yaml:"projectId"`
-	EncryptDatasetId    string   `yaml:"encryptDatasetId"`
-	DecryptDatasetId    string   `yaml:"decryptDatasetId"`
-	DetRoutinePrefix    string   `yaml:"detRoutinePrefix"`
-	NondetRoutinePrefix string   `yaml:"nondetRoutinePrefix"`
-	KmsKeyName          string   `yaml:"kmsKeyName"`
-	KvKeys              []string `yaml:"kvKeys"`
+	VaultUrl            string   `yaml:"vaultUrl" env:"VAULT_URL"`
+	ApproleId           string   `yaml:"approleId" env:"APPROLE_ID"`
+	SecretId            string   `yaml:"secretId" env:"SECRET_ID"`
+	Engine              string   `yaml:"engine" env:"ENGINE"`
+	EngineVersion       string   `yaml:"engineVersion" env:"ENGINE_VERSION"`
+	ProjectId           string   `yaml:"projectId" env:"PROJECT_ID"`
+	EncryptDatasetId    string   `yaml:"encryptDatasetId" env:"ENCRYPT_DATASET_ID"`
+	DecryptDatasetId    string   `yaml:"decryptDatasetId" env:"DECRYPT_DATASET_ID"`
+	DetRoutinePrefix    string   `yaml:"detRoutinePrefix" env:"DET_ROUTINE_PREFIX"`
+	NondetRoutinePrefix string   `yaml:"nondetRoutinePrefix" env:"NONDET_ROUTINE_PREFIX"`
+	RoutineNameTemplate string   `yaml:"routineNameTemplate" env:"ROUTINE_NAME_TEMPLATE"`
+	KmsKeyName          string   `yaml:"kmsKeyName" env:"KMS_KEY_NAME"`
+	KvKeys              []string `yaml:"kvKeys" env:"KV_KEYS"`
+	KeyPrefixes         []string `yaml:"keyPrefixes" env:"KEY_PREFIXES"`
+	FieldFilter         string   `yaml:"fieldFilter" env:"FIELD_FILTER"`
 }
 
-func (c *conf) getConf() *conf {
+// getConf reads the conf files in order, a field set in a later file overriding an earlier one, and then the
+// environment overrides. A missing file is logged, so the config can come from the environment alone
+func (c *conf) getConf(paths []string, lookupEnv func(string) (string, bool)) *conf {
 
-	yamlFile, err := os.ReadFile("./conf.yaml")
-	if err != nil {
-		log.Printf("yamlFile.Get err   #%v ", err)
-	}
-	err = yaml.Unmarshal(yamlFile, c)
-	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+	for _, path := range paths {
+		yamlFile, err := os.ReadFile(strings.TrimSpace(path))
+		if err != nil {
+			log.Printf("yamlFile.Get err   #%v ", err)
+			continue
+		}
+		err = yaml.Unmarshal(yamlFile, c)
+		if err != nil {
+			log.Fatalf("Unmarshal %s: %v", path, err)
+		}
 	}
+	c.applyEnv(lookupEnv)
 
 	return c
 }
 
-func readKV(vaultconf conf, bqconfig cmap.ConcurrentMap) {
-	ctx := context.Background()
+// applyEnv sets each field from the environment variable in its env tag, if it is set. A list is comma separated
+func (c *conf) applyEnv(lookupEnv func(string) (string, bool)) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		value, ok := lookupEnv(v.Type().Field(i).Tag.Get("env"))
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() != reflect.Slice {
+			field.SetString(value)
+			continue
+		}
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	}
+}
+
+func readKV(ctx context.Context, vaultconf conf, bqconfig cmap.ConcurrentMap) {
 
 	// get a client
 	client, err := kvutils.KvGetClient(vaultconf.VaultUrl, "", vaultconf.ApproleId, vaultconf.SecretId)
@@ -76,16 +134,11 @@ func readKV(vaultconf conf, bqconfig cmap.ConcurrentMap) {
 		return
 	}
 
-	var paths []string
-	if len(vaultconf.KvKeys) > 0 {
-		paths = vaultconf.KvKeys
-	} else {
-		// read the paths recursively
-		paths, err = kvutils.KvGetSecretPaths(client, vaultconf.Engine, vaultconf.EngineVersion, "")
-	}
-
-	if err != nil || paths == nil {
-		fmt.Print("failed to read paths")
+	// the kvKeys or all paths read recursively, only syncing the fields matching the filter
+	paths, err := keyPaths(vaultKVSource{client, vaultconf.Engine, vaultconf.EngineVersion}, vaultconf)
+	if err != nil {
+		fmt.Printf("\n%v", err)
+		return
 	}
 
 	datasets, err := bqutils.GetBQDatasets(ctx, vaultconf.ProjectId)
@@ -94,10 +147,20 @@ func readKV(vaultconf conf, bqconfig cmap.ConcurrentMap) {
 		return
 	}
 
+	// the options are read once for the run rather than for every key
+	snapshot := bqutils.NewOptionsSnapshot(bqconfig)
+
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var totals bqutils.RegionSyncResult
+	synced := 0
+	cancelled := 0
 
 	// iterate through the paths
 	for _, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
 		keyFound := false
 		kvsecret, err := kvutils.KvGetSecret(client, vaultconf.Engine, vaultconf.EngineVersion, path)
 		if err != nil || kvsecret.Data == nil {
@@ -105,9 +168,9 @@ func readKV(vaultconf conf, bqconfig cmap.ConcurrentMap) {
 			continue
 		}
 
-		if strings.HasPrefix(path, "gcm/") || strings.HasPrefix(path, "siv/") {
+		if aeadutils.HasKeyPrefix(path) {
 			keyFound = true
-			jsonKey, ok := kvsecret.Data["data"]
+			jsonKey, ok := kvutils.KvGetSecretKeyset(kvsecret, vaultconf.EngineVersion)
 			if !ok {
 				fmt.Printf("\nfailed to read back the aead engine %s key %s", vaultconf.Engine, path)
 			}
@@ -121,7 +184,29 @@ func readKV(vaultconf conf, bqconfig cmap.ConcurrentMap) {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					bqutils.DoBQSync(ctx, kh, newkeyname, deterministic, bqconfig, datasets)
+					result, err := bqutils.DoBQSync(ctx, kh, newkeyname, deterministic, snapshot, datasets)
+					if err != nil {
+						fmt.Printf("\nfailed to sync key %s: %v", newkeyname, err)
+						return
+					}
+					for _, routine := range result.Cancelled {
+						fmt.Printf("\ncancelled before syncing routine %s for key %s", routine, newkeyname)
+					}
+					for dataset, reason := range result.Skipped {
+						fmt.Printf("\nskipped dataset %s for key %s: %s", dataset, newkeyname, reason)
+					}
+					for _, syncErr := range result.Errors {
+						fmt.Printf("\nfailed to sync key %s: %s", newkeyname, syncErr)
+					}
+					keyTotals := result.Totals()
+					fmt.Printf("\nsynced key %s: %d routines created, %d updated, %d skipped", newkeyname, keyTotals.Created, keyTotals.Updated, keyTotals.Skipped)
+					mu.Lock()
+					defer mu.Unlock()
+					synced++
+					cancelled += len(result.Cancelled)
+					totals.Created += keyTotals.Created
+					totals.Updated += keyTotals.Updated
+					totals.Skipped += keyTotals.Skipped
 				}()
 			}
 		}
@@ -132,5 +217,27 @@ func readKV(vaultconf conf, bqconfig cmap.ConcurrentMap) {
 
 	}
 	wg.Wait()
+
+	// a partial summary, so an interrupted sync can be re-run for what is missing
+	if ctx.Err() != nil {
+		fmt.Printf("\ninterrupted: synced %d keys of %d paths, %d routines created, %d updated, %d skipped, %d cancelled\n", synced, len(paths), totals.Created, totals.Updated, totals.Skipped, cancelled)
+	}
 	return
 }
+
+// validateOnlyKV is kv2bq --validate-only, it prints whether each path is a valid keyset and returns the number that
+// are not, 1 if vault cannot be read
+func validateOnlyKV(ctx context.Context, vaultconf conf) int {
+	client, err := kvutils.KvGetClient(vaultconf.VaultUrl, "", vaultconf.ApproleId, vaultconf.SecretId)
+	if err != nil {
+		fmt.Print("\nfailed to initialize Vault client")
+		return 1
+	}
+	results, err := validateKV(ctx, vaultKVSource{client, vaultconf.Engine, vaultconf.EngineVersion}, vaultconf)
+	if err != nil {
+		fmt.Printf("\n%v", err)
+		return 1
+	}
+	fmt.Println()
+	return printValidationReport(os.Stdout, results)
+}
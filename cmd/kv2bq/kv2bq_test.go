@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetConf(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "conf.yaml")
+	override := filepath.Join(dir, "override.yaml")
+	if err := os.WriteFile(base, []byte("vaultUrl: https://base\napproleId: base-role\nengine: base-engine\nkvKeys:\n  - gcm/a\n  - siv/b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(override, []byte("engine: override-engine\nprojectId: override-project\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"APPROLE_ID":   "env-role",
+		"KEY_PREFIXES": "chacha/, team-a/",
+		"FIELD_FILTER": "",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	var c conf
+	c.FieldFilter = "address*"
+	c.getConf([]string{base, override, filepath.Join(dir, "missing.yaml")}, lookupEnv)
+
+	expected := conf{
+		VaultUrl:    "https://base",
+		ApproleId:   "env-role",
+		Engine:      "override-engine",
+		ProjectId:   "override-project",
+		KvKeys:      []string{"gcm/a", "siv/b"},
+		KeyPrefixes: []string{"chacha/", "team-a/"},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected the environment to override the later file to override the first\n%+v got\n%+v", expected, c)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	aeadutils "github.com/Vodafone/vault-plugin-aead/aeadutils"
+	kvutils "github.com/Vodafone/vault-plugin-aead/kvutils"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// kvSource is the KV engine the keysets are read from, vault in main and a fake in the tests
+type kvSource interface {
+	SecretPaths() ([]string, error)
+	Secret(path string) (*vault.KVSecret, error)
+}
+
+// vaultKVSource reads the secret engine of the conf with a vault client
+type vaultKVSource struct {
+	client        *vault.Client
+	engine        string
+	engineVersion string
+}
+
+func (s vaultKVSource) SecretPaths() ([]string, error) {
+	return kvutils.KvGetSecretPaths(s.client, s.engine, s.engineVersion, "")
+}
+
+func (s vaultKVSource) Secret(path string) (*vault.KVSecret, error) {
+	return kvutils.KvGetSecret(s.client, s.engine, s.engineVersion, path)
+}
+
+// keyPaths returns the kvKeys of the conf, or else every path of the engine, matching the fieldFilter
+func keyPaths(src kvSource, vaultconf conf) ([]string, error) {
+	paths := vaultconf.KvKeys
+	if len(paths) == 0 {
+		var err error
+		paths, err = src.SecretPaths()
+		if err != nil || paths == nil {
+			return nil, fmt.Errorf("failed to read paths: %v", err)
+		}
+	}
+
+	// only the fields matching the filter
+	if vaultconf.FieldFilter != "" {
+		total := len(paths)
+		filtered, err := kvutils.FilterFieldPaths(paths, vaultconf.FieldFilter)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("\nfieldFilter %s matched %d of %d paths", vaultconf.FieldFilter, len(filtered), total)
+		paths = filtered
+	}
+	return paths, nil
+}
+
+// keysetValidation is what --validate-only found at a KV path. Classification is deterministic (siv/) or
+// non-deterministic (gcm/), and Warning is set for a valid keyset under the key prefix of the other kind
+type keysetValidation struct {
+	Path           string
+	Valid          bool
+	Classification string
+	Algorithms     string
+	Keys           int
+	Warning        string
+	Error          string
+}
+
+// validateKV reads the keyset at each path with IsSecretAnAEADKeyset, as readKV does before a sync, without any
+// BQ or KMS calls
+func validateKV(ctx context.Context, src kvSource, vaultconf conf) ([]keysetValidation, error) {
+	paths, err := keyPaths(src, vaultconf)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]keysetValidation, 0, len(paths))
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, validatePath(src, vaultconf, path))
+	}
+	return results, nil
+}
+
+// validatePath classifies the keyset at the path, or says why it is not one
+func validatePath(src kvSource, vaultconf conf, path string) keysetValidation {
+	result := keysetValidation{Path: path}
+	if !aeadutils.HasKeyPrefix(path) {
+		result.Error = "not under a key prefix, gcm/, siv/ or one of keyPrefixes"
+		return result
+	}
+	kvsecret, err := src.Secret(path)
+	if err != nil || kvsecret == nil || kvsecret.Data == nil {
+		result.Error = fmt.Sprintf("failed to read the secret: %v", err)
+		return result
+	}
+	jsonKey, ok := kvutils.KvGetSecretKeyset(kvsecret, vaultconf.EngineVersion)
+	if !ok {
+		result.Error = "the secret has no keyset data"
+		return result
+	}
+	keySetJson, kh, err := aeadutils.IsSecretAnAEADKeyset(jsonKey, path)
+	if err != nil {
+		result.Error = fmt.Sprintf("not a valid aead keyset: %v", err)
+		return result
+	}
+
+	result.Valid = true
+	result.Keys = len(kh.KeysetInfo().KeyInfo)
+	result.Algorithms, _ = aeadutils.GetKeySetAlgorithms(keySetJson)
+	prefix := "gcm/"
+	result.Classification = "non-deterministic (gcm/)"
+	if aeadutils.IsKeyHandleDeterministic(kh) {
+		prefix = "siv/"
+		result.Classification = "deterministic (siv/)"
+	}
+	if (strings.HasPrefix(path, "gcm/") || strings.HasPrefix(path, "siv/")) && !strings.HasPrefix(path, prefix) {
+		result.Warning = fmt.Sprintf("the keyset is %s but the path is not under %s", result.Classification, prefix)
+	}
+	return result
+}
+
+// printValidationReport writes a line for each path and the totals, returning the number of invalid paths
+func printValidationReport(w io.Writer, results []keysetValidation) int {
+	invalid := 0
+	for _, result := range results {
+		if !result.Valid {
+			invalid++
+			fmt.Fprintf(w, "INVALID %s: %s\n", result.Path, result.Error)
+			continue
+		}
+		fmt.Fprintf(w, "VALID   %s: %s, %s, %d keys\n", result.Path, result.Classification, result.Algorithms, result.Keys)
+		if result.Warning != "" {
+			fmt.Fprintf(w, "        %s: warning %s\n", result.Path, result.Warning)
+		}
+	}
+	fmt.Fprintf(w, "%d valid, %d invalid of %d paths\n", len(results)-invalid, invalid, len(results))
+	return invalid
+}
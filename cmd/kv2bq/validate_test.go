@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	aeadutils "github.com/Vodafone/vault-plugin-aead/aeadutils"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// fakeKVSource is a KV engine of the secrets by path, where a nil secret fails to read
+type fakeKVSource map[string]*vault.KVSecret
+
+func (s fakeKVSource) SecretPaths() ([]string, error) {
+	paths := make([]string, 0, len(s))
+	for path := range s {
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func (s fakeKVSource) Secret(path string) (*vault.KVSecret, error) {
+	secret, ok := s[path]
+	if !ok || secret == nil {
+		return nil, errors.New("permission denied")
+	}
+	return secret, nil
+}
+
+// keysetSecret is a secret as the plugin writes it, the keyset of the field under "data"
+func keysetSecret(t *testing.T, fieldName string, deterministic bool) *vault.KVSecret {
+	kh, _, err := aeadutils.CreateNewAead()
+	if deterministic {
+		kh, _, err = aeadutils.CreateNewDeterministicAead()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySetJson, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(kh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &vault.KVSecret{Data: map[string]interface{}{"data": fmt.Sprintf(`{"%s":%s}`, fieldName, keySetJson)}}
+}
+
+func TestValidateKV(t *testing.T) {
+	src := fakeKVSource{
+		"gcm/address":  keysetSecret(t, "address", false),
+		"siv/msisdn":   keysetSecret(t, "msisdn", true),
+		"gcm/imsi":     keysetSecret(t, "imsi", true),
+		"siv/garbage":  {Data: map[string]interface{}{"data": `{"garbage":{"primaryKeyId":1,"key":[]}}`}},
+		"siv/nodata":   {Data: map[string]interface{}{"other": "value"}},
+		"gcm/denied":   nil,
+		"notes/readme": {Data: map[string]interface{}{"data": "not a key"}},
+	}
+
+	results, err := validateKV(context.Background(), src, conf{EngineVersion: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(src) {
+		t.Fatalf("expected a result for each of the %d paths got %v", len(src), results)
+	}
+	byPath := make(map[string]keysetValidation)
+	for _, result := range results {
+		byPath[result.Path] = result
+	}
+
+	for path, classification := range map[string]string{"gcm/address": "non-deterministic (gcm/)", "siv/msisdn": "deterministic (siv/)", "gcm/imsi": "deterministic (siv/)"} {
+		result := byPath[path]
+		if !result.Valid || result.Classification != classification || result.Keys != 1 || result.Algorithms == "" {
+			t.Errorf("expected %s to be a valid %s keyset got %+v", path, classification, result)
+		}
+	}
+	if byPath["gcm/address"].Warning != "" || !strings.Contains(byPath["gcm/imsi"].Warning, "not under siv/") {
+		t.Errorf("expected only the deterministic keyset under gcm/ to be warned about got %+v %+v", byPath["gcm/address"], byPath["gcm/imsi"])
+	}
+	for path, expectedErr := range map[string]string{
+		"siv/garbage":  "not a valid aead keyset",
+		"siv/nodata":   "no keyset data",
+		"gcm/denied":   "failed to read",
+		"notes/readme": "not under a key prefix",
+	} {
+		result := byPath[path]
+		if result.Valid || !strings.Contains(result.Error, expectedErr) {
+			t.Errorf("expected %s to be invalid with %q got %+v", path, expectedErr, result)
+		}
+	}
+
+	var report bytes.Buffer
+	if invalid := printValidationReport(&report, results); invalid != 4 {
+		t.Errorf("expected 4 invalid paths got %d", invalid)
+	}
+	if !strings.Contains(report.String(), "VALID   siv/msisdn: deterministic (siv/)") || !strings.Contains(report.String(), "INVALID gcm/denied: ") || !strings.HasSuffix(report.String(), "3 valid, 4 invalid of 7 paths\n") {
+		t.Errorf("unexpected report\n%s", report.String())
+	}
+
+	// kvKeys and fieldFilter pick the paths as they do for a sync
+	results, err = validateKV(context.Background(), src, conf{EngineVersion: "v2", KvKeys: []string{"gcm/address", "siv/msisdn", "gcm/imsi"}, FieldFilter: "i*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Path != "gcm/imsi" {
+		t.Errorf("expected only gcm/imsi to be validated got %+v", results)
+	}
+}
@@ -0,0 +1,69 @@
+package aeadplugin
+
+import (
+	"fmt"
+	"strconv"
+
+	hclog "github.com/hashicorp/go-hclog"
+	lru "github.com/hashicorp/golang-lru"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// decryptCaches holds the decrypt cache of each field with DECRYPT_CACHE_<field> set in the config
+var decryptCaches = cmap.New()
+
+// decryptCache is a size bounded LRU cache of the plaintext of cyphertext decrypted for a field. Every entry is from
+// the one keyset, the cache is replaced when the keyset of the field changes, ie on rotate or when a key is disabled,
+// so a cached plaintext is never returned once its keyset could no longer decrypt it
+type decryptCache struct {
+	keySet  string
+	size    int
+	entries *lru.Cache
+}
+
+// getDecryptCache returns the decrypt cache of the field for its current keyset, or nil if the field has no
+// DECRYPT_CACHE_<field>. The cache of a field that no longer has one is dropped so its plaintexts are not retained
+func getDecryptCache(fieldName string, keySet string) *decryptCache {
+	sizeIntf, ok := AEAD_CONFIG.Get("DECRYPT_CACHE_" + fieldName)
+	if !ok {
+		decryptCaches.Remove(fieldName)
+		return nil
+	}
+	size, err := strconv.Atoi(fmt.Sprintf("%v", sizeIntf))
+	if err != nil || size < 1 {
+		hclog.L().Error("invalid DECRYPT_CACHE_" + fieldName + ", the decrypt cache is off")
+		decryptCaches.Remove(fieldName)
+		return nil
+	}
+
+	if cacheIntf, ok := decryptCaches.Get(fieldName); ok {
+		cache := cacheIntf.(*decryptCache)
+		if cache.keySet == keySet && cache.size == size {
+			return cache
+		}
+	}
+	entries, err := lru.New(size)
+	if err != nil {
+		return nil
+	}
+	cache := &decryptCache{keySet: keySet, size: size, entries: entries}
+	decryptCaches.Set(fieldName, cache)
+	return cache
+}
+
+// decryptCacheKey is the cyphertext as it was supplied with the encoding and additional data it was decrypted with
+func decryptCacheKey(encoding string, additionalData []byte, cipherText string) string {
+	return fmt.Sprintf("%s:%d:%s%s", encoding, len(additionalData), additionalData, cipherText)
+}
+
+func (c *decryptCache) get(encoding string, additionalData []byte, cipherText string) (string, bool) {
+	plainText, ok := c.entries.Get(decryptCacheKey(encoding, additionalData, cipherText))
+	if !ok {
+		return "", false
+	}
+	return plainText.(string), true
+}
+
+func (c *decryptCache) add(encoding string, additionalData []byte, cipherText string, plainText string) {
+	c.entries.Add(decryptCacheKey(encoding, additionalData, cipherText), plainText)
+}
@@ -0,0 +1,74 @@
+package aeadplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// the error codes returned as error_code on error responses, so clients can handle errors without matching the message
+const (
+	ERROR_INVALID_REQUEST = "INVALID_REQUEST"
+	ERROR_KEY_NOT_FOUND   = "KEY_NOT_FOUND"
+	ERROR_INVALID_KEYSET  = "INVALID_KEYSET"
+	ERROR_DECRYPT_FAILED  = "DECRYPT_FAILED"
+	ERROR_FIELD_EXISTS    = "FIELD_EXISTS"
+	ERROR_RATE_LIMITED    = "RATE_LIMITED"
+)
+
+// codedError is an error with one of the error codes
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// codedErrorf formats an error as fmt.Errorf does, with the error code
+func codedErrorf(code string, format string, a ...interface{}) error {
+	return &codedError{code: code, err: fmt.Errorf(format, a...)}
+}
+
+// invalidKeysetError is the INVALID_KEYSET error of a keyset, or json that was meant to be one, that does not parse
+// or validate. It never wraps the parse or validation error as that can quote the key material
+func invalidKeysetError(name string) error {
+	return codedErrorf(ERROR_INVALID_KEYSET, "%s is not a valid keyset", name)
+}
+
+// errorCode returns the code of the first coded error in the chain of err
+func errorCode(err error) (string, bool) {
+	var coded *codedError
+	if !errors.As(err, &coded) {
+		return "", false
+	}
+	return coded.code, true
+}
+
+// withErrorCodes turns a coded error from the callback into a response with the message and the error_code. Vault's
+// http api only returns the message of a failed request, so the message starts with the code too. Errors without a
+// code are returned as they were
+func (b *backend) withErrorCodes(callback framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		resp, err := callback(ctx, req, data)
+		code, ok := errorCode(err)
+		if !ok {
+			return resp, err
+		}
+		err = fmt.Errorf("%s: %w", code, err)
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"error":      err.Error(),
+				"error_code": code,
+			},
+		}, err
+	}
+}
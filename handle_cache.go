@@ -0,0 +1,56 @@
+package aeadplugin
+
+import (
+	"fmt"
+
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"github.com/google/tink/go/tink"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// handleCache holds the encrypt primitive of each keyset by key name, so encrypt does not parse the keyset json on
+// every request
+var handleCache = cmap.New()
+
+// cachedHandle is the primitive built from one keyset json. It is only used while that json is still the keyset in
+// config, so a rotate, import or key status change replaces it
+type cachedHandle struct {
+	keySet string
+	aead   tink.AEAD
+	daead  tink.DeterministicAEAD
+}
+
+// getCachedHandle returns the primitive of the keyset and whether it came from the cache, building and caching it
+// if the cache has none for the key name or it was built from a different keyset
+func getCachedHandle(keyName string, keySet string, deterministic bool) (*cachedHandle, bool, error) {
+	if handleIntf, ok := handleCache.Get(keyName); ok {
+		handle := handleIntf.(*cachedHandle)
+		if handle.keySet == keySet && (handle.daead != nil) == deterministic {
+			return handle, true, nil
+		}
+	}
+
+	handle := &cachedHandle{keySet: keySet}
+	var err error
+	if deterministic {
+		_, handle.daead, err = aeadutils.CreateInsecureHandleAndDeterministicAead(keySet)
+	} else {
+		_, handle.aead, err = aeadutils.CreateInsecureHandleAndAead(keySet)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// the aeadutils constructors log rather than return a keyset that has no usable primary key
+	if handle.aead == nil && handle.daead == nil {
+		return nil, false, fmt.Errorf("keyset %s has no usable primary key", keyName)
+	}
+	handleCache.Set(keyName, handle)
+	return handle, false, nil
+}
+
+// encryptCacheResult is the cyphertext of a field encrypted with DEBUG_CACHE, with whether its primitive came from
+// the handle cache
+type encryptCacheResult struct {
+	cypherText string
+	hit        bool
+}
@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	pathpkg "path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -232,6 +234,39 @@ func KvGetSecret(client *vault.Client, kv_engine string, kv_version string, secr
 	}
 }
 
+// KvGetSecretKeyset returns the keyset data of a secret, a json string of {"field":<keyset>}.
+// Secrets written by the plugin hold it under "data" (for v2 the api has already removed the v2 data wrapper)
+// but legacy kv v1 secrets have no "data" sub-key and hold the keysets flat, as the secret data itself
+func KvGetSecretKeyset(kvsecret *vault.KVSecret, kv_version string) (interface{}, bool) {
+	if kvsecret == nil || kvsecret.Data == nil {
+		return nil, false
+	}
+	jsonKey, ok := kvsecret.Data["data"]
+	if ok || kv_version != "v1" {
+		return jsonKey, ok
+	}
+
+	flat := make(map[string]interface{}, len(kvsecret.Data))
+	for k, v := range kvsecret.Data {
+		if k == "aad" {
+			continue
+		}
+		// a keyset can be stored as a json string or as an object
+		if str, isStr := v.(string); isStr && json.Valid([]byte(str)) {
+			v = json.RawMessage(str)
+		}
+		flat[k] = v
+	}
+	if len(flat) == 0 {
+		return nil, false
+	}
+	flatJson, err := json.Marshal(flat)
+	if err != nil {
+		return nil, false
+	}
+	return string(flatJson), true
+}
+
 func KvDeleteSecret(client *vault.Client, kv_engine string, kv_version string, secretPath string) error {
 	if kv_version == "v1" {
 		err := client.KVv1(kv_engine).Delete(context.Background(), secretPath)
@@ -289,6 +324,44 @@ func KvGetSecretPaths(client *vault.Client, kv_engine string, kv_version string,
 	return pathSliceOut, err
 }
 
+// FilterFieldPaths returns the key paths whose field name, the path without its key prefix (see aeadutils.RemoveKeyPrefix),
+// matches the filter. The filter is a glob, ie address*, or a regular expression after re:, ie re:^(address|email)$.
+// An empty filter matches every path
+func FilterFieldPaths(paths []string, filter string) ([]string, error) {
+	if filter == "" {
+		return paths, nil
+	}
+	var match func(fieldName string) (bool, error)
+	if expr, ok := strings.CutPrefix(filter, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field filter %s: %w", filter, err)
+		}
+		match = func(fieldName string) (bool, error) {
+			return re.MatchString(fieldName), nil
+		}
+	} else {
+		if _, err := pathpkg.Match(filter, ""); err != nil {
+			return nil, fmt.Errorf("invalid field filter %s: %w", filter, err)
+		}
+		match = func(fieldName string) (bool, error) {
+			return pathpkg.Match(filter, fieldName)
+		}
+	}
+
+	matched := []string{}
+	for _, path := range paths {
+		ok, err := match(aeadutils.RemoveKeyPrefix(path))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, path)
+		}
+	}
+	return matched, nil
+}
+
 func KvCreateHttpClient() *retryablehttp.Client {
 	var tr *http.Transport
 	tr = &http.Transport{
@@ -0,0 +1,94 @@
+package kvutils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	vault "github.com/hashicorp/vault/api"
+)
+
+const testKeyset = `{"primaryKeyId":3987026049,"key":[{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GiCRExtHflcWVUbmk0mwB5TzqSGc3GVMu6Hk+HbL4oH61A==","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":3987026049,"outputPrefixType":"TINK"}]}`
+
+func TestKvGetSecretKeyset(t *testing.T) {
+	var keysetMap map[string]interface{}
+	err := json.Unmarshal([]byte(testKeyset), &keysetMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shapes := map[string]struct {
+		version string
+		secret  *vault.KVSecret
+	}{
+		// as written by the plugin, the v2 api has already removed the v2 data wrapper
+		"v2": {"v2", &vault.KVSecret{Data: map[string]interface{}{
+			"data": `{"address":` + testKeyset + `}`,
+			"aad":  `{"address":"address"}`,
+		}}},
+		"v1 written by the plugin": {"v1", &vault.KVSecret{Data: map[string]interface{}{
+			"data": `{"address":` + testKeyset + `}`,
+		}}},
+		"v1 flat keyset string": {"v1", &vault.KVSecret{Data: map[string]interface{}{
+			"address": testKeyset,
+		}}},
+		"v1 flat keyset object": {"v1", &vault.KVSecret{Data: map[string]interface{}{
+			"address": keysetMap,
+		}}},
+	}
+
+	for name, shape := range shapes {
+		jsonKey, ok := KvGetSecretKeyset(shape.secret, shape.version)
+		if !ok {
+			t.Errorf("%s: expected to find the keyset", name)
+			continue
+		}
+		_, kh, err := aeadutils.IsSecretAnAEADKeyset(jsonKey, "gcm/address")
+		if err != nil || kh == nil {
+			t.Errorf("%s: expected a valid keyset from %v: %v", name, jsonKey, err)
+		}
+	}
+
+	// v2 secrets must have the data sub-key
+	_, ok := KvGetSecretKeyset(&vault.KVSecret{Data: map[string]interface{}{"address": testKeyset}}, "v2")
+	if ok {
+		t.Errorf("expected no keyset for a v2 secret without data")
+	}
+	_, ok = KvGetSecretKeyset(&vault.KVSecret{}, "v1")
+	if ok {
+		t.Errorf("expected no keyset for a secret without data")
+	}
+}
+
+func TestFilterFieldPaths(t *testing.T) {
+	paths := []string{"gcm/address", "siv/address", "gcm/addressline2", "siv/email", "gcm/phone"}
+
+	tests := []struct {
+		filter   string
+		expected []string
+	}{
+		{"", paths},
+		{"address*", []string{"gcm/address", "siv/address", "gcm/addressline2"}},
+		{"address", []string{"gcm/address", "siv/address"}},
+		{"re:^(email|phone)$", []string{"siv/email", "gcm/phone"}},
+		{"re:line", []string{"gcm/addressline2"}},
+		{"nothing*", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := FilterFieldPaths(paths, tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %v got %v", tt.filter, tt.expected, got)
+		}
+	}
+
+	for _, filter := range []string{"[address", "re:(address"} {
+		if _, err := FilterFieldPaths(paths, filter); err == nil {
+			t.Errorf("%s: expected an invalid filter error", filter)
+		}
+	}
+}
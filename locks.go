@@ -0,0 +1,70 @@
+package aeadplugin
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// fieldLockName is the name a field is locked under, a keyset and the field it was created for (ie gcm/field and
+// field, or its export keyset export/field) share a lock
+func fieldLockName(name string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(name, "gcm/"), "siv/"), aeadutils.ExportKeyPrefix)
+}
+
+// lockFields takes the field locks of the names, for writing if write is set, and returns the function that releases
+// them. The locks are taken in a fixed order so two requests locking overlapping fields cannot deadlock
+func (b *backend) lockFields(names []string, write bool) func() {
+	lockNames := make([]string, 0, len(names))
+	for _, name := range names {
+		lockNames = append(lockNames, fieldLockName(name))
+	}
+	locks := locksutil.LocksForKeys(b.fieldLocks, lockNames)
+	for _, lock := range locks {
+		if write {
+			lock.Lock()
+		} else {
+			lock.RLock()
+		}
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			if write {
+				locks[i].Unlock()
+			} else {
+				locks[i].RUnlock()
+			}
+		}
+	}
+}
+
+// withFieldLocks runs the callback holding the read locks of the fields of the request and of the keysets they point
+// to, so a keyset written at the same time (ie by createAEADkeyOverwrite, which takes the write lock) is either wholly
+// used or not used at all. The keysets are found from the cached config, as it was before the request
+func (b *backend) withFieldLocks(callback framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		fieldNames := requestFieldNames(data.Raw)
+		names := fieldNames
+		for _, fieldName := range fieldNames {
+			if keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG); ok {
+				names = append(names, keyName)
+			}
+		}
+		unlock := b.lockFields(names, false)
+		defer unlock()
+		return callback(ctx, req, data)
+	}
+}
+
+// mapKeys returns the keys of the map, ie the field names of a config write
+func mapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -1,9 +1,15 @@
 package aeadplugin
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
@@ -12,13 +18,17 @@ import (
 	hclog "github.com/hashicorp/go-hclog"
 
 	b64 "encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 
 	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"github.com/Vodafone/vault-plugin-aead/bqutils"
+	"github.com/google/tink/go/keyset"
 	"github.com/google/tink/go/tink"
 	"github.com/google/uuid"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (b *backend) pathAeadEncrypt(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -40,6 +50,66 @@ func (b *backend) pathAeadEncrypt(ctx context.Context, req *logical.Request, dat
 
 	*/
 
+	// optionally leave values that are already cyphertext for the field untouched
+	skipEncrypted := false
+	skipEncryptedStr, ok := extractRequestOption(data.Raw, "SKIP_ENCRYPTED")
+	if ok {
+		var err error
+		skipEncrypted, err = strconv.ParseBool(skipEncryptedStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "SKIP_ENCRYPTED must be true or false: %w", err)
+		}
+	}
+
+	// optionally report whether each field was encrypted with a cached primitive
+	debugCache := false
+	debugCacheStr, ok := extractRequestOption(data.Raw, "DEBUG_CACHE")
+	if ok {
+		var err error
+		debugCache, err = strconv.ParseBool(debugCacheStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "DEBUG_CACHE must be true or false: %w", err)
+		}
+	}
+
+	// optional encoding of the cyphertext: base64, base64url, hex or bqbytes, by default that of each field
+	encoding, ok := extractRequestOption(data.Raw, "ENCODING")
+	if !ok {
+		encoding = ENCODING_FIELD
+	}
+	encoding = strings.ToLower(encoding)
+	if ok && encoding != ENCODING_BASE64 && encoding != ENCODING_BASE64URL && encoding != ENCODING_HEX && encoding != ENCODING_BQBYTES {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "unsupported ENCODING %s, expected base64, base64url, hex or bqbytes", encoding)
+	}
+
+	// optional parts for fields with a composite additional data
+	aadParts, err := extractAADParts(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// internal or export keysets, and of which kind
+	mode, err := extractMode(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+	keyKind, err := extractKeyKind(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.checkShape(ctx, req, data.Raw, "encrypt", false, true); err != nil {
+		return nil, err
+	}
+
+	// a single row can have map values to encrypt as json, so only bulk rows are bulk
+	isBulk := detectShape(data.Raw) == SHAPE_ROWS
+
+	// the fields with a RATE_LIMIT_ take a token for each of their values
+	if err := takeRateLimits(fieldValueCounts(data.Raw, isBulk)); err != nil {
+		return nil, err
+	}
+
 	// fire and forget the telemetry
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -48,8 +118,6 @@ func (b *backend) pathAeadEncrypt(ctx context.Context, req *logical.Request, dat
 	var respStruct = logical.Response{}
 	var resp = &respStruct
 
-	isBulk, _ := isBulkData(data.Raw)
-
 	if isBulk {
 
 		// split the bulk file into rows and process each row concurrently in a  goroutine
@@ -59,7 +127,9 @@ func (b *backend) pathAeadEncrypt(ctx context.Context, req *logical.Request, dat
 		for rowKey, rowDataMap := range data.Raw {
 			rowDataMapAsMapStrInt, ok := rowDataMap.(map[string]interface{})
 			if !ok {
-				panic("expecting a map pathAeadEncrypt")
+				// checkShape has already rejected this, but don't panic if it is reached
+				wg.Wait()
+				return nil, codedErrorf(ERROR_INVALID_REQUEST, "row %s is not a map of fields", rowKey)
 			}
 			req.Data = rowDataMapAsMapStrInt
 
@@ -71,24 +141,34 @@ func (b *backend) pathAeadEncrypt(ctx context.Context, req *logical.Request, dat
 
 			// data.Raw = rowDataMapAsMapStrInt
 			//localResp, err := b.pathAeadEncryptRowChan(ctx, req, data)
-			go b.encryptRowChan(ctx, req, &dn, rowKey, channel)
+			go b.encryptRowChan(ctx, req, &dn, rowKey, skipEncrypted, debugCache, encoding, aadParts, mode, keyKind, channel)
 		}
 
+		var rowErr error
 		resp.Data = make(map[string]interface{})
 		for i := 0; i < channelCap; i++ {
 			res := <-channel
 			for k, v := range res {
+				if err, ok := v.(error); ok {
+					rowErr = err
+					continue
+				}
 				// this should be a map of 1 row of rownumber index as string and the map of values
 				resp.Data[k] = v
 			}
 		}
+		if rowErr != nil {
+			wg.Wait()
+			return nil, rowErr
+		}
 
 	} else {
 
 		// process a ringle row
-		localResp, err := b.encryptRow(ctx, req, data)
+		localResp, err := b.encryptRow(ctx, req, data, skipEncrypted, debugCache, encoding, aadParts, mode, keyKind)
 		if err != nil {
-			panic(err)
+			wg.Wait()
+			return nil, err
 		}
 		resp = localResp
 	}
@@ -97,37 +177,45 @@ func (b *backend) pathAeadEncrypt(ctx context.Context, req *logical.Request, dat
 	return resp, nil
 }
 
-func (b *backend) encryptRowChan(ctx context.Context, req *logical.Request, data *framework.FieldData, row string, ch chan map[string]interface{}) {
+func (b *backend) encryptRowChan(ctx context.Context, req *logical.Request, data *framework.FieldData, row string, skipEncrypted bool, debugCache bool, encoding string, aadParts map[string]string, mode string, keyKind string, ch chan map[string]interface{}) {
 
 	// this is just a wrapper around the pathAeadEncryptRow methos so that it can be used concurrently in a channel
-	resp, err := b.encryptRow(ctx, req, data)
+	localResp := make(map[string]interface{})
+	resp, err := b.encryptRow(ctx, req, data, skipEncrypted, debugCache, encoding, aadParts, mode, keyKind)
 	if err != nil {
-		panic(err)
+		// pass the error back to the caller rather than a row
+		localResp[row] = err
+		ch <- localResp
+		return
 	}
 
-	localResp := make(map[string]interface{})
 	localResp[row] = resp.Data
 
 	ch <- localResp
 
 }
 
-func (b *backend) decryptRowChan(ctx context.Context, req *logical.Request, data *framework.FieldData, fieldName string, ch chan map[string]interface{}) {
+func (b *backend) decryptRowChan(ctx context.Context, req *logical.Request, data *framework.FieldData, fieldName string, encoding string, tryAllKeys bool, keyIDs bool, noAAD bool, aadParts map[string]string, candidateAADs map[string][]string, mode string, keyKind string, ch chan map[string]interface{}) {
 
 	// this is just a wrapper around the pathAeadDecryptRow methos so that it can be used concurrently in a channel
-	resp, err := b.pathAeadDecrypt(ctx, req, data)
+	localResp := make(map[string]interface{})
+	resp, err := b.decryptData(ctx, req, data, encoding, tryAllKeys, keyIDs, noAAD, aadParts, candidateAADs, mode, keyKind)
 	if err != nil {
-		panic(err)
+		// pass the error back to the caller rather than a row
+		localResp[fieldName] = err
+		ch <- localResp
+		return
 	}
 
-	localResp := make(map[string]interface{})
+	// the key id counts of the rows are added up for the whole request
+	delete(resp.Data, "KEY_ID_COUNTS")
 	localResp[fieldName] = resp.Data
 
 	ch <- localResp
 
 }
 
-func (b *backend) encryptRow(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+func (b *backend) encryptRow(ctx context.Context, req *logical.Request, data *framework.FieldData, skipEncrypted bool, debugCache bool, encoding string, aadParts map[string]string, mode string, keyKind string) (*logical.Response, error) {
 
 	// retrive the config fro  storage
 
@@ -153,66 +241,125 @@ func (b *backend) encryptRow(ctx context.Context, req *logical.Request, data *fr
 	// iterate through the key=value supplied (ie field1=myaddress field2=myphonenumber)
 	for fieldName, unencryptedData := range data.Raw {
 		// doEncryption(fieldName, unencryptedData, resp, data, b, ctx, req)
-		go b.doEncryptionChan(fieldName, unencryptedData, data, ctx, req, channel)
+		go b.doEncryptionChan(fieldName, unencryptedData, skipEncrypted, debugCache, encoding, aadParts, mode, keyKind, data, ctx, req, channel)
 	}
 
+	var fieldErr error
+	cacheHits := make(map[string]interface{})
 	for i := 0; i < channelCap; i++ {
 		res := <-channel
 		// this is only 1 key=value pair, but we don't know the key or the value so we iterate over a range of 1 pair
 		for k, v := range res {
+			if err, ok := v.(error); ok {
+				fieldErr = err
+				continue
+			}
+			if result, ok := v.(encryptCacheResult); ok {
+				cacheHits[k] = result.hit
+				v = result.cypherText
+			}
 			resp[k] = v
 		}
 	}
+	if fieldErr != nil {
+		return nil, fieldErr
+	}
+	if debugCache {
+		resp["DEBUG_CACHE"] = cacheHits
+	}
 	return &logical.Response{
 		Data: resp,
 	}, nil
 }
 
-func (b *backend) doEncryptionChan(fieldName string, unencryptedData interface{}, data *framework.FieldData, ctx context.Context, req *logical.Request, ch chan map[string]interface{}) {
+func (b *backend) doEncryptionChan(fieldName string, unencryptedData interface{}, skipEncrypted bool, debugCache bool, encoding string, aadParts map[string]string, mode string, keyKind string, data *framework.FieldData, ctx context.Context, req *logical.Request, ch chan map[string]interface{}) {
 	resp := make(map[string]interface{})
-	encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+	encryptionkey, keyName, ok, err := modeEncryptionKey(fieldName, mode, keyKind)
+	if err != nil {
+		resp[fieldName] = err
+		ch <- resp
+		return
+	}
 	// do we have a key already in config
 	if ok {
 		// is the key we have retrived deterministic?
 		encryptionKeyStr, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionkey)
 		// set additionalDataBytes as field name of the right type
-		additionalDataBytes := b.getAdditionalData(fieldName, AEAD_CONFIG)
+		additionalDataBytes, err := b.getCompositeAdditionalData(fieldName, aadParts)
+		if err != nil {
+			resp[fieldName] = err
+			ch <- resp
+			return
+		}
 
-		if deterministic {
-			// SUPPORT FOR DETERMINISTIC AEAD
-			// we don't need the key handle which is returned first
-			_, tinkDetAead, err := aeadutils.CreateInsecureHandleAndDeterministicAead(encryptionKeyStr)
-			if err != nil {
-				hclog.L().Error("Failed to create a keyhandle", err)
+		// KEY_KIND chooses the kind of keyset in the request, in place of DETERMINISTIC_<field>
+		if keyKind == "" {
+			if err := checkFieldDeterminism(fieldName, keyName, deterministic); err != nil {
+				resp[fieldName] = err
+				ch <- resp
+				return
 			}
-			// set the unencrypted data to be the right type
-			unencryptedDataBytes := []byte(fmt.Sprintf("%v", unencryptedData))
+		}
 
-			// encrypt it
-			cypherText, err := tinkDetAead.EncryptDeterministically(unencryptedDataBytes, additionalDataBytes)
-			if err != nil {
-				hclog.L().Error("Failed to encrypt", err)
-			}
+		// set the unencrypted data to be the right type, a map or a list as json
+		plainText, err := fieldPlaintext(unencryptedData)
+		if err != nil {
+			resp[fieldName] = codedErrorf(ERROR_INVALID_REQUEST, "failed to serialize field %s as json: %w", fieldName, err)
+			ch <- resp
+			return
+		}
+		if err := checkFieldSize(fieldName, plainText); err != nil {
+			resp[fieldName] = err
+			ch <- resp
+			return
+		}
+
+		// probe: if the value decrypts with this field's keyset it is already encrypted so return it as-is
+		if skipEncrypted && isAlreadyEncrypted(fieldName, encoding, encryptionKeyStr, string(plainText), additionalDataBytes) {
+			resp[fieldName] = string(plainText)
+			ch <- resp
+			return
+		}
 
-			// set the response as the base64 encrypted data
-			resp[fieldName] = b64.StdEncoding.EncodeToString(cypherText)
+		// compressed if the field is configured for it
+		unencryptedDataBytes, err := compressPlaintext(fieldName, plainText)
+		if err != nil {
+			resp[fieldName] = err
+			ch <- resp
+			return
+		}
+
+		// the primitive is built once per keyset and reused until the keyset changes
+		handle, cacheHit, err := getCachedHandle(keyName, encryptionKeyStr, deterministic)
+		if err != nil {
+			hclog.L().Error("Failed to create a keyhandle", err)
+			resp[fieldName] = fmt.Errorf("failed to create a keyhandle for %s: %w", fieldName, err)
+			ch <- resp
+			return
+		}
+
+		var cypherText []byte
+		if deterministic {
+			// SUPPORT FOR DETERMINISTIC AEAD
+			cypherText, err = handle.daead.EncryptDeterministically(unencryptedDataBytes, additionalDataBytes)
 		} else {
 			// SUPPORT FOR NON DETERMINISTIC AEAD
-			_, tinkAead, err := aeadutils.CreateInsecureHandleAndAead(encryptionKeyStr)
-			if err != nil {
-				hclog.L().Error("Failed to create a keyhandle", err)
-			}
-			// set the unencrypted data to be the right type
-			unencryptedDataBytes := []byte(fmt.Sprintf("%v", unencryptedData))
-
-			// encrypt it
-			cyphertext, err := tinkAead.Encrypt(unencryptedDataBytes, additionalDataBytes)
-			if err != nil {
-				hclog.L().Error("Failed to encrypt", err)
-			}
+			cypherText, err = handle.aead.Encrypt(unencryptedDataBytes, additionalDataBytes)
+		}
+		if err != nil {
+			hclog.L().Error("Failed to encrypt", err)
+		}
 
-			// set the response as the base64 encrypted data
-			resp[fieldName] = b64.StdEncoding.EncodeToString(cyphertext)
+		// set the response as the encrypted data in the encoding of the field
+		encoded, err := encodeCiphertext(fieldName, encoding, cypherText)
+		if err != nil {
+			resp[fieldName] = err
+			ch <- resp
+			return
+		}
+		resp[fieldName] = encoded
+		if debugCache {
+			resp[fieldName] = encryptCacheResult{cypherText: encoded, hit: cacheHit}
 		}
 	} else {
 		// we didn't find a key - return original data
@@ -222,90 +369,1300 @@ func (b *backend) doEncryptionChan(fieldName string, unencryptedData interface{}
 	ch <- resp
 }
 
-func (b *backend) pathAeadDecrypt(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-
-	// what is data.Raw
-	//
-	// is this a bulk file: ie a map of map[string]map[string]interface{} where the second map is the row to be decrypted
-	// {"0":{"bulkfield0":"fgbsrhbrgbr","bulkfield1":"sfgbsfbrnegnehtfngb","bulkfield2":"srbgwrgbwrgbwrg"},"1":{"bulkfield0":"srgbrgbewrgbg","bulkfield1":"egbetbgnetbn","bulkfield2":"sfbfbgwrbg"},"2":{"bulkfield0":"sfgbetbnet","bulkfield1":"sfgbetgbet","bulkfield2":"sfbegbet"}}
-	//
-	// or a single row of key value pairs to be encrypted map[string]interface{}
-	// {"bulkfield0":"fgbsrhbrgbr","bulkfield1":"sfgbsfbrnegnehtfngb","bulkfield2":"srbgwrgbwrgbwrg"}
+// isAlreadyEncrypted is the SKIP_ENCRYPTED heuristic - the value is treated as cyphertext if it is in the encoding, with or
+// without a version tag, and decrypts with the keyset and additional data of the field
+func isAlreadyEncrypted(fieldName string, encoding string, encryptionKeyStr string, value string, additionalData []byte) bool {
+	cypherText, err := decodeTaggedCiphertext(fieldName, value, encoding)
+	if err != nil || len(cypherText) == 0 {
+		return false
+	}
+	kh, err := aeadutils.ValidateKeySetJson(encryptionKeyStr)
+	if err != nil {
+		return false
+	}
+	_, err = aeadutils.DecryptWithKeyHandle(kh, cypherText, additionalData)
+	return err == nil
+}
 
-	// fire and forget the telemetry
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go b.publishTelemetry(&wg, ctx, req, "decrypt", data.Raw)
+// the default MAX_FIELD_BYTES, well over any sensible field but small enough that a runaway client can't exhaust memory
+const defaultMaxFieldBytes = 16 * 1024 * 1024
 
-	var respStruct = logical.Response{}
-	var resp = &respStruct
+// maxFieldBytes is MAX_FIELD_BYTES in the config, or the default if it is not set
+func maxFieldBytes() int {
+	if maxIntf, ok := AEAD_CONFIG.Get("MAX_FIELD_BYTES"); ok {
+		configMax, err := strconv.Atoi(fmt.Sprintf("%v", maxIntf))
+		if err == nil && configMax > 0 {
+			return configMax
+		}
+		hclog.L().Error("invalid MAX_FIELD_BYTES, using the default")
+	}
+	return defaultMaxFieldBytes
+}
 
-	isBulk, _ := isBulkData(data.Raw)
+// checkFieldSize rejects plaintext bigger than MAX_FIELD_BYTES in the config before it is encrypted
+func checkFieldSize(fieldName string, plainText []byte) error {
+	maxFieldBytes := maxFieldBytes()
+	if len(plainText) > maxFieldBytes {
+		return codedErrorf(ERROR_INVALID_REQUEST, "field %s is %d bytes, more than the MAX_FIELD_BYTES limit of %d", fieldName, len(plainText), maxFieldBytes)
+	}
+	return nil
+}
 
-	if isBulk {
+// checkFieldDeterminism rejects a field whose keyset, keyName, is not the kind recorded for it in DETERMINISTIC_<field>,
+// ie a field that expects deterministic encryption pointing at a key family with a non deterministic keyset
+func checkFieldDeterminism(fieldName string, keyName string, deterministic bool) error {
+	expectedIntf, ok := AEAD_CONFIG.Get("DETERMINISTIC_" + fieldName)
+	if !ok {
+		return nil
+	}
+	expected, err := strconv.ParseBool(fmt.Sprintf("%v", expectedIntf))
+	if err != nil {
+		return fmt.Errorf("DETERMINISTIC_%s must be true or false: %w", fieldName, err)
+	}
+	if expected != deterministic {
+		return codedErrorf(ERROR_INVALID_KEYSET, "field %s expects a %s keyset but %s is %s", fieldName, determinismName(expected), keyName, determinismName(deterministic))
+	}
+	return nil
+}
 
-		channelCap := len(data.Raw)
-		channel := make(chan map[string]interface{}, channelCap)
+func determinismName(deterministic bool) string {
+	if deterministic {
+		return "deterministic"
+	}
+	return "non deterministic"
+}
 
-		for rowKey, rowDataMap := range data.Raw {
-			rowDataMapAsMapStrInt, ok := rowDataMap.(map[string]interface{})
-			if !ok {
-				panic("expecting a map pathAeadEncrypt")
+// fieldValueCounts is the number of values of each field in a single row, or across the bulk rows
+func fieldValueCounts(data map[string]interface{}, isBulk bool) map[string]int {
+	counts := make(map[string]int)
+	if !isBulk {
+		for fieldName := range data {
+			counts[fieldName]++
+		}
+		return counts
+	}
+	for _, row := range data {
+		if rowMap, ok := row.(map[string]interface{}); ok {
+			for fieldName := range rowMap {
+				counts[fieldName]++
 			}
-			req.Data = rowDataMapAsMapStrInt
+		}
+	}
+	return counts
+}
 
-			// prior to this there were race conditions as multiple goroutines access data
-			dn := framework.FieldData{
-				Raw:    rowDataMapAsMapStrInt,
-				Schema: nil,
-			}
+const (
+	MODE_INTERNAL = "internal"
+	MODE_EXPORT   = "export"
+)
 
-			// data.Raw = rowDataMapAsMapStrInt
-			go b.decryptRowChan(ctx, req, &dn, rowKey, channel)
+const (
+	KEY_KIND_DET    = "det"
+	KEY_KIND_NONDET = "nondet"
+)
+
+// extractMode removes the MODE request option, internal (the default) to use the keyset of each field or export to
+// use its export keyset, ie with the RAW prefix BigQuery needs
+func extractMode(data map[string]interface{}) (string, error) {
+	mode, ok := extractRequestOption(data, "MODE")
+	if !ok {
+		return MODE_INTERNAL, nil
+	}
+	mode = strings.ToLower(mode)
+	if mode != MODE_INTERNAL && mode != MODE_EXPORT {
+		return "", codedErrorf(ERROR_INVALID_REQUEST, "unsupported MODE %s, expected internal or export", mode)
+	}
+	return mode, nil
+}
+
+// extractKeyKind removes the KEY_KIND request option, det or nondet to use the deterministic or non deterministic
+// keyset of a field that has both, see pairedKeyName. It is empty without KEY_KIND, for the keyset each field points at
+func extractKeyKind(data map[string]interface{}) (string, error) {
+	keyKind, ok := extractRequestOption(data, "KEY_KIND")
+	if !ok {
+		return "", nil
+	}
+	keyKind = strings.ToLower(keyKind)
+	if keyKind != KEY_KIND_DET && keyKind != KEY_KIND_NONDET {
+		return "", codedErrorf(ERROR_INVALID_REQUEST, "unsupported KEY_KIND %s, expected det or nondet", keyKind)
+	}
+	return keyKind, nil
+}
+
+// pairedKeyName is the keyset of the other kind in the key family of keyName, siv/<name> for gcm/<name> and gcm/<name>
+// for siv/<name>, so a field pointing at either has both, ie deterministic for joins and non deterministic for storage.
+// It is empty for a keyset name without gcm/ or siv/
+func pairedKeyName(keyName string) string {
+	if strings.HasPrefix(keyName, "gcm/") {
+		return "siv/" + strings.TrimPrefix(keyName, "gcm/")
+	}
+	if strings.HasPrefix(keyName, "siv/") {
+		return "gcm/" + strings.TrimPrefix(keyName, "siv/")
+	}
+	return ""
+}
+
+// pairedKeyset returns the keyset of pairedKeyName if it is in the config and is a valid keyset
+func pairedKeyset(keyName string) (string, string, bool) {
+	pairedName := pairedKeyName(keyName)
+	if pairedName == "" {
+		return "", "", false
+	}
+	paired, ok := AEAD_CONFIG.Get(pairedName)
+	if !ok {
+		return "", "", false
+	}
+	pairedStr := fmt.Sprintf("%v", paired)
+	if _, err := aeadutils.ValidateKeySetJson(pairedStr); err != nil {
+		return "", "", false
+	}
+	return pairedStr, pairedName, true
+}
+
+// modeEncryptionKey returns the keyset of the field for the mode and key kind, with the name of its config entry and
+// whether it was found. In export mode a field that has a keyset but no export keyset is an error, rather than returned
+// as it is, and with a key kind so is a field whose keyset is not of that kind. Only in internal mode is the paired
+// keyset of the field tried, an export keyset is a copy of one keyset
+func modeEncryptionKey(fieldName string, mode string, keyKind string) (interface{}, string, bool, error) {
+	keyField := fieldName
+	if mode == MODE_EXPORT {
+		keyField = aeadutils.ExportKeyPrefix + fieldName
+	}
+	encryptionkey, ok := aeadutils.GetEncryptionKey(keyField, AEAD_CONFIG)
+	if !ok {
+		if _, internal := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG); internal && mode == MODE_EXPORT {
+			return nil, "", false, codedErrorf(ERROR_KEY_NOT_FOUND, "field %s has no export keyset, create one with exportKey", fieldName)
 		}
+		return nil, "", false, nil
+	}
+	keyName, _ := aeadutils.GetEncryptionKeyName(keyField, AEAD_CONFIG)
+	if keyKind == "" {
+		return encryptionkey, keyName, true, nil
+	}
 
-		resp.Data = make(map[string]interface{})
-		for i := 0; i < channelCap; i++ {
-			res := <-channel
-			for k, v := range res {
-				// this should be a map of 1 row of rownumber index as string and the map of values
-				resp.Data[k] = v
+	det := keyKind == KEY_KIND_DET
+	if _, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionkey); deterministic == det {
+		return encryptionkey, keyName, true, nil
+	}
+	if mode == MODE_INTERNAL {
+		if pairedStr, pairedName, ok := pairedKeyset(keyName); ok {
+			if _, deterministic := aeadutils.IsKeyJsonDeterministic(pairedStr); deterministic == det {
+				return pairedStr, pairedName, true, nil
 			}
 		}
+		return nil, "", false, codedErrorf(ERROR_KEY_NOT_FOUND, "field %s has no %s keyset, %s is %s and has no paired keyset of the other kind", fieldName, determinismName(det), keyName, determinismName(!det))
+	}
+	return nil, "", false, codedErrorf(ERROR_KEY_NOT_FOUND, "field %s has no %s export keyset, %s is %s", fieldName, determinismName(det), keyName, determinismName(!det))
+}
+
+// compressedMarker is put in front of gzipped plaintext so decrypt knows which values of a field with COMPRESS_ set
+// were compressed, ie not those from before it was turned on
+var compressedMarker = []byte{0x00, 'G', 'Z'}
+
+// fieldCompressed is whether COMPRESS_<field> is true in the config
+func fieldCompressed(fieldName string) bool {
+	compressIntf, ok := AEAD_CONFIG.Get("COMPRESS_" + fieldName)
+	if !ok {
+		return false
+	}
+	compress, err := strconv.ParseBool(fmt.Sprintf("%v", compressIntf))
+	return err == nil && compress
+}
+
+// compressPlaintext gzips the plaintext, behind the compressedMarker, if COMPRESS_<field> is true in the config
+func compressPlaintext(fieldName string, plainText []byte) ([]byte, error) {
+	if !fieldCompressed(fieldName) {
+		return plainText, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(compressedMarker)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(plainText); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonMarker is put in front of the json of a map or list value so decrypt knows to restore the map or list. Like the
+// compressedMarker it starts with a NUL so plaintext strings are not mistaken for it
+var jsonMarker = []byte{0x00, 'J', 'S'}
+
+// fieldPlaintext is the plaintext of a field value, the json of a map or a list behind the jsonMarker
+func fieldPlaintext(v interface{}) ([]byte, error) {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		jsonBytes, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, jsonMarker...), jsonBytes...), nil
+	}
+	return []byte(fmt.Sprintf("%v", v)), nil
+}
+
+// plaintextValue reverses fieldPlaintext, json behind the jsonMarker is returned as the map or list and any other
+// plaintext as a string
+func plaintextValue(plainText []byte) (interface{}, error) {
+	if !bytes.HasPrefix(plainText, jsonMarker) {
+		return string(plainText), nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(plainText[len(jsonMarker):]))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// jsonText is the plaintext without the jsonMarker, for the paths that return the json of a map or list as text
+func jsonText(plainText []byte) []byte {
+	return bytes.TrimPrefix(plainText, jsonMarker)
+}
+
+// decompressPlaintext reverses compressPlaintext for a field that is compressed, any other plaintext, or plaintext
+// without the compressedMarker, is returned as-is. The output is limited to MAX_FIELD_BYTES, so a small cyphertext
+// cannot inflate without bound
+func decompressPlaintext(plainText []byte, compressed bool) ([]byte, error) {
+	if !compressed || !bytes.HasPrefix(plainText, compressedMarker) {
+		return plainText, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(plainText[len(compressedMarker):]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	limit := maxFieldBytes()
+	decompressed, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > limit {
+		return nil, fmt.Errorf("the plaintext is more than the MAX_FIELD_BYTES limit of %d once decompressed", limit)
+	}
+	return decompressed, nil
+}
+
+func (b *backend) pathAeadDecrypt(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// optional encoding of the cyphertext: base64, base64url, hex, bqbytes, auto or bq, by default that of each field
+	encoding, ok := extractRequestOption(data.Raw, "ENCODING")
+	if !ok {
+		encoding = ENCODING_FIELD
+	}
+	encoding = strings.ToLower(encoding)
+	if ok && encoding != ENCODING_BASE64 && encoding != ENCODING_BASE64URL && encoding != ENCODING_HEX && encoding != ENCODING_BQBYTES && encoding != ENCODING_AUTO && encoding != ENCODING_BQ {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "unsupported ENCODING %s, expected base64, base64url, hex, bqbytes, auto or bq", encoding)
+	}
+
+	// optionally fall back to trying each enabled key, also as a RAW key, when a field does not decrypt
+	tryAllKeys := false
+	tryAllKeysStr, ok := extractRequestOption(data.Raw, "TRY_ALL_KEYS")
+	if ok {
+		var err error
+		tryAllKeys, err = strconv.ParseBool(tryAllKeysStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "TRY_ALL_KEYS must be true or false: %w", err)
+		}
+	}
+
+	// optionally report the id of the key that decrypted each field, and how many values each key decrypted
+	keyIDs := false
+	keyIDsStr, ok := extractRequestOption(data.Raw, "KEY_IDS")
+	if ok {
+		var err error
+		keyIDs, err = strconv.ParseBool(keyIDsStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "KEY_IDS must be true or false: %w", err)
+		}
+	}
+
+	// optionally decrypt with no additional data at all, for legacy cyphertext that was encrypted without any
+	noAAD := false
+	noAADStr, ok := extractRequestOption(data.Raw, "NO_AAD")
+	if ok {
+		var err error
+		noAAD, err = strconv.ParseBool(noAADStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "NO_AAD must be true or false: %w", err)
+		}
+	}
+
+	// optional parts for fields with a composite additional data
+	aadParts, err := extractAADParts(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+	if noAAD && len(aadParts) > 0 {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "NO_AAD cannot be used with AAD_PARTS")
+	}
+
+	// optional previous additional data of each field, tried when the current additional data does not decrypt
+	candidateAADs, err := extractCandidateAADs(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+	if noAAD && len(candidateAADs) > 0 {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "NO_AAD cannot be used with CANDIDATE_AADS")
+	}
+
+	// internal or export keysets, and of which kind
+	mode, err := extractMode(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+	keyKind, err := extractKeyKind(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.decryptData(ctx, req, data, encoding, tryAllKeys, keyIDs, noAAD, aadParts, candidateAADs, mode, keyKind)
+}
+
+func (b *backend) pathAeadDecryptTyped(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// the caller supplied type of each field, fields without a type are returned as strings
+	types, err := extractFieldTypes(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.pathAeadDecrypt(ctx, req, data)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldErrs := []string{}
+	isBulk, _ := isBulkData(resp.Data)
+	if isBulk {
+		for rowKey, row := range resp.Data {
+			rowMap, ok := row.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, fieldErr := range coerceFieldTypes(rowMap, types) {
+				fieldErrs = append(fieldErrs, "row "+rowKey+" "+fieldErr)
+			}
+		}
+	} else {
+		fieldErrs = coerceFieldTypes(resp.Data, types)
+	}
+	if len(fieldErrs) > 0 {
+		sort.Strings(fieldErrs)
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "failed to convert decrypted data: %s", strings.Join(fieldErrs, ", "))
+	}
+
+	return resp, nil
+}
+
+const (
+	FIELD_TYPE_STRING = "string"
+	FIELD_TYPE_INT    = "int"
+	FIELD_TYPE_FLOAT  = "float"
+	FIELD_TYPE_BOOL   = "bool"
+)
+
+// extractFieldTypes removes the TYPES request option, a map of field name to type supplied as a map or a json string,
+// checking each type is one we can convert to
+func extractFieldTypes(data map[string]interface{}) (map[string]string, error) {
+	types := map[string]string{}
+	v, ok := data["TYPES"]
+	if !ok {
+		return types, nil
+	}
+	delete(data, "TYPES")
+
+	typesMap, ok := v.(map[string]interface{})
+	if !ok {
+		err := json.Unmarshal([]byte(fmt.Sprintf("%v", v)), &typesMap)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "TYPES must be a map of field name to type: %w", err)
+		}
+	}
+	for fieldName, fieldType := range typesMap {
+		typeStr := strings.ToLower(fmt.Sprintf("%v", fieldType))
+		switch typeStr {
+		case FIELD_TYPE_STRING, FIELD_TYPE_INT, FIELD_TYPE_FLOAT, FIELD_TYPE_BOOL:
+			types[fieldName] = typeStr
+		default:
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "unsupported type %s for field %s, expected string, int, float or bool", typeStr, fieldName)
+		}
+	}
+	return types, nil
+}
+
+// coerceFieldTypes converts the decrypted plaintext of each field in place to the type requested for it,
+// returning a description of each field that could not be converted
+func coerceFieldTypes(row map[string]interface{}, types map[string]string) []string {
+	fieldErrs := []string{}
+	for fieldName, fieldType := range types {
+		v, ok := row[fieldName]
+		if !ok {
+			continue
+		}
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			// a map or list encrypted as json is already restored
+			continue
+		}
+		plainText := fmt.Sprintf("%v", v)
+		var typed interface{}
+		var err error
+		switch fieldType {
+		case FIELD_TYPE_INT:
+			typed, err = strconv.ParseInt(plainText, 10, 64)
+		case FIELD_TYPE_FLOAT:
+			typed, err = strconv.ParseFloat(plainText, 64)
+		case FIELD_TYPE_BOOL:
+			typed, err = strconv.ParseBool(plainText)
+		default:
+			typed = plainText
+		}
+		if err != nil {
+			fieldErrs = append(fieldErrs, fmt.Sprintf("field %s is not a valid %s", fieldName, fieldType))
+			continue
+		}
+		row[fieldName] = typed
+	}
+	return fieldErrs
+}
+
+func (b *backend) decryptData(ctx context.Context, req *logical.Request, data *framework.FieldData, encoding string, tryAllKeys bool, keyIDs bool, noAAD bool, aadParts map[string]string, candidateAADs map[string][]string, mode string, keyKind string) (*logical.Response, error) {
+
+	// what is data.Raw
+	//
+	// is this a bulk file: ie a map of map[string]map[string]interface{} where the second map is the row to be decrypted
+	// {"0":{"bulkfield0":"fgbsrhbrgbr","bulkfield1":"sfgbsfbrnegnehtfngb","bulkfield2":"srbgwrgbwrgbwrg"},"1":{"bulkfield0":"srgbrgbewrgbg","bulkfield1":"egbetbgnetbn","bulkfield2":"sfbfbgwrbg"},"2":{"bulkfield0":"sfgbetbnet","bulkfield1":"sfgbetgbet","bulkfield2":"sfbegbet"}}
+	//
+	// or a single row of key value pairs to be encrypted map[string]interface{}
+	// {"bulkfield0":"fgbsrhbrgbr","bulkfield1":"sfgbsfbrnegnehtfngb","bulkfield2":"srbgwrgbwrgbwrg"}
+
+	if err := b.checkShape(ctx, req, data.Raw, "decrypt", false, false); err != nil {
+		return nil, err
+	}
+
+	// fire and forget the telemetry
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go b.publishTelemetry(&wg, ctx, req, "decrypt", data.Raw)
+
+	var respStruct = logical.Response{}
+	var resp = &respStruct
+
+	isBulk, _ := isBulkData(data.Raw)
+
+	if isBulk {
+
+		channelCap := len(data.Raw)
+		channel := make(chan map[string]interface{}, channelCap)
+
+		for rowKey, rowDataMap := range data.Raw {
+			rowDataMapAsMapStrInt, ok := rowDataMap.(map[string]interface{})
+			if !ok {
+				// checkShape has already rejected this, but don't panic if it is reached
+				wg.Wait()
+				return nil, codedErrorf(ERROR_INVALID_REQUEST, "row %s is not a map of fields", rowKey)
+			}
+			req.Data = rowDataMapAsMapStrInt
+
+			// prior to this there were race conditions as multiple goroutines access data
+			dn := framework.FieldData{
+				Raw:    rowDataMapAsMapStrInt,
+				Schema: nil,
+			}
+
+			// data.Raw = rowDataMapAsMapStrInt
+			go b.decryptRowChan(ctx, req, &dn, rowKey, encoding, tryAllKeys, keyIDs, noAAD, aadParts, candidateAADs, mode, keyKind, channel)
+		}
+
+		var rowErr error
+		resp.Data = make(map[string]interface{})
+		for i := 0; i < channelCap; i++ {
+			res := <-channel
+			for k, v := range res {
+				if err, ok := v.(error); ok {
+					rowErr = err
+					continue
+				}
+				// this should be a map of 1 row of rownumber index as string and the map of values
+				resp.Data[k] = v
+			}
+		}
+		if rowErr != nil {
+			wg.Wait()
+			return nil, rowErr
+		}
+
+	} else {
+		localResp, err := b.decryptRow(ctx, req, data, encoding, tryAllKeys, keyIDs, noAAD, aadParts, candidateAADs, mode, keyKind)
+		if err != nil {
+			wg.Wait()
+			return nil, err
+		}
+		resp = localResp
+	}
+	if keyIDs {
+		resp.Data["KEY_ID_COUNTS"] = keyIDCounts(resp.Data, isBulk, mode, keyKind)
+	}
+	wg.Wait()
+	return resp, nil
+}
+
+// keyIDCounts is the number of values of a decrypt response each key decrypted, by key name and key id, from the
+// KEY_IDS of each row
+func keyIDCounts(data map[string]interface{}, isBulk bool, mode string, keyKind string) map[string]interface{} {
+	rows := []interface{}{data}
+	if isBulk {
+		rows = []interface{}{}
+		for _, row := range data {
+			rows = append(rows, row)
+		}
+	}
+	counts := make(map[string]interface{})
+	for _, row := range rows {
+		rowMap, ok := row.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rowKeyIDs, ok := rowMap["KEY_IDS"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for fieldName, keyID := range rowKeyIDs {
+			_, keyName, ok, _ := modeEncryptionKey(fieldName, mode, keyKind)
+			if !ok {
+				continue
+			}
+			keyCounts, ok := counts[keyName].(map[string]int)
+			if !ok {
+				keyCounts = make(map[string]int)
+				counts[keyName] = keyCounts
+			}
+			keyCounts[fmt.Sprintf("%v", keyID)]++
+		}
+	}
+	return counts
+}
+
+func (b *backend) decryptRow(ctx context.Context, req *logical.Request, data *framework.FieldData, encoding string, tryAllKeys bool, keyIDs bool, noAAD bool, aadParts map[string]string, candidateAADs map[string][]string, mode string, keyKind string) (*logical.Response, error) {
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make(map[string]interface{})
+	channel := make(chan map[string]interface{}, len(data.Raw))
+
+	// iterate through the key=value supplied (ie field1=sdfvbbvwrbwr field2=advwefvwfvbwrfvb)
+	for field, encryptedDataBase64 := range data.Raw {
+		// doDecryption(field, encryptedDataBase64, resp)
+		go b.doDecryptionChan(field, encryptedDataBase64, encoding, tryAllKeys, keyIDs, noAAD, aadParts, candidateAADs, mode, keyKind, channel)
+	}
+
+	var fieldErr error
+	fallbackKeys := make(map[string]interface{})
+	decryptKeys := make(map[string]interface{})
+	for i := 0; i < len(data.Raw); i++ {
+		res := <-channel
+		// this is only 1 key=value pair, but we don't know the key or the value so we iterate over a range of 1 pair
+		for k, v := range res {
+			if err, ok := v.(error); ok {
+				fieldErr = err
+				continue
+			}
+			if result, ok := v.(keyIDResult); ok {
+				if result.fellBack {
+					fallbackKeys[k] = result.keyID
+				}
+				decryptKeys[k] = result.keyID
+				v = result.plainText
+			}
+			resp[k] = v
+		}
+	}
+	if fieldErr != nil {
+		return nil, fieldErr
+	}
+	if tryAllKeys {
+		resp["TRY_ALL_KEYS"] = fallbackKeys
+	}
+	if keyIDs {
+		resp["KEY_IDS"] = decryptKeys
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+func (b *backend) doDecryptionChan(fieldName string, encryptedDataBase64 interface{}, encoding string, tryAllKeys bool, keyIDs bool, noAAD bool, aadParts map[string]string, candidateAADs map[string][]string, mode string, keyKind string, ch chan map[string]interface{}) {
+	resp := make(map[string]interface{})
+	encryptionkey, keyName, ok, err := modeEncryptionKey(fieldName, mode, keyKind)
+	if err != nil {
+		resp[fieldName] = err
+		ch <- resp
+		return
+	}
+	// do we have a key already in config
+	if ok {
+		// is the key deterministig or non deterministic
+		encryptionKeyStr, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionkey)
+
+		// set additionalDataBytes as field name of the right type, or none at all with NO_AAD
+		var additionalDataBytes []byte
+		if !noAAD {
+			additionalDataBytes, err = b.getCompositeAdditionalData(fieldName, aadParts)
+			if err != nil {
+				resp[fieldName] = err
+				ch <- resp
+				return
+			}
+		}
+
+		// tagged cyphertext is decoded as its version tag says, otherwise as the request or the field says
+		if encoding == ENCODING_FIELD {
+			encoding, err = fieldEncoding(fieldName)
+			if err != nil {
+				resp[fieldName] = err
+				ch <- resp
+				return
+			}
+		}
+		cipherText := fmt.Sprintf("%v", encryptedDataBase64)
+		cipherText, encoding, err = stripVersionTag(fieldName, cipherText, encoding)
+		if err != nil {
+			resp[fieldName] = err
+			ch <- resp
+			return
+		}
+
+		// a repeat of cyphertext already decrypted with this keyset, if the field has a decrypt cache
+		// the cache does not know which key decrypted the cyphertext, so KEY_IDS always decrypts
+		cache := getDecryptCache(fieldName, encryptionKeyStr)
+		if cache != nil && !keyIDs {
+			if plainText, ok := cache.get(encoding, additionalDataBytes, cipherText); ok {
+				resp[fieldName], err = plaintextValue([]byte(plainText))
+				if err != nil {
+					resp[fieldName] = codedErrorf(ERROR_DECRYPT_FAILED, "failed to restore the json of field %s: %w", fieldName, err)
+				}
+				ch <- resp
+				return
+			}
+		}
+
+		decrypt := keysetDecrypter(encryptionKeyStr, deterministic)
+
+		// set the encrypted data to be the right type, for auto there may be more than 1 candidate
+		var plainText []byte
+		// the cyphertext that decrypted and its additional data, for KEY_IDS
+		var decryptedBytes, decryptedAAD []byte
+		err = fmt.Errorf("failed to decode the cyphertext as %s", encoding)
+		for _, encryptedDataBytes := range decodeCiphertext(cipherText, encoding) {
+			// decrypt it
+			plainText, err = decrypt(encryptedDataBytes, additionalDataBytes)
+			if err == nil {
+				decryptedBytes, decryptedAAD = encryptedDataBytes, additionalDataBytes
+				break
+			}
+		}
+		decrypted := err == nil
+
+		// cyphertext from before the additional data of the field changed, with the previous additional data in the
+		// request CANDIDATE_AADS or the config AAD_HISTORY_<field>. It is not cached as it is not the current AD
+		if err != nil && !noAAD {
+			candidates, candidateErr := b.candidateAdditionalData(fieldName, candidateAADs)
+			if candidateErr != nil {
+				resp[fieldName] = candidateErr
+				ch <- resp
+				return
+			}
+		candidateLoop:
+			for _, candidate := range candidates {
+				for _, encryptedDataBytes := range decodeCiphertext(cipherText, encoding) {
+					if candidatePlainText, candidateErr := decrypt(encryptedDataBytes, candidate); candidateErr == nil {
+						plainText, err = candidatePlainText, nil
+						decryptedBytes, decryptedAAD = encryptedDataBytes, candidate
+						break candidateLoop
+					}
+				}
+			}
+		}
+
+		// a field whose key family has a deterministic and a non deterministic keyset (see pairedKeyName) has cyphertext
+		// of either, so what its own keyset cannot decrypt is tried with the other one. det and nondet only use their own
+		if err != nil && mode == MODE_INTERNAL && keyKind == "" {
+			if pairedStr, _, ok := pairedKeyset(keyName); ok {
+				_, pairedDeterministic := aeadutils.IsKeyJsonDeterministic(pairedStr)
+				pairedDecrypt := keysetDecrypter(pairedStr, pairedDeterministic)
+				for _, encryptedDataBytes := range decodeCiphertext(cipherText, encoding) {
+					if pairedPlainText, pairedErr := pairedDecrypt(encryptedDataBytes, additionalDataBytes); pairedErr == nil {
+						plainText, err = pairedPlainText, nil
+						decryptedBytes, decryptedAAD = encryptedDataBytes, additionalDataBytes
+						encryptionKeyStr = pairedStr
+						break
+					}
+				}
+			}
+		}
+
+		// with TRY_ALL_KEYS each enabled key is tried on its own, and as a RAW key, as the key id prefix may not match
+		fellBack := false
+		fallbackKeyID := 0
+		if err != nil && tryAllKeys {
+			for _, encryptedDataBytes := range decodeCiphertext(cipherText, encoding) {
+				var fallbackErr error
+				plainText, fallbackKeyID, fallbackErr = aeadutils.DecryptTryAllKeys(encryptionKeyStr, encryptedDataBytes, additionalDataBytes)
+				if fallbackErr == nil {
+					err = nil
+					fellBack = true
+					break
+				}
+			}
+		}
+		if err != nil {
+			hclog.L().Error("Failed to decrypt ", err)
+		}
+		if encoding == ENCODING_AUTO && err != nil {
+			resp[fieldName] = codedErrorf(ERROR_DECRYPT_FAILED, "failed to decrypt field %s as either base64 or hex cyphertext", fieldName)
+			ch <- resp
+			return
+		}
+		if encoding == ENCODING_BQ && err != nil {
+			resp[fieldName] = codedErrorf(ERROR_DECRYPT_FAILED, "failed to decrypt field %s as any of the BigQuery BYTES formats", fieldName)
+			ch <- resp
+			return
+		}
+
+		plainText, err = decompressPlaintext(plainText, fieldCompressed(fieldName))
+		if err != nil {
+			resp[fieldName] = codedErrorf(ERROR_DECRYPT_FAILED, "failed to decompress field %s: %w", fieldName, err)
+			ch <- resp
+			return
+		}
+
+		// only cyphertext that decrypted is cached
+		if cache != nil && decrypted {
+			cache.add(encoding, additionalDataBytes, cipherText, string(plainText))
+		}
+
+		// a map or list encrypted as json is restored
+		value, err := plaintextValue(plainText)
+		if err != nil {
+			resp[fieldName] = codedErrorf(ERROR_DECRYPT_FAILED, "failed to restore the json of field %s: %w", fieldName, err)
+			ch <- resp
+			return
+		}
+		resp[fieldName] = value
+		if fellBack {
+			resp[fieldName] = keyIDResult{plainText: value, keyID: fallbackKeyID, fellBack: true}
+		} else if keyIDs && decryptedBytes != nil {
+			keyID, err := aeadutils.CiphertextKeyID(encryptionKeyStr, decryptedBytes, decryptedAAD)
+			if err != nil {
+				resp[fieldName] = codedErrorf(ERROR_DECRYPT_FAILED, "failed to find the key id of field %s: %w", fieldName, err)
+				ch <- resp
+				return
+			}
+			resp[fieldName] = keyIDResult{plainText: value, keyID: keyID}
+		}
+	} else {
+		// we didn't find a key - return original data
+		// hclog.L().Info("did not find a key for field " + fieldName)
+		resp[fieldName] = fmt.Sprintf("%s", encryptedDataBase64)
+	}
+	ch <- resp
+}
+
+// keysetDecrypter returns the decrypt of the keyset, deterministic or not
+func keysetDecrypter(encryptionKeyStr string, deterministic bool) func(encryptedDataBytes []byte, aad []byte) ([]byte, error) {
+	if deterministic {
+		// SUPPORT FOR DETERMINISTIC AEAD
+		// we don't need the key handle which is returned first
+		_, tinkDetAead, err := aeadutils.CreateInsecureHandleAndDeterministicAead(encryptionKeyStr)
+		if err != nil {
+			hclog.L().Error("Failed to create a  key handle", err)
+		}
+		return func(encryptedDataBytes []byte, aad []byte) ([]byte, error) {
+			return tinkDetAead.DecryptDeterministically(encryptedDataBytes, aad)
+		}
+	}
+	// SUPPORT FOR NON DETERMINISTIC AEAD
+	_, tinkAead, err := aeadutils.CreateInsecureHandleAndAead(encryptionKeyStr)
+	if err != nil {
+		hclog.L().Error("Failed to create tinkAead", err)
+	}
+	return func(encryptedDataBytes []byte, aad []byte) ([]byte, error) {
+		return tinkAead.Decrypt(encryptedDataBytes, aad)
+	}
+}
+
+// keyIDResult is the plaintext of a field with the id of the key that decrypted it, for KEY_IDS or when it only
+// decrypted with TRY_ALL_KEYS
+type keyIDResult struct {
+	plainText interface{}
+	keyID     int
+	fellBack  bool
+}
+
+const (
+	ENCODING_BASE64    = "base64"
+	ENCODING_BASE64URL = "base64url"
+	ENCODING_HEX       = "hex"
+	ENCODING_AUTO      = "auto"
+	ENCODING_BQ        = "bq"
+	// ENCODING_BQBYTES is the escaped bytestring bqutils embeds the wrapped keysets in the routines as, ie \x00\x01\xad
+	ENCODING_BQBYTES = "bqbytes"
+	// ENCODING_FIELD is the ENCODING_<field> of each field, for a decrypt request without an ENCODING
+	ENCODING_FIELD = ""
+)
+
+// fieldEncoding is the ENCODING_<field> of the field in the config, base64 (the default), base64url, hex or bqbytes,
+// that encrypt writes the cyphertext of the field in and decrypt reads it in unless the request has an ENCODING
+func fieldEncoding(fieldName string) (string, error) {
+	encodingIntf, ok := AEAD_CONFIG.Get("ENCODING_" + fieldName)
+	if !ok {
+		return ENCODING_BASE64, nil
+	}
+	encoding := strings.ToLower(fmt.Sprintf("%v", encodingIntf))
+	if encoding != ENCODING_BASE64 && encoding != ENCODING_BASE64URL && encoding != ENCODING_HEX && encoding != ENCODING_BQBYTES {
+		return "", codedErrorf(ERROR_INVALID_REQUEST, "ENCODING_%s must be base64, base64url, hex or bqbytes, got %s", fieldName, encoding)
+	}
+	return encoding, nil
+}
+
+// encodeCiphertext encodes the cyphertext of the field in the encoding, or its ENCODING_<field> for ENCODING_FIELD,
+// behind a version tag if the field has VERSION_TAG_
+func encodeCiphertext(fieldName string, encoding string, cypherText []byte) (string, error) {
+	if encoding == ENCODING_FIELD {
+		var err error
+		encoding, err = fieldEncoding(fieldName)
+		if err != nil {
+			return "", err
+		}
+	}
+	var encoded string
+	switch encoding {
+	case ENCODING_HEX:
+		encoded = hex.EncodeToString(cypherText)
+	case ENCODING_BQBYTES:
+		encoded = bqutils.EscapeBytes(cypherText)
+	case ENCODING_BASE64URL:
+		encoded = b64.RawURLEncoding.EncodeToString(cypherText)
+	default:
+		encoded = b64.StdEncoding.EncodeToString(cypherText)
+	}
+	return versionTagged(fieldName, encoding, encoded), nil
+}
+
+// decodeBase64URL decodes url safe base64, without the padding as it is written or with it
+func decodeBase64URL(cipherText string) ([]byte, error) {
+	return b64.RawURLEncoding.DecodeString(strings.TrimRight(cipherText, "="))
+}
+
+// decodeBQBytes decodes the escaped bytestring of ENCODING_BQBYTES, every byte a \x and two hex digits
+func decodeBQBytes(cipherText string) ([]byte, error) {
+	if len(cipherText)%4 != 0 {
+		return nil, fmt.Errorf("not an escaped bytestring")
+	}
+	decoded := make([]byte, 0, len(cipherText)/4)
+	for i := 0; i < len(cipherText); i += 4 {
+		if cipherText[i] != '\\' || (cipherText[i+1] != 'x' && cipherText[i+1] != 'X') {
+			return nil, fmt.Errorf("not an escaped bytestring")
+		}
+		v, err := strconv.ParseUint(cipherText[i+2:i+4], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex escape in bytestring")
+		}
+		decoded = append(decoded, byte(v))
+	}
+	return decoded, nil
+}
+
+// decodeCiphertext returns the decoded cyphertext for the encoding. For auto it returns each decoding that
+// succeeds, base64 first then url safe base64 then hex then bqbytes, as a hex string can also be valid base64 and only
+// decryption can tell them apart
+func decodeCiphertext(cipherText string, encoding string) [][]byte {
+	candidates := [][]byte{}
+	if encoding == ENCODING_BASE64 || encoding == ENCODING_AUTO {
+		decoded, err := b64.StdEncoding.DecodeString(cipherText)
+		if err == nil || encoding == ENCODING_BASE64 {
+			candidates = append(candidates, decoded)
+		}
+	}
+	if encoding == ENCODING_BASE64URL || encoding == ENCODING_AUTO {
+		decoded, err := decodeBase64URL(cipherText)
+		if err == nil || encoding == ENCODING_BASE64URL {
+			candidates = append(candidates, decoded)
+		}
+	}
+	if encoding == ENCODING_HEX || encoding == ENCODING_AUTO {
+		decoded, err := hex.DecodeString(cipherText)
+		if err == nil || encoding == ENCODING_HEX {
+			candidates = append(candidates, decoded)
+		}
+	}
+	if encoding == ENCODING_BQBYTES || encoding == ENCODING_AUTO {
+		decoded, err := decodeBQBytes(cipherText)
+		if err == nil || encoding == ENCODING_BQBYTES {
+			candidates = append(candidates, decoded)
+		}
+	}
+	if encoding == ENCODING_BQ {
+		candidates = append(candidates, decodeBQCiphertext(cipherText)...)
+	}
+	return candidates
+}
+
+// decodeBQCiphertext returns each decoding that succeeds of the ways BQ BYTES are exported or cast to strings:
+// a bytes literal (FORMAT("%T")), base64 (TO_BASE64, json and csv exports) with or without padding, url safe
+// base64 (some clients) and hex (TO_HEX)
+func decodeBQCiphertext(cipherText string) [][]byte {
+	candidates := [][]byte{}
+	cipherText = strings.TrimSpace(cipherText)
+	if decoded, err := decodeBQBytesLiteral(cipherText); err == nil {
+		candidates = append(candidates, decoded)
+	}
+	if decoded, err := decodeBQBytes(cipherText); err == nil {
+		candidates = append(candidates, decoded)
+	}
+	for _, encoding := range []*b64.Encoding{b64.StdEncoding, b64.RawStdEncoding, b64.URLEncoding, b64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(cipherText); err == nil {
+			candidates = append(candidates, decoded)
+		}
+	}
+	if decoded, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(cipherText), "0x")); err == nil {
+		candidates = append(candidates, decoded)
+	}
+	return candidates
+}
+
+// the single character escapes of a BQ bytes literal
+var bqBytesEscapes = map[byte]byte{'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v',
+	'\\': '\\', '?': '?', '"': '"', '\'': '\'', '`': '`'}
+
+// decodeBQBytesLiteral decodes a BQ bytes literal, ie b"\x01\xadAB", as FORMAT("%T") writes them
+func decodeBQBytesLiteral(literal string) ([]byte, error) {
+	if len(literal) < 3 || (literal[0] != 'b' && literal[0] != 'B') {
+		return nil, fmt.Errorf("not a bytes literal")
+	}
+	quote := literal[1]
+	if (quote != '"' && quote != '\'') || literal[len(literal)-1] != quote {
+		return nil, fmt.Errorf("not a bytes literal")
+	}
+	body := literal[2 : len(literal)-1]
+
+	decoded := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			decoded = append(decoded, body[i])
+			continue
+		}
+		i++
+		if i >= len(body) {
+			return nil, fmt.Errorf("bytes literal ends with an escape")
+		}
+		switch {
+		case body[i] == 'x' || body[i] == 'X':
+			if i+3 > len(body) {
+				return nil, fmt.Errorf("short hex escape in bytes literal")
+			}
+			v, err := strconv.ParseUint(body[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex escape in bytes literal")
+			}
+			decoded = append(decoded, byte(v))
+			i += 2
+		case body[i] >= '0' && body[i] <= '7':
+			if i+3 > len(body) {
+				return nil, fmt.Errorf("short octal escape in bytes literal")
+			}
+			v, err := strconv.ParseUint(body[i:i+3], 8, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid octal escape in bytes literal")
+			}
+			decoded = append(decoded, byte(v))
+			i += 2
+		default:
+			c, ok := bqBytesEscapes[body[i]]
+			if !ok {
+				return nil, fmt.Errorf("invalid escape in bytes literal")
+			}
+			decoded = append(decoded, c)
+		}
+	}
+	return decoded, nil
+}
+
+func (b *backend) pathAeadVerifyDecrypt(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make(map[string]interface{})
+
+	// iterate through the key=value supplied (ie field1=sdfvbbvwrbwr field2=advwefvwfvbwrfvb)
+	// the plaintext is never returned, only whether it decrypted and which key id did it
+	for fieldName, encryptedDataBase64 := range data.Raw {
+		result := map[string]interface{}{
+			"verified": false,
+		}
+		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+		if ok {
+			additionalDataBytes, aadErr := b.getAdditionalData(fieldName, AEAD_CONFIG)
+			encryptedDataBytes, err := decodeTaggedCiphertext(fieldName, fmt.Sprintf("%v", encryptedDataBase64), ENCODING_FIELD)
+			if aadErr != nil {
+				hclog.L().Error(aadErr.Error())
+			} else if err != nil {
+				hclog.L().Error("Failed to decode " + fieldName)
+			} else {
+				_, keyID, err := aeadutils.DecryptWithKeyID(fmt.Sprintf("%v", encryptionkey), encryptedDataBytes, additionalDataBytes)
+				if err != nil {
+					hclog.L().Info("Failed to verify " + fieldName)
+				} else {
+					result["verified"] = true
+					result["keyId"] = keyID
+				}
+			}
+		}
+		resp[fieldName] = result
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// selfTestCanary is the value pathSelfTest encrypts and decrypts back
+const selfTestCanary = "vault-plugin-aead selftest canary"
+
+// pathSelfTest is a canary for monitoring, for each field in the request (the values are ignored) it encrypts a known
+// value with the field's key and Additional Data and decrypts it back. Only whether the roundtrip passed and how long
+// each half took are returned, the canary is never stored, returned or sent to telemetry and takes no rate limit
+func (b *backend) pathSelfTest(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make(map[string]interface{})
+	for fieldName := range data.Raw {
+		result := map[string]interface{}{
+			"PASSED": false,
+		}
+		resp[fieldName] = result
+		if _, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG); !ok {
+			hclog.L().Info("selftest of " + fieldName + " failed, it has no key")
+			continue
+		}
+
+		start := time.Now()
+		encrypted, err := b.encryptRow(ctx, req, &framework.FieldData{Raw: map[string]interface{}{fieldName: selfTestCanary}}, false, false, ENCODING_FIELD, nil, MODE_INTERNAL, "")
+		result["ENCRYPT_MS"] = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			hclog.L().Info("selftest of " + fieldName + " failed to encrypt: " + err.Error())
+			continue
+		}
+
+		start = time.Now()
+		decrypted, err := b.decryptRow(ctx, req, &framework.FieldData{Raw: encrypted.Data}, ENCODING_FIELD, false, false, false, nil, nil, MODE_INTERNAL, "")
+		result["DECRYPT_MS"] = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			hclog.L().Info("selftest of " + fieldName + " failed to decrypt: " + err.Error())
+			continue
+		}
+		if decrypted.Data[fieldName] != selfTestCanary {
+			hclog.L().Info("selftest of " + fieldName + " failed, the canary did not decrypt back to itself")
+			continue
+		}
+		result["PASSED"] = true
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// pathDecryptWithKey decrypts cyphertext with a keyset supplied in the request, ie a superseded keyset held in an archive.
+// The stored config is only read for ALLOW_RAW_KEYS, nothing is written. As it accepts raw key material it is refused
+// unless ALLOW_RAW_KEYS is true in the config
+func (b *backend) pathDecryptWithKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	allowIntf, ok := AEAD_CONFIG.Get("ALLOW_RAW_KEYS")
+	if !ok {
+		return nil, fmt.Errorf("decryptWithKey is disabled, set ALLOW_RAW_KEYS to true in the config to allow it")
+	}
+	allow, err := strconv.ParseBool(fmt.Sprintf("%v", allowIntf))
+	if err != nil || !allow {
+		return nil, fmt.Errorf("decryptWithKey is disabled, set ALLOW_RAW_KEYS to true in the config to allow it")
+	}
+
+	keySetIntf, ok := data.Raw["KEYSET"]
+	if !ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "KEYSET is required")
+	}
+	delete(data.Raw, "KEYSET")
+	cipherTextBase64, ok := extractRequestOption(data.Raw, "CIPHERTEXT")
+	if !ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "CIPHERTEXT is required")
+	}
+	additionalData, _ := extractRequestOption(data.Raw, "ADDITIONAL_DATA")
+	additionalDataBytes := []byte(additionalData)
+	// COMPRESS=true when the cyphertext is of a field with COMPRESS_ set
+	compressed := false
+	if compressStr, ok := extractRequestOption(data.Raw, "COMPRESS"); ok {
+		compressed, err = strconv.ParseBool(compressStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "COMPRESS must be true or false")
+		}
+	}
+	if isB64Str, ok := extractRequestOption(data.Raw, "AAD_IS_B64"); ok {
+		isB64, err := strconv.ParseBool(isB64Str)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "AAD_IS_B64 must be true or false")
+		}
+		if isB64 {
+			additionalDataBytes, err = b64.StdEncoding.DecodeString(additionalData)
+			if err != nil {
+				return nil, codedErrorf(ERROR_INVALID_REQUEST, "ADDITIONAL_DATA is not valid base64 as AAD_IS_B64 is set")
+			}
+		}
+	}
+
+	// the errors below do not wrap the underlying error as it can quote the keyset
+	keySetJson, err := templateJsonFromValue(keySetIntf)
+	if err != nil {
+		return nil, codedErrorf(ERROR_INVALID_KEYSET, "KEYSET is not a valid keyset")
+	}
+	if _, err := aeadutils.ParseKeySetJson(keySetJson); err != nil {
+		return nil, codedErrorf(ERROR_INVALID_KEYSET, "KEYSET is not a valid keyset")
+	}
+	cipherText, err := b64.StdEncoding.DecodeString(cipherTextBase64)
+	if err != nil {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "CIPHERTEXT is not valid base64")
+	}
+
+	plainText, keyID, err := aeadutils.DecryptWithKeyID(keySetJson, cipherText, additionalDataBytes)
+	if err != nil {
+		return nil, codedErrorf(ERROR_DECRYPT_FAILED, "failed to decrypt CIPHERTEXT with KEYSET")
+	}
+	plainText, err = decompressPlaintext(plainText, compressed)
+	if err != nil {
+		return nil, codedErrorf(ERROR_DECRYPT_FAILED, "failed to decompress the plaintext: %w", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"plaintext": string(jsonText(plainText)),
+			"key_id":    keyID,
+		},
+	}, nil
+}
+
+// pathIndexToken returns an index token for each field in the request, ie {"fieldname":"plaintext"}, the HMAC of the
+// plaintext under the index key of the field. Equal plaintexts give equal tokens even if the field is encrypted non
+// deterministically, so a token stored beside the cyphertext can be searched on (a blind index). Each field needs an
+// index key, see createIndexKey
+func (b *backend) pathIndexToken(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make(map[string]interface{}, len(data.Raw))
+	for fieldName, v := range data.Raw {
+		key, ok := AEAD_CONFIG.Get(INDEX_KEY_PREFIX + fieldName)
+		if !ok {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s has no index key", fieldName)
+		}
+		token, err := aeadutils.IndexToken(fmt.Sprintf("%v", key), []byte(fmt.Sprintf("%v", v)))
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "the index key of %s is not valid: %w", fieldName, err)
+		}
+		resp[fieldName] = token
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// pathDerive returns LENGTH bytes (default 32) of the PRF of INPUT under the PRF keyset KEY, ie a sub-key for a tenant
+// derived from a master key. The same KEY and INPUT always give the same output, as base64, until the keyset is
+// replaced. See createPRFkey
+func (b *backend) pathDerive(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := extractRequestOption(data.Raw, "KEY")
+	if !ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "KEY is required")
+	}
+	input, ok := extractRequestOption(data.Raw, "INPUT")
+	if !ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "INPUT is required")
+	}
+	length := 32
+	if lengthStr, ok := extractRequestOption(data.Raw, "LENGTH"); ok {
+		length, err = strconv.Atoi(lengthStr)
+		if err != nil || length < 1 {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "LENGTH must be a positive number of bytes")
+		}
+	}
 
-	} else {
-		localResp, err := b.decryptRow(ctx, req, data)
-		if err != nil {
-			panic(err)
-		}
-		resp = localResp
+	keyName := aeadutils.PRFKeyPrefix + strings.TrimPrefix(name, aeadutils.PRFKeyPrefix)
+	keySet, ok := AEAD_CONFIG.Get(keyName)
+	if !ok {
+		return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s has no PRF keyset", name)
 	}
-	wg.Wait()
-	return resp, nil
+	output, keyID, err := aeadutils.ComputePRF(fmt.Sprintf("%v", keySet), []byte(input), length)
+	if err != nil {
+		// the error does not quote the keyset
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "failed to derive %d bytes with %s: %v", length, keyName, err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"output": b64.StdEncoding.EncodeToString(output),
+			"key_id": keyID,
+		},
+	}, nil
 }
 
-func (b *backend) decryptRow(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+func (b *backend) pathAeadRekeyData(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	resp := make(map[string]interface{})
-	channel := make(chan map[string]interface{}, len(data.Raw))
-
-	// iterate through the key=value supplied (ie field1=sdfvbbvwrbwr field2=advwefvwfvbwrfvb)
-	for field, encryptedDataBase64 := range data.Raw {
-		// doDecryption(field, encryptedDataBase64, resp)
-		go b.doDecryptionChan(field, encryptedDataBase64, channel)
-	}
-
-	for i := 0; i < len(data.Raw); i++ {
-		res := <-channel
-		// this is only 1 key=value pair, but we don't know the key or the value so we iterate over a range of 1 pair
-		for k, v := range res {
-			resp[k] = v
-		}
+	resp, err := b.rekeyRows(ctx, req, data.Raw, func(keyName string, kh *keyset.Handle) (*keyset.Handle, error) {
+		aeadutils.RotateKeys(kh, aeadutils.IsKeyHandleDeterministic(kh))
+		return kh, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &logical.Response{
@@ -313,60 +1670,167 @@ func (b *backend) decryptRow(ctx context.Context, req *logical.Request, data *fr
 	}, nil
 }
 
-func (b *backend) doDecryptionChan(fieldName string, encryptedDataBase64 interface{}, ch chan map[string]interface{}) {
-	resp := make(map[string]interface{})
-	encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
-	// do we have a key already in config
-	if ok {
-		// is the key deterministig or non deterministic
-		encryptionKeyStr, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionkey)
+// rekeyRows decrypts the cyphertext in raw, a single row or bulk rows, with the current keysets, changes each keyset
+// once with roll, saves it and re-encrypts the rows with it. Nothing is saved if any value fails to decrypt or any
+// keyset fails to roll
+func (b *backend) rekeyRows(ctx context.Context, req *logical.Request, raw map[string]interface{}, roll func(keyName string, kh *keyset.Handle) (*keyset.Handle, error)) (map[string]interface{}, error) {
 
-		// set additionalDataBytes as field name of the right type
-		additionalDataBytes := b.getAdditionalData(fieldName, AEAD_CONFIG)
+	// raw is either a single row {"field0":"cyphertext"} or bulk rows {"0":{"field0":"cyphertext"}}
+	// hold both as a map of rows, a single row has no row key
+	rows := make(map[string]map[string]interface{})
+	isBulk, _ := isBulkData(raw)
+	if isBulk {
+		for rowKey, rowData := range raw {
+			rowDataMap, ok := rowData.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expecting a map for row %s", rowKey)
+			}
+			rows[rowKey] = rowDataMap
+		}
+	} else {
+		rows[""] = raw
+	}
 
-		if deterministic {
-			// SUPPORT FOR DETERMINISTIC AEAD
-			// we don't need the key handle which is returned first
-			_, tinkDetAead, err := aeadutils.CreateInsecureHandleAndDeterministicAead(encryptionKeyStr)
+	// the values are re-encrypted, so the fields with a RATE_LIMIT_ take a token for each of them as in /encrypt
+	if err := takeRateLimits(fieldValueCounts(raw, isBulk)); err != nil {
+		return nil, err
+	}
+
+	// 1. decrypt everything with the current keysets, so nothing is rotated if any value fails
+	keyHandles := make(map[string]*keyset.Handle)
+	plainTexts := make(map[string]map[string][]byte)
+	for rowKey, row := range rows {
+		plainTexts[rowKey] = make(map[string][]byte)
+		for fieldName, encryptedDataBase64 := range row {
+			keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+			if !ok {
+				// we didn't find a key - the original data is returned
+				continue
+			}
+			kh, ok := keyHandles[keyName]
+			if !ok {
+				var err error
+				encryptionKey, _ := AEAD_CONFIG.Get(keyName)
+				kh, err = aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
+				if err != nil {
+					return nil, fmt.Errorf("failed to read the keyset for %s: %w", fieldName, err)
+				}
+				keyHandles[keyName] = kh
+			}
+
+			encryptedDataBytes, err := decodeTaggedCiphertext(fieldName, fmt.Sprintf("%v", encryptedDataBase64), ENCODING_FIELD)
 			if err != nil {
-				hclog.L().Error("Failed to create a  key handle", err)
+				return nil, fmt.Errorf("failed to decode %s: %w", fieldName, err)
 			}
+			additionalDataBytes, err := b.getAdditionalData(fieldName, AEAD_CONFIG)
+			if err != nil {
+				return nil, err
+			}
+			plainText, err := aeadutils.DecryptWithKeyHandle(kh, encryptedDataBytes, additionalDataBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s: %w", fieldName, err)
+			}
+			plainTexts[rowKey][fieldName] = plainText
+		}
+	}
 
-			// set the unencrypted data to be the right type
-			encryptedDataBytes, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", encryptedDataBase64))
+	// 2. roll each keyset once, even if it is shared by a key family, and only save them once they have all rolled
+	for keyName, kh := range keyHandles {
+		rolledKh, err := roll(keyName, kh)
+		if err != nil {
+			return nil, err
+		}
+		keyHandles[keyName] = rolledKh
+	}
+	for keyName, kh := range keyHandles {
+		b.saveKeyToConfig(kh, keyName, ctx, req, true)
+	}
 
-			// decrypt it
-			plainText, err := tinkDetAead.DecryptDeterministically(encryptedDataBytes, additionalDataBytes)
+	// 3. re-encrypt with the new primary keys
+	resp := make(map[string]interface{})
+	for rowKey, row := range rows {
+		rowResp := make(map[string]interface{})
+		for fieldName, encryptedDataBase64 := range row {
+			plainText, ok := plainTexts[rowKey][fieldName]
+			if !ok {
+				rowResp[fieldName] = fmt.Sprintf("%s", encryptedDataBase64)
+				continue
+			}
+			keyName, _ := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+			additionalDataBytes, err := b.getAdditionalData(fieldName, AEAD_CONFIG)
 			if err != nil {
-				hclog.L().Error("Failed to decrypt ", err)
+				return nil, err
 			}
-
-			resp[fieldName] = string(plainText)
-		} else {
-			// SUPPORT FOR NON DETERMINISTIC AEAD
-			_, tinkAead, err := aeadutils.CreateInsecureHandleAndAead(encryptionKeyStr)
+			cypherText, err := aeadutils.EncryptWithKeyHandle(keyHandles[keyName], plainText, additionalDataBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to re-encrypt %s: %w", fieldName, err)
+			}
+			rowResp[fieldName], err = encodeCiphertext(fieldName, ENCODING_FIELD, cypherText)
 			if err != nil {
-				hclog.L().Error("Failed to create tinkAead", err)
+				return nil, err
 			}
+		}
+		if isBulk {
+			resp[rowKey] = rowResp
+		} else {
+			resp = rowResp
+		}
+	}
 
-			// set the unencrypted data to be the right type
+	return resp, nil
+}
 
-			encryptedDataBytes, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", encryptedDataBase64))
+// pathRollKey is rotate, rekeyData and purgeKeys in one request: the keyset of each field of the cyphertext supplied
+// is rotated, the cyphertext is re-encrypted with the new primary key and the DISABLED keys, and with
+// INCLUDE_DESTROYED the DESTROYED keys, are purged. The primary and the keys that decrypted the cyphertext are ENABLED
+// so are always kept. Nothing is saved if any value fails to decrypt. The response is the re-encrypted cyphertext and
+// ROLLED, the new primary key id and the number of keys purged of each keyset
+func (b *backend) pathRollKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
-			// encrypt it
-			plainText, err := tinkAead.Decrypt(encryptedDataBytes, additionalDataBytes)
-			if err != nil {
-				hclog.L().Error("Failed to decrypt ", err)
-			}
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
-			resp[fieldName] = string(plainText)
+	// optionally purge DESTROYED keys as well as DISABLED keys, as purgeKeys
+	includeDestroyed := false
+	includeDestroyedStr, ok := extractRequestOption(data.Raw, "INCLUDE_DESTROYED")
+	if ok {
+		includeDestroyed, err = strconv.ParseBool(includeDestroyedStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "INCLUDE_DESTROYED must be true or false: %w", err)
 		}
-	} else {
-		// we didn't find a key - return original data
-		// hclog.L().Info("did not find a key for field " + fieldName)
-		resp[fieldName] = fmt.Sprintf("%s", encryptedDataBase64)
 	}
-	ch <- resp
+	if len(data.Raw) == 0 {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "no cyphertext supplied to re-encrypt")
+	}
+
+	rolled := make(map[string]interface{})
+	resp, err := b.rekeyRows(ctx, req, data.Raw, func(keyName string, kh *keyset.Handle) (*keyset.Handle, error) {
+		primaryKeyId, err := aeadutils.RotateKeySet(kh, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rotate %s: %w", keyName, err)
+		}
+		purgedKh, purged, err := aeadutils.PurgeKeys(kh, includeDestroyed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to purge the keys of %s: %w", keyName, err)
+		}
+		rolled[keyName] = map[string]interface{}{
+			"PRIMARY_KEY_ID": primaryKeyId,
+			"PURGED":         purged,
+		}
+		aeadutils.AddKeySetEvent(trace.SpanFromContext(ctx), "rolled", keyName, purgedKh)
+		return purgedKh, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp["ROLLED"] = rolled
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
 }
 
 func (b *backend) pathAeadEncryptBulkCol(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -388,6 +1852,19 @@ func (b *backend) pathAeadEncryptBulkCol(ctx context.Context, req *logical.Reque
 
 	*/
 
+	if err := b.checkShape(ctx, req, data.Raw, "encryptcol", true, false); err != nil {
+		return nil, err
+	}
+
+	isBulk, _ := isBulkData(data.Raw)
+
+	// the fields with a RATE_LIMIT_ take a token for each of their values, as in /encrypt
+	if isBulk {
+		if err := takeRateLimits(fieldValueCounts(data.Raw, true)); err != nil {
+			return nil, err
+		}
+	}
+
 	// fire and forget the telemetry
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -396,8 +1873,6 @@ func (b *backend) pathAeadEncryptBulkCol(ctx context.Context, req *logical.Reque
 	var respStruct = logical.Response{}
 	var resp = &respStruct
 
-	isBulk, _ := isBulkData(data.Raw)
-
 	if isBulk {
 
 		// ok, 1st thing to do is to pivot the map
@@ -410,7 +1885,9 @@ func (b *backend) pathAeadEncryptBulkCol(ctx context.Context, req *logical.Reque
 		for fieldName, rowDataMap := range pivotedMap {
 			rowDataMapAsMapStrInt, ok := rowDataMap.(map[string]interface{})
 			if !ok {
-				panic("expecting a map pathAeadEncrypt")
+				// checkShape has already rejected this, but don't panic if it is reached
+				wg.Wait()
+				return nil, codedErrorf(ERROR_INVALID_REQUEST, "field %s is not a column of rows", fieldName)
 			}
 			req.Data = rowDataMapAsMapStrInt
 
@@ -427,13 +1904,22 @@ func (b *backend) pathAeadEncryptBulkCol(ctx context.Context, req *logical.Reque
 
 		resp.Data = make(map[string]interface{})
 		resultsMap := make(map[string]interface{})
+		var colErr error
 		for i := 0; i < channelCap; i++ {
 			res := <-channel
 			for k, v := range res {
+				if err, ok := v.(error); ok {
+					colErr = err
+					continue
+				}
 				// this should be a map of 1 row of rownumber index as string and the map of values
 				resultsMap[k] = v
 			}
 		}
+		if colErr != nil {
+			wg.Wait()
+			return nil, colErr
+		}
 
 		// unpivot the map
 		aeadutils.PivotMapInt(resultsMap, resp.Data)
@@ -451,12 +1937,15 @@ func (b *backend) pathAeadEncryptBulkCol(ctx context.Context, req *logical.Reque
 func (b *backend) encryptColChan(ctx context.Context, req *logical.Request, data *framework.FieldData, fieldName string, ch chan map[string]interface{}) {
 
 	// this is just a wrapper around the pathAeadEncryptRow methos so that it can be used concurrently in a channel
+	localResp := make(map[string]interface{})
 	resp, err := b.encryptCol(ctx, req, data, fieldName)
 	if err != nil {
-		panic(err)
+		// pass the error back to the caller rather than a column
+		localResp[fieldName] = err
+		ch <- localResp
+		return
 	}
 
-	localResp := make(map[string]interface{})
 	localResp[fieldName] = resp.Data
 
 	ch <- localResp
@@ -476,6 +1965,12 @@ func (b *backend) encryptCol(ctx context.Context, req *logical.Request, data *fr
 	encryptionkey, keyFound := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
 	// is the key we have retrived deterministic?
 	encryptionKeyStr, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionkey)
+	if keyFound {
+		keyName, _ := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		if err := checkFieldDeterminism(fieldName, keyName, deterministic); err != nil {
+			return nil, err
+		}
+	}
 
 	var tinkDetAead tink.DeterministicAEAD
 	var tinkAead tink.AEAD
@@ -501,19 +1996,33 @@ func (b *backend) encryptCol(ctx context.Context, req *logical.Request, data *fr
 		}
 	}
 	// set additionalDataBytes as field name of the right type
-	additionalDataBytes := b.getAdditionalData(fieldName, AEAD_CONFIG)
+	additionalDataBytes, err := b.getAdditionalData(fieldName, AEAD_CONFIG)
+	if err != nil {
+		return nil, err
+	}
 
 	// iterate through the key=value supplied (ie field1=myaddress field2=myphonenumber)
 	for rowNum, unencryptedData := range data.Raw {
 		// do we have a key already in config
 		if keyFound {
 
+			// set the unencrypted data to be the right type, compressed if the field is configured for it
+			plainText := []byte(fmt.Sprintf("%v", unencryptedData))
+			if err := checkFieldSize(fieldName, plainText); err != nil {
+				return &logical.Response{
+					Data: resp,
+				}, err
+			}
+			unencryptedDataBytes, err := compressPlaintext(fieldName, plainText)
+			if err != nil {
+				return &logical.Response{
+					Data: resp,
+				}, err
+			}
+
 			if deterministic {
 				// SUPPORT FOR DETERMINISTIC AEAD
 
-				// set the unencrypted data to be the right type
-				unencryptedDataBytes := []byte(fmt.Sprintf("%v", unencryptedData))
-
 				// encrypt it
 				cypherText, err := tinkDetAead.EncryptDeterministically(unencryptedDataBytes, additionalDataBytes)
 				if err != nil {
@@ -523,13 +2032,13 @@ func (b *backend) encryptCol(ctx context.Context, req *logical.Request, data *fr
 					}, err
 				}
 
-				// set the response as the base64 encrypted data
-				resp[rowNum] = b64.StdEncoding.EncodeToString(cypherText)
+				// set the response as the encrypted data in the encoding of the field
+				resp[rowNum], err = encodeCiphertext(fieldName, ENCODING_FIELD, cypherText)
+				if err != nil {
+					return nil, err
+				}
 			} else {
 
-				// set the unencrypted data to be the right type
-				unencryptedDataBytes := []byte(fmt.Sprintf("%v", unencryptedData))
-
 				// encrypt it
 				cyphertext, err := tinkAead.Encrypt(unencryptedDataBytes, additionalDataBytes)
 				if err != nil {
@@ -539,8 +2048,11 @@ func (b *backend) encryptCol(ctx context.Context, req *logical.Request, data *fr
 					}, err
 				}
 
-				// set the response as the base64 encrypted data
-				resp[rowNum] = b64.StdEncoding.EncodeToString(cyphertext)
+				// set the response as the encrypted data in the encoding of the field
+				resp[rowNum], err = encodeCiphertext(fieldName, ENCODING_FIELD, cyphertext)
+				if err != nil {
+					return nil, err
+				}
 			}
 		} else {
 			// we didn't find a key - return original data
@@ -563,6 +2075,16 @@ func (b *backend) pathAeadDecryptBulkCol(ctx context.Context, req *logical.Reque
 	// or a single row of key value pairs to be encrypted map[string]interface{}
 	// {"bulkfield0":"fgbsrhbrgbr","bulkfield1":"sfgbsfbrnegnehtfngb","bulkfield2":"srbgwrgbwrgbwrg"}
 
+	// optionally decrypt the rows of each column with more than one worker
+	workers, err := extractBulkWorkers(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.checkShape(ctx, req, data.Raw, "decryptcol", true, false); err != nil {
+		return nil, err
+	}
+
 	// fire and forget the telemetry
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -599,19 +2121,28 @@ func (b *backend) pathAeadDecryptBulkCol(ctx context.Context, req *logical.Reque
 			}
 
 			// data.Raw = rowDataMapAsMapStrInt
-			go b.decryptColChan(ctx, req, &dn, fieldName, channel)
+			go b.decryptColChan(ctx, req, &dn, fieldName, workers, channel)
 		}
 
 		resp.Data = make(map[string]interface{})
 		resultsMap := make(map[string]interface{})
 
+		var colErr error
 		for i := 0; i < channelCap; i++ {
 			res := <-channel
 			for k, v := range res {
+				if err, ok := v.(error); ok {
+					colErr = err
+					continue
+				}
 				// this should be a map of 1 row of rownumber index as string and the map of values
 				resultsMap[k] = v
 			}
 		}
+		if colErr != nil {
+			wg.Wait()
+			return nil, colErr
+		}
 
 		// unpivot the map
 		aeadutils.PivotMapInt(resultsMap, resp.Data)
@@ -624,22 +2155,25 @@ func (b *backend) pathAeadDecryptBulkCol(ctx context.Context, req *logical.Reque
 	return resp, nil
 }
 
-func (b *backend) decryptColChan(ctx context.Context, req *logical.Request, data *framework.FieldData, fieldName string, ch chan map[string]interface{}) {
+func (b *backend) decryptColChan(ctx context.Context, req *logical.Request, data *framework.FieldData, fieldName string, workers int, ch chan map[string]interface{}) {
 
 	// this is just a wrapper around the pathAeadDecryptRow methos so that it can be used concurrently in a channel
-	resp, err := b.decryptCol(ctx, req, data, fieldName)
+	localResp := make(map[string]interface{})
+	resp, err := b.decryptCol(ctx, req, data, fieldName, workers)
 	if err != nil {
-		panic(err)
+		// pass the error back to the caller rather than a column
+		localResp[fieldName] = err
+		ch <- localResp
+		return
 	}
 
-	localResp := make(map[string]interface{})
 	localResp[fieldName] = resp.Data
 
 	ch <- localResp
 
 }
 
-func (b *backend) decryptCol(ctx context.Context, req *logical.Request, data *framework.FieldData, fieldName string) (*logical.Response, error) {
+func (b *backend) decryptCol(ctx context.Context, req *logical.Request, data *framework.FieldData, fieldName string, workers int) (*logical.Response, error) {
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
@@ -675,49 +2209,109 @@ func (b *backend) decryptCol(ctx context.Context, req *logical.Request, data *fr
 		}
 	}
 	// set additionalDataBytes as field name of the right type
-	additionalDataBytes := b.getAdditionalData(fieldName, AEAD_CONFIG)
+	additionalDataBytes, err := b.getAdditionalData(fieldName, AEAD_CONFIG)
+	if err != nil {
+		return nil, err
+	}
 
-	// iterate through the key=value supplied (ie field1=sdfvbbvwrbwr field2=advwefvwfvbwrfvb)
-	for rowNumber, encryptedDataBase64 := range data.Raw {
-		if keyFound {
-			if deterministic {
+	// the cyphertext is always base64 for decryptcol
+	var cache *decryptCache
+	if keyFound {
+		cache = getDecryptCache(fieldName, encryptionKeyStr)
+	}
 
-				// SUPPORT FOR DETERMINISTIC AEAD
-				// set the unencrypted data to be the right type
-				encryptedDataBytes, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", encryptedDataBase64))
+	// decryptValue decrypts the value of one row, the primitives and the cache are safe to share between workers
+	decryptValue := func(encryptedDataBase64 interface{}) (string, error) {
+		if !keyFound {
+			// we didn't find a key - return original data
+			return fmt.Sprintf("%s", encryptedDataBase64), nil
+		}
+		if cache != nil {
+			if plainText, ok := cache.get(ENCODING_BASE64, additionalDataBytes, fmt.Sprintf("%v", encryptedDataBase64)); ok {
+				return string(jsonText([]byte(plainText))), nil
+			}
+		}
 
-				// decrypt it
-				plainText, err := tinkDetAead.DecryptDeterministically(encryptedDataBytes, additionalDataBytes)
-				if err != nil {
-					hclog.L().Error("Failed to decrypt", err)
-					return &logical.Response{
-						Data: resp,
-					}, err
-				}
+		// set the unencrypted data to be the right type
+		encryptedDataBytes, err := decodeTaggedCiphertext(fieldName, fmt.Sprintf("%v", encryptedDataBase64), ENCODING_FIELD)
+		if err != nil {
+			return "", err
+		}
 
-				resp[rowNumber] = string(plainText)
-			} else {
-				// SUPPORT FOR NON DETERMINISTIC AEAD
-				// set the unencrypted data to be the right type
+		// decrypt it
+		var plainText []byte
+		if deterministic {
+			// SUPPORT FOR DETERMINISTIC AEAD
+			plainText, err = tinkDetAead.DecryptDeterministically(encryptedDataBytes, additionalDataBytes)
+		} else {
+			// SUPPORT FOR NON DETERMINISTIC AEAD
+			plainText, err = tinkAead.Decrypt(encryptedDataBytes, additionalDataBytes)
+		}
+		if err != nil {
+			hclog.L().Error("Failed to decrypt", err)
+			return "", err
+		}
+		plainText, err = decompressPlaintext(plainText, fieldCompressed(fieldName))
+		if err != nil {
+			return "", codedErrorf(ERROR_DECRYPT_FAILED, "failed to decompress field %s: %w", fieldName, err)
+		}
 
-				encryptedDataBytes, _ := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", encryptedDataBase64))
+		if cache != nil {
+			cache.add(ENCODING_BASE64, additionalDataBytes, fmt.Sprintf("%v", encryptedDataBase64), string(plainText))
+		}
+		return string(jsonText(plainText)), nil
+	}
 
-				// encrypt it
-				plainText, err := tinkAead.Decrypt(encryptedDataBytes, additionalDataBytes)
+	// iterate through the key=value supplied (ie field1=sdfvbbvwrbwr field2=advwefvwfvbwrfvb)
+	if workers <= 1 {
+		for rowNumber, encryptedDataBase64 := range data.Raw {
+			plainText, err := decryptValue(encryptedDataBase64)
+			if err != nil {
+				return &logical.Response{
+					Data: resp,
+				}, err
+			}
+			resp[rowNumber] = plainText
+		}
+		return &logical.Response{
+			Data: resp,
+		}, nil
+	}
+
+	// the rows are shared between the workers, each result is stored under its row number so the response is the
+	// same as the serial one
+	rows := make(chan string, len(data.Raw))
+	for rowNumber := range data.Raw {
+		rows <- rowNumber
+	}
+	close(rows)
+
+	var mu sync.Mutex
+	var rowErr error
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rowNumber := range rows {
+				plainText, err := decryptValue(data.Raw[rowNumber])
+				mu.Lock()
 				if err != nil {
-					hclog.L().Error("Failed to decrypt", err)
-					return &logical.Response{
-						Data: resp,
-					}, err
+					if rowErr == nil {
+						rowErr = err
+					}
+				} else {
+					resp[rowNumber] = plainText
 				}
-
-				resp[rowNumber] = string(plainText)
+				mu.Unlock()
 			}
-		} else {
-			// we didn't find a key - return original data
-			// hclog.L().Info("did not find a key for field " + fieldName)
-			resp[rowNumber] = fmt.Sprintf("%s", encryptedDataBase64)
-		}
+		}()
+	}
+	wg.Wait()
+	if rowErr != nil {
+		return &logical.Response{
+			Data: resp,
+		}, rowErr
 	}
 
 	return &logical.Response{
@@ -725,6 +2319,23 @@ func (b *backend) decryptCol(ctx context.Context, req *logical.Request, data *fr
 	}, nil
 }
 
+// the most workers BULK_WORKERS can ask for per column
+const maxBulkWorkers = 64
+
+// extractBulkWorkers removes the request option BULK_WORKERS, the number of workers that decrypt the rows of each
+// column of a decryptcol, default 1 which decrypts them serially
+func extractBulkWorkers(data map[string]interface{}) (int, error) {
+	workersStr, ok := extractRequestOption(data, "BULK_WORKERS")
+	if !ok {
+		return 1, nil
+	}
+	workers, err := strconv.Atoi(workersStr)
+	if err != nil || workers < 1 || workers > maxBulkWorkers {
+		return 0, codedErrorf(ERROR_INVALID_REQUEST, "BULK_WORKERS must be a number from 1 to %d", maxBulkWorkers)
+	}
+	return workers, nil
+}
+
 func isBulkData(data map[string]interface{}) (bool, error) {
 	// it is bulk data if it is a nested map
 	// map[string]map[string]interface{}
@@ -739,6 +2350,150 @@ func isBulkData(data map[string]interface{}) (bool, error) {
 	return false, nil
 }
 
+// the shapes of a request payload
+const (
+	SHAPE_FLAT    = "flat"    // a single row {"field0":"value0","field1":"value1"}
+	SHAPE_ROWS    = "rows"    // bulk rows {"0":{"field0":"value00"},"1":{"field0":"value10"}}
+	SHAPE_COLUMNS = "columns" // bulk columns {"field0":{"0":"value00","1":"value10"}}, which no path takes
+	SHAPE_MIXED   = "mixed"   // some values are maps and some are not
+)
+
+// detectShape works out the shape of a payload. Nested maps are rows unless their outer keys are fields with a
+// keyset and their inner keys are not, ie columns
+func detectShape(data map[string]interface{}) string {
+	nested := 0
+	outerFields := 0
+	innerFields := 0
+	for k, v := range data {
+		row, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		nested++
+		if _, ok := aeadutils.GetEncryptionKey(k, AEAD_CONFIG); ok {
+			outerFields++
+		}
+		for innerKey := range row {
+			if _, ok := aeadutils.GetEncryptionKey(innerKey, AEAD_CONFIG); ok {
+				innerFields++
+			}
+		}
+	}
+	switch {
+	case nested == 0:
+		return SHAPE_FLAT
+	case nested < len(data):
+		return SHAPE_MIXED
+	case outerFields > 0 && innerFields == 0:
+		return SHAPE_COLUMNS
+	}
+	return SHAPE_ROWS
+}
+
+// checkShape rejects a payload the path would mis-process rather than returning it unencrypted or empty. encrypt and
+// decrypt take a single row or bulk rows, the column paths only take bulk rows. With jsonValues, ie for encrypt, a map
+// or list value of a field with a keyset is a value to encrypt as json rather than a misplaced row or a column
+func (b *backend) checkShape(ctx context.Context, req *logical.Request, data map[string]interface{}, path string, bulkOnly bool, jsonValues bool) error {
+	// retrive the config from  storage, so the fields with a keyset are known
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	shape := detectShape(data)
+	if jsonValues && (shape == SHAPE_MIXED || shape == SHAPE_COLUMNS) && mapsAreJsonValues(data) {
+		shape = SHAPE_FLAT
+	}
+	switch shape {
+	case SHAPE_MIXED:
+		return codedErrorf(ERROR_INVALID_REQUEST, "%s expects either a single row {\"field\":\"value\"} or bulk rows {\"row\":{\"field\":\"value\"}}, not a mix of the two: %s", path, mixedShapeOffender(data))
+	case SHAPE_COLUMNS:
+		return codedErrorf(ERROR_INVALID_REQUEST, "the request looks like columns {\"field\":{\"row\":\"value\"}} but %s expects bulk rows {\"row\":{\"field\":\"value\"}}, the column paths pivot the rows themselves", path)
+	case SHAPE_FLAT:
+		if bulkOnly {
+			return codedErrorf(ERROR_INVALID_REQUEST, "%s expects bulk rows {\"row\":{\"field\":\"value\"}}, send a single row to %s", path, strings.TrimSuffix(path, "col"))
+		}
+	}
+	return checkShapeValues(data, shape, path, jsonValues)
+}
+
+// mapsAreJsonValues is whether every map in what is otherwise a single row, or what looks like columns, is the value of
+// a field with a keyset, so the maps are values to encrypt as json
+func mapsAreJsonValues(data map[string]interface{}) bool {
+	for k, v := range data {
+		if _, ok := v.(map[string]interface{}); !ok {
+			continue
+		}
+		if _, ok := aeadutils.GetEncryptionKey(k, AEAD_CONFIG); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mixedShapeOffender names the values of a mixed payload that do not fit, the maps of what is mostly a single row or
+// the values of what is mostly bulk rows
+func mixedShapeOffender(data map[string]interface{}) string {
+	nested := []string{}
+	scalar := []string{}
+	for k, v := range data {
+		if _, ok := v.(map[string]interface{}); ok {
+			nested = append(nested, k)
+		} else {
+			scalar = append(scalar, k)
+		}
+	}
+	sort.Strings(nested)
+	sort.Strings(scalar)
+	if len(nested) <= len(scalar) {
+		return fmt.Sprintf("field %s is a map in a single row", strings.Join(nested, ", "))
+	}
+	return fmt.Sprintf("row %s is not a map of fields", strings.Join(scalar, ", "))
+}
+
+// checkShapeValues rejects a single row or bulk rows with a value that is a map or a list, ie a row nested a level too
+// deep, naming the first offending row and field, rather than encrypting the printed value or failing part way. With
+// jsonValues the maps and lists of fields with a keyset are allowed, they are encrypted as json
+func checkShapeValues(data map[string]interface{}, shape string, path string, jsonValues bool) error {
+	checkRow := func(row map[string]interface{}, rowKey string) error {
+		fieldNames := mapKeys(row)
+		sort.Strings(fieldNames)
+		for _, fieldName := range fieldNames {
+			if jsonValues {
+				if _, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG); ok {
+					continue
+				}
+			}
+			kind := ""
+			switch row[fieldName].(type) {
+			case map[string]interface{}:
+				kind = "map"
+			case []interface{}:
+				kind = "list"
+			default:
+				continue
+			}
+			if rowKey == "" {
+				return codedErrorf(ERROR_INVALID_REQUEST, "%s expects a single value for each field, field %s is a %s", path, fieldName, kind)
+			}
+			return codedErrorf(ERROR_INVALID_REQUEST, "%s expects a single value for each field of a row, row %s field %s is a %s", path, rowKey, fieldName, kind)
+		}
+		return nil
+	}
+
+	if shape != SHAPE_ROWS {
+		return checkRow(data, "")
+	}
+	rowKeys := mapKeys(data)
+	sort.Strings(rowKeys)
+	for _, rowKey := range rowKeys {
+		if err := checkRow(data[rowKey].(map[string]interface{}), rowKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (b *backend) publishTelemetry(wg *sync.WaitGroup, ctx context.Context, req *logical.Request, encryptOrDecrypt string, data map[string]interface{}) {
 
 	defer wg.Done()
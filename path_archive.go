@@ -0,0 +1,230 @@
+package aeadplugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// archivePrefix is the storage prefix of the keysets configDelete archives with ARCHIVE_ON_DELETE true, each under
+// archive/<escaped name>/<unix nanos of the delete>
+const archivePrefix = "archive/"
+
+// defaultArchiveRetentionDays is how long an archived keyset can be restored when ARCHIVE_RETENTION_DAYS is not set
+const defaultArchiveRetentionDays = 30
+
+// archiveNow is the time keysets are archived at and archives expire against, replaced in the tests
+var archiveNow = time.Now
+
+// archivedKeyset is a keyset deleted with ARCHIVE_ON_DELETE true, with its config name and when it was deleted
+type archivedKeyset struct {
+	Name       string    `json:"name"`
+	Keyset     string    `json:"keyset"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// archiveOnDelete is ARCHIVE_ON_DELETE in the config, off if it is not set
+func archiveOnDelete() bool {
+	archiveIntf, ok := AEAD_CONFIG.Get("ARCHIVE_ON_DELETE")
+	if !ok {
+		return false
+	}
+	archive, err := strconv.ParseBool(fmt.Sprintf("%v", archiveIntf))
+	if err != nil {
+		hclog.L().Error("invalid ARCHIVE_ON_DELETE, keysets are not archived")
+		return false
+	}
+	return archive
+}
+
+// archiveRetention is ARCHIVE_RETENTION_DAYS in the config, how long an archived keyset can be restored
+func archiveRetention() time.Duration {
+	days := defaultArchiveRetentionDays
+	if daysIntf, ok := AEAD_CONFIG.Get("ARCHIVE_RETENTION_DAYS"); ok {
+		configDays, err := strconv.Atoi(fmt.Sprintf("%v", daysIntf))
+		if err == nil && configDays > 0 {
+			days = configDays
+		} else {
+			hclog.L().Error("invalid ARCHIVE_RETENTION_DAYS, using the default")
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// archiveEntryName is the storage entry of the keyset of the name archived at the time
+func archiveEntryName(name string, archivedAt time.Time) string {
+	return archivePrefix + url.QueryEscape(name) + "/" + strconv.FormatInt(archivedAt.UnixNano(), 10)
+}
+
+// archiveKeyset stores the keyset of the config name in the archive, under the current keyset wrapper
+func archiveKeyset(ctx context.Context, s logical.Storage, name string, keySetJson string) error {
+	stored, err := currentKeysetWrapper.Wrap(keySetJson)
+	if err != nil {
+		return fmt.Errorf("failed to wrap %s with the %s wrapper", name, currentKeysetWrapper.Name())
+	}
+	archived := archivedKeyset{Name: name, Keyset: stored, ArchivedAt: archiveNow().UTC()}
+	entry, err := logical.StorageEntryJSON(archiveEntryName(name, archived.ArchivedAt), archived)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// readArchives returns the archived keysets that are within ARCHIVE_RETENTION_DAYS by name, newest first, skipping the
+// ones that have expired. Only a write, which is forwarded to the active node, passes deleteExpired as a performance
+// standby cannot delete from storage
+func readArchives(ctx context.Context, s logical.Storage, deleteExpired bool) (map[string][]archivedKeyset, error) {
+	expiry := archiveNow().Add(-archiveRetention())
+	names, err := s.List(ctx, archivePrefix)
+	if err != nil {
+		return nil, err
+	}
+	archives := make(map[string][]archivedKeyset)
+	for _, name := range names {
+		times, err := s.List(ctx, archivePrefix+name)
+		if err != nil {
+			return nil, err
+		}
+		for _, archivedAt := range times {
+			entryName := archivePrefix + name + archivedAt
+			entry, err := s.Get(ctx, entryName)
+			if err != nil {
+				return nil, err
+			}
+			if entry == nil {
+				continue
+			}
+			var archived archivedKeyset
+			if err := entry.DecodeJSON(&archived); err != nil {
+				return nil, fmt.Errorf("failed to read archive %s: %w", entryName, err)
+			}
+			if archived.ArchivedAt.Before(expiry) {
+				if !deleteExpired {
+					continue
+				}
+				hclog.L().Info("deleting the expired archive of " + archived.Name + " from " + archived.ArchivedAt.Format(time.RFC3339Nano))
+				if err := s.Delete(ctx, entryName); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			archives[archived.Name] = append(archives[archived.Name], archived)
+		}
+	}
+	for _, nameArchives := range archives {
+		sort.Slice(nameArchives, func(i, j int) bool {
+			return nameArchives[i].ArchivedAt.After(nameArchives[j].ArchivedAt)
+		})
+	}
+	return archives, nil
+}
+
+// pathArchivesRead lists when each archived keyset that can still be restored was deleted, newest first. The key
+// material is never returned
+func (b *backend) pathArchivesRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	archives, err := readArchives(ctx, req.Storage, false)
+	if err != nil {
+		return nil, err
+	}
+	resp := make(map[string]interface{})
+	for name, nameArchives := range archives {
+		archivedAt := make([]string, 0, len(nameArchives))
+		for _, archived := range nameArchives {
+			archivedAt = append(archivedAt, archived.ArchivedAt.Format(time.RFC3339Nano))
+		}
+		resp[name] = archivedAt
+	}
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// pathRestoreArchived puts archived keysets back in the config under the name they were deleted from. Each field is
+// the config name, ie gcm/field, with "" for its latest archive or the archived_at of the one to restore. Nothing is
+// restored if any archive is not found or has expired, or a name is in the config again
+func (b *backend) pathRestoreArchived(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	if len(data.Raw) == 0 {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "no archived keysets named")
+	}
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := readArchives(ctx, req.Storage, true)
+	if err != nil {
+		return nil, err
+	}
+
+	restore := make(map[string]archivedKeyset)
+	for name, v := range data.Raw {
+		if _, ok := AEAD_CONFIG.Get(name); ok {
+			return nil, codedErrorf(ERROR_FIELD_EXISTS, "%s is in the config, delete it before restoring its archive", name)
+		}
+		nameArchives := archives[name]
+		if len(nameArchives) == 0 {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s has no archived keyset, or its archives are older than %v", name, archiveRetention())
+		}
+		wanted := strings.TrimSpace(fmt.Sprintf("%v", v))
+		if wanted == "" {
+			restore[name] = nameArchives[0]
+			continue
+		}
+		wantedAt, err := time.Parse(time.RFC3339Nano, wanted)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%s must be empty for the latest archive or an archived_at: %w", name, err)
+		}
+		found := false
+		for _, archived := range nameArchives {
+			if archived.ArchivedAt.Equal(wantedAt) {
+				restore[name] = archived
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s has no archive from %s, or it is older than %v", name, wanted, archiveRetention())
+		}
+	}
+
+	// every archive must still be a valid keyset before any is restored. The errors never wrap the parse error
+	// as it can quote the keyset
+	keysets := make(map[string]interface{})
+	for name, archived := range restore {
+		keySetJson, err := currentKeysetWrapper.Unwrap(archived.Keyset)
+		if err == nil {
+			_, err = aeadutils.ParseKeySetJson(keySetJson)
+		}
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "the archive of %s is not a valid keyset", name)
+		}
+		keysets[name] = keySetJson
+	}
+
+	_, err = b.configWriteOverwriteCheck(ctx, req, &framework.FieldData{Raw: keysets, Schema: data.Schema}, false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make(map[string]interface{})
+	for name, archived := range restore {
+		// the restored keyset is in the config again, so its archive is no longer needed
+		if err := req.Storage.Delete(ctx, archiveEntryName(name, archived.ArchivedAt)); err != nil {
+			hclog.L().Error("failed to delete the restored archive of " + name + ": " + err.Error())
+		}
+		resp[name] = archived.ArchivedAt.Format(time.RFC3339Nano)
+	}
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
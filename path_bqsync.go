@@ -9,6 +9,7 @@ import (
 
 	"github.com/Vodafone/vault-plugin-aead/aeadutils"
 	"github.com/Vodafone/vault-plugin-aead/bqutils"
+	"github.com/google/tink/go/keyset"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -22,6 +23,13 @@ func (b *backend) pathBQKeySync(ctx context.Context, req *logical.Request, data
 		return nil, err
 	}
 
+	// the BQ options are read from the settings, falling back to config
+	err = b.getAeadSettings(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	options := bqOptions()
+
 	keysToSync := data.Raw
 
 	keysMap := make(map[string]interface{})
@@ -29,7 +37,8 @@ func (b *backend) pathBQKeySync(ctx context.Context, req *logical.Request, data
 	for keyField, encryptionKey := range AEAD_CONFIG.Items() {
 		fieldName := fmt.Sprintf("%v", keyField)
 		keyStr := fmt.Sprintf("%v", encryptionKey)
-		if !strings.Contains(keyStr, "primaryKeyId") {
+		if !strings.Contains(keyStr, "primaryKeyId") || strings.HasPrefix(fieldName, aeadutils.PRFKeyPrefix) || strings.HasPrefix(fieldName, aeadutils.ExportKeyPrefix) {
+			// not a keyset, or a PRF or export keyset which has no routines
 			continue
 		}
 
@@ -45,7 +54,14 @@ func (b *backend) pathBQKeySync(ctx context.Context, req *logical.Request, data
 		keysMap[fieldName] = encryptionKey
 	}
 
-	projectIdInterface, ok := AEAD_CONFIG.Get("BQ_PROJECT")
+	// fail fast if the kms provider cannot be used with BQ rather than produce a broken routine
+	err = bqutils.CheckKMSProvider(bqutils.ResolveKMSProvider(options), bqutils.WAREHOUSE_BIGQUERY)
+	if err != nil {
+		hclog.L().Error(err.Error())
+		return nil, err
+	}
+
+	projectIdInterface, ok := options.Get("BQ_PROJECT")
 	projectId := fmt.Sprintf("%s", projectIdInterface)
 	if !ok {
 		return nil, &logical.KeyNotFoundError{
@@ -59,9 +75,49 @@ func (b *backend) pathBQKeySync(ctx context.Context, req *logical.Request, data
 		return nil, err
 	}
 
+	// the options are read once for the sync rather than for every field
+	snapshot := bqutils.NewOptionsSnapshot(options)
+
 	// hclog.L().Info("datasets: ", datasets)
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	summary := make(map[string]interface{})
+	skipped := make(map[string]interface{})
+	syncErrors := make(map[string]interface{})
+	var totals bqutils.RegionSyncResult
+	doSync := func(kh *keyset.Handle, fieldName string, deterministic bool) {
+		defer wg.Done()
+		result, err := bqutils.DoBQSync(ctx, kh, fieldName, deterministic, snapshot, datasets)
+		mu.Lock()
+		defer mu.Unlock()
+		var fieldErrors []string
+		if err != nil {
+			fieldErrors = append(fieldErrors, err.Error())
+		}
+		if result != nil {
+			regions := make(map[string]interface{})
+			for region, regionResult := range result.Regions {
+				regions[region] = regionSummary(*regionResult)
+			}
+			summary[fieldName] = regions
+			fieldTotals := result.Totals()
+			totals.Created += fieldTotals.Created
+			totals.Updated += fieldTotals.Updated
+			totals.Skipped += fieldTotals.Skipped
+			if len(result.Skipped) > 0 {
+				skipped[fieldName] = result.Skipped
+			}
+			fieldErrors = append(fieldErrors, result.Errors...)
+			for _, routine := range result.Cancelled {
+				fieldErrors = append(fieldErrors, "cancelled before syncing routine "+routine)
+			}
+		}
+		if len(fieldErrors) > 0 {
+			syncErrors[fieldName] = fieldErrors
+		}
+	}
 	for fieldName, encryptionKey := range keysMap {
+		fieldName := fieldName
 
 		encryptionKeyStr, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionKey)
 		if deterministic {
@@ -73,10 +129,7 @@ func (b *backend) pathBQKeySync(ctx context.Context, req *logical.Request, data
 				}, err
 			}
 			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				bqutils.DoBQSync(ctx, kh, fieldName, true, AEAD_CONFIG, datasets)
-			}()
+			go doSync(kh, fieldName, true)
 			// do deterministic sync
 		} else {
 			kh, _, err := aeadutils.CreateInsecureHandleAndAead(encryptionKeyStr)
@@ -88,14 +141,95 @@ func (b *backend) pathBQKeySync(ctx context.Context, req *logical.Request, data
 			}
 			// do non- deterministic sync
 			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				bqutils.DoBQSync(ctx, kh, fieldName, false, AEAD_CONFIG, datasets)
-			}()
+			go doSync(kh, fieldName, false)
 		}
 
 	}
 	wg.Wait()
 
-	return nil, nil
+	// report what was synced in each region, and the datasets that did not get routines so operators can fix IAM
+	// on the kms keys
+	resp := map[string]interface{}{
+		"summary": summary,
+		"totals":  regionSummary(totals),
+	}
+	if len(skipped) > 0 {
+		resp["skipped"] = skipped
+	}
+	if len(syncErrors) > 0 {
+		resp["errors"] = syncErrors
+	}
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// regionSummary is the counts of routines created, updated and skipped as returned by bqsync
+func regionSummary(regionResult bqutils.RegionSyncResult) map[string]interface{} {
+	return map[string]interface{}{
+		"created": regionResult.Created,
+		"updated": regionResult.Updated,
+		"skipped": regionResult.Skipped,
+	}
+}
+
+// pathKMSCheck checks the kms keys bqsync would wrap the keysets with can be found and can encrypt, in each region,
+// without touching BQ. The keys are those of the keyset fields in the request, or of every keyset field if none are
+// supplied, as for bqsync
+func (b *backend) pathKMSCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	err = b.getAeadSettings(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	options := bqOptions()
+
+	err = bqutils.CheckKMSProvider(bqutils.ResolveKMSProvider(options), bqutils.WAREHOUSE_BIGQUERY)
+	if err != nil {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "%w", err)
+	}
+
+	fieldNames := []string{}
+	for keyField, encryptionKey := range AEAD_CONFIG.Items() {
+		if !strings.Contains(fmt.Sprintf("%v", encryptionKey), "primaryKeyId") || strings.HasPrefix(keyField, aeadutils.PRFKeyPrefix) || strings.HasPrefix(keyField, aeadutils.ExportKeyPrefix) {
+			continue
+		}
+		if len(data.Raw) != 0 {
+			if _, ok := data.Raw[keyField]; !ok {
+				continue
+			}
+		}
+		fieldNames = append(fieldNames, aeadutils.RemoveKeyPrefix(keyField))
+	}
+
+	kmsWrapper, err := newKMSWrapper(ctx, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the kms client: %w", err)
+	}
+	defer kmsWrapper.Close()
+
+	valid := true
+	regions := make(map[string]interface{})
+	for region, keyResults := range bqutils.CheckKMSKeys(ctx, kmsWrapper, fieldNames, options) {
+		keys := make(map[string]interface{})
+		for keyName, err := range keyResults {
+			keys[keyName] = "ok"
+			if err != nil {
+				hclog.L().Error("kmscheck: " + err.Error())
+				keys[keyName] = err.Error()
+				valid = false
+			}
+		}
+		regions[region] = keys
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"regions": regions,
+			"valid":   valid,
+		},
+	}, nil
 }
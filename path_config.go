@@ -4,15 +4,22 @@ import (
 	"bytes"
 	"context"
 	b64 "encoding/base64"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"github.com/Vodafone/vault-plugin-aead/bqutils"
 	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 	cmap "github.com/orcaman/concurrent-map"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var AEAD_CONFIG = cmap.New()
@@ -29,6 +36,10 @@ func (b *backend) configWriteOverwriteCheck(ctx context.Context, req *logical.Re
 	// hclog.L().Info("mountpoint - " + req.MountPoint)
 	// fmt.Printf("\nmountpoint - %s", req.MountPoint)
 
+	// encrypt and decrypt wait for the keysets to be written
+	unlock := b.lockFields(mapKeys(data.Raw), true)
+	defer unlock()
+
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
@@ -36,6 +47,7 @@ func (b *backend) configWriteOverwriteCheck(ctx context.Context, req *logical.Re
 	}
 
 	// iterate through the supplied map, adding it to the config map
+	written := make(map[string]bool)
 	for k, v := range data.Raw {
 
 		prefix := aeadutils.GetKeyPrefix(k, fmt.Sprintf("%v", v), nil)
@@ -50,6 +62,7 @@ func (b *backend) configWriteOverwriteCheck(ctx context.Context, req *logical.Re
 			}
 		}
 		AEAD_CONFIG.Set(k, v)
+		written[k] = true
 		if overwriteKV {
 			ok, err := saveToKV(k, v)
 			if !ok || err != nil {
@@ -58,6 +71,12 @@ func (b *backend) configWriteOverwriteCheck(ctx context.Context, req *logical.Re
 		}
 	}
 
+	// the export keysets made from the keysets written are made again so they keep encrypting with the same keys.
+	// Nothing is saved if any fails, the next read of the config puts back what is in storage
+	if err := rederiveExportKeysets(written, overwriteKV); err != nil {
+		return nil, err
+	}
+
 	entry, err := logical.StorageEntryJSON("config", AEAD_CONFIG)
 	// entry, err := logical.StorageEntryJSON("config", data.Raw)
 	if err != nil {
@@ -67,18 +86,89 @@ func (b *backend) configWriteOverwriteCheck(ctx context.Context, req *logical.Re
 	if err := req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
+	applyLogLevel()
+	applyKeyPrefixes()
 
 	return nil, nil
 }
 
+func (b *backend) pathConfigDiff(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare the supplied map to the config as configOverwrite would write it, nothing is saved
+	resp := make(map[string]interface{})
+	for k, v := range data.Raw {
+		proposed := fmt.Sprintf("%v", v)
+		prefix := aeadutils.GetKeyPrefix(k, proposed, nil)
+		k = prefix + k
+
+		diff := make(map[string]interface{})
+		currentInterface, ok := AEAD_CONFIG.Get(k)
+		current := fmt.Sprintf("%v", currentInterface)
+		switch {
+		case !ok:
+			diff["status"] = "added"
+		case current == proposed:
+			diff["status"] = "unchanged"
+		default:
+			diff["status"] = "changed"
+		}
+
+		if diff["status"] == "changed" {
+			// never reveal key material, only that it would change
+			_, currentErr := aeadutils.ValidateKeySetJson(current)
+			_, proposedErr := aeadutils.ValidateKeySetJson(proposed)
+			if currentErr == nil || proposedErr == nil {
+				diff["detail"] = "material would change"
+			} else {
+				diff["current"] = current
+				diff["proposed"] = proposed
+			}
+		}
+		resp[k] = diff
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
 func (b *backend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
+	// encrypt and decrypt wait for the keysets to be deleted
+	unlock := b.lockFields(mapKeys(data.Raw), true)
+	defer unlock()
+
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	// with ARCHIVE_ON_DELETE the keysets are archived before anything is deleted, so they can be restored with
+	// restoreArchived
+	if archiveOnDelete() {
+		for k := range data.Raw {
+			v, ok := AEAD_CONFIG.Get(k)
+			if !ok {
+				continue
+			}
+			keySetJson := fmt.Sprintf("%v", v)
+			if _, err := aeadutils.ValidateKeySetJson(keySetJson); err != nil {
+				// not a keyset, ie an option or a pointer
+				continue
+			}
+			if err := archiveKeyset(ctx, req.Storage, k, keySetJson); err != nil {
+				return nil, fmt.Errorf("failed to archive %s, nothing was deleted: %w", k, err)
+			}
+		}
+	}
+
 	// iterate through the supplied map, deleting from the store
 	for k, _ := range data.Raw {
 		AEAD_CONFIG.Remove(k)
@@ -97,6 +187,8 @@ func (b *backend) pathConfigDelete(ctx context.Context, req *logical.Request, da
 	if err := req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
+	applyLogLevel()
+	applyKeyPrefixes()
 
 	return nil, nil
 }
@@ -113,7 +205,10 @@ func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data
 		_, err := aeadutils.ValidateKeySetJson(v.(string))
 		if err == nil {
 			// key is valid
-			v = aeadutils.MuteKeyMaterial(v.(string))
+			v = muteKeyMaterial(v.(string))
+		} else if strings.HasPrefix(k, INDEX_KEY_PREFIX) {
+			// an index key is raw key material
+			v = maskString()
 		}
 		result[k] = v
 	}
@@ -131,11 +226,30 @@ func (b *backend) pathReadKeyTypes(ctx context.Context, req *logical.Request, da
 		return nil, err
 	}
 
+	// ALGORITHMS=true returns the algorithm of each keyset instead of its key type
+	algorithms := false
+	if algorithmsStr, ok := extractRequestOption(data.Raw, "ALGORITHMS"); ok {
+		algorithms, err = strconv.ParseBool(algorithmsStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "ALGORITHMS must be true or false")
+		}
+	}
+
 	m := map[string]interface{}{}
 	for k, v := range AEAD_CONFIG.Items() {
+		if algorithms {
+			// only keysets have an algorithm
+			algorithm, err := aeadutils.GetKeySetAlgorithms(fmt.Sprintf("%v", v))
+			if err == nil {
+				m[k] = algorithm
+			}
+			continue
+		}
 		str := ""
 		_, determinstic := aeadutils.IsKeyJsonDeterministic(v)
-		if determinstic {
+		if strings.HasPrefix(k, aeadutils.PRFKeyPrefix) {
+			str = "PRF"
+		} else if determinstic {
 			str = "DETERMINISTIC"
 		} else {
 			str = "NON DETERMINISTIC"
@@ -147,388 +261,2132 @@ func (b *backend) pathReadKeyTypes(ctx context.Context, req *logical.Request, da
 	}, nil
 }
 
-func (b *backend) getAeadConfig(ctx context.Context, req *logical.Request) error {
-
-	consulConfig, err := b.readConsulConfig(ctx, req.Storage)
+// pathListKeys returns the sorted names of the config entries that hold a keyset, and whether each is deterministic,
+// without any key material so it is cheaper than reading the config for inventory
+func (b *backend) pathListKeys(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
 	if err != nil {
-		return err
-	}
-
-	// if the config retrieved from the storage is null use the in memory config
-	// add config from consul into the AEAD_CONFIG cache
-	for k, v := range consulConfig {
-		AEAD_CONFIG.Set(k, v)
+		return nil, err
 	}
 
-	// remove config from the cache anything that is not in consul
-	for k, _ := range AEAD_CONFIG.Items() {
-		if _, ok := consulConfig[k]; !ok {
-			AEAD_CONFIG.Remove(k)
+	keys := []string{}
+	types := map[string]interface{}{}
+	for k, v := range AEAD_CONFIG.Items() {
+		if _, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", v)); err != nil {
+			// plain config, ie an option or a pointer to a keyset
+			continue
+		}
+		keys = append(keys, k)
+		_, deterministic := aeadutils.IsKeyJsonDeterministic(v)
+		if strings.HasPrefix(k, aeadutils.PRFKeyPrefix) {
+			types[k] = "PRF"
+		} else if deterministic {
+			types[k] = "DETERMINISTIC"
+		} else {
+			types[k] = "NON DETERMINISTIC"
 		}
 	}
+	sort.Strings(keys)
 
-	return nil
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"keys":  keys,
+			"types": types,
+		},
+	}, nil
 }
 
-func (b *backend) readConsulConfig(ctx context.Context, s logical.Storage) (map[string]interface{}, error) {
-
-	consulConfig := make(map[string]interface{})
-	entry, err := s.Get(ctx, "config")
+// pathKeyInfo returns the key name, determinism, algorithm and number of keys of each field in FIELDS (a list or a
+// comma separated string) or, without FIELDS, of each field in the request, ie the body of an encryptcol or decryptcol
+// request, so a client can plan the encoding of bulk data in one call. A keyset with more keys than MAX_KEYS_WARN is
+// flagged with a warning to purge it. Nothing is encrypted and no key material is returned
+func (b *backend) pathKeyInfo(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	if entry == nil {
-		return nil, nil
-	}
 
-	if err := entry.DecodeJSON(&consulConfig); err != nil {
+	maxKeys, err := maxKeysWarn()
+	if err != nil {
 		return nil, err
 	}
-	return consulConfig, nil
-}
 
-func (b *backend) pathKeyRotate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-
-	// retrive the config from  storage
-	err := b.getAeadConfig(ctx, req)
-	if err != nil {
-		return nil, err
+	var fields []string
+	if fieldsValue, ok := data.Raw["FIELDS"]; ok {
+		fields = fieldList(fieldsValue)
+	} else {
+		for fieldName := range data.Raw {
+			fields = append(fields, fieldName)
+		}
 	}
 
-	for keyField, encryptionKey := range AEAD_CONFIG.Items() {
-		fieldName := fmt.Sprintf("%v", keyField)
-		keyStr := fmt.Sprintf("%v", encryptionKey)
-		_, err := aeadutils.ValidateKeySetJson(keyStr)
-		if err != nil {
-			// not a valid key
+	resp := make(map[string]interface{})
+	var warnings []string
+	for _, fieldName := range fields {
+		keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		if !ok {
+			// encrypt and decrypt return the data of a field without a keyset as it is
+			resp[fieldName] = map[string]interface{}{
+				"FOUND": false,
+			}
 			continue
-		} else {
-			encryptionKeyStr, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionKey)
-			if deterministic {
-				kh, _, err := aeadutils.CreateInsecureHandleAndDeterministicAead(encryptionKeyStr)
-				if err != nil {
-					hclog.L().Error("feiled to create key handlep")
-					return &logical.Response{
-						Data: make(map[string]interface{}),
-					}, nil
-				}
-				aeadutils.RotateKeys(kh, true)
-				b.saveKeyToConfig(kh, fieldName, ctx, req, true)
-			} else {
-				kh, _, err := aeadutils.CreateInsecureHandleAndAead(encryptionKeyStr)
-				if err != nil {
-					hclog.L().Error("feiled to create key handlep")
-					return &logical.Response{
-						Data: make(map[string]interface{}),
-					}, nil
+		}
+		key, _ := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+		keyType := "NON DETERMINISTIC"
+		if _, deterministic := aeadutils.IsKeyJsonDeterministic(key); deterministic {
+			keyType = "DETERMINISTIC"
+		}
+		algorithm, _ := aeadutils.GetKeySetAlgorithms(fmt.Sprintf("%v", key))
+		fieldInfo := map[string]interface{}{
+			"FOUND":     true,
+			"KEY_NAME":  keyName,
+			"TYPE":      keyType,
+			"ALGORITHM": algorithm,
+		}
+		if kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", key)); err == nil {
+			keyCount := len(kh.KeysetInfo().GetKeyInfo())
+			fieldInfo["KEY_COUNT"] = keyCount
+			if maxKeys > 0 {
+				fieldInfo["KEYS_WARNING"] = keyCount > maxKeys
+				if keyCount > maxKeys {
+					warnings = append(warnings, fmt.Sprintf("%s has %d keys, more than MAX_KEYS_WARN %d, consider purging the keys no longer needed with purgeKeys", keyName, keyCount, maxKeys))
 				}
-				aeadutils.RotateKeys(kh, false)
-				b.saveKeyToConfig(kh, fieldName, ctx, req, true)
 			}
 		}
+		resp[fieldName] = fieldInfo
 	}
 
-	// TODO poss not needed
-	// entry, err := logical.StorageEntryJSON("config", AEAD_CONFIG)
-	// if err != nil {
-	// 	return nil, err
-	// }
+	response := &logical.Response{
+		Data: resp,
+	}
+	sort.Strings(warnings)
+	for _, warning := range warnings {
+		response.AddWarning(warning)
+	}
+	return response, nil
+}
 
-	// if err := req.Storage.Put(ctx, entry); err != nil {
-	// 	return nil, err
-	// }
+// maxKeysWarn returns MAX_KEYS_WARN from the config, the number of keys above which keyinfo flags a keyset, or 0 if
+// it is not set
+func maxKeysWarn() (int, error) {
+	maxKeysIntf, ok := AEAD_CONFIG.Get("MAX_KEYS_WARN")
+	if !ok {
+		return 0, nil
+	}
+	maxKeys, err := strconv.Atoi(fmt.Sprintf("%v", maxKeysIntf))
+	if err != nil || maxKeys < 0 {
+		return 0, fmt.Errorf("MAX_KEYS_WARN must be a number of keys, ie 50, got %v", maxKeysIntf)
+	}
+	return maxKeys, nil
+}
 
-	return nil, nil
+// fieldList reads a list of field names supplied as a list or a comma separated string
+func fieldList(v interface{}) []string {
+	fields := []string{}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, f := range v {
+			fields = append(fields, fmt.Sprintf("%v", f))
+		}
+	default:
+		for _, f := range strings.Split(fmt.Sprintf("%v", v), ",") {
+			fields = append(fields, strings.TrimSpace(f))
+		}
+	}
+	return fields
 }
 
-func (b *backend) pathUpdateKeyStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+func (b *backend) pathMapFamily(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
-	// data.Raw is map[string]map[string]string
-	// map['field0':map['key':'status']]
+	// data.Raw is the family and the fields to point at it, the fields as a list or a comma separated string
+	// map['FAMILY':'ADDRESS_FAMILY', 'FIELDS':['address-line1','postcode']]
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	resp := make(map[string]interface{})
+	family, ok := extractRequestOption(data.Raw, "FAMILY")
+	if !ok || family == "" {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "FAMILY is required")
+	}
+	familyKey, ok := aeadutils.GetEncryptionKey(family, AEAD_CONFIG)
+	if !ok {
+		return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "no keyset found for family %s", family)
+	}
+	familyKeyName, _ := aeadutils.GetEncryptionKeyName(family, AEAD_CONFIG)
+	// recorded against each new field so encrypt fails if the family keyset is later replaced with the other kind
+	_, familyDeterministic := aeadutils.IsKeyJsonDeterministic(familyKey)
 
-	for fieldName, v := range data.Raw {
-		// GET THE KEY
-		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
-		if !ok {
-			hclog.L().Error("failed to get an existing key")
+	fieldsValue, ok := data.Raw["FIELDS"]
+	if !ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "FIELDS is required")
+	}
+	fields := fieldList(fieldsValue)
+
+	// check every field first so nothing is saved if any field fails
+	mappings := make(map[string]interface{})
+	resp := make(map[string]interface{})
+	for _, fieldName := range fields {
+		if err := aeadutils.ValidateFieldName(fieldName); err != nil {
+			return nil, err
 		}
-		rawKeyset := fmt.Sprintf("%s", encryptionkey)
-		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
-		kh, err := insecurecleartextkeyset.Read(r)
-		if err != nil {
-			hclog.L().Error("failed to get an existing key handle")
+		if fieldName == family {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%s cannot point at itself", fieldName)
 		}
-
-		//assert
-		vMap := v.(map[string]interface{})
-		for keyId, status := range vMap {
-			statusStr := fmt.Sprintf("%s", status)
-
-			// update the status, get a new heyhandle
-			newKh, err := aeadutils.UpdateKeyStatus(kh, keyId, statusStr)
-			if err != nil || newKh == nil {
-				hclog.L().Error("failed to update the status")
-				resp[fieldName] = "failed to update the status"
-			} else {
-
-				// save the keyhandle for the field
-				b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
-
-				// extract the JSON from the new key
-				buf := new(bytes.Buffer)
-				jsonWriter := keyset.NewJSONWriter(buf)
-				insecurecleartextkeyset.Write(newKh, jsonWriter)
-				// unmarshall the keyset
-				str := buf.String()
-				resp[fieldName] = str
+		existing, ok := AEAD_CONFIG.Get(fieldName)
+		if ok {
+			if fmt.Sprintf("%v", existing) != family {
+				return nil, codedErrorf(ERROR_FIELD_EXISTS, "%s is already configured", fieldName)
 			}
+			// already in the family
+			resp[fieldName] = false
+			continue
 		}
+		if err := checkFieldDeterminism(fieldName, familyKeyName, familyDeterministic); err != nil {
+			return nil, err
+		}
+		mappings[fieldName] = family
+		mappings["DETERMINISTIC_"+fieldName] = strconv.FormatBool(familyDeterministic)
+		resp[fieldName] = true
 	}
 
-	mutedResult := make(map[string]interface{}, len(resp))
-	for k, v := range resp {
-		_, err := aeadutils.ValidateKeySetJson(v.(string))
-		if err == nil {
-			// we do have a valid key
-			v = aeadutils.MuteKeyMaterial(v.(string))
+	if len(mappings) > 0 {
+		dn := framework.FieldData{
+			Raw:    mappings,
+			Schema: nil,
+		}
+		_, err = b.configWriteOverwriteCheck(ctx, req, &dn, false, true)
+		if err != nil {
+			hclog.L().Error("save family mappings failed", err.Error())
+			return nil, err
 		}
-		mutedResult[k] = v
 	}
 
 	return &logical.Response{
-		Data: mutedResult,
+		Data: resp,
 	}, nil
 }
-func (b *backend) pathUpdateKeyMaterial(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
-	// data.Raw is map[string]map[string]string
-	// map['field0':map['key':'material']]
+func (b *backend) pathReadFingerprint(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	resp := make(map[string]interface{})
-
-	for fieldName, v := range data.Raw {
-		// GET THE KEY
-		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
 
+	// fields that point at a keyset get the fingerprint of that keyset
+	m := map[string]interface{}{}
+	for k := range AEAD_CONFIG.Items() {
+		encryptionKey, ok := aeadutils.GetEncryptionKey(k, AEAD_CONFIG)
 		if !ok {
-			hclog.L().Error("failed to get an existing key")
+			continue
 		}
-		rawKeyset := fmt.Sprintf("%s", encryptionkey)
-		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
-		kh, err := insecurecleartextkeyset.Read(r)
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
 		if err != nil {
-			hclog.L().Error("failed to get an existing key handle")
+			continue
 		}
-
-		//assert
-		vMap := v.(map[string]interface{})
-		for keyId, material := range vMap {
-			materialStr := fmt.Sprintf("%s", material)
-
-			// update the status, get a new heyhandle
-			newKh, err := aeadutils.UpdateKeyMaterial(kh, keyId, materialStr)
-			if err != nil {
-				hclog.L().Error("failed to update the material")
-				resp[fieldName] = "failed to update the material"
-			} else {
-
-				// save the keyhandle for the field
-				b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
-
-				// extract the JSON from the new key
-				buf := new(bytes.Buffer)
-				jsonWriter := keyset.NewJSONWriter(buf)
-				insecurecleartextkeyset.Write(newKh, jsonWriter)
-				// unmarshall the keyset
-				str := buf.String()
-				resp[fieldName] = str
-			}
+		fingerprint, err := aeadutils.KeySetFingerprint(kh)
+		if err != nil {
+			hclog.L().Error("failed to fingerprint keyset for " + k)
+			return nil, err
 		}
+		m[k] = fingerprint
 	}
+	return &logical.Response{
+		Data: m,
+	}, nil
+}
 
-	mutedResult := make(map[string]interface{}, len(resp))
-	for k, v := range resp {
-		_, err := aeadutils.ValidateKeySetJson(v.(string))
-		if err == nil {
-			// valid key
-			v = aeadutils.MuteKeyMaterial(v.(string))
+// configOptionPrefixes are the config entries that are options rather than fields or keysets
+var configOptionPrefixes = []string{"VAULT_", "BQ_", "TELEMETRY_", "ADDITIONAL_DATA_", "AAD_", "COMPRESS_", "MASK_STRING", "LOG_LEVEL", "MAX_FIELD_BYTES", "DETERMINISTIC_", "ALLOW_RAW_KEYS", "DEFAULT_AEAD_TEMPLATE", "DEFAULT_DAEAD_TEMPLATE", "DEFAULT_ADDITIONAL_DATA", "DECRYPT_CACHE_", "KEY_PREFIXES", "MIN_AEAD_BITS", "MAX_KEYS_WARN", "EXPORT_PREFIX", "RATE_LIMIT_", "VERSION_TAG_", "ENCODING_", "ARCHIVE_"}
+
+func isConfigOption(k string) bool {
+	for _, prefix := range configOptionPrefixes {
+		if strings.HasPrefix(k, prefix) {
+			return true
 		}
-		mutedResult[k] = v
 	}
-
-	return &logical.Response{
-		Data: mutedResult,
-	}, nil
+	return false
 }
-func (b *backend) pathUpdatePrimaryKeyID(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
-	// data.Raw is map[string]string
-	// map['field0':'primaryKey']]
+func (b *backend) pathValidateConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	resp := make(map[string]interface{})
-
-	for fieldName, v := range data.Raw {
-		// GET THE KEY
-		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
 
-		if !ok {
-			hclog.L().Error("failed to get an existing key")
+	// walk every field and family pointer to its keyset, nothing is changed
+	dangling := map[string]interface{}{}
+	mismatched := map[string]interface{}{}
+	for k := range AEAD_CONFIG.Items() {
+		if strings.HasPrefix(k, "DETERMINISTIC_") {
+			// the field's keyset must still be the kind recorded for it
+			fieldName := strings.TrimPrefix(k, "DETERMINISTIC_")
+			if key, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG); ok {
+				_, deterministic := aeadutils.IsKeyJsonDeterministic(key)
+				keyName, _ := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+				if err := checkFieldDeterminism(fieldName, keyName, deterministic); err != nil {
+					mismatched[k] = err.Error()
+				}
+			}
+			continue
 		}
-		rawKeyset := fmt.Sprintf("%s", encryptionkey)
-		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
-		kh, err := insecurecleartextkeyset.Read(r)
-		if err != nil {
-			hclog.L().Error("failed to get an existing key handle")
+		if isConfigOption(k) {
+			continue
+		}
+		problem, isMismatch := checkConfigPointer(k)
+		if problem == "" {
+			continue
+		}
+		if isMismatch {
+			mismatched[k] = problem
+		} else {
+			dangling[k] = problem
 		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"valid":      len(dangling) == 0 && len(mismatched) == 0,
+			"dangling":   dangling,
+			"mismatched": mismatched,
+		},
+	}, nil
+}
+
+// checkConfigPointer follows a config entry to its keyset as GetEncryptionKey does, returning a description of the
+// problem if it does not get there, and whether the problem is a keyset of the wrong type for a gcm/ or siv/ name
+func checkConfigPointer(k string) (string, bool) {
+	maxDepth := 5
+	chain := []string{}
+	name := k
+	for depth := 0; depth < maxDepth; depth++ {
+		configValue, ok := AEAD_CONFIG.Get(name)
+		if !ok {
+			// k itself can be gone, ie deleted since the config was listed
+			if len(chain) == 0 {
+				return fmt.Sprintf("%s does not exist", name), false
+			}
+			return fmt.Sprintf("%s points at %s which does not exist", chain[len(chain)-1], name), false
+		}
+		chain = append(chain, name)
+		configValueStr := fmt.Sprintf("%v", configValue)
+		if _, err := aeadutils.ValidateKeySetJson(configValueStr); err == nil {
+			// a gcm/ or siv/ name must hold the matching keyset type or the field encrypts with the wrong kind of key
+			_, deterministic := aeadutils.IsKeyJsonDeterministic(configValueStr)
+			for _, n := range chain {
+				if strings.HasPrefix(n, "gcm/") && deterministic {
+					return fmt.Sprintf("%s is a deterministic keyset", n), true
+				}
+				if strings.HasPrefix(n, "siv/") && !deterministic {
+					return fmt.Sprintf("%s is a non-deterministic keyset", n), true
+				}
+			}
+			return "", false
+		}
+		if depth == 0 && (strings.HasPrefix(name, "gcm/") || strings.HasPrefix(name, "siv/")) {
+			return fmt.Sprintf("%s is not a valid keyset", name), false
+		}
+		name = configValueStr
+	}
+	return fmt.Sprintf("%s is more than %d pointers from a keyset, or circular", k, maxDepth), false
+}
+
+func (b *backend) getAeadConfig(ctx context.Context, req *logical.Request) error {
+
+	consulConfig, err := b.readConsulConfig(ctx, req.Storage)
+
+	if err != nil {
+		return err
+	}
+
+	// if the config retrieved from the storage is null use the in memory config
+	// add config from consul into the AEAD_CONFIG cache
+	for k, v := range consulConfig {
+		AEAD_CONFIG.Set(k, v)
+	}
+
+	// remove config from the cache anything that is not in consul
+	for k, _ := range AEAD_CONFIG.Items() {
+		if _, ok := consulConfig[k]; !ok {
+			AEAD_CONFIG.Remove(k)
+			handleCache.Remove(k)
+		}
+	}
+
+	applyLogLevel()
+	applyKeyPrefixes()
+
+	return nil
+}
+
+// the level the plugin logs at when LOG_LEVEL is not configured
+var defaultLogLevel = hclog.L().GetLevel()
+
+// applyLogLevel sets the level of the plugin logger, used by the backend and bqutils, from LOG_LEVEL in the config
+// (trace, debug, info, warn or error), or back to the default level if it is not set
+func applyLogLevel() {
+	level := defaultLogLevel
+	if levelIntf, ok := AEAD_CONFIG.Get("LOG_LEVEL"); ok {
+		configLevel := hclog.LevelFromString(fmt.Sprintf("%v", levelIntf))
+		if configLevel == hclog.NoLevel {
+			hclog.L().Error(fmt.Sprintf("invalid LOG_LEVEL %v, expected trace, debug, info, warn or error", levelIntf))
+		} else {
+			level = configLevel
+		}
+	}
+	if hclog.L().GetLevel() != level {
+		hclog.L().SetLevel(level)
+	}
+}
+
+// applyKeyPrefixes sets the prefixes stripped from key names to give the field name, ie the BQ routine names of
+// bqsync, from the comma separated KEY_PREFIXES in the config as well as gcm/ and siv/
+func applyKeyPrefixes() {
+	prefixes := ""
+	if prefixesIntf, ok := AEAD_CONFIG.Get("KEY_PREFIXES"); ok {
+		prefixes = fmt.Sprintf("%v", prefixesIntf)
+	}
+	aeadutils.SetKeyPrefixes(aeadutils.ParseKeyPrefixes(prefixes))
+}
+
+func (b *backend) readConsulConfig(ctx context.Context, s logical.Storage) (map[string]interface{}, error) {
+
+	consulConfig := make(map[string]interface{})
+	entry, err := s.Get(ctx, "config")
+
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	if err := entry.DecodeJSON(&consulConfig); err != nil {
+		return nil, err
+	}
+	return consulConfig, nil
+}
+
+// the storage entry holding the version of the layout of the config entry
+const configVersionEntry = "config_version"
+
+// configMigrations upgrade the stored config from one layout to the next, configMigrations[i] upgrading version i
+// to version i+1, so the current version is the number of migrations. Append to add a new version, never reorder
+var configMigrations = []func(config map[string]interface{}) error{
+	// v0 to v1 - the layout is unchanged, upgrading just tags the existing entries as v1
+	func(config map[string]interface{}) error {
+		return nil
+	},
+}
+
+func currentConfigVersion() int {
+	return len(configMigrations)
+}
+
+// configVersion holds the stored version, config written before versioning was added has no entry and is version 0
+type configVersion struct {
+	Version int `json:"version"`
+}
+
+func readConfigVersion(ctx context.Context, s logical.Storage) (int, error) {
+	entry, err := s.Get(ctx, configVersionEntry)
+	if err != nil {
+		return 0, err
+	}
+	if entry == nil {
+		return 0, nil
+	}
+	var version configVersion
+	if err := entry.DecodeJSON(&version); err != nil {
+		return 0, err
+	}
+	return version.Version, nil
+}
+
+// migrateConfig upgrades the stored config to the current layout, running each migration from the stored version
+// in turn, then saves the config and the new version. Config newer than this plugin is left untouched
+func (b *backend) migrateConfig(ctx context.Context, s logical.Storage) error {
+	version, err := readConfigVersion(ctx, s)
+	if err != nil {
+		return err
+	}
+	if version > currentConfigVersion() {
+		return fmt.Errorf("config is version %d, newer than version %d supported by this plugin", version, currentConfigVersion())
+	}
+	if version == currentConfigVersion() {
+		return nil
+	}
+
+	consulConfig, err := b.readConsulConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if consulConfig != nil {
+		for v := version; v < currentConfigVersion(); v++ {
+			if err := configMigrations[v](consulConfig); err != nil {
+				return fmt.Errorf("failed to migrate config from version %d to %d: %w", v, v+1, err)
+			}
+		}
+		entry, err := logical.StorageEntryJSON("config", consulConfig)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(configVersionEntry, configVersion{Version: currentConfigVersion()})
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return err
+	}
+	hclog.L().Info(fmt.Sprintf("migrated config from version %d to %d", version, currentConfigVersion()))
+	return nil
+}
+
+// checkStoredKeysets logs each gcm/ or siv/ entry of the stored config that is not a valid keyset under the current
+// wrapper, ie one written by hand or part written, so an operator can overwrite it before it is used. It returns their
+// sorted names and changes nothing
+func (b *backend) checkStoredKeysets(ctx context.Context, s logical.Storage) ([]string, error) {
+	consulConfig, err := b.readConsulConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	invalid := []string{}
+	for k, v := range consulConfig {
+		if !strings.HasPrefix(k, "gcm/") && !strings.HasPrefix(k, "siv/") {
+			continue
+		}
+		keySetJson, err := currentKeysetWrapper.Unwrap(fmt.Sprintf("%v", v))
+		if err == nil {
+			_, err = aeadutils.ParseKeySetJson(keySetJson)
+		}
+		if err != nil {
+			hclog.L().Error("the stored keyset " + k + " does not parse, it needs operator attention before it can encrypt or decrypt")
+			invalid = append(invalid, k)
+		}
+	}
+	sort.Strings(invalid)
+	return invalid, nil
+}
+
+// keysetWrapper wraps the keysets in the stored config under a master key. Keysets are only stored in plaintext for
+// now, but a master key rotation would rewrap the config from the old wrapper to the new one
+type keysetWrapper interface {
+	// Name is returned by rewrapConfig, ie plaintext
+	Name() string
+	// Unwrap returns the keyset json of a stored keyset
+	Unwrap(stored string) (string, error)
+	// Wrap returns the keyset json as it is stored
+	Wrap(keySetJson string) (string, error)
+}
+
+// plaintextKeysetWrapper stores keysets as their json, as they always have been
+type plaintextKeysetWrapper struct{}
+
+func (plaintextKeysetWrapper) Name() string {
+	return "plaintext"
+}
+
+func (plaintextKeysetWrapper) Unwrap(stored string) (string, error) {
+	return stored, nil
+}
+
+func (plaintextKeysetWrapper) Wrap(keySetJson string) (string, error) {
+	return keySetJson, nil
+}
+
+// currentKeysetWrapper is the wrapper the stored keysets are under
+var currentKeysetWrapper keysetWrapper = plaintextKeysetWrapper{}
+
+// rewrapKeysets unwraps each keyset in config with from, checks it is still a valid keyset and wraps it with to,
+// returning the sorted names of the keysets. gcm/ and siv/ entries must be keysets, other entries are only rewrapped
+// if they unwrap to a keyset. config is only changed if every keyset rewraps
+func rewrapKeysets(config map[string]interface{}, from keysetWrapper, to keysetWrapper) ([]string, error) {
+	rewrapped := make(map[string]interface{})
+	for k, v := range config {
+		isKeyName := strings.HasPrefix(k, "gcm/") || strings.HasPrefix(k, "siv/")
+		keySetJson, err := from.Unwrap(fmt.Sprintf("%v", v))
+		if err == nil {
+			_, err = aeadutils.ParseKeySetJson(keySetJson)
+		}
+		if err != nil {
+			if isKeyName {
+				// the error does not wrap the underlying error as it can quote the keyset
+				return nil, fmt.Errorf("%s is not a valid keyset under the %s wrapper", k, from.Name())
+			}
+			// plain config, ie an option or a pointer to a keyset
+			continue
+		}
+		stored, err := to.Wrap(keySetJson)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap %s with the %s wrapper", k, to.Name())
+		}
+		rewrapped[k] = stored
+	}
+
+	names := make([]string, 0, len(rewrapped))
+	for k, v := range rewrapped {
+		config[k] = v
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pathRewrapConfig rewraps every stored keyset from the current wrapper to the current wrapper, validating them all
+// on the way. Nothing is saved unless every keyset rewraps
+func (b *backend) pathRewrapConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	consulConfig, err := b.readConsulConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if consulConfig == nil {
+		consulConfig = make(map[string]interface{})
+	}
+
+	names, err := rewrapKeysets(consulConfig, currentKeysetWrapper, currentKeysetWrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := logical.StorageEntryJSON("config", consulConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	// refresh the cache from the rewrapped config
+	err = b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"rewrapped": names,
+			"wrapper":   currentKeysetWrapper.Name(),
+		},
+	}, nil
+}
+
+// INDEX_KEY_PREFIX is the prefix of the config entries holding the index key of a field, idx/<field>. An index key is
+// raw key material for an HMAC rather than a keyset so it is never taken for an encryption key
+const INDEX_KEY_PREFIX = "idx/"
+
+// pathCreateIndexKey creates an index key for each field in the request, ie {"fieldname":""}. An index key is never
+// overwritten as that would change every index token of the field, so nothing is created if any field has one
+func (b *backend) pathCreateIndexKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(data.Raw))
+	for fieldName := range data.Raw {
+		if _, ok := AEAD_CONFIG.Get(INDEX_KEY_PREFIX + fieldName); ok {
+			return nil, codedErrorf(ERROR_FIELD_EXISTS, "%s already has an index key", fieldName)
+		}
+		fields = append(fields, fieldName)
+	}
+	sort.Strings(fields)
+
+	keys := make(map[string]interface{}, len(fields))
+	resp := make(map[string]interface{}, len(fields))
+	for _, fieldName := range fields {
+		key, err := aeadutils.NewIndexKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[INDEX_KEY_PREFIX+fieldName] = key
+		resp[fieldName] = INDEX_KEY_PREFIX + fieldName
+	}
+
+	dn := framework.FieldData{
+		Raw:    keys,
+		Schema: nil,
+	}
+	if _, err := b.pathConfigWrite(ctx, req, &dn); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// pathCreatePRFKey creates a PRF keyset for each name in the request, ie {"tenant-master":""}, held in config as
+// prf/<name> for derive. The optional TEMPLATE names the PRF, HMAC_SHA256_PRF by default. An existing PRF keyset is
+// never overwritten as that would change every output derived from it
+func (b *backend) pathCreatePRFKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	templateName, ok := extractRequestOption(data.Raw, "TEMPLATE")
+	if !ok {
+		templateName = "HMAC_SHA256_PRF"
+	}
+	template, ok := aeadutils.PrfTemplates[strings.ToUpper(templateName)]
+	if !ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "unsupported TEMPLATE %s, expected one of %s", templateName, strings.Join(aeadutils.TemplateNames(aeadutils.PrfTemplates), ", "))
+	}
+
+	resp := make(map[string]interface{})
+	for name := range data.Raw {
+		keyName := aeadutils.PRFKeyPrefix + strings.TrimPrefix(name, aeadutils.PRFKeyPrefix)
+		if _, ok := AEAD_CONFIG.Get(keyName); ok {
+			resp[name] = map[string]interface{}{
+				"created": false,
+				"message": keyName + " key exists",
+			}
+			continue
+		}
+
+		kh, err := aeadutils.CreateNewPRFKeySet(template())
+		if err != nil {
+			return nil, err
+		}
+		b.saveKeyToConfig(kh, keyName, ctx, req, false)
+		resp[name] = map[string]interface{}{
+			"created":  true,
+			"key_name": keyName,
+		}
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+func (b *backend) pathKeyRotate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// an optional template for the new primary keys, ie to move to a stronger key type. It is only used for the
+	// keysets of the same kind (deterministic or not), the others are rotated with the default template
+	template, templateDeterministic, err := extractRotateTemplate(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// every keyset is rotated in memory first and nothing is written if any fails
+	rotated := make(map[string]*keyset.Handle)
+	for keyField, encryptionKey := range AEAD_CONFIG.Items() {
+		fieldName := fmt.Sprintf("%v", keyField)
+		keyStr := fmt.Sprintf("%v", encryptionKey)
+		_, err := aeadutils.ValidateKeySetJson(keyStr)
+		if err != nil || strings.HasPrefix(fieldName, aeadutils.PRFKeyPrefix) || strings.HasPrefix(fieldName, aeadutils.ExportKeyPrefix) {
+			// not a valid key, a PRF keyset which is not rotated as that would change everything derived from it, or
+			// an export keyset which is made again from the keyset of its field when that rotates
+			continue
+		} else {
+			encryptionKeyStr, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionKey)
+			if template != nil && deterministic == templateDeterministic {
+				kh, err := aeadutils.ValidateKeySetJson(encryptionKeyStr)
+				if err != nil {
+					return nil, err
+				}
+				err = aeadutils.RotateKeysWithTemplate(kh, template)
+				if err != nil {
+					hclog.L().Error("failed to rotate " + fieldName + " with the template")
+					return nil, fmt.Errorf("failed to rotate %s with the template: %w", fieldName, err)
+				}
+				rotated[fieldName] = kh
+			} else if deterministic {
+				kh, _, err := aeadutils.CreateInsecureHandleAndDeterministicAead(encryptionKeyStr)
+				if err != nil {
+					hclog.L().Error("failed to create the key handle of " + fieldName)
+					return nil, codedErrorf(ERROR_INVALID_KEYSET, "failed to rotate %s, no keyset was rotated", fieldName)
+				}
+				aeadutils.RotateKeys(kh, true)
+				rotated[fieldName] = kh
+			} else {
+				kh, _, err := aeadutils.CreateInsecureHandleAndAead(encryptionKeyStr)
+				if err != nil {
+					hclog.L().Error("failed to create the key handle of " + fieldName)
+					return nil, codedErrorf(ERROR_INVALID_KEYSET, "failed to rotate %s, no keyset was rotated", fieldName)
+				}
+				aeadutils.RotateKeys(kh, false)
+				rotated[fieldName] = kh
+			}
+		}
+	}
+
+	if err := b.saveRotatedKeysets(ctx, req, rotated); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// saveRotatedKeysets checks each rotated keyset parses again and then writes them all in one config write, a single
+// storage put, so a rotate that fails or is interrupted leaves the stored keysets as they were rather than some rotated
+// and some not
+func (b *backend) saveRotatedKeysets(ctx context.Context, req *logical.Request, rotated map[string]*keyset.Handle) error {
+	if len(rotated) == 0 {
+		return nil
+	}
+	keysets := make(map[string]interface{}, len(rotated))
+	for keyName, kh := range rotated {
+		keyAsJson, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(kh)
+		if err == nil {
+			_, err = aeadutils.ParseKeySetJson(keyAsJson)
+		}
+		if err != nil {
+			// the error is not wrapped as it can quote the keyset
+			return codedErrorf(ERROR_INVALID_KEYSET, "the rotated keyset of %s is not valid, no keyset was rotated", keyName)
+		}
+		keysets[keyName] = keyAsJson
+	}
+	if _, err := b.pathConfigOverwrite(ctx, req, &framework.FieldData{Raw: keysets}); err != nil {
+		return err
+	}
+	for keyName, kh := range rotated {
+		aeadutils.AddKeySetEvent(trace.SpanFromContext(ctx), "rotated", keyName, kh)
+	}
+	return nil
+}
+
+func (b *backend) pathKeyRotateAll(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same optional template as rotate
+	template, templateDeterministic, err := extractRotateTemplate(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// rotate each keyset on its own so one that fails does not stop the rest, then write those that rotated together
+	resp := make(map[string]interface{})
+	failed := []string{}
+	rotated := make(map[string]*keyset.Handle)
+	for keyName, encryptionKey := range AEAD_CONFIG.Items() {
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
+		if err != nil || strings.HasPrefix(keyName, aeadutils.PRFKeyPrefix) || strings.HasPrefix(keyName, aeadutils.ExportKeyPrefix) {
+			// not a keyset, a PRF keyset, or an export keyset which follows the keyset of its field
+			continue
+		}
+		_, deterministic := aeadutils.IsKeyJsonDeterministic(encryptionKey)
+		keyTemplate := template
+		if deterministic != templateDeterministic {
+			keyTemplate = nil
+		}
+		primaryKeyId, err := aeadutils.RotateKeySet(kh, keyTemplate)
+		if err != nil {
+			hclog.L().Error("failed to rotate " + keyName)
+			failed = append(failed, fmt.Sprintf("failed to rotate %s: %v", keyName, err))
+			continue
+		}
+		rotated[keyName] = kh
+		resp[keyName] = primaryKeyId
+	}
+	if err := b.saveRotatedKeysets(ctx, req, rotated); err != nil {
+		return nil, err
+	}
+
+	response := &logical.Response{
+		Data: resp,
+	}
+	sort.Strings(failed)
+	for _, warning := range failed {
+		response.AddWarning(warning)
+	}
+	return response, nil
+}
+
+// extractRotateTemplate removes the optional TEMPLATE for the new primary keys from the request, returning the
+// template, or nil, and whether it makes deterministic keys
+func extractRotateTemplate(data map[string]interface{}) (*tinkpb.KeyTemplate, bool, error) {
+	v, ok := data["TEMPLATE"]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(data, "TEMPLATE")
+	templateJson, err := templateJsonFromValue(v)
+	if err != nil {
+		return nil, false, err
+	}
+	template, err := aeadutils.KeyTemplateFromJson(templateJson)
+	if err != nil {
+		return nil, false, err
+	}
+	templateDeterministic, err := aeadutils.IsKeyTemplateDeterministic(template)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkTemplateMinAeadBits("TEMPLATE", template); err != nil {
+		return nil, false, err
+	}
+	return template, templateDeterministic, nil
+}
+
+// templateJsonFromValue returns a json key template supplied either as a json string or as an object
+func templateJsonFromValue(v interface{}) (string, error) {
+	templateMap, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Sprintf("%s", v), nil
+	}
+	templateBytes, err := json.Marshal(templateMap)
+	if err != nil {
+		return "", err
+	}
+	return string(templateBytes), nil
+}
+
+func (b *backend) pathPurgeKeys(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// data.Raw is map[string]interface{} of the fields to purge, the values are ignored
+	// map['field0':'', 'field1':'']
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// optionally purge DESTROYED keys as well as DISABLED keys
+	includeDestroyed := false
+	includeDestroyedStr, ok := extractRequestOption(data.Raw, "INCLUDE_DESTROYED")
+	if ok {
+		includeDestroyed, err = strconv.ParseBool(includeDestroyedStr)
+		if err != nil {
+			return nil, fmt.Errorf("INCLUDE_DESTROYED must be true or false: %w", err)
+		}
+	}
+
+	// purge every keyset first so nothing is saved if any field fails
+	keyHandles := make(map[string]*keyset.Handle)
+	resp := make(map[string]interface{})
+	for fieldName := range data.Raw {
+		keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		if !ok {
+			return nil, fmt.Errorf("no keyset found for %s", fieldName)
+		}
+		encryptionKey, _ := AEAD_CONFIG.Get(keyName)
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the keyset for %s: %w", fieldName, err)
+		}
+
+		newKh, purged, err := aeadutils.PurgeKeys(kh, includeDestroyed)
+		if err != nil {
+			hclog.L().Error("failed to purge the keys for " + fieldName)
+			return nil, fmt.Errorf("failed to purge the keys for %s: %w", fieldName, err)
+		}
+		if purged > 0 {
+			keyHandles[keyName] = newKh
+		}
+		resp[fieldName] = purged
+	}
+
+	for keyName, kh := range keyHandles {
+		b.saveKeyToConfig(kh, keyName, ctx, req, true)
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// pathRepairPrimary checks that the primary key of each keyset is ENABLED, as a keyset whose primary is DISABLED or
+// DESTROYED cannot encrypt. data.Raw is the fields to check, or empty for every keyset. With REPAIR true the newest
+// ENABLED key of each broken keyset is promoted to primary, otherwise nothing is changed. The response has each broken
+// keyset with what was found and changed, and the number of keysets checked
+func (b *backend) pathRepairPrimary(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	repair := false
+	repairStr, ok := extractRequestOption(data.Raw, "REPAIR")
+	if ok {
+		repair, err = strconv.ParseBool(repairStr)
+		if err != nil {
+			return nil, fmt.Errorf("REPAIR must be true or false: %w", err)
+		}
+	}
+
+	// the keysets to check, the keysets of the fields or else every keyset
+	keyNames := []string{}
+	if len(data.Raw) > 0 {
+		for fieldName := range data.Raw {
+			keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+			if !ok {
+				return nil, fmt.Errorf("no keyset found for %s", fieldName)
+			}
+			keyNames = append(keyNames, keyName)
+		}
+	} else {
+		for k, v := range AEAD_CONFIG.Items() {
+			if _, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", v)); err == nil {
+				keyNames = append(keyNames, k)
+			}
+		}
+	}
+	sort.Strings(keyNames)
+
+	// check every keyset first so nothing is saved if any keyset cannot be read
+	keyHandles := make(map[string]*keyset.Handle)
+	broken := make(map[string]interface{})
+	checked := 0
+	for _, keyName := range keyNames {
+		if _, ok := broken[keyName]; ok {
+			// two fields share the keyset
+			continue
+		}
+		encryptionKey, _ := AEAD_CONFIG.Get(keyName)
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the keyset %s", keyName)
+		}
+		problem, candidate, err := aeadutils.CheckPrimary(kh)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the keyset %s: %w", keyName, err)
+		}
+		checked++
+		if problem == "" {
+			continue
+		}
+
+		result := map[string]interface{}{
+			"problem":  problem,
+			"repaired": false,
+		}
+		switch {
+		case candidate == 0:
+			result["message"] = "no ENABLED key to promote"
+		case !repair:
+			result["message"] = fmt.Sprintf("set REPAIR to promote key %d", candidate)
+		default:
+			newKh, err := aeadutils.UpdatePrimaryKeyID(kh, strconv.Itoa(candidate))
+			if err != nil {
+				return nil, fmt.Errorf("failed to promote key %d of %s: %w", candidate, keyName, err)
+			}
+			keyHandles[keyName] = newKh
+			result["repaired"] = true
+			result["primary"] = candidate
+		}
+		broken[keyName] = result
+	}
+
+	for keyName, kh := range keyHandles {
+		b.saveKeyToConfig(kh, keyName, ctx, req, true)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"checked": checked,
+			"broken":  broken,
+		},
+	}, nil
+}
+
+// fieldOptionPrefixes are the config options that are set per field, as the prefix followed by the field name
+var fieldOptionPrefixes = []string{"ADDITIONAL_DATA_", "AAD_IS_B64_", "AAD_PARTS_", "COMPRESS_", "DETERMINISTIC_", "DECRYPT_CACHE_", "BQ_KMSKEY_", "RATE_LIMIT_", "VERSION_TAG_", "AAD_INHERIT_", "ENCODING_", "AAD_HISTORY_"}
+
+// pathRenameKey renames fields, data.Raw is the old field name to the new field name. The keyset of the field, its
+// index key, its pointer and its per field options (ie ADDITIONAL_DATA_<field>) move to the new name, and the pointers of other fields
+// to the keyset are updated. Everything is written in one config write under the locks of both names, so encrypt and
+// decrypt see the field under the old name or the new name, never part renamed. A new name that has any config
+// already fails the request and nothing is saved.
+// The additional data of a field defaults to its name, so cyphertext from before the rename only decrypts under the
+// new name if the additional data is kept - KEEP_ADDITIONAL_DATA=true sets ADDITIONAL_DATA_<new> to the old name if the
+// field did not have its own additional data, inherit that of its family or have DEFAULT_ADDITIONAL_DATA
+func (b *backend) pathRenameKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	keepAdditionalData := false
+	keepStr, ok := extractRequestOption(data.Raw, "KEEP_ADDITIONAL_DATA")
+	if ok {
+		var err error
+		keepAdditionalData, err = strconv.ParseBool(keepStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "KEEP_ADDITIONAL_DATA must be true or false: %w", err)
+		}
+	}
+	if len(data.Raw) == 0 {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "no fields to rename")
+	}
+
+	renames := make(map[string]string, len(data.Raw))
+	lockNames := []string{}
+	for oldName, newNameIntf := range data.Raw {
+		newName := fmt.Sprintf("%v", newNameIntf)
+		if err := aeadutils.ValidateFieldName(newName); err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%w", err)
+		}
+		if newName == oldName {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%s cannot be renamed to itself", oldName)
+		}
+		renames[oldName] = newName
+		lockNames = append(lockNames, oldName, newName)
+	}
+	oldNames := mapKeys(data.Raw)
+	sort.Strings(oldNames)
+
+	// encrypt and decrypt of both names wait for the rename
+	unlock := b.lockFields(lockNames, true)
+	defer unlock()
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// rename in a copy of the config so nothing changes unless every rename is valid
+	config := AEAD_CONFIG.Items()
+	resp := make(map[string]interface{})
+	for _, oldName := range oldNames {
+		newName := renames[oldName]
+
+		for _, k := range fieldConfigNames(newName) {
+			if _, ok := config[k]; ok {
+				return nil, codedErrorf(ERROR_FIELD_EXISTS, "%s cannot be renamed to %s as %s is already configured", oldName, newName, k)
+			}
+		}
+
+		moved := make(map[string]interface{})
+		for _, k := range fieldConfigNames(oldName) {
+			v, ok := config[k]
+			if !ok {
+				continue
+			}
+			newKey := strings.TrimSuffix(k, oldName) + newName
+			config[newKey] = v
+			delete(config, k)
+			moved[k] = newKey
+		}
+		if len(moved) == 0 {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s has no keyset or config to rename", oldName)
+		}
+
+		// the pointers to the keyset, including the field's own, follow it
+		keyName, _ := aeadutils.GetEncryptionKeyName(oldName, AEAD_CONFIG)
+		pointers := []string{}
+		for _, prefix := range []string{"gcm/", "siv/"} {
+			if _, ok := moved[prefix+oldName]; !ok {
+				continue
+			}
+			keyName = prefix + newName
+			for k, v := range config {
+				if fmt.Sprintf("%v", v) == prefix+oldName {
+					config[k] = keyName
+					if k != newName {
+						pointers = append(pointers, k)
+					}
+				}
+			}
+		}
+		sort.Strings(pointers)
+
+		_, hasAdditionalData := moved["ADDITIONAL_DATA_"+oldName]
+		_, hasAADParts := moved["AAD_PARTS_"+oldName]
+		_, hasDefaultAdditionalData := defaultAdditionalData()
+		if keepAdditionalData && !hasAdditionalData && !hasAADParts && !hasDefaultAdditionalData && additionalDataName(oldName) == oldName {
+			config["ADDITIONAL_DATA_"+newName] = oldName
+		}
+
+		resp[oldName] = map[string]interface{}{
+			"renamed_to": newName,
+			"key_name":   keyName,
+			"moved":      moved,
+			"pointers":   pointers,
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON("config", config)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	// the rename is saved, bring the cached config in line
+	for k, v := range config {
+		AEAD_CONFIG.Set(k, v)
+	}
+	for k := range AEAD_CONFIG.Items() {
+		if _, ok := config[k]; !ok {
+			AEAD_CONFIG.Remove(k)
+			handleCache.Remove(k)
+			ok, err := deleteFromKV(k)
+			if !ok || err != nil {
+				hclog.L().Error("failed to delete from KV " + k)
+			}
+		}
+	}
+	for _, oldName := range oldNames {
+		decryptCaches.Remove(oldName)
+		for _, k := range fieldConfigNames(renames[oldName]) {
+			if v, ok := config[k]; ok {
+				ok, err := saveToKV(k, v)
+				if !ok || err != nil {
+					hclog.L().Error(fmt.Sprintf("failed to save to KV:%s Error:%v", k, err))
+				}
+			}
+		}
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// fieldConfigNames are the config entries that belong to a field - its keysets, its index key, its pointer and its per
+// field options
+func fieldConfigNames(fieldName string) []string {
+	names := []string{"gcm/" + fieldName, "siv/" + fieldName, aeadutils.ExportKeyPrefix + fieldName, INDEX_KEY_PREFIX + fieldName, fieldName}
+	for _, prefix := range fieldOptionPrefixes {
+		names = append(names, prefix+fieldName)
+	}
+	return names
+}
+
+func (b *backend) pathConvertPrefix(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// data.Raw is map[string]interface{} of field to the new output prefix type
+	// map['field0':'RAW', 'field1':'TINK']
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// convert every keyset first so nothing is saved if any field fails
+	keyHandles := make(map[string]*keyset.Handle)
+	resp := make(map[string]interface{})
+	for fieldName, v := range data.Raw {
+		keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		if !ok {
+			return nil, fmt.Errorf("no keyset found for %s", fieldName)
+		}
+		encryptionKey, _ := AEAD_CONFIG.Get(keyName)
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the keyset for %s: %w", fieldName, err)
+		}
+
+		newKh, changed, err := aeadutils.ConvertOutputPrefix(kh, fmt.Sprintf("%v", v))
+		if err != nil {
+			hclog.L().Error("failed to convert the output prefix for " + fieldName)
+			return nil, fmt.Errorf("failed to convert the output prefix for %s: %w", fieldName, err)
+		}
+		if changed {
+			keyHandles[keyName] = newKh
+		}
+		keyAsJson, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(newKh)
+		if err != nil {
+			return nil, err
+		}
+		resp[fieldName] = muteKeyMaterial(keyAsJson)
+	}
+
+	for keyName, kh := range keyHandles {
+		b.saveKeyToConfig(kh, keyName, ctx, req, true)
+	}
+
+	response := &logical.Response{
+		Data: resp,
+	}
+	for keyName := range keyHandles {
+		response.AddWarning("the output prefix of " + keyName + " has changed, existing cyphertext made with this keyset will no longer decrypt")
+	}
+	return response, nil
+}
+
+// pathExportKey makes the export keyset of each field, used by encrypt and decrypt with MODE=export. data.Raw is the
+// field to the output prefix of its export keyset, or empty for the config option EXPORT_PREFIX (default RAW). The
+// export keyset is a copy of the keyset of the field with that output prefix, saved as export/<field>, and is made again
+// whenever the keyset of the field is written (see rederiveExportKeysets), ie on a rotate
+func (b *backend) pathExportKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// convert every keyset first so nothing is saved if any field fails
+	exportKeys := make(map[string]interface{})
+	resp := make(map[string]interface{})
+	for fieldName, v := range data.Raw {
+		encryptionKey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+		if !ok {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "no keyset found for %s", fieldName)
+		}
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionKey))
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "failed to read the keyset for %s: %w", fieldName, err)
+		}
+
+		outputPrefix := fmt.Sprintf("%v", v)
+		if outputPrefix == "" {
+			outputPrefix = exportPrefix()
+		}
+		exportKh, _, err := aeadutils.ConvertOutputPrefix(kh, outputPrefix)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "failed to make the export keyset for %s: %w", fieldName, err)
+		}
+		keyAsJson, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(exportKh)
+		if err != nil {
+			return nil, err
+		}
+		exportKeys[aeadutils.ExportKeyPrefix+fieldName] = keyAsJson
+		resp[fieldName] = muteKeyMaterial(keyAsJson)
+	}
+
+	// one config write, under the field locks
+	dn := framework.FieldData{
+		Raw:    exportKeys,
+		Schema: nil,
+	}
+	if _, err := b.pathConfigOverwrite(ctx, req, &dn); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// rederiveExportKeysets makes each export keyset in config again from the keyset of its field, with the output prefix it
+// already has, when that keyset is one of the config entries written. An export keyset written itself is left as it is
+func rederiveExportKeysets(written map[string]bool, overwriteKV bool) error {
+	for k, v := range AEAD_CONFIG.Items() {
+		if !strings.HasPrefix(k, aeadutils.ExportKeyPrefix) || written[k] {
+			continue
+		}
+		fieldName := strings.TrimPrefix(k, aeadutils.ExportKeyPrefix)
+		keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		if !ok || !written[keyName] {
+			continue
+		}
+		// the errors do not wrap the parse error as it can quote the keyset
+		exportKh, err := aeadutils.ParseKeySetJson(fmt.Sprintf("%v", v))
+		if err != nil {
+			return codedErrorf(ERROR_INVALID_KEYSET, "the export keyset of %s is not a valid keyset", fieldName)
+		}
+		outputPrefix, err := aeadutils.PrimaryOutputPrefix(exportKh)
+		if err != nil {
+			return codedErrorf(ERROR_INVALID_KEYSET, "the export keyset of %s: %w", fieldName, err)
+		}
+		encryptionKey, _ := AEAD_CONFIG.Get(keyName)
+		kh, err := aeadutils.ParseKeySetJson(fmt.Sprintf("%v", encryptionKey))
+		if err != nil {
+			return codedErrorf(ERROR_INVALID_KEYSET, "%s is not a valid keyset, its export keyset cannot be made again", keyName)
+		}
+		exportKh, _, err = aeadutils.ConvertOutputPrefix(kh, outputPrefix)
+		if err != nil {
+			return codedErrorf(ERROR_INVALID_KEYSET, "failed to make the export keyset of %s again: %w", fieldName, err)
+		}
+		keyAsJson, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(exportKh)
+		if err != nil {
+			return err
+		}
+		AEAD_CONFIG.Set(k, keyAsJson)
+		if overwriteKV {
+			ok, err := saveToKV(k, keyAsJson)
+			if !ok || err != nil {
+				hclog.L().Error("rederiveExportKeysets failed to save to KV:" + k)
+			}
+		}
+	}
+	return nil
+}
+
+// exportPrefix is the output prefix of the export keysets from the config option EXPORT_PREFIX, or RAW if there is
+// none
+func exportPrefix() string {
+	prefix, ok := AEAD_CONFIG.Get("EXPORT_PREFIX")
+	if !ok || fmt.Sprintf("%v", prefix) == "" {
+		return "RAW"
+	}
+	return fmt.Sprintf("%v", prefix)
+}
+
+func (b *backend) pathUpdateKeyStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// data.Raw is map[string]map[string]string
+	// map['field0':map['key':'status']]
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make(map[string]interface{})
+
+	for fieldName, v := range data.Raw {
+		// GET THE KEY
+		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+		if !ok {
+			hclog.L().Error("failed to get an existing key")
+		}
+		rawKeyset := fmt.Sprintf("%s", encryptionkey)
+		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
+		kh, err := insecurecleartextkeyset.Read(r)
+		if err != nil {
+			hclog.L().Error("failed to get an existing key handle")
+		}
+
+		//assert
+		vMap := v.(map[string]interface{})
+		for keyId, status := range vMap {
+			statusStr := fmt.Sprintf("%s", status)
+
+			// update the status, get a new heyhandle
+			newKh, err := aeadutils.UpdateKeyStatus(kh, keyId, statusStr)
+			if err != nil || newKh == nil {
+				hclog.L().Error("failed to update the status")
+				resp[fieldName] = "failed to update the status"
+			} else {
+
+				// save the keyhandle for the field
+				b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
+
+				// extract the JSON from the new key
+				buf := new(bytes.Buffer)
+				jsonWriter := keyset.NewJSONWriter(buf)
+				insecurecleartextkeyset.Write(newKh, jsonWriter)
+				// unmarshall the keyset
+				str := buf.String()
+				resp[fieldName] = str
+			}
+		}
+	}
+
+	mutedResult := make(map[string]interface{}, len(resp))
+	for k, v := range resp {
+		_, err := aeadutils.ValidateKeySetJson(v.(string))
+		if err == nil {
+			// we do have a valid key
+			v = muteKeyMaterial(v.(string))
+		}
+		mutedResult[k] = v
+	}
+
+	return &logical.Response{
+		Data: mutedResult,
+	}, nil
+}
+func (b *backend) pathUpdateKeyMaterial(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// data.Raw is map[string]map[string]string
+	// map['field0':map['key':'material']]
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := make(map[string]interface{})
+
+	for fieldName, v := range data.Raw {
+		// GET THE KEY
+		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+
+		if !ok {
+			hclog.L().Error("failed to get an existing key")
+		}
+		rawKeyset := fmt.Sprintf("%s", encryptionkey)
+		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
+		kh, err := insecurecleartextkeyset.Read(r)
+		if err != nil {
+			hclog.L().Error("failed to get an existing key handle")
+		}
+
+		//assert
+		vMap := v.(map[string]interface{})
+		for keyId, material := range vMap {
+			materialStr := fmt.Sprintf("%s", material)
+
+			// update the status, get a new heyhandle
+			newKh, err := aeadutils.UpdateKeyMaterial(kh, keyId, materialStr)
+			if err != nil {
+				hclog.L().Error("failed to update the material")
+				resp[fieldName] = "failed to update the material"
+			} else {
+
+				// save the keyhandle for the field
+				b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
+
+				// extract the JSON from the new key
+				buf := new(bytes.Buffer)
+				jsonWriter := keyset.NewJSONWriter(buf)
+				insecurecleartextkeyset.Write(newKh, jsonWriter)
+				// unmarshall the keyset
+				str := buf.String()
+				resp[fieldName] = str
+			}
+		}
+	}
+
+	mutedResult := make(map[string]interface{}, len(resp))
+	for k, v := range resp {
+		_, err := aeadutils.ValidateKeySetJson(v.(string))
+		if err == nil {
+			// valid key
+			v = muteKeyMaterial(v.(string))
+		}
+		mutedResult[k] = v
+	}
+
+	return &logical.Response{
+		Data: mutedResult,
+	}, nil
+}
+func (b *backend) pathUpdatePrimaryKeyID(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// data.Raw is map[string]string
+	// map['field0':'primaryKey']]
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := make(map[string]interface{})
+
+	for fieldName, v := range data.Raw {
+		// GET THE KEY
+		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+
+		if !ok {
+			hclog.L().Error("failed to get an existing key")
+		}
+		rawKeyset := fmt.Sprintf("%s", encryptionkey)
+		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
+		kh, err := insecurecleartextkeyset.Read(r)
+		if err != nil {
+			hclog.L().Error("failed to get an existing key handle")
+		}
+
+		//assert
+		newPrimaryKeyStr := fmt.Sprintf("%s", v)
+
+		// update the status, get a new heyhandle
+		newKh, err := aeadutils.UpdatePrimaryKeyID(kh, newPrimaryKeyStr)
+		if err != nil {
+			hclog.L().Error("failed to update the keyID")
+			resp[fieldName] = "failed to update the keyID"
+		} else {
+
+			// save the keyhandle for the field
+			b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
+
+			// extract the JSON from the new key
+			buf := new(bytes.Buffer)
+			jsonWriter := keyset.NewJSONWriter(buf)
+			insecurecleartextkeyset.Write(newKh, jsonWriter)
+			// unmarshall the keyset
+			str := buf.String()
+			resp[fieldName] = str
+		}
+
+	}
+
+	mutedResult := make(map[string]interface{}, len(resp))
+	for k, v := range resp {
+		_, err := aeadutils.ValidateKeySetJson(v.(string))
+		if err == nil {
+			// valid key
+			v = muteKeyMaterial(v.(string))
+		}
+		mutedResult[k] = v
+	}
+
+	return &logical.Response{
+		Data: mutedResult,
+	}, nil
+}
+
+// pathSetPrimaryByMaterial promotes the key whose material matches the value supplied for each field to the primary of
+// the field's keyset, ie {"field2":"GiBQUDTlxVawIr3T1/dRvuF5CzBhTZtnnpuVsNZayxv1LQ=="}. The keys are all found before
+// anything is saved so one bad field fails the whole request
+func (b *backend) pathSetPrimaryByMaterial(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldNames := make([]string, 0, len(data.Raw))
+	for fieldName := range data.Raw {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+
+	newKeys := make(map[string]*keyset.Handle, len(fieldNames))
+	for _, fieldName := range fieldNames {
+		keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		if !ok {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s does not have a keyset", fieldName)
+		}
+		encryptionkey, _ := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+		kh, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionkey))
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "%s does not have a valid keyset", fieldName)
+		}
+		keyID, err := aeadutils.KeyIDByMaterial(kh, fmt.Sprintf("%v", data.Raw[fieldName]))
+		if err != nil {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s: %w", fieldName, err)
+		}
+		newKh, err := aeadutils.UpdatePrimaryKeyID(kh, strconv.Itoa(keyID))
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to update the primary key: %w", fieldName, err)
+		}
+		newKeys[keyName] = newKh
+	}
+
+	resp := make(map[string]interface{})
+	for _, fieldName := range fieldNames {
+		keyName, _ := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		newKh := newKeys[keyName]
+
+		// save under the resolved key name, so a field in a family promotes the family key
+		b.saveKeyToConfig(newKh, keyName, ctx, req, true)
+
+		buf := new(bytes.Buffer)
+		insecurecleartextkeyset.Write(newKh, keyset.NewJSONWriter(buf))
+		resp[fieldName] = muteKeyMaterial(buf.String())
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// pathAddKey adds a new ENABLED key to the keyset of each field, leaving the primary as it is so the new key can be
+// rolled out to consumers before it is promoted with updatePrimaryKeyID or setPrimaryByMaterial. The values are
+// ignored. The optional TEMPLATE, as for rotate, makes the new keys and must be of the keysets' kind. Nothing is saved
+// if any field fails
+func (b *backend) pathAddKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	template, templateDeterministic, err := extractRotateTemplate(data.Raw)
+	if err != nil {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "%w", err)
+	}
+
+	fieldNames := mapKeys(data.Raw)
+	if len(fieldNames) == 0 {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "no fields to add a key to")
+	}
+	sort.Strings(fieldNames)
+
+	newKeys := make(map[string]*keyset.Handle, len(fieldNames))
+	resp := make(map[string]interface{})
+	for _, fieldName := range fieldNames {
+		keyName, ok := aeadutils.GetEncryptionKeyName(fieldName, AEAD_CONFIG)
+		if !ok {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s does not have a keyset", fieldName)
+		}
+		if strings.HasPrefix(keyName, aeadutils.PRFKeyPrefix) {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%s is a PRF keyset, keys are not added to it", fieldName)
+		}
+		kh, ok := newKeys[keyName]
+		if !ok {
+			encryptionkey, _ := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+			kh, err = aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", encryptionkey))
+			if err != nil {
+				return nil, codedErrorf(ERROR_INVALID_KEYSET, "%s does not have a valid keyset", fieldName)
+			}
+		}
+		if template != nil && aeadutils.IsKeyHandleDeterministic(kh) != templateDeterministic {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "TEMPLATE is not the same kind of key as the keyset of %s", fieldName)
+		}
+		keyID, err := aeadutils.AddKeySet(kh, template)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to add a key: %w", fieldName, err)
+		}
+		newKeys[keyName] = kh
+		resp[fieldName] = map[string]interface{}{
+			"key_name":       keyName,
+			"key_id":         keyID,
+			"primary_key_id": kh.KeysetInfo().GetPrimaryKeyId(),
+		}
+	}
+
+	for keyName, kh := range newKeys {
+		// save under the resolved key name, so a field in a family adds to the family key
+		b.saveKeyToConfig(kh, keyName, ctx, req, true)
+		aeadutils.AddKeySetEvent(trace.SpanFromContext(ctx), "key added", keyName, kh)
+	}
+
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+func (b *backend) pathUpdateKeyID(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// data.Raw is map[string]map[string]string
+	// map['field0':map['key':'newkey']]
+	// retrive the config from  storage
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := make(map[string]interface{})
+
+	for fieldName, v := range data.Raw {
+		// GET THE KEY
+		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+
+		if !ok {
+			hclog.L().Error("failed to get an existing key")
+		}
+		rawKeyset := fmt.Sprintf("%s", encryptionkey)
+		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
+		kh, err := insecurecleartextkeyset.Read(r)
+		if err != nil {
+			hclog.L().Error("failed to get an existing key handle")
+		}
+
+		//assert
+		vMap := v.(map[string]interface{})
+		for keyId, newKey := range vMap {
+			newKeyStr := fmt.Sprintf("%s", newKey)
+
+			// update the status, get a new heyhandle
+			newKh, err := aeadutils.UpdateKeyID(kh, keyId, newKeyStr)
+			if err != nil {
+				hclog.L().Error("failed to update the keyid")
+				resp[fieldName] = "failed to update the keyid"
+			} else {
+
+				// save the keyhandle for the field
+				b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
+
+				// extract the JSON from the new key
+				buf := new(bytes.Buffer)
+				jsonWriter := keyset.NewJSONWriter(buf)
+				insecurecleartextkeyset.Write(newKh, jsonWriter)
+				// unmarshall the keyset
+				str := buf.String()
+				resp[fieldName] = str
+			}
+		}
+	}
+
+	mutedResult := make(map[string]interface{}, len(resp))
+	for k, v := range resp {
+		_, err := aeadutils.ValidateKeySetJson(v.(string))
+		if err == nil {
+			// valid key
+			v = muteKeyMaterial(v.(string))
+		}
+		mutedResult[k] = v
+	}
+
+	return &logical.Response{
+		Data: mutedResult,
+	}, nil
+}
+
+// newSecretFetcher creates the client importKey reads sm:// references with, replaced in the tests
+var newSecretFetcher = aeadutils.NewSecretFetcher
+
+// resolveSecretRefs replaces the sm:// references in data with the keysets held in secret manager, returning the
+// references so they, rather than the key material, can be returned
+func resolveSecretRefs(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error) {
+	refs := make(map[string]interface{})
+	var fetcher aeadutils.SecretFetcher
+	for k, v := range data {
+		ref, ok := v.(string)
+		if !ok || !aeadutils.IsSecretManagerRef(ref) {
+			continue
+		}
+		name, err := aeadutils.SecretManagerName(ref)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%s: %w", k, err)
+		}
+		if fetcher == nil {
+			fetcher, err = newSecretFetcher(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create the secret manager client: %w", err)
+			}
+		}
+		payload, err := fetcher.AccessSecretVersion(ctx, name)
+		if err != nil {
+			return nil, codedErrorf(ERROR_KEY_NOT_FOUND, "%s: failed to read %s: %w", k, ref, err)
+		}
+		// the error does not wrap the validation error as it can quote the keyset
+		if _, err := aeadutils.ValidateImportKeySetJson(string(payload)); err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "%s: %s is not a valid keyset", k, ref)
+		}
+		data[k] = string(payload)
+		refs[k] = ref
+	}
+	return refs, nil
+}
+
+func (b *backend) pathImportKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage, for MIN_AEAD_BITS
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response has the key types under KEY_TYPES, so no field can be called that
+	if _, ok := data.Raw["KEY_TYPES"]; ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "KEY_TYPES is reserved for the response and cannot be imported as a field")
+	}
+
+	// keysets can be supplied as sm:// references to secret manager rather than as json
+	refs, err := resolveSecretRefs(ctx, data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// data.Raw should be map[string]interface{}
+	keyHandles := make(map[string]*keyset.Handle)
+	keyTypes := make(map[string]interface{})
+	for k, v := range data.Raw {
+		// k is the field of the key
+		// v is the json representation of a string
+		jSonKeyset := fmt.Sprintf("%s", v)
+
+		// is the json a valid key
+		if _, err := aeadutils.ParseKeySetJson(jSonKeyset); err != nil {
+			hclog.L().Error("pathImportKey Invaid Json as key " + k)
+			return &logical.Response{
+				Data: make(map[string]interface{}),
+			}, invalidKeysetError(k)
+		}
+		// once it parses the import rules name key ids and key types, not key material, so the reason is returned
+		kh, err := aeadutils.ValidateImportKeySetJson(jSonKeyset)
+		if err != nil {
+			return &logical.Response{
+				Data: make(map[string]interface{}),
+			}, codedErrorf(ERROR_INVALID_KEYSET, "%s is not a valid keyset: %w", k, err)
+		}
+		if err := checkMinAeadBits(k, kh); err != nil {
+			return nil, err
+		}
+		keyHandles[k] = kh
+
+		// the same classification as keyinfo, so a script does not need a keytypes call after the import
+		keyType := "NON DETERMINISTIC"
+		if aeadutils.IsKeyHandleDeterministic(kh) {
+			keyType = "DETERMINISTIC"
+		}
+		algorithm, _ := aeadutils.GetKeySetAlgorithms(jSonKeyset)
+		keyTypes[k] = map[string]interface{}{
+			"KEY_NAME":  aeadutils.GetKeyPrefix(k, "", kh) + k,
+			"TYPE":      keyType,
+			"ALGORITHM": algorithm,
+		}
+	}
+	// ok, its ALL valid, save it
+	_, err = b.configWriteOverwriteCheck(ctx, req, data, true, true)
+	if err != nil {
+		hclog.L().Error("save key failed", err.Error())
+		return &logical.Response{
+			Data: make(map[string]interface{}),
+		}, err
+	}
+	for k, kh := range keyHandles {
+		aeadutils.AddKeySetEvent(trace.SpanFromContext(ctx), "imported", aeadutils.GetKeyPrefix(k, "", kh)+k, kh)
+	}
+	// the keysets as they were supplied, the reference rather than the keyset for those from secret manager
+	respData := make(map[string]interface{}, len(data.Raw)+1)
+	for k, v := range data.Raw {
+		respData[k] = v
+	}
+	for k, ref := range refs {
+		respData[k] = ref
+	}
+	respData["KEY_TYPES"] = keyTypes
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+// newKMSWrapper creates the kms client importKeyEncrypted unwraps keysets with, replaced in the tests
+var newKMSWrapper = bqutils.NewKMSWrapper
+
+// pathImportKeyEncrypted imports keysets supplied wrapped by a kms key, as base64 of the wrapped keyset. KMS_KEY is the
+// kms key that wrapped them, unwrapped with the provider in BQ_KMS_PROVIDER (default gcp). The unwrapped keyset can be
+// json or tink binary, and is validated and stored as importKey does. The key material is never returned, the response
+// has the name each keyset is stored under
+func (b *backend) pathImportKeyEncrypted(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	kmsKey, ok := extractRequestOption(data.Raw, "KMS_KEY")
+	if !ok || kmsKey == "" {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "KMS_KEY must be the kms key the keysets are wrapped with")
+	}
+	if len(data.Raw) == 0 {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "no wrapped keysets supplied")
+	}
+
+	// the kms provider is a setting, falling back to config
+	if err := b.getAeadConfig(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := b.getAeadSettings(ctx, req); err != nil {
+		return nil, err
+	}
+	kmsWrapper, err := newKMSWrapper(ctx, bqOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the kms client: %w", err)
+	}
+	defer kmsWrapper.Close()
+
+	// unwrap everything before anything is saved. The errors never wrap the validation error as it can quote the keyset
+	keysets := make(map[string]interface{})
+	keyHandles := make(map[string]*keyset.Handle)
+	for k, v := range data.Raw {
+		wrappedKeyset, err := b64.StdEncoding.DecodeString(fmt.Sprintf("%v", v))
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%s is not a base64 wrapped keyset: %w", k, err)
+		}
+		unwrappedKeyset, err := kmsWrapper.UnwrapKeyset(ctx, kmsKey, wrappedKeyset)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "%s could not be unwrapped with %s: %w", k, kmsKey, err)
+		}
+		jSonKeyset, err := unwrappedKeySetJson(unwrappedKeyset)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "%s is not a valid keyset once unwrapped", k)
+		}
+		kh, err := aeadutils.ValidateImportKeySetJson(jSonKeyset)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_KEYSET, "%s is not a valid keyset once unwrapped", k)
+		}
+		if err := checkMinAeadBits(k, kh); err != nil {
+			return nil, err
+		}
+		keysets[k] = jSonKeyset
+		keyHandles[k] = kh
+	}
+
+	_, err = b.configWriteOverwriteCheck(ctx, req, &framework.FieldData{Raw: keysets, Schema: data.Schema}, true, true)
+	if err != nil {
+		hclog.L().Error("save key failed", err.Error())
+		return nil, err
+	}
+	keyNames := make(map[string]interface{})
+	for k, kh := range keyHandles {
+		keyNames[k] = aeadutils.GetKeyPrefix(k, "", kh) + k
+		aeadutils.AddKeySetEvent(trace.SpanFromContext(ctx), "imported", keyNames[k].(string), kh)
+	}
+	return &logical.Response{
+		Data: keyNames,
+	}, nil
+}
+
+// unwrappedKeySetJson returns the json of an unwrapped keyset, which is either json or tink binary
+func unwrappedKeySetJson(unwrappedKeyset []byte) (string, error) {
+	if json.Valid(unwrappedKeyset) {
+		return string(unwrappedKeyset), nil
+	}
+	kh, err := insecurecleartextkeyset.Read(keyset.NewBinaryReader(bytes.NewReader(unwrappedKeyset)))
+	if err != nil {
+		return "", err
+	}
+	return aeadutils.ExtractInsecureKeySetFromKeyhandle(kh)
+}
 
-		//assert
-		newPrimaryKeyStr := fmt.Sprintf("%s", v)
+// pathValidateKey runs the importKey validation over each field's keyset and returns how it would be classified,
+// without writing anything, so keysets can be checked before they are imported
+func (b *backend) pathValidateKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
-		// update the status, get a new heyhandle
-		newKh, err := aeadutils.UpdatePrimaryKeyID(kh, newPrimaryKeyStr)
-		if err != nil {
-			hclog.L().Error("failed to update the keyID")
-			resp[fieldName] = "failed to update the keyID"
-		} else {
+	// retrive the config from  storage, for MIN_AEAD_BITS
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
-			// save the keyhandle for the field
-			b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
+	// data.Raw should be map[string]interface{} of field to a json keyset
+	fieldNames := make([]string, 0, len(data.Raw))
+	for fieldName := range data.Raw {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
 
-			// extract the JSON from the new key
-			buf := new(bytes.Buffer)
-			jsonWriter := keyset.NewJSONWriter(buf)
-			insecurecleartextkeyset.Write(newKh, jsonWriter)
-			// unmarshall the keyset
-			str := buf.String()
-			resp[fieldName] = str
+	resp := make(map[string]interface{})
+	for _, fieldName := range fieldNames {
+		jSonKeyset := fmt.Sprintf("%s", data.Raw[fieldName])
+		kh, err := aeadutils.ValidateImportKeySetJson(jSonKeyset)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid keyset: %w", fieldName, err)
+		}
+		if err := checkMinAeadBits(fieldName, kh); err != nil {
+			return nil, err
+		}
+		algorithm, err := aeadutils.GetKeySetAlgorithms(jSonKeyset)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid keyset: %w", fieldName, err)
 		}
 
-	}
-
-	mutedResult := make(map[string]interface{}, len(resp))
-	for k, v := range resp {
-		_, err := aeadutils.ValidateKeySetJson(v.(string))
-		if err == nil {
-			// valid key
-			v = aeadutils.MuteKeyMaterial(v.(string))
+		keyType := "NON DETERMINISTIC"
+		if aeadutils.IsKeyHandleDeterministic(kh) {
+			keyType = "DETERMINISTIC"
+		}
+		resp[fieldName] = map[string]interface{}{
+			"KEY_NAME":  aeadutils.GetKeyPrefix(fieldName, "", kh) + fieldName,
+			"TYPE":      keyType,
+			"ALGORITHM": algorithm,
 		}
-		mutedResult[k] = v
 	}
-
 	return &logical.Response{
-		Data: mutedResult,
+		Data: resp,
 	}, nil
 }
-func (b *backend) pathUpdateKeyID(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
-	// data.Raw is map[string]map[string]string
-	// map['field0':map['key':'newkey']]
+func (b *backend) pathImportTemplate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// data.Raw should be map[string]interface{} of field to a json key template, as a string or an object
 	// retrive the config from  storage
 	err := b.getAeadConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	resp := make(map[string]interface{})
 
+	keysets := make(map[string]interface{})
+	resp := make(map[string]interface{})
 	for fieldName, v := range data.Raw {
-		// GET THE KEY
-		encryptionkey, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
-
-		if !ok {
-			hclog.L().Error("failed to get an existing key")
-		}
-		rawKeyset := fmt.Sprintf("%s", encryptionkey)
-		r := keyset.NewJSONReader(bytes.NewBufferString(rawKeyset))
-		kh, err := insecurecleartextkeyset.Read(r)
+		templateJson, err := templateJsonFromValue(v)
 		if err != nil {
-			hclog.L().Error("failed to get an existing key handle")
+			return nil, err
 		}
 
-		//assert
-		vMap := v.(map[string]interface{})
-		for keyId, newKey := range vMap {
-			newKeyStr := fmt.Sprintf("%s", newKey)
-
-			// update the status, get a new heyhandle
-			newKh, err := aeadutils.UpdateKeyID(kh, keyId, newKeyStr)
-			if err != nil {
-				hclog.L().Error("failed to update the keyid")
-				resp[fieldName] = "failed to update the keyid"
-			} else {
-
-				// save the keyhandle for the field
-				b.saveKeyToConfig(newKh, fieldName, ctx, req, true)
+		kh, err := aeadutils.NewKeySetFromTemplateJson(templateJson)
+		if err != nil {
+			hclog.L().Error("pathImportTemplate invalid template for " + fieldName)
+			return nil, fmt.Errorf("%s: %w", fieldName, err)
+		}
+		if err := checkMinAeadBits(fieldName, kh); err != nil {
+			return nil, err
+		}
 
-				// extract the JSON from the new key
-				buf := new(bytes.Buffer)
-				jsonWriter := keyset.NewJSONWriter(buf)
-				insecurecleartextkeyset.Write(newKh, jsonWriter)
-				// unmarshall the keyset
-				str := buf.String()
-				resp[fieldName] = str
-			}
+		// don't replace an existing keyset with a fresh one
+		keyName := aeadutils.GetKeyPrefix(fieldName, "", kh) + fieldName
+		if _, ok := AEAD_CONFIG.Get(keyName); ok {
+			return nil, fmt.Errorf("%s key exists", keyName)
 		}
-	}
 
-	mutedResult := make(map[string]interface{}, len(resp))
-	for k, v := range resp {
-		_, err := aeadutils.ValidateKeySetJson(v.(string))
-		if err == nil {
-			// valid key
-			v = aeadutils.MuteKeyMaterial(v.(string))
+		keyAsJson, err := aeadutils.ExtractInsecureKeySetFromKeyhandle(kh)
+		if err != nil {
+			return nil, err
 		}
-		mutedResult[k] = v
+		keysets[fieldName] = keyAsJson
+		resp[keyName] = muteKeyMaterial(keyAsJson)
 	}
 
+	// ok, its ALL valid, save it
+	dn := framework.FieldData{
+		Raw:    keysets,
+		Schema: nil,
+	}
+	_, err = b.configWriteOverwriteCheck(ctx, req, &dn, true, true)
+	if err != nil {
+		hclog.L().Error("save key failed", err.Error())
+		return nil, err
+	}
 	return &logical.Response{
-		Data: mutedResult,
+		Data: resp,
 	}, nil
 }
-func (b *backend) pathImportKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 
-	// data.Raw should be map[string]interface{}
-	for _, v := range data.Raw {
-		// k is the field of the key
-		// v is the json representation of a string
-		jSonKeyset := fmt.Sprintf("%s", v)
+// defaultKeyTemplate returns the template named by the config option (DEFAULT_AEAD_TEMPLATE or DEFAULT_DAEAD_TEMPLATE),
+// or the fallback if the option is not set. Only the templates in templates can be named
+func defaultKeyTemplate(option string, templates map[string]func() *tinkpb.KeyTemplate, fallback string) (*tinkpb.KeyTemplate, error) {
+	name := fallback
+	if nameIntf, ok := AEAD_CONFIG.Get(option); ok {
+		name = strings.ToUpper(fmt.Sprintf("%v", nameIntf))
+	}
+	template, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("%s %s is not supported, expected one of %s", option, name, strings.Join(aeadutils.TemplateNames(templates), ", "))
+	}
+	if err := checkTemplateMinAeadBits(option+" "+name, template()); err != nil {
+		return nil, err
+	}
+	return template(), nil
+}
 
-		// is the json a valid key
-		_, err := aeadutils.ValidateKeySetJson(jSonKeyset)
-		if err != nil {
-			hclog.L().Error("pathImportKey Invaid Json as key", err.Error())
-			return &logical.Response{
-				Data: make(map[string]interface{}),
-			}, err
-		}
+// minAeadBits returns MIN_AEAD_BITS from the config, the weakest key in bits a keyset may have, or 0 if it is not set
+func minAeadBits() (int, error) {
+	minBitsIntf, ok := AEAD_CONFIG.Get("MIN_AEAD_BITS")
+	if !ok {
+		return 0, nil
 	}
-	// ok, its ALL valid, save it
-	_, err := b.configWriteOverwriteCheck(ctx, req, data, true, true)
+	minBits, err := strconv.Atoi(fmt.Sprintf("%v", minBitsIntf))
+	if err != nil || minBits < 0 {
+		return 0, fmt.Errorf("MIN_AEAD_BITS must be a number of bits, ie 256, got %v", minBitsIntf)
+	}
+	return minBits, nil
+}
+
+// checkMinAeadBits returns an error if the keyset has a key weaker than MIN_AEAD_BITS
+func checkMinAeadBits(name string, kh *keyset.Handle) error {
+	minBits, err := minAeadBits()
+	if err != nil || minBits == 0 {
+		return err
+	}
+	bits, err := aeadutils.KeySetBits(kh)
 	if err != nil {
-		hclog.L().Error("save key failed", err.Error())
-		return &logical.Response{
-			Data: make(map[string]interface{}),
-		}, err
+		return codedErrorf(ERROR_INVALID_KEYSET, "%s: %w", name, err)
 	}
-	return &logical.Response{
-		Data: data.Raw,
-	}, nil
+	if bits < minBits {
+		return codedErrorf(ERROR_INVALID_KEYSET, "%s has a %d bit key, MIN_AEAD_BITS requires at least %d bits", name, bits, minBits)
+	}
+	return nil
+}
+
+// checkTemplateMinAeadBits returns an error if the template creates keys weaker than MIN_AEAD_BITS
+func checkTemplateMinAeadBits(name string, template *tinkpb.KeyTemplate) error {
+	minBits, err := minAeadBits()
+	if err != nil || minBits == 0 {
+		return err
+	}
+	bits, err := aeadutils.TemplateBits(template)
+	if err != nil {
+		return codedErrorf(ERROR_INVALID_REQUEST, "%s: %w", name, err)
+	}
+	if bits < minBits {
+		return codedErrorf(ERROR_INVALID_REQUEST, "%s creates %d bit keys, MIN_AEAD_BITS requires at least %d bits", name, bits, minBits)
+	}
+	return nil
 }
 
 func (b *backend) pathAeadCreateDeterministicKeys(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -549,20 +2407,44 @@ func (b *backend) createDeterministicKeysOverwriteCheck(ctx context.Context, req
 
 	resp := make(map[string]interface{})
 
+	// optional output prefix for the new keysets, default TINK
+	outputPrefix, ok := extractRequestOption(data.Raw, "OUTPUT_PREFIX")
+	if !ok {
+		outputPrefix = "TINK"
+	}
+
+	// the template of the new keysets, DEFAULT_DAEAD_TEMPLATE in the config or AES256_SIV
+	template, err := defaultKeyTemplate("DEFAULT_DAEAD_TEMPLATE", aeadutils.DaeadTemplates, "AES256_SIV")
+	if err != nil {
+		return nil, err
+	}
+
+	// the field names must survive the translation to BQ names
+	fields, err := checkNewFieldNames(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
 	// iterate through the key=value supplied (ie field1=myaddress field2=myphonenumber)
-	for fieldName, unencryptedData := range data.Raw {
+	for fieldName, unencryptedData := range fields {
 
 		if !overwrite {
-			// don't do this if we already have a key in the config - prevents overwrite
+			// don't do this if we already have a key in the config, either a pointer or the keyset itself - prevents overwrite
 			_, ok := AEAD_CONFIG.Get(fieldName)
+			if !ok {
+				_, ok = AEAD_CONFIG.Get("siv/" + fieldName)
+			}
 			if ok {
-				resp[fieldName] = fieldName + " key exists"
+				resp[fieldName] = map[string]interface{}{
+					"created": false,
+					"message": fieldName + " key exists",
+				}
 				continue
 			}
 		}
 
 		// create new DAEAD key
-		keysetHandle, tinkDetAead, err := aeadutils.CreateNewDeterministicAead()
+		keysetHandle, tinkDetAead, err := aeadutils.CreateNewDeterministicAeadWithTemplate(template, outputPrefix)
 		if err != nil {
 			hclog.L().Error("Failed to create a new key", err)
 			return &logical.Response{
@@ -585,7 +2467,10 @@ func (b *backend) createDeterministicKeysOverwriteCheck(ctx context.Context, req
 		}
 
 		// set the response as the base64 encrypted data
-		resp[fieldName] = b64.StdEncoding.EncodeToString(cypherText)
+		resp[fieldName] = map[string]interface{}{
+			"created":    true,
+			"ciphertext": b64.StdEncoding.EncodeToString(cypherText),
+		}
 
 		// extract the key that could be stored, do not overwrite
 		b.saveKeyToConfig(keysetHandle, fieldName, ctx, req, true)
@@ -613,20 +2498,44 @@ func (b *backend) createNonDeterministicKeysOverwriteCheck(ctx context.Context,
 
 	resp := make(map[string]interface{})
 
+	// optional output prefix for the new keysets, default TINK
+	outputPrefix, ok := extractRequestOption(data.Raw, "OUTPUT_PREFIX")
+	if !ok {
+		outputPrefix = "TINK"
+	}
+
+	// the template of the new keysets, DEFAULT_AEAD_TEMPLATE in the config or AES256_GCM
+	template, err := defaultKeyTemplate("DEFAULT_AEAD_TEMPLATE", aeadutils.AeadTemplates, "AES256_GCM")
+	if err != nil {
+		return nil, err
+	}
+
+	// the field names must survive the translation to BQ names
+	fields, err := checkNewFieldNames(data.Raw)
+	if err != nil {
+		return nil, err
+	}
+
 	// iterate through the key=value supplied (ie field1=myaddress field2=myphonenumber)
-	for fieldName, unencryptedData := range data.Raw {
+	for fieldName, unencryptedData := range fields {
 
 		if !overwrite {
-			// don't do this if we already have a key in the config - prevents overwrite
+			// don't do this if we already have a key in the config, either a pointer or the keyset itself - prevents overwrite
 			_, ok := AEAD_CONFIG.Get(fieldName)
+			if !ok {
+				_, ok = AEAD_CONFIG.Get("gcm/" + fieldName)
+			}
 			if ok {
-				resp[fieldName] = fieldName + " key exists"
+				resp[fieldName] = map[string]interface{}{
+					"created": false,
+					"message": fieldName + " key exists",
+				}
 				continue
 			}
 		}
 
 		// create new DAEAD key
-		keysetHandle, tinkAead, err := aeadutils.CreateNewAead()
+		keysetHandle, tinkAead, err := aeadutils.CreateNewAeadWithTemplate(template, outputPrefix)
 		if err != nil {
 			hclog.L().Error("Failed to create a new key", err)
 			return &logical.Response{
@@ -649,7 +2558,10 @@ func (b *backend) createNonDeterministicKeysOverwriteCheck(ctx context.Context,
 		}
 
 		// set the response as the base64 encrypted data
-		resp[fieldName] = b64.StdEncoding.EncodeToString(cypherText)
+		resp[fieldName] = map[string]interface{}{
+			"created":    true,
+			"ciphertext": b64.StdEncoding.EncodeToString(cypherText),
+		}
 
 		// extract the key that could be stored, do not overwrite
 		b.saveKeyToConfig(keysetHandle, fieldName, ctx, req, true)
@@ -686,8 +2598,8 @@ func (b *backend) saveKeyToConfig(keysetHandle *keyset.Handle, fieldName string,
 		hclog.L().Error("Failed to save to config", err)
 	}
 
-	AEAD_CONFIG.Set(fieldName, keyAsJson)
-
+	// the keyset is set in the cache by the config write, under the field lock, so encrypt never sees a keyset that is
+	// not yet stored
 	m1 := make(map[string]interface{})
 	m1[fieldName] = keyAsJson
 
@@ -704,14 +2616,267 @@ func (b *backend) saveKeyToConfig(keysetHandle *keyset.Handle, fieldName string,
 	}
 }
 
-func (b *backend) getAdditionalData(fieldName string, config cmap.ConcurrentMap) []byte {
+// getAdditionalData returns the additional data for the field, ADDITIONAL_DATA_<field> if it is configured, else
+// DEFAULT_ADDITIONAL_DATA if it is configured, else the field name. If AAD_IS_B64_<field> is true the configured
+// additional data is base64 and is decoded, for binary AAD. A field in a family with AAD_INHERIT_<family> true has the
+// additional data of the family instead, see additionalDataName
+func (b *backend) getAdditionalData(fieldName string, config cmap.ConcurrentMap) ([]byte, error) {
 
 	// set additionalDataBytes as field name of the right type
+	fieldName = additionalDataName(fieldName)
 	aad, ok := AEAD_CONFIG.Get("ADDITIONAL_DATA_" + fieldName)
 	if ok {
 		aadStr := fmt.Sprintf("%s", aad)
-		return []byte(aadStr)
+		isB64Intf, ok := AEAD_CONFIG.Get("AAD_IS_B64_" + fieldName)
+		if !ok {
+			return []byte(aadStr), nil
+		}
+		isB64, err := strconv.ParseBool(fmt.Sprintf("%v", isB64Intf))
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "AAD_IS_B64_%s must be true or false: %w", fieldName, err)
+		}
+		if !isB64 {
+			return []byte(aadStr), nil
+		}
+		aadBytes, err := b64.StdEncoding.DecodeString(aadStr)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "ADDITIONAL_DATA_%s is not valid base64 as AAD_IS_B64_%s is set: %w", fieldName, fieldName, err)
+		}
+		return aadBytes, nil
+	}
+	if defaultAAD, ok := defaultAdditionalData(); ok {
+		return []byte(defaultAAD), nil
+	}
+
+	return []byte(fieldName), nil
+}
+
+// defaultAdditionalData is DEFAULT_ADDITIONAL_DATA in the config, the additional data of every field that has no
+// ADDITIONAL_DATA_<field> of its own or of the family it inherits from, ie an environment salt
+func defaultAdditionalData() (string, bool) {
+	defaultIntf, ok := AEAD_CONFIG.Get("DEFAULT_ADDITIONAL_DATA")
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%v", defaultIntf), true
+}
+
+// additionalDataName is the name whose additional data the field has. It is the field itself unless the field has no
+// ADDITIONAL_DATA_<field> and points at a family with AAD_INHERIT_<family> true, in which case it is the family, and so
+// on up a family of families as far as the pointers of a key lookup are followed
+func additionalDataName(fieldName string) string {
+	for depth := 0; depth < 5; depth++ {
+		if _, ok := AEAD_CONFIG.Get("ADDITIONAL_DATA_" + fieldName); ok {
+			return fieldName
+		}
+		familyIntf, ok := AEAD_CONFIG.Get(fieldName)
+		if !ok {
+			return fieldName
+		}
+		family := fmt.Sprintf("%v", familyIntf)
+		inheritIntf, ok := AEAD_CONFIG.Get("AAD_INHERIT_" + family)
+		if !ok {
+			return fieldName
+		}
+		inherit, err := strconv.ParseBool(fmt.Sprintf("%v", inheritIntf))
+		if err != nil || !inherit {
+			return fieldName
+		}
+		fieldName = family
+	}
+	return fieldName
+}
+
+// checkNewFieldNames validates the names of the fields new keysets are being created for, so the names used by bqsync
+// match the config names. With the request option NORMALIZE_FIELD_NAMES=true the "-" in a name is replaced by "_" rather
+// than relying on the translation at sync time. A name that would sync to the same BQ name as another keyset is rejected
+func checkNewFieldNames(data map[string]interface{}) (map[string]interface{}, error) {
+	normalize := false
+	normalizeStr, ok := extractRequestOption(data, "NORMALIZE_FIELD_NAMES")
+	if ok {
+		var err error
+		normalize, err = strconv.ParseBool(normalizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("NORMALIZE_FIELD_NAMES must be true or false: %w", err)
+		}
+	}
+
+	// the BQ names of the existing keysets
+	bqNames := make(map[string]string)
+	for k, v := range AEAD_CONFIG.Items() {
+		if strings.HasPrefix(k, aeadutils.PRFKeyPrefix) || strings.HasPrefix(k, aeadutils.ExportKeyPrefix) {
+			// PRF and export keysets are never synced to BQ
+			continue
+		}
+		if _, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", v)); err == nil {
+			bqNames[aeadutils.BQFieldName(k)] = aeadutils.RemoveKeyPrefix(k)
+		}
+	}
+
+	fields := make(map[string]interface{}, len(data))
+	for fieldName, v := range data {
+		err := aeadutils.ValidateFieldName(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		if normalize {
+			fieldName = aeadutils.BQFieldName(fieldName)
+		}
+		bqName := aeadutils.BQFieldName(fieldName)
+		existing, ok := bqNames[bqName]
+		if ok && existing != aeadutils.RemoveKeyPrefix(fieldName) {
+			return nil, fmt.Errorf("field %s would be synced to BQ as %s which is already used by %s", fieldName, bqName, existing)
+		}
+		bqNames[bqName] = aeadutils.RemoveKeyPrefix(fieldName)
+		fields[fieldName] = v
+	}
+	return fields, nil
+}
+
+// getCompositeAdditionalData returns the additional data for the field. If AAD_PARTS_<field> is configured, ie "table,column",
+// the additional data is composed from those parts, supplied in the request AAD_PARTS, joined by AAD_SEPARATOR (default ":").
+// The part FIELD is the field name and the part ADDITIONAL_DATA is the additional data the field would otherwise use.
+// A part containing the separator is an error, as "a:b"+"c" and "a"+"b:c" would be the same additional data
+func (b *backend) getCompositeAdditionalData(fieldName string, aadParts map[string]string) ([]byte, error) {
+	partNamesIntf, ok := AEAD_CONFIG.Get("AAD_PARTS_" + fieldName)
+	if !ok {
+		return b.getAdditionalData(fieldName, AEAD_CONFIG)
+	}
+
+	separator := ":"
+	separatorIntf, ok := AEAD_CONFIG.Get("AAD_SEPARATOR")
+	if ok {
+		separator = fmt.Sprintf("%v", separatorIntf)
+	}
+
+	parts := []string{}
+	for _, partName := range strings.Split(fmt.Sprintf("%v", partNamesIntf), ",") {
+		partName = strings.TrimSpace(partName)
+		switch partName {
+		case "FIELD":
+			parts = append(parts, fieldName)
+		case "ADDITIONAL_DATA":
+			additionalDataBytes, err := b.getAdditionalData(fieldName, AEAD_CONFIG)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, string(additionalDataBytes))
+		default:
+			part, ok := aadParts[partName]
+			if !ok {
+				return nil, codedErrorf(ERROR_INVALID_REQUEST, "field %s needs additional data part %s in AAD_PARTS", fieldName, partName)
+			}
+			parts = append(parts, part)
+		}
+		if separator != "" && strings.Contains(parts[len(parts)-1], separator) {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "additional data part %s of field %s contains the AAD_SEPARATOR %q", partName, fieldName, separator)
+		}
+	}
+	return []byte(strings.Join(parts, separator)), nil
+}
+
+// extractAADParts removes the request level AAD_PARTS, a map of part name to value given as an object or a json string
+func extractAADParts(data map[string]interface{}) (map[string]string, error) {
+	aadParts := map[string]string{}
+	v, ok := data["AAD_PARTS"]
+	if !ok {
+		return aadParts, nil
+	}
+	delete(data, "AAD_PARTS")
+
+	partsMap, ok := v.(map[string]interface{})
+	if !ok {
+		err := json.Unmarshal([]byte(fmt.Sprintf("%v", v)), &partsMap)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "AAD_PARTS must be a map of part name to value: %w", err)
+		}
+	}
+	for k, part := range partsMap {
+		aadParts[k] = fmt.Sprintf("%v", part)
+	}
+	return aadParts, nil
+}
+
+// extractCandidateAADs removes the request level CANDIDATE_AADS, a map of field name to the previous additional data
+// of the field, each a list or a comma separated string, given as an object or a json string
+func extractCandidateAADs(data map[string]interface{}) (map[string][]string, error) {
+	candidateAADs := map[string][]string{}
+	v, ok := data["CANDIDATE_AADS"]
+	if !ok {
+		return candidateAADs, nil
+	}
+	delete(data, "CANDIDATE_AADS")
+
+	candidatesMap, ok := v.(map[string]interface{})
+	if !ok {
+		err := json.Unmarshal([]byte(fmt.Sprintf("%v", v)), &candidatesMap)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "CANDIDATE_AADS must be a map of field name to a list of additional data: %w", err)
+		}
+	}
+	for fieldName, candidates := range candidatesMap {
+		candidateAADs[fieldName] = fieldList(candidates)
+	}
+	return candidateAADs, nil
+}
+
+// candidateAdditionalData returns the previous additional data to try for the field once its current additional data
+// has not decrypted, those in the request CANDIDATE_AADS then those in the config AAD_HISTORY_<field>, a comma separated
+// list. Like ADDITIONAL_DATA_<field> they are base64 decoded if AAD_IS_B64_<field> is true
+func (b *backend) candidateAdditionalData(fieldName string, candidateAADs map[string][]string) ([][]byte, error) {
+	candidates := append([]string{}, candidateAADs[fieldName]...)
+	if historyIntf, ok := AEAD_CONFIG.Get("AAD_HISTORY_" + fieldName); ok {
+		candidates = append(candidates, fieldList(historyIntf)...)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	isB64 := false
+	if isB64Intf, ok := AEAD_CONFIG.Get("AAD_IS_B64_" + fieldName); ok {
+		var err error
+		isB64, err = strconv.ParseBool(fmt.Sprintf("%v", isB64Intf))
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "AAD_IS_B64_%s must be true or false: %w", fieldName, err)
+		}
+	}
+	candidateBytes := make([][]byte, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !isB64 {
+			candidateBytes = append(candidateBytes, []byte(candidate))
+			continue
+		}
+		aadBytes, err := b64.StdEncoding.DecodeString(candidate)
+		if err != nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "candidate additional data %s of field %s is not valid base64 as AAD_IS_B64_%s is set: %w", candidate, fieldName, fieldName, err)
+		}
+		candidateBytes = append(candidateBytes, aadBytes)
 	}
+	return candidateBytes, nil
+}
+
+// extractRequestOption removes a request level option (ie OUTPUT_PREFIX) from the supplied data so
+// it is not treated as a field, returning its value and whether it was present
+func extractRequestOption(data map[string]interface{}, option string) (string, bool) {
+	v, ok := data[option]
+	if !ok {
+		return "", false
+	}
+	delete(data, option)
+	return fmt.Sprintf("%v", v), true
+}
 
-	return []byte(fieldName)
+// muteKeyMaterial masks the key material in a keyset with MASK_STRING from the config, default ***
+func muteKeyMaterial(theKey string) string {
+	return aeadutils.MuteKeyMaterialWithMask(theKey, maskString())
+}
+
+// maskString is the MASK_STRING from the config, or *** if there is none
+func maskString() string {
+	mask := "***"
+	maskIntf, ok := AEAD_CONFIG.Get("MASK_STRING")
+	if ok {
+		mask = fmt.Sprintf("%v", maskIntf)
+	}
+	return mask
 }
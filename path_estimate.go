@@ -0,0 +1,171 @@
+package aeadplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// estimateTinkPrefixBytes is the key id prefix of TINK, LEGACY and CRUNCHY cyphertext, RAW cyphertext has none
+	estimateTinkPrefixBytes = 5
+	// estimateFieldNameBytes is the length assumed for field names that are only counted
+	estimateFieldNameBytes = 10
+	// estimateEnvelopeBytes is the vault response around the data, ie request_id, lease and warnings
+	estimateEnvelopeBytes = 200
+)
+
+// cyphertextOverheadBytes is what each algorithm adds to the plaintext besides the key id prefix, the iv or nonce and
+// the tag. AesCtrHmacAead is the larger of its HMAC tags
+var cyphertextOverheadBytes = map[string]int{
+	"AesGcm":            28,
+	"AesGcmSiv":         28,
+	"AesEax":            32,
+	"AesCtrHmacAead":    48,
+	"ChaCha20Poly1305":  28,
+	"XChaCha20Poly1305": 40,
+	"AesSiv":            16,
+}
+
+// defaultCyphertextOverheadBytes is the overhead of the AES256_GCM keysets createAEADkey makes, for fields that are
+// only counted or whose algorithm is not known
+const defaultCyphertextOverheadBytes = 28
+
+// estimateField is the estimate for one field of a row
+type estimateField struct {
+	cypherTextBytes int
+	encodedBytes    int
+	encrypted       bool
+}
+
+// pathEstimate estimates the size of the response to a bulk encrypt, so a client can chunk a large payload, from the
+// number of ROWS and FIELDS, either a count of fields with AVG_VALUE_BYTES or a map of field name to the average
+// bytes of its values. A named field is sized by the algorithm and output prefix of its keyset, or as it is without
+// one. Nothing is encrypted
+func (b *backend) pathEstimate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage, for the keysets of named fields
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := 1
+	if rowsIntf, ok := data.Raw["ROWS"]; ok {
+		rows, err = estimateInt(rowsIntf, "ROWS", 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fieldsIntf, ok := data.Raw["FIELDS"]
+	if !ok {
+		return nil, codedErrorf(ERROR_INVALID_REQUEST, "FIELDS is required, a number of fields or a map of field name to the average bytes of its values")
+	}
+	fields := make(map[string]estimateField)
+	bytesPerRow := 0
+	if fieldSizes, ok := fieldsIntf.(map[string]interface{}); ok {
+		for fieldName, avgIntf := range fieldSizes {
+			avgValueBytes, err := estimateInt(avgIntf, "the average bytes of field "+fieldName, 0)
+			if err != nil {
+				return nil, err
+			}
+			field := estimateNamedField(fieldName, avgValueBytes)
+			fields[fieldName] = field
+			bytesPerRow += len(fieldName) + field.encodedBytes + 6 // "name":"value",
+		}
+	} else {
+		fieldCount, err := estimateInt(fieldsIntf, "FIELDS", 1)
+		if err != nil {
+			return nil, err
+		}
+		avgIntf, ok := data.Raw["AVG_VALUE_BYTES"]
+		if !ok {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "AVG_VALUE_BYTES is required with a number of FIELDS")
+		}
+		avgValueBytes, err := estimateInt(avgIntf, "AVG_VALUE_BYTES", 0)
+		if err != nil {
+			return nil, err
+		}
+		field := estimateCypherText(avgValueBytes, estimateTinkPrefixBytes+defaultCyphertextOverheadBytes)
+		bytesPerRow = fieldCount * (estimateFieldNameBytes + field.encodedBytes + 6)
+	}
+
+	// "rowkey":{...},
+	rowKeyBytes := len(strconv.Itoa(rows - 1))
+	bytesPerRow += rowKeyBytes + 6
+
+	resp := map[string]interface{}{
+		"rows":            rows,
+		"bytes_per_row":   bytesPerRow,
+		"estimated_bytes": estimateEnvelopeBytes + rows*bytesPerRow,
+	}
+	if len(fields) > 0 {
+		fieldsResp := make(map[string]interface{}, len(fields))
+		for fieldName, field := range fields {
+			fieldsResp[fieldName] = map[string]interface{}{
+				"encrypted":        field.encrypted,
+				"cyphertext_bytes": field.cypherTextBytes,
+				"encoded_bytes":    field.encodedBytes,
+			}
+		}
+		resp["fields"] = fieldsResp
+	}
+	return &logical.Response{
+		Data: resp,
+	}, nil
+}
+
+// estimateNamedField sizes a value of the field by the algorithm and output prefix of the primary key of its keyset. A
+// field without a keyset is returned as it is
+func estimateNamedField(fieldName string, avgValueBytes int) estimateField {
+	key, ok := aeadutils.GetEncryptionKey(fieldName, AEAD_CONFIG)
+	if !ok {
+		return estimateField{cypherTextBytes: avgValueBytes, encodedBytes: avgValueBytes}
+	}
+
+	overhead := estimateTinkPrefixBytes + defaultCyphertextOverheadBytes
+	var keySetStruct aeadutils.KeySetStruct
+	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", key)), &keySetStruct); err == nil {
+		for _, k := range keySetStruct.Key {
+			if k.KeyID != keySetStruct.PrimaryKeyID {
+				continue
+			}
+			typeURL := k.KeyData.TypeURL
+			algorithmOverhead, ok := cyphertextOverheadBytes[strings.TrimSuffix(typeURL[strings.LastIndex(typeURL, ".")+1:], "Key")]
+			if !ok {
+				algorithmOverhead = defaultCyphertextOverheadBytes
+			}
+			overhead = algorithmOverhead
+			if k.OutputPrefixType != "RAW" {
+				overhead += estimateTinkPrefixBytes
+			}
+		}
+	}
+	return estimateCypherText(avgValueBytes, overhead)
+}
+
+// estimateCypherText is the cyphertext of a value with the overhead, and its base64 encoding
+func estimateCypherText(avgValueBytes int, overhead int) estimateField {
+	cypherTextBytes := avgValueBytes + overhead
+	return estimateField{
+		cypherTextBytes: cypherTextBytes,
+		encodedBytes:    (cypherTextBytes + 2) / 3 * 4,
+		encrypted:       true,
+	}
+}
+
+// estimateInt reads a whole number of at least min from the request
+func estimateInt(v interface{}, name string, min int) (int, error) {
+	n, err := strconv.Atoi(fmt.Sprintf("%v", v))
+	if err != nil || n < min {
+		return 0, codedErrorf(ERROR_INVALID_REQUEST, "%s must be a whole number of at least %d, got %v", name, min, v)
+	}
+	return n, nil
+}
@@ -2,7 +2,10 @@ package aeadplugin
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
 	version "github.com/Vodafone/vault-plugin-aead/version"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -11,7 +14,62 @@ import (
 func (b *backend) pathInfo(_ context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"version": version.Version,
+			"version":       version.Version,
+			"name":          version.Name,
+			"human_version": version.HumanVersion,
+			"build_commit":  version.Commit,
+			"build_date":    version.BuildDate,
+			"key_types":     aeadutils.SupportedKeyTypes,
+		},
+	}, nil
+}
+
+// compiledFeatures are the kinds of tink primitive this build can use. Index tokens are HMAC-SHA256 from the go
+// standard library rather than tink MAC keysets
+var compiledFeatures = map[string]interface{}{
+	"aead":      true,
+	"daead":     true,
+	"prf":       true,
+	"mac":       false,
+	"streaming": false,
+	"hybrid":    false,
+	"signature": false,
+}
+
+// pathCapabilities describes what this build supports, for key agility planning: the type urls of the keys that can be
+// imported and used, the templates the create paths can name with the ones they use now, and which kinds of tink
+// primitive are compiled in
+func (b *backend) pathCapabilities(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the config from  storage, for the default templates
+	err := b.getAeadConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultTemplate := func(option string, fallback string) string {
+		if nameIntf, ok := AEAD_CONFIG.Get(option); ok {
+			return strings.ToUpper(fmt.Sprintf("%v", nameIntf))
+		}
+		return fallback
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"type_urls": map[string]interface{}{
+				"keysets": aeadutils.SupportedTypeURLs(),
+				"prf":     aeadutils.TemplateTypeURLs(aeadutils.PrfTemplates),
+			},
+			"templates": map[string]interface{}{
+				"createAEADkey":  aeadutils.TemplateNames(aeadutils.AeadTemplates),
+				"createDAEADkey": aeadutils.TemplateNames(aeadutils.DaeadTemplates),
+				"createPRFkey":   aeadutils.TemplateNames(aeadutils.PrfTemplates),
+			},
+			"default_templates": map[string]interface{}{
+				"createAEADkey":  defaultTemplate("DEFAULT_AEAD_TEMPLATE", "AES256_GCM"),
+				"createDAEADkey": defaultTemplate("DEFAULT_DAEAD_TEMPLATE", "AES256_SIV"),
+			},
+			"features": compiledFeatures,
 		},
 	}, nil
 }
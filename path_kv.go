@@ -192,7 +192,7 @@ func (b *backend) readKV(ctx context.Context, s logical.Storage, mask ...bool) (
 
 		if strings.HasPrefix(path, "gcm/") || strings.HasPrefix(path, "siv/") {
 			keyFound = true
-			jsonKey, ok := kvsecret.Data["data"]
+			jsonKey, ok := kvutils.KvGetSecretKeyset(kvsecret, kvOptions.Vault_kv_version)
 			if !ok {
 				hclog.L().Error("failed to read back the aead key " + path)
 			}
@@ -202,7 +202,7 @@ func (b *backend) readKV(ctx context.Context, s logical.Storage, mask ...bool) (
 			} else {
 				// hclog.L().Info("valid secret key")
 				if mask == nil || mask[0] == true {
-					consulKV[path] = aeadutils.MuteKeyMaterial(extractedKeySet)
+					consulKV[path] = muteKeyMaterial(extractedKeySet)
 				} else {
 					consulKV[path] = extractedKeySet
 				}
@@ -434,7 +434,7 @@ func putAndCheckKvSecret(client *vault.Client, Vault_kv_engine string, Vault_kv_
 		return nil, fmt.Errorf(errMsg)
 	}
 
-	secret, ok := kvsecret.Data["data"]
+	secret, ok := kvutils.KvGetSecretKeyset(kvsecret, Vault_kv_version)
 	if !ok {
 		hclog.L().Error("failed to extract the data from the secrets in folder:" + keyNameIn)
 		return nil, err
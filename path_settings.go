@@ -0,0 +1,122 @@
+package aeadplugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Vodafone/vault-plugin-aead/aeadutils"
+	"github.com/Vodafone/vault-plugin-aead/bqutils"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// the storage entry holding the settings, the non key options ie BQ_PROJECT, kept apart from the keysets in config
+const settingsEntry = "settings"
+
+var AEAD_SETTINGS = cmap.New()
+
+func (b *backend) getAeadSettings(ctx context.Context, req *logical.Request) error {
+
+	settings, err := b.readSettings(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	// add the stored settings into the AEAD_SETTINGS cache and remove anything that is no longer stored
+	for k, v := range settings {
+		AEAD_SETTINGS.Set(k, v)
+	}
+	for k := range AEAD_SETTINGS.Items() {
+		if _, ok := settings[k]; !ok {
+			AEAD_SETTINGS.Remove(k)
+		}
+	}
+	return nil
+}
+
+func (b *backend) readSettings(ctx context.Context, s logical.Storage) (map[string]interface{}, error) {
+
+	settings := make(map[string]interface{})
+	entry, err := s.Get(ctx, settingsEntry)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return settings, nil
+	}
+	if err := entry.DecodeJSON(&settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (b *backend) saveSettings(ctx context.Context, req *logical.Request) error {
+	entry, err := logical.StorageEntryJSON(settingsEntry, AEAD_SETTINGS)
+	if err != nil {
+		return err
+	}
+	return req.Storage.Put(ctx, entry)
+}
+
+// bqOptions returns the options for bqutils, the settings falling back to the options still held in config. The
+// settings and config must already be retrieved from storage
+func bqOptions() cmap.ConcurrentMap {
+	return bqutils.WithSettings(AEAD_SETTINGS, AEAD_CONFIG)
+}
+
+func (b *backend) pathSettingsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the settings from  storage
+	err := b.getAeadSettings(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: AEAD_SETTINGS.Items(),
+	}, nil
+}
+
+// pathSettingsWrite adds the supplied options to the settings, overwriting any with the same name. Settings never
+// hold keys, so a keyset is refused and nothing is saved
+func (b *backend) pathSettingsWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the settings from  storage
+	err := b.getAeadSettings(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range data.Raw {
+		if _, err := aeadutils.ValidateKeySetJson(fmt.Sprintf("%v", v)); err == nil {
+			return nil, codedErrorf(ERROR_INVALID_REQUEST, "%s is a keyset, settings cannot hold keys - use importKey or config", k)
+		}
+	}
+	for k, v := range data.Raw {
+		AEAD_SETTINGS.Set(k, v)
+	}
+
+	if err := b.saveSettings(ctx, req); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) pathSettingsDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	// retrive the settings from  storage
+	err := b.getAeadSettings(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range data.Raw {
+		AEAD_SETTINGS.Remove(k)
+	}
+
+	if err := b.saveSettings(ctx, req); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,88 @@
+package aeadplugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	cmap "github.com/orcaman/concurrent-map"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiters holds the encrypt rate limiter of each field with RATE_LIMIT_<field> set in the config
+var rateLimiters = cmap.New()
+
+// fieldRateLimiter is a token bucket of RATE_LIMIT_<field> encrypts a second, that can burst to one second's worth.
+// It is replaced when the limit of the field changes
+type fieldRateLimiter struct {
+	limit   float64
+	limiter *rate.Limiter
+}
+
+// getRateLimiter returns the encrypt rate limiter of the field for its current limit, or nil if the field has no
+// RATE_LIMIT_<field> and so is unlimited. The limiter of a field that no longer has one is dropped
+func getRateLimiter(fieldName string) *rate.Limiter {
+	limitIntf, ok := AEAD_CONFIG.Get("RATE_LIMIT_" + fieldName)
+	if !ok {
+		rateLimiters.Remove(fieldName)
+		return nil
+	}
+	limit, err := strconv.ParseFloat(fmt.Sprintf("%v", limitIntf), 64)
+	if err != nil || limit <= 0 {
+		hclog.L().Error("invalid RATE_LIMIT_" + fieldName + ", the rate limit is off")
+		rateLimiters.Remove(fieldName)
+		return nil
+	}
+
+	if limiterIntf, ok := rateLimiters.Get(fieldName); ok {
+		fieldLimiter := limiterIntf.(*fieldRateLimiter)
+		if fieldLimiter.limit == limit {
+			return fieldLimiter.limiter
+		}
+	}
+	fieldLimiter := &fieldRateLimiter{
+		limit:   limit,
+		limiter: rate.NewLimiter(rate.Limit(limit), int(math.Ceil(limit))),
+	}
+	rateLimiters.Set(fieldName, fieldLimiter)
+	return fieldLimiter.limiter
+}
+
+// takeRateLimits takes a token from the rate limiter of each field for each of its values in the request, counts
+// being the number of values of each field. If any field is over its limit no tokens are taken and the request fails
+// with RATE_LIMITED, saying when the field can be retried
+func takeRateLimits(counts map[string]int) error {
+	fieldNames := make([]string, 0, len(counts))
+	for fieldName := range counts {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+
+	now := time.Now()
+	reservations := []*rate.Reservation{}
+	cancel := func() {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+	}
+	for _, fieldName := range fieldNames {
+		limiter := getRateLimiter(fieldName)
+		if limiter == nil {
+			continue
+		}
+		reservation := limiter.ReserveN(now, counts[fieldName])
+		if !reservation.OK() {
+			cancel()
+			return codedErrorf(ERROR_RATE_LIMITED, "field %s is limited to %v encrypts a second and the request has %d values", fieldName, limiter.Limit(), counts[fieldName])
+		}
+		reservations = append(reservations, reservation)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			cancel()
+			return codedErrorf(ERROR_RATE_LIMITED, "field %s is over its limit of %v encrypts a second, retry in %v", fieldName, limiter.Limit(), delay.Round(time.Millisecond))
+		}
+	}
+	return nil
+}
@@ -4,6 +4,12 @@ import "fmt"
 
 var Version string
 
+// set at build time with -ldflags "-X github.com/Vodafone/vault-plugin-aead/version.Commit=..."
+var (
+	Commit    string
+	BuildDate string
+)
+
 var (
 	Name         string
 	HumanVersion = fmt.Sprintf("%s v%s", Name, Version)
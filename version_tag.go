@@ -0,0 +1,90 @@
+package aeadplugin
+
+import (
+	b64 "encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// versionTagFormat is the format version written in the version tag, decrypt refuses a tag of any other version so a
+// future format is detected rather than decrypted as this one
+const versionTagFormat = 1
+
+// versionTagEncodings are the letters of the version tag for the encoding of the cyphertext behind it
+var versionTagEncodings = map[byte]string{
+	'b': ENCODING_BASE64,
+	'u': ENCODING_BASE64URL,
+	'h': ENCODING_HEX,
+	'x': ENCODING_BQBYTES,
+}
+
+// versionTagOf is put in front of the cyphertext of a field with VERSION_TAG_<field> true: a "v", the format version,
+// the letter of the encoding and a ':'. None of the encodings has a ':' so untagged cyphertext is never taken for it
+func versionTagOf(encoding string) string {
+	for letter, tagEncoding := range versionTagEncodings {
+		if tagEncoding == encoding {
+			return fmt.Sprintf("v%d%c:", versionTagFormat, letter)
+		}
+	}
+	return ""
+}
+
+// versionTag is the tag of base64 cyphertext
+var versionTag = versionTagOf(ENCODING_BASE64)
+
+// versionTagged puts the version tag of the encoding in front of the cyphertext if VERSION_TAG_<field> is true in the
+// config
+func versionTagged(fieldName string, encoding string, encoded string) string {
+	tagIntf, ok := AEAD_CONFIG.Get("VERSION_TAG_" + fieldName)
+	if !ok {
+		return encoded
+	}
+	tag, err := strconv.ParseBool(fmt.Sprintf("%v", tagIntf))
+	if err != nil || !tag {
+		return encoded
+	}
+	return versionTagOf(encoding) + encoded
+}
+
+// stripVersionTag reverses versionTagged, returning the cyphertext behind a version tag with the encoding the tag
+// names in place of the encoding of the request. Untagged cyphertext is returned as-is whatever VERSION_TAG_<field>
+// is, so values from before the tag was turned on or off still decrypt. A tag of another format version fails
+func stripVersionTag(fieldName string, cipherText string, encoding string) (string, string, error) {
+	if len(cipherText) < 4 || cipherText[0] != 'v' || cipherText[3] != ':' {
+		return cipherText, encoding, nil
+	}
+	if cipherText[1] != byte('0'+versionTagFormat) {
+		return "", "", codedErrorf(ERROR_DECRYPT_FAILED, "field %s has version tag %s, only format %d can be decrypted", fieldName, cipherText[:4], versionTagFormat)
+	}
+	tagEncoding, ok := versionTagEncodings[cipherText[2]]
+	if !ok {
+		return "", "", codedErrorf(ERROR_DECRYPT_FAILED, "field %s has version tag %s with an unknown encoding", fieldName, cipherText[:4])
+	}
+	return cipherText[4:], tagEncoding, nil
+}
+
+// decodeTaggedCiphertext decodes cyphertext in the encoding, or the ENCODING_<field> of the field for ENCODING_FIELD,
+// or the cyphertext behind a version tag in the encoding it names
+func decodeTaggedCiphertext(fieldName string, cipherText string, encoding string) ([]byte, error) {
+	var err error
+	if encoding == ENCODING_FIELD {
+		encoding, err = fieldEncoding(fieldName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cipherText, encoding, err = stripVersionTag(fieldName, cipherText, encoding)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case ENCODING_HEX:
+		return hex.DecodeString(cipherText)
+	case ENCODING_BASE64URL:
+		return decodeBase64URL(cipherText)
+	case ENCODING_BQBYTES:
+		return decodeBQBytes(cipherText)
+	}
+	return b64.StdEncoding.DecodeString(cipherText)
+}